@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"gateway/config"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+)
+
+// 网关入口：按配置文件组装并启动网关
+//
+// 	go run ./cmd/gateway -c config/testdata/gateway.yaml
+// 配置文件格式见 config 包
+//
+// 热加载配置，不中断已建立的连接：
+// 	kill -HUP <pid>：重新读取配置文件
+// 	-watch 5s：定期检查配置文件，内容变化时热加载
+// 	-zk 127.0.0.1:2181 -zk-path /gateway/config：监听 zookeeper 节点中的配置
+//
+// 收到 SIGINT、SIGTERM 后停止接受新连接，在配置的 drain_timeout 内排空处理中的请求（连接）后退出；
+// 排空期间再次收到信号时立即退出
+func main() {
+	path := flag.String("c", "gateway.yaml", "gateway config file (yaml or json)")
+	watch := flag.Duration("watch", 0, "interval to check config file changes, 0 to disable")
+	zkHosts := flag.String("zk", "", "comma separated zookeeper hosts to watch config from")
+	zkPath := flag.String("zk-path", "", "zookeeper node holding the config")
+	flag.Parse()
+
+	cfg, err := config.LoadFile(*path)
+	if err != nil {
+		log.Fatalf("load config %s: %v", *path, err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	g, err := config.Build(ctx, cfg)
+	if err != nil {
+		log.Fatalf("build gateway: %v", err)
+	}
+	if err := g.Start(); err != nil {
+		log.Fatalf("start gateway: %v", err)
+	}
+	g.WatchSignal(*path)
+	if *watch > 0 {
+		g.WatchFile(*path, *watch)
+	}
+	if *zkHosts != "" && *zkPath != "" {
+		if err := g.WatchZk(strings.Split(*zkHosts, ","), *zkPath); err != nil {
+			log.Fatalf("watch zookeeper %s: %v", *zkPath, err)
+		}
+	}
+
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	<-quit
+	log.Println("gateway: shutting down, draining connections")
+	done := make(chan error, 1)
+	go func() { done <- g.Shutdown(context.Background()) }()
+	select {
+	case err := <-done:
+		if err != nil {
+			log.Printf("gateway: shutdown: %v", err)
+		}
+	case <-quit:
+		log.Println("gateway: closing immediately")
+		g.Close()
+	}
+}
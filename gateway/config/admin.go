@@ -0,0 +1,460 @@
+package config
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"gateway/loadbalance"
+	"gateway/middleware/circuitbreaker"
+	"gateway/middleware/flowcount"
+	"gateway/middleware/quota"
+	sr "gateway/middleware/router/http"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// 管理接口：查看网关运行时状态，摘除主机、修改权重、停用路由
+//
+// 	GET  /routes                                        路由列表及启用状态
+// 	POST /routes/:listener/:route/enable                启用路由
+// 	POST /routes/:listener/:route/disable               停用路由：http 返回 503，tcp 关闭新连接
+// 	GET  /services                                      服务列表：负载均衡算法、主机健康/驱逐/摘除状态与权重
+// 	GET  /services/:service                             单个服务
+// 	POST /services/:service/backends/:backend/drain     摘除主机（backend 为 host:port），处理中的请求不受影响
+// 	POST /services/:service/backends/:backend/undrain   恢复主机
+// 	PUT  /services/:service/backends/:backend/weight    修改权重，请求体 {"weight": 10}，0 表示恢复配置中的权重
+// 	GET  /limiters                                      限流中间件与 flowcount 限流器的设置
+// 	GET  /breakers                                      熔断器状态与设置
+// 	GET  /stats                                         流量统计，查询参数：window（minute、hour、day）、
+// 	                                                    service、route、tenant、backend（过滤）、group_by（逗号分隔）
+// 	GET  /redis                                         Redis 健康状态：当前节点、连接数、最近一次错误
+// 	GET  /apps                                          应用列表，不包含密钥
+// 	POST /apps                                          新增应用，请求体见 quota.App，secret 为空时生成随机密钥，响应包含密钥
+// 	GET  /apps/:app                                     单个应用及其当天、当月用量
+// 	PUT  /apps/:app                                     修改应用，请求体同新增，secret 为空时保留原密钥
+// 	DELETE /apps/:app                                   删除应用
+// 摘除、权重、路由状态、应用保存在内存中，热加载后保留，重启后失效。
+// 监听地址不是回环地址时必须配置访问令牌（admin.token），否则配置校验失败，网关无法启动。
+
+// serviceStatus 服务状态
+type serviceStatus struct {
+	Name      string          `json:"name"`
+	Protocol  string          `json:"protocol"`
+	Balancer  string          `json:"balancer"`
+	Discovery string          `json:"discovery"`
+	Backends  []backendStatus `json:"backends"` // 按地址排序
+}
+
+// backendStatus 主机状态
+type backendStatus struct {
+	Addr             string     `json:"addr"`
+	Weight           int        `json:"weight"`
+	WeightOverridden bool       `json:"weight_overridden"` // 权重是否通过管理接口修改
+	Healthy          bool       `json:"healthy"`           // 主动健康检查结果，未配置时为 true
+	Ejected          bool       `json:"ejected"`           // 是否被被动健康检查驱逐
+	EjectedUntil     *time.Time `json:"ejected_until,omitempty"`
+	Drained          bool       `json:"drained"`   // 是否通过管理接口摘除
+	Available        bool       `json:"available"` // 负载均衡器当前是否可以选中
+}
+
+// routeStatus 路由状态
+type routeStatus struct {
+	Listener   string   `json:"listener"`
+	Name       string   `json:"name"`
+	Protocol   string   `json:"protocol"`
+	Path       string   `json:"path,omitempty"`
+	Hosts      []string `json:"hosts,omitempty"`
+	Methods    []string `json:"methods,omitempty"`
+	SNI        []string `json:"sni,omitempty"`
+	SourceCIDR []string `json:"source_cidr,omitempty"`
+	Service    string   `json:"service"`
+	Stacks     []string `json:"stacks,omitempty"`
+	Middleware []string `json:"middleware,omitempty"`
+	Enabled    bool     `json:"enabled"`
+}
+
+// limiterStatus 限流中间件设置
+type limiterStatus struct {
+	Scope     string                        `json:"scope"` // 监听器名称、监听器/路由名称或 stack/栈名称
+	Rate      int                           `json:"rate"`
+	Burst     int                           `json:"burst"`
+	Key       string                        `json:"key,omitempty"` // 按键限流的键，为空时所有请求共用一个令牌桶
+	Overrides map[string]*RateLimitOverride `json:"overrides,omitempty"`
+}
+
+// appStatus 应用及其用量，Redis 不可用时没有用量
+type appStatus struct {
+	quota.App
+	Usage      *quota.Usage `json:"usage,omitempty"`
+	UsageError string       `json:"usage_error,omitempty"`
+}
+
+// AdminHandler 创建管理接口的处理器，token 不为空时校验 Authorization: Bearer <token>
+func (g *Gateway) AdminHandler(token string) http.Handler {
+	router := sr.NewSliceRouter()
+	if token != "" {
+		want := []byte("Bearer " + token)
+		router.UseGlobal(func(c *sr.SliceRouteContext) {
+			// 常量时间比较，避免通过响应时间逐字节猜测令牌
+			if subtle.ConstantTimeCompare([]byte(c.Req.Header.Get("Authorization")), want) != 1 {
+				writeError(c, http.StatusUnauthorized, "unauthorized")
+				return
+			}
+			c.Next()
+		})
+	}
+	router.Group("/routes").Method(http.MethodGet).Use(g.adminRoutes)
+	router.Group("/routes/:listener/:route/enable").Method(http.MethodPost).Use(g.adminToggleRoute(true))
+	router.Group("/routes/:listener/:route/disable").Method(http.MethodPost).Use(g.adminToggleRoute(false))
+	router.Group("/services").Method(http.MethodGet).Use(g.adminServices)
+	router.Group("/services/:service").Method(http.MethodGet).Use(g.adminService)
+	router.Group("/services/:service/backends/:backend/drain").Method(http.MethodPost).Use(g.adminDrain(true))
+	router.Group("/services/:service/backends/:backend/undrain").Method(http.MethodPost).Use(g.adminDrain(false))
+	router.Group("/services/:service/backends/:backend/weight").Method(http.MethodPut).Use(g.adminWeight)
+	router.Group("/limiters").Method(http.MethodGet).Use(g.adminLimiters)
+	router.Group("/breakers").Method(http.MethodGet).Use(adminBreakers)
+	router.Group("/stats").Method(http.MethodGet).Use(g.adminStats)
+	router.Group("/redis").Method(http.MethodGet).Use(adminRedis)
+	router.Group("/apps").Method(http.MethodGet).Use(g.adminApps)
+	router.Group("/apps").Method(http.MethodPost).Use(g.adminSetApp(true))
+	router.Group("/apps/:app").Method(http.MethodGet).Use(g.adminApp)
+	router.Group("/apps/:app").Method(http.MethodPut).Use(g.adminSetApp(false))
+	router.Group("/apps/:app").Method(http.MethodDelete).Use(g.adminDeleteApp)
+	// 处理函数响应后跳出中间件，没有匹配的路由时才会执行核心处理器
+	return sr.NewSliceRouterHandler(func(c *sr.SliceRouteContext) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			writeError(c, http.StatusNotFound, "not found")
+		})
+	}, router)
+}
+
+func (g *Gateway) adminRoutes(c *sr.SliceRouteContext) {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+	routes := []routeStatus{}
+	for _, l := range g.cfg.Listeners {
+		for _, r := range l.Routes {
+			status := routeStatus{
+				Listener:   l.Name,
+				Name:       r.Name,
+				Protocol:   l.Protocol,
+				Path:       r.Path,
+				Hosts:      r.Hosts,
+				Methods:    r.Methods,
+				SNI:        r.SNI,
+				SourceCIDR: r.SourceCIDR,
+				Service:    r.Service,
+				Stacks:     r.Stacks,
+				Enabled:    true,
+			}
+			for _, m := range r.Middleware {
+				status.Middleware = append(status.Middleware, m.Type)
+			}
+			if state, ok := g.routes[l.Name+"/"+r.Name]; ok {
+				status.Enabled = atomic.LoadInt32(&state.disabled) == 0
+			}
+			routes = append(routes, status)
+		}
+	}
+	writeJSON(c, http.StatusOK, routes)
+}
+
+func (g *Gateway) adminToggleRoute(enabled bool) sr.HandlerFunc {
+	return func(c *sr.SliceRouteContext) {
+		g.mux.Lock()
+		state, ok := g.routes[c.Param("listener")+"/"+c.Param("route")]
+		g.mux.Unlock()
+		if !ok {
+			writeError(c, http.StatusNotFound, "route not found")
+			return
+		}
+		var disabled int32
+		if !enabled {
+			disabled = 1
+		}
+		atomic.StoreInt32(&state.disabled, disabled)
+		writeJSON(c, http.StatusOK, map[string]bool{"enabled": enabled})
+	}
+}
+
+func (g *Gateway) adminServices(c *sr.SliceRouteContext) {
+	g.mux.Lock()
+	services := []*service{}
+	for _, s := range g.cfg.Services {
+		services = append(services, g.services[s.Name])
+	}
+	g.mux.Unlock()
+	statuses := []serviceStatus{}
+	for _, s := range services {
+		statuses = append(statuses, s.status())
+	}
+	writeJSON(c, http.StatusOK, statuses)
+}
+
+func (g *Gateway) adminService(c *sr.SliceRouteContext) {
+	s := g.service(c.Param("service"))
+	if s == nil {
+		writeError(c, http.StatusNotFound, "service not found")
+		return
+	}
+	writeJSON(c, http.StatusOK, s.status())
+}
+
+func (g *Gateway) adminDrain(drained bool) sr.HandlerFunc {
+	return func(c *sr.SliceRouteContext) {
+		s, host, ok := g.backend(c)
+		if !ok {
+			return
+		}
+		s.manage.Drain(host, drained)
+		writeJSON(c, http.StatusOK, s.status())
+	}
+}
+
+func (g *Gateway) adminWeight(c *sr.SliceRouteContext) {
+	s, host, ok := g.backend(c)
+	if !ok {
+		return
+	}
+	body := struct {
+		Weight *int `json:"weight"`
+	}{}
+	if err := json.NewDecoder(c.Req.Body).Decode(&body); err != nil || body.Weight == nil || *body.Weight < 0 {
+		writeError(c, http.StatusBadRequest, `request body must be {"weight": <non-negative integer>}`)
+		return
+	}
+	s.manage.SetWeight(host, *body.Weight)
+	writeJSON(c, http.StatusOK, s.status())
+}
+
+func (g *Gateway) adminLimiters(c *sr.SliceRouteContext) {
+	g.mux.Lock()
+	limiters := []limiterStatus{}
+	add := func(scope string, confs []*MiddlewareConfig) {
+		for _, m := range confs {
+			if m.Type == "rate_limit" {
+				limiters = append(limiters, limiterStatus{Scope: scope, Rate: m.Rate, Burst: m.Burst, Key: m.Key, Overrides: m.Overrides})
+			}
+		}
+	}
+	for _, l := range g.cfg.Listeners {
+		add(l.Name, l.Middleware)
+		for _, r := range l.Routes {
+			add(l.Name+"/"+r.Name, r.Middleware)
+		}
+	}
+	for name, stack := range g.cfg.MiddlewareStacks {
+		add("stack/"+name, stack)
+	}
+	g.mux.Unlock()
+	writeJSON(c, http.StatusOK, map[string]interface{}{
+		"middleware":    limiters,
+		"flow_limiters": flowcount.FlowLimiterHandler.States(),
+	})
+}
+
+func adminBreakers(c *sr.SliceRouteContext) {
+	writeJSON(c, http.StatusOK, circuitbreaker.CircuitStates())
+}
+
+func (g *Gateway) adminStats(c *sr.SliceRouteContext) {
+	query := c.Req.URL.Query()
+	q := flowcount.StatsQuery{
+		Window:  query.Get("window"),
+		Service: query.Get("service"),
+		Route:   query.Get("route"),
+		Tenant:  query.Get("tenant"),
+		Backend: query.Get("backend"),
+	}
+	if groupBy := query.Get("group_by"); groupBy != "" {
+		q.GroupBy = strings.Split(groupBy, ",")
+	}
+	result, err := g.stats.Query(q)
+	if err != nil {
+		writeError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(c, http.StatusOK, result)
+}
+
+// adminRedis 检查一次连接后返回健康状态，Redis 不可用时返回 503
+func adminRedis(c *sr.SliceRouteContext) {
+	client := flowcount.DefaultRedis()
+	status := http.StatusOK
+	if client.Ping() != nil {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(c, status, client.Health())
+}
+
+func (g *Gateway) adminApps(c *sr.SliceRouteContext) {
+	apps := g.apps.Apps()
+	for i := range apps {
+		apps[i].Secret = ""
+	}
+	writeJSON(c, http.StatusOK, apps)
+}
+
+func (g *Gateway) adminApp(c *sr.SliceRouteContext) {
+	app, ok := g.apps.Get(c.Param("app"))
+	if !ok {
+		writeError(c, http.StatusNotFound, "app not found")
+		return
+	}
+	app.Secret = ""
+	status := appStatus{App: app}
+	if usage, err := g.apps.Usage(app.ID); err != nil {
+		status.UsageError = err.Error()
+	} else {
+		status.Usage = &usage
+	}
+	writeJSON(c, http.StatusOK, status)
+}
+
+// adminSetApp 新增（create 为 true）或修改应用，新增时响应包含密钥
+func (g *Gateway) adminSetApp(create bool) sr.HandlerFunc {
+	return func(c *sr.SliceRouteContext) {
+		var app quota.App
+		if err := json.NewDecoder(c.Req.Body).Decode(&app); err != nil {
+			writeError(c, http.StatusBadRequest, "invalid request body: "+err.Error())
+			return
+		}
+		if !create {
+			app.ID = c.Param("app")
+		}
+		old, exists := g.apps.Get(app.ID)
+		switch {
+		case create && exists:
+			writeError(c, http.StatusConflict, "app already exists")
+			return
+		case !create && !exists:
+			writeError(c, http.StatusNotFound, "app not found")
+			return
+		case !create && app.Secret == "":
+			app.Secret = old.Secret
+		}
+		app, err := g.apps.Set(app)
+		if err != nil {
+			writeError(c, http.StatusBadRequest, err.Error())
+			return
+		}
+		if !create {
+			app.Secret = ""
+			writeJSON(c, http.StatusOK, app)
+			return
+		}
+		writeJSON(c, http.StatusCreated, app)
+	}
+}
+
+func (g *Gateway) adminDeleteApp(c *sr.SliceRouteContext) {
+	if !g.apps.Delete(c.Param("app")) {
+		writeError(c, http.StatusNotFound, "app not found")
+		return
+	}
+	writeJSON(c, http.StatusOK, map[string]bool{"deleted": true})
+}
+
+// service 获取当前配置中的服务
+func (g *Gateway) service(name string) *service {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+	return g.services[name]
+}
+
+// backend 获取请求路径中的服务与主机，不存在时响应 404
+func (g *Gateway) backend(c *sr.SliceRouteContext) (*service, string, bool) {
+	s := g.service(c.Param("service"))
+	if s == nil {
+		writeError(c, http.StatusNotFound, "service not found")
+		return nil, "", false
+	}
+	host := c.Param("backend")
+	for _, h := range s.hosts() {
+		if h == host {
+			return s, host, true
+		}
+	}
+	writeError(c, http.StatusNotFound, "backend not found")
+	return nil, "", false
+}
+
+// hosts 服务发现配置中的所有主机（host:port），包括不健康、被摘除的主机
+func (s *service) hosts() []string {
+	hosts := []string{}
+	for _, item := range s.source.GetConf() {
+		_, host, _ := parseConfItem(item)
+		hosts = append(hosts, host)
+	}
+	return hosts
+}
+
+// status 读取服务及其主机的运行时状态
+func (s *service) status() serviceStatus {
+	status := serviceStatus{
+		Name:      s.conf.Name,
+		Protocol:  s.conf.Protocol,
+		Balancer:  s.conf.Balancer,
+		Discovery: s.conf.Discovery.Type,
+		Backends:  []backendStatus{},
+	}
+	var health map[string]bool
+	if s.health != nil {
+		health = s.health.Health()
+	}
+	var ejected map[string]time.Time
+	if s.outlier != nil {
+		ejected = s.outlier.EjectedHosts()
+	}
+	for _, item := range s.source.GetConf() {
+		addr, host, weight := parseConfItem(item)
+		b := backendStatus{Addr: host, Weight: weight, Healthy: true}
+		if w, ok := s.manage.Weight(host); ok {
+			b.Weight, b.WeightOverridden = w, true
+		}
+		if healthy, ok := health[host]; ok {
+			b.Healthy = healthy
+		}
+		if until, ok := ejected[addr]; ok {
+			b.Ejected, b.EjectedUntil = true, &until
+		}
+		b.Drained = s.manage.Drained(host)
+		b.Available = loadbalance.Available(s.lb, addr)
+		status.Backends = append(status.Backends, b)
+	}
+	sort.Slice(status.Backends, func(i, j int) bool {
+		return status.Backends[i].Addr < status.Backends[j].Addr
+	})
+	return status
+}
+
+// parseConfItem 解析负载均衡配置项 "addr,weight"
+// addr 为负载均衡器返回的地址（如 http://host:port），host 为 host:port
+func parseConfItem(item string) (addr, host string, weight int) {
+	parts := strings.Split(item, ",")
+	addr, host = parts[0], parts[0]
+	if len(parts) > 1 {
+		weight, _ = strconv.Atoi(parts[1])
+	}
+	if strings.Contains(addr, "://") {
+		if u, err := url.Parse(addr); err == nil {
+			host = u.Host
+		}
+	}
+	return
+}
+
+func writeJSON(c *sr.SliceRouteContext, status int, v interface{}) {
+	c.Rw.Header().Set("Content-Type", "application/json")
+	c.Rw.WriteHeader(status)
+	json.NewEncoder(c.Rw).Encode(v)
+	c.Abort()
+}
+
+func writeError(c *sr.SliceRouteContext, status int, msg string) {
+	writeJSON(c, status, map[string]string{"error": msg})
+}
@@ -0,0 +1,374 @@
+package config
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"gateway/middleware/flowcount"
+	"gateway/middleware/quota"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 管理接口：查看服务状态、摘除主机、修改权重、停用路由、校验 token
+func TestAdminAPI(t *testing.T) {
+	backend := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(name))
+		}))
+	}
+	a, b := backend("a"), backend("b")
+	defer a.Close()
+	defer b.Close()
+	hostA, hostB := strings.TrimPrefix(a.URL, "http://"), strings.TrimPrefix(b.URL, "http://")
+	cfg, err := Parse([]byte(fmt.Sprintf(`
+services:
+  - name: web
+    balancer: weight_round_robin
+    discovery: {hosts: [{addr: %q, weight: 10}, {addr: %q, weight: 10}]}
+listeners:
+  - name: web
+    addr: 127.0.0.1:0
+    routes:
+      - {name: api, path: /, service: web, middleware: [{type: rate_limit, rate: 1000, burst: 100}]}
+admin:
+  addr: 127.0.0.1:0
+  token: secret
+redis: {addrs: [127.0.0.1:1], dial_timeout: 100ms}
+stats: {tenant_key: header:X-Tenant}
+`, hostA, hostB)))
+	assert.Nil(t, err)
+	g, err := Build(context.Background(), cfg)
+	assert.Nil(t, err)
+	assert.Nil(t, g.Start())
+	defer g.Close()
+	webAddr, adminAddr := g.Addr("web"), g.Addr("admin")
+
+	call := func(method, path, token, body string) (int, string) {
+		req, _ := http.NewRequest(method, "http://"+adminAddr+path, strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if !assert.Nil(t, err) {
+			return 0, ""
+		}
+		defer resp.Body.Close()
+		data, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(data)
+	}
+	get := func() (int, string) {
+		resp, err := http.Get("http://" + webAddr + "/")
+		if !assert.Nil(t, err) {
+			return 0, ""
+		}
+		defer resp.Body.Close()
+		data, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(data)
+	}
+
+	code, _ := call(http.MethodGet, "/services", "", "")
+	assert.Equal(t, http.StatusUnauthorized, code)
+	code, _ = call(http.MethodGet, "/services", "wrong", "")
+	assert.Equal(t, http.StatusUnauthorized, code)
+	code, _ = call(http.MethodGet, "/unknown", "secret", "")
+	assert.Equal(t, http.StatusNotFound, code)
+
+	code, body := call(http.MethodGet, "/services/web", "secret", "")
+	assert.Equal(t, http.StatusOK, code)
+	var status serviceStatus
+	assert.Nil(t, json.Unmarshal([]byte(body), &status))
+	assert.Equal(t, "weight_round_robin", status.Balancer)
+	assert.Equal(t, 2, len(status.Backends))
+	backendA := findBackend(status, hostA)
+	assert.Equal(t, 10, backendA.Weight)
+	assert.True(t, backendA.Healthy)
+	assert.True(t, backendA.Available)
+
+	// 摘除 b 后只转发到 a
+	code, body = call(http.MethodPost, "/services/web/backends/"+hostB+"/drain", "secret", "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Nil(t, json.Unmarshal([]byte(body), &status))
+	assert.True(t, findBackend(status, hostB).Drained)
+	assert.False(t, findBackend(status, hostB).Available)
+	for i := 0; i < 4; i++ {
+		_, body = get()
+		assert.Equal(t, "a", body)
+	}
+	code, _ = call(http.MethodPost, "/services/web/backends/127.0.0.1:1/drain", "secret", "")
+	assert.Equal(t, http.StatusNotFound, code)
+	code, _ = call(http.MethodPost, "/services/web/backends/"+hostB+"/undrain", "secret", "")
+	assert.Equal(t, http.StatusOK, code)
+
+	// 修改权重
+	code, _ = call(http.MethodPut, "/services/web/backends/"+hostA+"/weight", "secret", `{"weight": -1}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, body = call(http.MethodPut, "/services/web/backends/"+hostA+"/weight", "secret", `{"weight": 30}`)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Nil(t, json.Unmarshal([]byte(body), &status))
+	assert.Equal(t, 30, findBackend(status, hostA).Weight)
+	assert.True(t, findBackend(status, hostA).WeightOverridden)
+	counts := map[string]int{}
+	for i := 0; i < 8; i++ {
+		_, body = get()
+		counts[body]++
+	}
+	assert.Equal(t, 6, counts["a"])
+	assert.Equal(t, 2, counts["b"])
+
+	// 停用、启用路由
+	code, _ = call(http.MethodPost, "/routes/web/api/disable", "secret", "")
+	assert.Equal(t, http.StatusOK, code)
+	code, _ = get()
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	_, body = call(http.MethodGet, "/routes", "secret", "")
+	var routes []routeStatus
+	assert.Nil(t, json.Unmarshal([]byte(body), &routes))
+	assert.Equal(t, 1, len(routes))
+	assert.False(t, routes[0].Enabled)
+	assert.Equal(t, []string{"rate_limit"}, routes[0].Middleware)
+	code, _ = call(http.MethodPost, "/routes/web/api/enable", "secret", "")
+	assert.Equal(t, http.StatusOK, code)
+	code, _ = get()
+	assert.Equal(t, http.StatusOK, code)
+	code, _ = call(http.MethodPost, "/routes/web/missing/enable", "secret", "")
+	assert.Equal(t, http.StatusNotFound, code)
+
+	_, body = call(http.MethodGet, "/limiters", "secret", "")
+	assert.Contains(t, body, `{"scope":"web/api","rate":1000,"burst":100}`)
+	code, _ = call(http.MethodGet, "/breakers", "secret", "")
+	assert.Equal(t, http.StatusOK, code)
+
+	// 流量统计：按下游主机分组，按租户过滤
+	req, _ := http.NewRequest(http.MethodGet, "http://"+webAddr+"/", nil)
+	req.Header.Set("X-Tenant", "acme")
+	resp, err := http.DefaultClient.Do(req)
+	if assert.Nil(t, err) {
+		resp.Body.Close()
+	}
+	code, body = call(http.MethodGet, "/stats?window=hour&group_by=route,backend", "secret", "")
+	assert.Equal(t, http.StatusOK, code)
+	var stats []flowcount.StatsSeries
+	assert.Nil(t, json.Unmarshal([]byte(body), &stats))
+	var total int64
+	for _, s := range stats {
+		assert.Equal(t, "web/api", s.Key.Route)
+		total += s.Total.Requests
+	}
+	assert.Equal(t, int64(4+8+2+1), total)
+	// 停用路由期间的 503 没有转发到下游主机
+	if disabled := stats[len(stats)-1]; assert.Equal(t, "", disabled.Key.Backend) {
+		assert.Equal(t, int64(1), disabled.Total.Status["5xx"])
+	}
+	_, body = call(http.MethodGet, "/stats?tenant=acme", "secret", "")
+	assert.Nil(t, json.Unmarshal([]byte(body), &stats))
+	if assert.Equal(t, 1, len(stats)) {
+		assert.Equal(t, int64(1), stats[0].Total.Requests)
+		assert.Equal(t, int64(1), stats[0].Total.Status["2xx"])
+	}
+	code, _ = call(http.MethodGet, "/stats?window=week", "secret", "")
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	// Redis 不可用
+	code, body = call(http.MethodGet, "/redis", "secret", "")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Contains(t, body, `"addr":"127.0.0.1:1","healthy":false`)
+}
+
+// 摘除所有主机：http 返回 503，tcp 关闭连接，网关继续运行
+func TestAdminDrainAll(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer backend.Close()
+	host := strings.TrimPrefix(backend.URL, "http://")
+	cfg, err := Parse([]byte(fmt.Sprintf(`
+services:
+  - {name: web, discovery: {hosts: [{addr: %q}]}}
+  - {name: raw, protocol: tcp, discovery: {hosts: [{addr: %q}]}}
+listeners:
+  - {name: web, addr: 127.0.0.1:0, routes: [{name: api, path: /, service: web}]}
+  - {name: raw, protocol: tcp, addr: 127.0.0.1:0, routes: [{name: raw, service: raw}]}
+admin: {addr: 127.0.0.1:0}
+`, host, host)))
+	assert.Nil(t, err)
+	g, err := Build(context.Background(), cfg)
+	assert.Nil(t, err)
+	assert.Nil(t, g.Start())
+	defer g.Close()
+
+	admin := func(path string) {
+		resp, err := http.Post("http://"+g.Addr("admin")+path, "", nil)
+		if assert.Nil(t, err) {
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			resp.Body.Close()
+		}
+	}
+	get := func() int {
+		resp, err := http.Get("http://" + g.Addr("web") + "/")
+		if !assert.Nil(t, err) {
+			return 0
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	admin("/services/web/backends/" + host + "/drain")
+	admin("/services/raw/backends/" + host + "/drain")
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, http.StatusServiceUnavailable, get())
+	}
+	conn, err := net.Dial("tcp", g.Addr("raw"))
+	if assert.Nil(t, err) {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		_, err = conn.Read(make([]byte, 1))
+		assert.Equal(t, io.EOF, err)
+		conn.Close()
+	}
+
+	admin("/services/web/backends/" + host + "/undrain")
+	assert.Equal(t, http.StatusOK, get())
+}
+
+// 应用管理：新增、修改、删除应用，app_quota 中间件鉴权；热加载保留通过管理接口新增的应用
+func TestAdminApps(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("X-App-ID") + r.Header.Get("X-App-Secret")))
+	}))
+	defer backend.Close()
+	data := fmt.Sprintf(`
+services: [{name: web, discovery: {hosts: [{addr: %q}]}}]
+listeners:
+  - name: web
+    addr: 127.0.0.1:0
+    routes:
+      - {name: api, path: /api, service: web, middleware: [{type: app_quota}]}
+      - {name: open, path: /, service: web}
+admin: {addr: 127.0.0.1:0}
+redis: {addrs: [127.0.0.1:1], dial_timeout: 100ms}
+apps: [{app_id: partner, secret: s1, routes: [web/api], daily_quota: 10}]
+`, strings.TrimPrefix(backend.URL, "http://"))
+	cfg, err := Parse([]byte(data))
+	assert.Nil(t, err)
+	g, err := Build(context.Background(), cfg)
+	assert.Nil(t, err)
+	assert.Nil(t, g.Start())
+	defer g.Close()
+	webAddr, adminAddr := g.Addr("web"), g.Addr("admin")
+
+	call := func(method, path, body string) (int, string) {
+		req, _ := http.NewRequest(method, "http://"+adminAddr+path, strings.NewReader(body))
+		resp, err := http.DefaultClient.Do(req)
+		if !assert.Nil(t, err) {
+			return 0, ""
+		}
+		defer resp.Body.Close()
+		data, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(data)
+	}
+	get := func(path, id, secret string) (int, string) {
+		req, _ := http.NewRequest(http.MethodGet, "http://"+webAddr+path, nil)
+		req.Header.Set("X-App-ID", id)
+		req.Header.Set("X-App-Secret", secret)
+		resp, err := http.DefaultClient.Do(req)
+		if !assert.Nil(t, err) {
+			return 0, ""
+		}
+		defer resp.Body.Close()
+		data, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(data)
+	}
+
+	// Redis 不可用时不检查配额，密钥不转发到下游
+	code, body := get("/api", "partner", "s1")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "partner", body)
+	code, _ = get("/api", "partner", "s2")
+	assert.Equal(t, http.StatusUnauthorized, code)
+	code, _ = get("/", "", "")
+	assert.Equal(t, http.StatusOK, code)
+
+	code, body = call(http.MethodPost, "/apps", `{"app_id": "acme", "qps": 100}`)
+	assert.Equal(t, http.StatusCreated, code)
+	var app quota.App
+	assert.Nil(t, json.Unmarshal([]byte(body), &app))
+	assert.Len(t, app.Secret, 32)
+	code, _ = call(http.MethodPost, "/apps", `{"app_id": "acme"}`)
+	assert.Equal(t, http.StatusConflict, code)
+	code, _ = call(http.MethodPost, "/apps", `{"app_id": "x", "monthly_quota": -1}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = get("/api", "acme", app.Secret)
+	assert.Equal(t, http.StatusOK, code)
+
+	// 修改时不传密钥保留原密钥
+	code, body = call(http.MethodPut, "/apps/acme", `{"routes": ["web/other"], "daily_quota": 5}`)
+	assert.Equal(t, http.StatusOK, code)
+	assert.NotContains(t, body, app.Secret)
+	code, body = get("/api", "acme", app.Secret)
+	assert.Equal(t, http.StatusForbidden, code)
+	assert.Equal(t, "route not allowed\n", body)
+	code, _ = call(http.MethodPut, "/apps/missing", `{}`)
+	assert.Equal(t, http.StatusNotFound, code)
+
+	code, body = call(http.MethodGet, "/apps", "")
+	assert.Equal(t, http.StatusOK, code)
+	var apps []quota.App
+	assert.Nil(t, json.Unmarshal([]byte(body), &apps))
+	if assert.Equal(t, 2, len(apps)) {
+		assert.Equal(t, "acme", apps[0].ID)
+		assert.Equal(t, int64(5), apps[0].DailyQuota)
+		assert.Empty(t, apps[0].Secret)
+	}
+	code, body = call(http.MethodGet, "/apps/partner", "")
+	assert.Equal(t, http.StatusOK, code)
+	var status appStatus
+	assert.Nil(t, json.Unmarshal([]byte(body), &status))
+	assert.Equal(t, []string{"web/api"}, status.Routes)
+	assert.Nil(t, status.Usage)
+	assert.NotEmpty(t, status.UsageError)
+
+	// 热加载：配置没有变化的 partner 保留，新增的 acme 保留
+	code, _ = call(http.MethodPut, "/apps/partner", `{"disabled": true}`)
+	assert.Equal(t, http.StatusOK, code)
+	cfg, err = Parse([]byte(data))
+	assert.Nil(t, err)
+	assert.Nil(t, g.Reload(cfg))
+	code, _ = get("/api", "partner", "s1")
+	assert.Equal(t, http.StatusForbidden, code)
+	// 配置变化后使用新配置
+	cfg, err = Parse([]byte(strings.Replace(data, "secret: s1", "secret: s3", 1)))
+	assert.Nil(t, err)
+	assert.Nil(t, g.Reload(cfg))
+	code, _ = get("/api", "partner", "s3")
+	assert.Equal(t, http.StatusOK, code)
+	// 配置中删除的应用被删除
+	cfg, err = Parse([]byte(strings.Replace(data, "apps: [{app_id: partner, secret: s1, routes: [web/api], daily_quota: 10}]", "", 1)))
+	assert.Nil(t, err)
+	assert.Nil(t, g.Reload(cfg))
+	code, _ = call(http.MethodGet, "/apps/partner", "")
+	assert.Equal(t, http.StatusNotFound, code)
+	_, ok := g.apps.Get("acme")
+	assert.True(t, ok)
+
+	code, _ = call(http.MethodDelete, "/apps/acme", "")
+	assert.Equal(t, http.StatusOK, code)
+	code, _ = call(http.MethodDelete, "/apps/acme", "")
+	assert.Equal(t, http.StatusNotFound, code)
+	code, _ = get("/api", "acme", app.Secret)
+	assert.Equal(t, http.StatusUnauthorized, code)
+}
+
+func findBackend(status serviceStatus, addr string) backendStatus {
+	for _, b := range status.Backends {
+		if b.Addr == addr {
+			return b
+		}
+	}
+	return backendStatus{}
+}
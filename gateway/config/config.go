@@ -0,0 +1,581 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"gateway/middleware/timerate"
+	"gopkg.in/yaml.v3"
+	"io"
+	"io/ioutil"
+	"net"
+	"regexp"
+	"time"
+)
+
+// 网关声明式配置
+//
+// 一个配置文件描述整个网关：
+// 	services：下游服务，包括服务发现来源、负载均衡算法、主动/被动健康检查、慢启动
+// 	middleware_stacks：命名中间件栈，路由通过 stacks 引用
+// 	listeners：监听器（http、tcp），每个监听器有自己的路由表，路由转发到某个服务
+// 	drain_timeout：关闭监听器时等待处理中的请求（连接）结束的最长时间，默认 30s
+// 	apps：接入网关的应用，路由使用 app_quota 中间件鉴权并检查应用的 QPS、日配额与月配额
+// 配置文件使用 YAML 格式；JSON 是 YAML 的子集，可以直接使用，字段名相同。
+// 示例见 testdata/gateway.yaml。
+
+// 服务与监听器协议
+const (
+	ProtocolHTTP  = "http"
+	ProtocolHTTPS = "https"
+	ProtocolTCP   = "tcp"
+)
+
+// 服务发现来源
+const (
+	DiscoveryStatic    = "static"
+	DiscoveryZookeeper = "zookeeper"
+)
+
+// defaultDrainTimeout 默认的连接排空时间
+const defaultDrainTimeout = 30 * time.Second
+
+// Config 网关配置
+type Config struct {
+	Services         []*ServiceConfig               `yaml:"services"`
+	MiddlewareStacks map[string][]*MiddlewareConfig `yaml:"middleware_stacks"`
+	Listeners        []*ListenerConfig              `yaml:"listeners"`
+	Admin            *AdminConfig                   `yaml:"admin"`
+	Redis            *RedisConfig                   `yaml:"redis"`
+	Stats            *StatsConfig                   `yaml:"stats"`
+	Apps             []*AppConfig                   `yaml:"apps"`
+	// 网关关闭、热加载删除监听器时，等待处理中的请求（连接）结束的最长时间，超时后强制关闭
+	DrainTimeout time.Duration `yaml:"drain_timeout"`
+}
+
+// AdminConfig 管理接口，见 admin.go；修改后需要重启网关才能生效
+type AdminConfig struct {
+	Addr string `yaml:"addr"`
+	// 访问令牌，不为空时请求需要携带 Authorization: Bearer <token>
+	// addr 不是回环地址（127.0.0.1、::1、localhost）时必须配置
+	Token string `yaml:"token"`
+}
+
+// validate 管理接口可以修改路由、主机与应用，监听非回环地址时必须配置令牌
+func (a *AdminConfig) validate() error {
+	if a.Addr == "" {
+		return errors.New("addr is required")
+	}
+	if a.Token != "" {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(a.Addr)
+	if err != nil {
+		return fmt.Errorf("invalid addr %q: %v", a.Addr, err)
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return fmt.Errorf("token is required when addr %q is not a loopback address", a.Addr)
+	}
+	return nil
+}
+
+// RedisConfig Redis 连接，流量统计等功能共用，未配置时连接 127.0.0.1:6379
+// master_name 不为空时 addrs 为哨兵地址；否则依次尝试 addrs，使用第一个主节点
+type RedisConfig struct {
+	Addrs        []string      `yaml:"addrs"`
+	MasterName   string        `yaml:"master_name"`
+	Password     string        `yaml:"password"`
+	DB           int           `yaml:"db"`
+	PoolSize     int           `yaml:"pool_size"`
+	DialTimeout  time.Duration `yaml:"dial_timeout"`
+	ReadTimeout  time.Duration `yaml:"read_timeout"`
+	WriteTimeout time.Duration `yaml:"write_timeout"`
+	IdleTimeout  time.Duration `yaml:"idle_timeout"`
+}
+
+// StatsConfig 流量统计，未配置时同样统计服务、路由、下游主机维度
+type StatsConfig struct {
+	// 租户键，格式见 timerate.ParseKey，如 header:X-Tenant-ID、jwt:tenant；为空时不统计租户维度
+	TenantKey string `yaml:"tenant_key"`
+	// 维度组合数上限，默认 1000，只在启动时生效
+	MaxSeries int `yaml:"max_series"`
+}
+
+// AppConfig 接入网关的应用，对应 quota.App
+// 通过管理接口新增、修改的应用保存在内存中；热加载时只更新配置有变化的应用，删除配置中已经删除的应用
+type AppConfig struct {
+	ID     string `yaml:"app_id"`
+	Secret string `yaml:"secret"`
+	// 允许访问的路由（监听器名称/路由名称），为空时允许所有使用 app_quota 中间件的路由
+	Routes       []string `yaml:"routes"`
+	QPS          int      `yaml:"qps"`
+	DailyQuota   int64    `yaml:"daily_quota"`
+	MonthlyQuota int64    `yaml:"monthly_quota"`
+	Disabled     bool     `yaml:"disabled"`
+}
+
+// ServiceConfig 下游服务
+type ServiceConfig struct {
+	Name string `yaml:"name"`
+	// 下游协议：http（默认）、https、tcp
+	Protocol string `yaml:"protocol"`
+	// 负载均衡算法，见 balancerTypes，默认 round_robin
+	Balancer    string             `yaml:"balancer"`
+	Discovery   DiscoveryConfig    `yaml:"discovery"`
+	HealthCheck *HealthCheckConfig `yaml:"health_check"`
+	Outlier     *OutlierConfig     `yaml:"outlier"`
+	SlowStart   *SlowStartConfig   `yaml:"slow_start"`
+}
+
+// DiscoveryConfig 服务发现来源
+type DiscoveryConfig struct {
+	// static（默认）、zookeeper
+	Type string `yaml:"type"`
+	// 静态主机列表；使用 zookeeper 时只用于指定主机权重
+	Hosts []HostConfig `yaml:"hosts"`
+	// zookeeper 集群地址与服务节点路径
+	ZkHosts []string `yaml:"zk_hosts"`
+	ZkPath  string   `yaml:"zk_path"`
+}
+
+// HostConfig 下游主机
+type HostConfig struct {
+	Addr string `yaml:"addr"`
+	// 权重，<= 0 时使用负载均衡配置的默认权重
+	Weight int `yaml:"weight"`
+}
+
+// HealthCheckConfig 主动健康检查，对应 loadbalance.HealthCheck
+type HealthCheckConfig struct {
+	// tcp（默认）、http、grpc
+	Type               string        `yaml:"type"`
+	Scheme             string        `yaml:"scheme"`
+	Path               string        `yaml:"path"`
+	ExpectedStatuses   []int         `yaml:"expected_statuses"`
+	BodyMatch          string        `yaml:"body_match"`
+	Service            string        `yaml:"service"`
+	Send               string        `yaml:"send"`
+	Expect             string        `yaml:"expect"`
+	Interval           time.Duration `yaml:"interval"`
+	Timeout            time.Duration `yaml:"timeout"`
+	HealthyThreshold   int           `yaml:"healthy_threshold"`
+	UnhealthyThreshold int           `yaml:"unhealthy_threshold"`
+	Jitter             time.Duration `yaml:"jitter"`
+}
+
+// OutlierConfig 被动健康检查，对应 loadbalance.OutlierConf
+type OutlierConfig struct {
+	ConsecutiveErrors  int           `yaml:"consecutive_errors"`
+	BaseEjectionTime   time.Duration `yaml:"base_ejection_time"`
+	MaxEjectionTime    time.Duration `yaml:"max_ejection_time"`
+	MaxEjectionPercent int           `yaml:"max_ejection_percent"`
+}
+
+// SlowStartConfig 新主机慢启动，对应 loadbalance.SlowStart
+type SlowStartConfig struct {
+	Window           time.Duration `yaml:"window"`
+	Aggression       float64       `yaml:"aggression"`
+	MinWeightPercent int           `yaml:"min_weight_percent"`
+}
+
+// StickyConfig cookie 会话保持，对应 proxy.StickySession
+type StickyConfig struct {
+	CookieName string        `yaml:"cookie_name"`
+	Secret     string        `yaml:"secret"`
+	Path       string        `yaml:"path"`
+	MaxAge     time.Duration `yaml:"max_age"`
+	Secure     bool          `yaml:"secure"`
+}
+
+// ListenerConfig 监听器
+type ListenerConfig struct {
+	Name string `yaml:"name"`
+	// http（默认）、tcp
+	Protocol string `yaml:"protocol"`
+	Addr     string `yaml:"addr"`
+	// 证书文件，都不为空时 http 监听器使用 https
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+	// 全局中间件，仅 http 监听器
+	Middleware []*MiddlewareConfig `yaml:"middleware"`
+	Routes     []*RouteConfig      `yaml:"routes"`
+}
+
+// RouteConfig 路由
+// http 路由按 path、hosts、methods、headers、queries 匹配，tcp 路由按 sni、source_cidr 匹配
+type RouteConfig struct {
+	Name    string            `yaml:"name"`
+	Path    string            `yaml:"path"`
+	Hosts   []string          `yaml:"hosts"`
+	Methods []string          `yaml:"methods"`
+	Headers map[string]string `yaml:"headers"`
+	Queries map[string]string `yaml:"queries"`
+
+	SNI        []string `yaml:"sni"`
+	SourceCIDR []string `yaml:"source_cidr"`
+
+	// 转发的服务名称
+	Service string `yaml:"service"`
+	// 引用的命名中间件栈，在 middleware 之前执行
+	Stacks     []string            `yaml:"stacks"`
+	Middleware []*MiddlewareConfig `yaml:"middleware"`
+	Sticky     *StickyConfig       `yaml:"sticky"`
+}
+
+// MiddlewareConfig http 中间件，type 决定使用哪些字段：
+// 	rate_limit：rate（每秒请求数）、burst；按键限流时 key、max_keys、key_ttl、overrides
+// 	circuit_breaker：name（默认为监听器名称/路由名称，全局中间件为监听器名称，中间件栈为监听器名称/栈名称）、timeout、max_concurrent、sleep_window（毫秒）、
+// 		request_volume、error_percent
+// 	strip_prefix：prefix
+// 	replace_prefix：prefix、replacement
+// 	regex_rewrite：pattern、replacement
+// 	host_rewrite：host
+// 	app_quota：没有参数，应用见 Config.Apps；只能用于路由与中间件栈
+type MiddlewareConfig struct {
+	Type string `yaml:"type"`
+
+	Rate  int `yaml:"rate"`
+	Burst int `yaml:"burst"`
+	// 限流键，格式见 timerate.ParseKey，如 client_ip、header:X-API-Key,client_ip、jwt:sub；
+	// 为空时所有请求共用一个令牌桶
+	Key       string                        `yaml:"key"`
+	MaxKeys   int                           `yaml:"max_keys"` // 保存的键数量上限，默认 10000
+	KeyTTL    time.Duration                 `yaml:"key_ttl"`  // 键空闲过期时间，默认 10m
+	Overrides map[string]*RateLimitOverride `yaml:"overrides"`
+
+	Name          string `yaml:"name"`
+	Timeout       int    `yaml:"timeout"`
+	MaxConcurrent int    `yaml:"max_concurrent"`
+	SleepWindow   int    `yaml:"sleep_window"`
+	RequestVolume int    `yaml:"request_volume"`
+	ErrorPercent  int    `yaml:"error_percent"`
+
+	Prefix      string `yaml:"prefix"`
+	Pattern     string `yaml:"pattern"`
+	Replacement string `yaml:"replacement"`
+	Host        string `yaml:"host"`
+}
+
+// RateLimitOverride 指定键的速率与容量，如付费客户的 API key
+type RateLimitOverride struct {
+	Rate  int `yaml:"rate" json:"rate"`
+	Burst int `yaml:"burst" json:"burst"`
+}
+
+// LoadFile 读取并校验配置文件
+func LoadFile(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(data)
+}
+
+// Parse 解析并校验 YAML 或 JSON 配置，未知字段视为错误
+func Parse(data []byte) (*Config, error) {
+	cfg := &Config{}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(cfg); err != nil && err != io.EOF {
+		return nil, err
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// Validate 填充默认值并校验配置，错误信息指明出错的服务、监听器或路由
+func (cfg *Config) Validate() error {
+	services := map[string]*ServiceConfig{}
+	for i, s := range cfg.Services {
+		if s.Name == "" {
+			return fmt.Errorf("services[%d]: name is required", i)
+		}
+		if services[s.Name] != nil {
+			return fmt.Errorf("service %s: duplicate name", s.Name)
+		}
+		services[s.Name] = s
+		if err := s.validate(); err != nil {
+			return fmt.Errorf("service %s: %v", s.Name, err)
+		}
+	}
+	for name, stack := range cfg.MiddlewareStacks {
+		for _, m := range stack {
+			if err := m.validate(); err != nil {
+				return fmt.Errorf("middleware stack %s: %v", name, err)
+			}
+		}
+	}
+	if len(cfg.Listeners) == 0 {
+		return errors.New("at least one listener is required")
+	}
+	if cfg.DrainTimeout < 0 {
+		return errors.New("drain_timeout must not be negative")
+	}
+	if cfg.DrainTimeout == 0 {
+		cfg.DrainTimeout = defaultDrainTimeout
+	}
+	if cfg.Admin != nil {
+		if err := cfg.Admin.validate(); err != nil {
+			return fmt.Errorf("admin: %v", err)
+		}
+	}
+	if cfg.Redis != nil {
+		if err := cfg.Redis.validate(); err != nil {
+			return fmt.Errorf("redis: %v", err)
+		}
+	}
+	if cfg.Stats != nil {
+		if err := cfg.Stats.validate(); err != nil {
+			return fmt.Errorf("stats: %v", err)
+		}
+	}
+	listeners := map[string]bool{}
+	routes := map[string]bool{}
+	for i, l := range cfg.Listeners {
+		if l.Name == "" {
+			l.Name = fmt.Sprintf("listener-%d", i)
+		}
+		if listeners[l.Name] {
+			return fmt.Errorf("listener %s: duplicate name", l.Name)
+		}
+		listeners[l.Name] = true
+		if err := l.validate(cfg, services); err != nil {
+			return fmt.Errorf("listener %s: %v", l.Name, err)
+		}
+		if l.Protocol == ProtocolHTTP {
+			for _, r := range l.Routes {
+				routes[l.Name+"/"+r.Name] = true
+			}
+		}
+	}
+	apps := map[string]bool{}
+	for i, a := range cfg.Apps {
+		if a.ID == "" {
+			return fmt.Errorf("apps[%d]: app_id is required", i)
+		}
+		if apps[a.ID] {
+			return fmt.Errorf("app %s: duplicate app_id", a.ID)
+		}
+		apps[a.ID] = true
+		if err := a.validate(routes); err != nil {
+			return fmt.Errorf("app %s: %v", a.ID, err)
+		}
+	}
+	return nil
+}
+
+// validate 校验应用，routes 为所有 http 路由（监听器名称/路由名称）
+func (a *AppConfig) validate(routes map[string]bool) error {
+	if a.Secret == "" {
+		return errors.New("secret is required")
+	}
+	app := a.app()
+	if err := app.Validate(); err != nil {
+		return err
+	}
+	for _, r := range a.Routes {
+		if !routes[r] {
+			return fmt.Errorf("unknown route %q, expect listener/route", r)
+		}
+	}
+	return nil
+}
+
+func (r *RedisConfig) validate() error {
+	if len(r.Addrs) == 0 {
+		return errors.New("addrs is required")
+	}
+	if r.DB < 0 || r.PoolSize < 0 || r.DialTimeout < 0 || r.ReadTimeout < 0 || r.WriteTimeout < 0 || r.IdleTimeout < 0 {
+		return errors.New("db, pool_size and timeouts must not be negative")
+	}
+	return nil
+}
+
+func (s *StatsConfig) validate() error {
+	if s.TenantKey != "" {
+		if _, err := timerate.ParseKey(s.TenantKey); err != nil {
+			return err
+		}
+	}
+	if s.MaxSeries < 0 {
+		return errors.New("max_series must not be negative")
+	}
+	return nil
+}
+
+func (s *ServiceConfig) validate() error {
+	if s.Protocol == "" {
+		s.Protocol = ProtocolHTTP
+	}
+	if s.Protocol != ProtocolHTTP && s.Protocol != ProtocolHTTPS && s.Protocol != ProtocolTCP {
+		return fmt.Errorf("unknown protocol %q", s.Protocol)
+	}
+	if s.Balancer == "" {
+		s.Balancer = "round_robin"
+	}
+	if _, ok := balancerTypes[s.Balancer]; !ok {
+		return fmt.Errorf("unknown balancer %q", s.Balancer)
+	}
+	d := &s.Discovery
+	if d.Type == "" {
+		d.Type = DiscoveryStatic
+	}
+	switch d.Type {
+	case DiscoveryStatic:
+		if len(d.Hosts) == 0 {
+			return errors.New("static discovery needs at least one host")
+		}
+	case DiscoveryZookeeper:
+		if len(d.ZkHosts) == 0 || d.ZkPath == "" {
+			return errors.New("zookeeper discovery needs zk_hosts and zk_path")
+		}
+	default:
+		return fmt.Errorf("unknown discovery type %q", d.Type)
+	}
+	for _, h := range d.Hosts {
+		if h.Addr == "" {
+			return errors.New("host addr is required")
+		}
+	}
+	if s.HealthCheck != nil {
+		if _, ok := healthCheckTypes[s.HealthCheck.Type]; !ok {
+			return fmt.Errorf("unknown health check type %q", s.HealthCheck.Type)
+		}
+	}
+	return nil
+}
+
+func (l *ListenerConfig) validate(cfg *Config, services map[string]*ServiceConfig) error {
+	if l.Protocol == "" {
+		l.Protocol = ProtocolHTTP
+	}
+	if l.Protocol != ProtocolHTTP && l.Protocol != ProtocolTCP {
+		return fmt.Errorf("unknown protocol %q", l.Protocol)
+	}
+	if l.Addr == "" {
+		return errors.New("addr is required")
+	}
+	if (l.CertFile == "") != (l.KeyFile == "") {
+		return errors.New("cert_file and key_file must be set together")
+	}
+	if l.Protocol == ProtocolTCP && (len(l.Middleware) > 0 || l.CertFile != "") {
+		return errors.New("tcp listener does not support middleware or tls termination")
+	}
+	for _, m := range l.Middleware {
+		if err := m.validate(); err != nil {
+			return err
+		}
+		// 全局中间件在路由中间件之前执行，此时还不知道请求的路由，无法检查应用允许的路由
+		if m.Type == "app_quota" {
+			return errors.New("app_quota can only be used in routes and middleware stacks")
+		}
+	}
+	if len(l.Routes) == 0 {
+		return errors.New("at least one route is required")
+	}
+	for i, r := range l.Routes {
+		if r.Name == "" {
+			r.Name = fmt.Sprintf("%s-route-%d", l.Name, i)
+		}
+		if err := r.validate(l, cfg, services); err != nil {
+			return fmt.Errorf("route %s: %v", r.Name, err)
+		}
+	}
+	return nil
+}
+
+func (r *RouteConfig) validate(l *ListenerConfig, cfg *Config, services map[string]*ServiceConfig) error {
+	s, ok := services[r.Service]
+	if !ok {
+		return fmt.Errorf("unknown service %q", r.Service)
+	}
+	if l.Protocol == ProtocolTCP {
+		if s.Protocol != ProtocolTCP {
+			return fmt.Errorf("tcp route can not forward to %s service %s", s.Protocol, s.Name)
+		}
+		if r.Path != "" || len(r.Hosts) > 0 || len(r.Methods) > 0 || len(r.Headers) > 0 || len(r.Queries) > 0 ||
+			len(r.Stacks) > 0 || len(r.Middleware) > 0 || r.Sticky != nil {
+			return errors.New("tcp route only supports sni, source_cidr and service")
+		}
+		for _, c := range r.SourceCIDR {
+			if _, _, err := net.ParseCIDR(c); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if s.Protocol == ProtocolTCP {
+		return fmt.Errorf("http route can not forward to tcp service %s", s.Name)
+	}
+	if len(r.SNI) > 0 || len(r.SourceCIDR) > 0 {
+		return errors.New("http route does not support sni or source_cidr")
+	}
+	if r.Path == "" {
+		r.Path = "/"
+	}
+	for _, name := range r.Stacks {
+		if _, ok := cfg.MiddlewareStacks[name]; !ok {
+			return fmt.Errorf("middleware stack %q not defined", name)
+		}
+	}
+	for _, m := range r.Middleware {
+		if err := m.validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *MiddlewareConfig) validate() error {
+	switch m.Type {
+	case "rate_limit":
+		if m.Rate <= 0 || m.Burst <= 0 {
+			return errors.New("rate_limit needs positive rate and burst")
+		}
+		if m.Key != "" {
+			if _, err := timerate.ParseKey(m.Key); err != nil {
+				return err
+			}
+		}
+		if m.MaxKeys < 0 || m.KeyTTL < 0 {
+			return errors.New("rate_limit: max_keys and key_ttl must not be negative")
+		}
+		if len(m.Overrides) > 0 && m.Key == "" {
+			return errors.New("rate_limit: overrides need key")
+		}
+		for key, o := range m.Overrides {
+			if o == nil || o.Rate <= 0 || o.Burst <= 0 {
+				return fmt.Errorf("rate_limit: override %q needs positive rate and burst", key)
+			}
+		}
+	case "circuit_breaker":
+		if m.Timeout <= 0 || m.MaxConcurrent <= 0 || m.SleepWindow <= 0 || m.RequestVolume <= 0 || m.ErrorPercent <= 0 {
+			return errors.New("circuit_breaker needs positive timeout, max_concurrent, sleep_window, request_volume and error_percent")
+		}
+	case "strip_prefix":
+		if m.Prefix == "" {
+			return errors.New("strip_prefix needs prefix")
+		}
+	case "replace_prefix":
+		if m.Prefix == "" {
+			return errors.New("replace_prefix needs prefix")
+		}
+	case "regex_rewrite":
+		if m.Pattern == "" {
+			return errors.New("regex_rewrite needs pattern")
+		}
+		if _, err := regexp.Compile(m.Pattern); err != nil {
+			return fmt.Errorf("regex_rewrite: %v", err)
+		}
+	case "host_rewrite":
+		if m.Host == "" {
+			return errors.New("host_rewrite needs host")
+		}
+	case "app_quota":
+	default:
+		return fmt.Errorf("unknown middleware type %q", m.Type)
+	}
+	return nil
+}
@@ -0,0 +1,270 @@
+package config
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"gateway/middleware/circuitbreaker"
+	"gateway/middleware/flowcount"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 示例配置：解析 YAML、填充默认值
+func TestLoadFile(t *testing.T) {
+	cfg, err := LoadFile("testdata/gateway.yaml")
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(cfg.Services))
+
+	orders := cfg.Services[0]
+	assert.Equal(t, "weight_round_robin", orders.Balancer)
+	assert.Equal(t, 5*time.Second, orders.HealthCheck.Interval)
+	assert.Equal(t, 30*time.Second, orders.Outlier.BaseEjectionTime)
+	assert.Equal(t, time.Minute, orders.SlowStart.Window)
+
+	users := cfg.Services[1]
+	assert.Equal(t, ProtocolHTTP, users.Protocol)
+	assert.Equal(t, DiscoveryZookeeper, users.Discovery.Type)
+
+	public := cfg.Listeners[0]
+	assert.Equal(t, "/api/orders", public.Routes[0].Path)
+	assert.Equal(t, time.Hour, public.Routes[0].Sticky.MaxAge)
+	assert.Equal(t, 2, len(cfg.MiddlewareStacks["protected"]))
+	assert.Equal(t, 2000, cfg.MiddlewareStacks["protected"][0].Overrides["partner-key"].Burst)
+	assert.Equal(t, "db-route-0", cfg.Listeners[1].Routes[0].Name)
+	assert.Equal(t, "127.0.0.1:9090", cfg.Admin.Addr)
+	assert.Equal(t, 15*time.Second, cfg.DrainTimeout)
+	assert.Equal(t, []string{"127.0.0.1:6379", "127.0.0.1:6380"}, cfg.Redis.Addrs)
+	assert.Equal(t, 500*time.Millisecond, cfg.Redis.DialTimeout)
+	assert.Equal(t, "app_quota", public.Routes[1].Middleware[0].Type)
+	assert.Equal(t, []string{"public/users"}, cfg.Apps[0].Routes)
+	assert.Equal(t, int64(2000000), cfg.Apps[0].MonthlyQuota)
+}
+
+// tcp 路由：多个连接共用一个代理，相隔超过拨号截止时间的连接仍然可以连接下游
+func TestGatewayTCPConnections(t *testing.T) {
+	defer func(d time.Duration) { tcpDialDeadline = d }(tcpDialDeadline)
+	tcpDialDeadline = 50 * time.Millisecond
+	echo := func(name string) net.Listener {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.Nil(t, err)
+		go func() {
+			for {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				go func() {
+					defer conn.Close()
+					line, _ := bufio.NewReader(conn).ReadString('\n')
+					conn.Write([]byte(name + " " + line))
+				}()
+			}
+		}()
+		return ln
+	}
+	a, b := echo("a"), echo("b")
+	defer a.Close()
+	defer b.Close()
+	cfg, err := Parse([]byte(fmt.Sprintf(`
+services: [{name: echo, protocol: tcp, discovery: {hosts: [{addr: %q}, {addr: %q}]}}]
+listeners: [{name: raw, protocol: tcp, addr: 127.0.0.1:0, routes: [{service: echo}]}]
+`, a.Addr().String(), b.Addr().String())))
+	assert.Nil(t, err)
+	g, err := Build(context.Background(), cfg)
+	assert.Nil(t, err)
+	assert.Nil(t, g.Start())
+	defer g.Close()
+
+	replies := map[string]int{}
+	for i := 0; i < 4; i++ {
+		if i > 0 {
+			time.Sleep(2 * tcpDialDeadline)
+		}
+		conn, err := net.Dial("tcp", g.Addr("raw"))
+		if !assert.Nil(t, err) {
+			return
+		}
+		conn.Write([]byte("ping\n"))
+		line, err := bufio.NewReader(conn).ReadString('\n')
+		conn.Close()
+		assert.Nil(t, err, "connection %d", i)
+		replies[line]++
+	}
+	assert.Equal(t, map[string]int{"a ping\n": 2, "b ping\n": 2}, replies)
+}
+
+// 熔断器默认名称包含监听器名称，不同监听器的同名路由使用各自的熔断器
+func TestCircuitBreakerNames(t *testing.T) {
+	cfg, err := Parse([]byte(`
+services: [{name: a, discovery: {hosts: [{addr: 127.0.0.1:1}]}}]
+listeners:
+  - name: cb-public
+    addr: 127.0.0.1:0
+    routes: [{name: api, service: a, middleware: [{type: circuit_breaker, timeout: 100, max_concurrent: 1, sleep_window: 1, request_volume: 1, error_percent: 1}]}]
+  - name: cb-internal
+    addr: 127.0.0.1:0
+    routes: [{name: api, service: a, middleware: [{type: circuit_breaker, timeout: 200, max_concurrent: 1, sleep_window: 1, request_volume: 1, error_percent: 1}]}]
+`))
+	assert.Nil(t, err)
+	_, err = Build(context.Background(), cfg)
+	assert.Nil(t, err)
+	timeouts := map[string]int64{}
+	for _, s := range circuitbreaker.CircuitStates() {
+		timeouts[s.Name] = s.Timeout
+	}
+	assert.Equal(t, int64(100), timeouts["cb-public/api"])
+	assert.Equal(t, int64(200), timeouts["cb-internal/api"])
+}
+
+// 错误配置：错误信息指明出错位置
+func TestParseErrors(t *testing.T) {
+	service := "services: [{name: a, discovery: {hosts: [{addr: 127.0.0.1:80}]}}]\n"
+	cases := map[string]string{
+		"listeners: [{addr: ':80', routes: [{service: a}]}]":                                                               `unknown service "a"`,
+		service + "listeners: [{addr: ':80', routes: [{service: b}]}]":                                                     `unknown service "b"`,
+		service + "listeners: [{addr: ':80', protocol: tcp, routes: [{service: a}]}]":                                      "tcp route can not forward to http service a",
+		service + "listeners: [{addr: ':80', routes: [{service: a, stacks: [x]}]}]":                                        `middleware stack "x" not defined`,
+		service + "listeners: [{addr: ':80', routes: [{service: a, middleware: [{type: gzip}]}]}]":                         `unknown middleware type "gzip"`,
+		service + "listeners: [{addr: ':80', routes: [{service: a, middleware: [{type: regex_rewrite, pattern: '(' }]}]}]": "regex_rewrite",
+		service + "listeners: [{addr: ':80', routes: [{service: a, hots: [x]}]}]":                                          "field hots not found",
+		"services: [{name: a, balancer: fastest, discovery: {hosts: [{addr: x}]}}]\nlisteners: []":                         `service a: unknown balancer "fastest"`,
+		service: "at least one listener is required",
+		service + "listeners: [{addr: ':80', routes: [{service: a}]}]\nredis: {addrs: []}":                              "redis: addrs is required",
+		service + "listeners: [{addr: ':80', middleware: [{type: app_quota}], routes: [{service: a}]}]":                 "app_quota can only be used in routes",
+		service + "listeners: [{addr: ':80', routes: [{service: a}]}]\napps: [{app_id: x}]":                             "app x: secret is required",
+		service + "listeners: [{addr: ':80', routes: [{service: a}]}]\napps: [{app_id: x, secret: s, routes: [a]}]":     `app x: unknown route "a"`,
+		service + "listeners: [{addr: ':80', routes: [{service: a}]}]\napps: [{app_id: x, secret: s, daily_quota: -1}]": "must not be negative",
+		service + "listeners: [{addr: ':80', routes: [{service: a}]}]\napps: [{app_id: x, secret: s}, {app_id: x}]":     "app x: duplicate app_id",
+		service + "listeners: [{addr: ':80', routes: [{service: a}]}]\nadmin: {addr: ':9090'}":                          "admin: token is required",
+		service + "listeners: [{addr: ':80', routes: [{service: a}]}]\nadmin: {addr: '10.0.0.1:9090'}":                  "admin: token is required",
+	}
+	for data, want := range cases {
+		_, err := Parse([]byte(data))
+		if assert.NotNil(t, err, data) {
+			assert.Contains(t, err.Error(), want)
+		}
+	}
+	// 回环地址可以不配置令牌
+	for _, addr := range []string{"127.0.0.1:9090", "'[::1]:9090'", "localhost:9090"} {
+		_, err := Parse([]byte(service + "listeners: [{addr: ':80', routes: [{service: a}]}]\nadmin: {addr: " + addr + "}"))
+		assert.Nil(t, err, addr)
+	}
+
+	rateLimit := service + "listeners: [{addr: ':80', routes: [{service: a, middleware: [{type: rate_limit, rate: 1, burst: 1, %s}]}]}]"
+	rateLimitCases := map[string]string{
+		"key: ip":                                   `unknown rate limit key "ip"`,
+		"overrides: {k: {rate: 2, burst: 2}}":       "overrides need key",
+		"key: client_ip, overrides: {k: {rate: 2}}": `override "k" needs positive rate and burst`,
+	}
+	for fields, want := range rateLimitCases {
+		_, err := Parse([]byte(fmt.Sprintf(rateLimit, fields)))
+		if assert.NotNil(t, err, fields) {
+			assert.Contains(t, err.Error(), want)
+		}
+	}
+}
+
+// 按 JSON 配置启动网关：http 路由、前缀去除、中间件栈、404，tcp 路由
+func TestGateway(t *testing.T) {
+	backend := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(name + " " + r.Host + " " + r.URL.Path))
+		}))
+	}
+	orders, users := backend("orders"), backend("users")
+	defer orders.Close()
+	defer users.Close()
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer echo.Close()
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				line, _ := bufio.NewReader(conn).ReadString('\n')
+				conn.Write([]byte("echo " + line))
+			}()
+		}
+	}()
+
+	data := fmt.Sprintf(`{
+	"services": [
+		{"name": "orders", "discovery": {"hosts": [{"addr": %q}]}},
+		{"name": "users", "balancer": "p2c", "discovery": {"hosts": [{"addr": %q}]}, "outlier": {}},
+		{"name": "echo", "protocol": "tcp", "discovery": {"hosts": [{"addr": %q}]}}
+	],
+	"middleware_stacks": {"limited": [{"type": "rate_limit", "rate": 1, "burst": 1}]},
+	"listeners": [
+		{"name": "web", "addr": "127.0.0.1:0", "routes": [
+			{"path": "/api/orders", "service": "orders", "middleware": [{"type": "strip_prefix", "prefix": "/api"}]},
+			{"path": "/users", "service": "users", "stacks": ["limited"],
+				"middleware": [{"type": "host_rewrite", "host": "users.internal"}]}
+		]},
+		{"name": "raw", "protocol": "tcp", "addr": "127.0.0.1:0", "routes": [{"service": "echo"}]}
+	]
+}`, strings.TrimPrefix(orders.URL, "http://"), strings.TrimPrefix(users.URL, "http://"), echo.Addr().String())
+	cfg, err := Parse([]byte(data))
+	assert.Nil(t, err)
+	g, err := Build(context.Background(), cfg)
+	assert.Nil(t, err)
+	assert.Nil(t, g.Start())
+	defer g.Close()
+
+	get := func(path string) (int, string) {
+		resp, err := http.Get("http://" + g.Addr("web") + path)
+		if !assert.Nil(t, err) {
+			return 0, ""
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+	status, body := get("/api/orders/1")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "orders "+strings.TrimPrefix(orders.URL, "http://")+" /orders/1", body)
+
+	status, body = get("/users/7")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "users users.internal /users/7", body)
+	// 中间件栈中的限流器：突发 1 个请求
+	_, body = get("/users/7")
+	assert.Contains(t, body, "rate limit")
+
+	status, _ = get("/payments")
+	assert.Equal(t, http.StatusNotFound, status)
+
+	conn, err := net.Dial("tcp", g.Addr("raw"))
+	assert.Nil(t, err)
+	defer conn.Close()
+	conn.Write([]byte("ping\n"))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	assert.Nil(t, err)
+	assert.Equal(t, "echo ping\n", line)
+
+	// 流量统计：被限流与没有匹配路由的请求同样计入；tcp 连接结束后计入
+	conn.Close()
+	time.Sleep(50 * time.Millisecond)
+	stats, err := g.stats.Query(flowcount.StatsQuery{GroupBy: []string{"service"}})
+	assert.Nil(t, err)
+	requests := map[string]flowcount.StatsSummary{}
+	for _, s := range stats {
+		requests[s.Key.Service] = s.Total
+	}
+	assert.Equal(t, int64(1), requests["orders"].Requests)
+	assert.Equal(t, map[string]int64{"2xx": 1, "4xx": 1}, requests["users"].Status)
+	assert.Equal(t, map[string]int64{"4xx": 1}, requests[""].Status)
+	assert.Equal(t, int64(1), requests["echo"].Requests)
+	assert.Equal(t, int64(len("ping\n")), requests["echo"].BytesIn)
+	assert.Equal(t, int64(len("echo ping\n")), requests["echo"].BytesOut)
+}
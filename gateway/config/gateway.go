@@ -0,0 +1,622 @@
+package config
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"gateway/loadbalance"
+	"gateway/middleware/circuitbreaker"
+	"gateway/middleware/flowcount"
+	"gateway/middleware/quota"
+	"gateway/middleware/rewrite"
+	sr "gateway/middleware/router/http"
+	tcprouter "gateway/middleware/router/tcp"
+	"gateway/middleware/timerate"
+	"gateway/proxy"
+	tcp "gateway/proxy/tcp_proxy/server"
+	"log"
+	"net"
+	"net/http"
+	"reflect"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// balancerTypes 负载均衡算法名称
+var balancerTypes = map[string]loadbalance.LbType{
+	"random":                  loadbalance.LbRandom,
+	"round_robin":             loadbalance.LbRoundRobin,
+	"weight_round_robin":      loadbalance.LbWeightRoundRobin,
+	"consistent_hash":         loadbalance.LbConsistentHash,
+	"least_conn":              loadbalance.LbLeastConn,
+	"p2c":                     loadbalance.LbP2C,
+	"consistent_hash_bounded": loadbalance.LbConsistentHashBounded,
+	"maglev":                  loadbalance.LbMaglev,
+}
+
+// healthCheckTypes 健康检查方式名称
+var healthCheckTypes = map[string]loadbalance.HealthCheckType{
+	"":     loadbalance.HealthCheckTCP,
+	"tcp":  loadbalance.HealthCheckTCP,
+	"http": loadbalance.HealthCheckHTTP,
+	"grpc": loadbalance.HealthCheckGRPC,
+}
+
+// tcpDialDeadline tcp 路由连接下游的截止时间，从每个连接开始计算
+var tcpDialDeadline = time.Minute
+
+// 未指定权重时主机的权重，与负载均衡配置的默认权重相同
+const defaultHostWeight = 50
+
+// Gateway 按配置组装的网关：每个服务一个负载均衡器，每个监听器一个路由器
+//
+// 使用步骤：
+//
+//	1.Build 创建负载均衡器、路由器、中间件与代理
+//	2.Start 监听所有地址并提供服务
+//	3.Reload 热加载新配置（可选），见 reload.go
+//	4.Shutdown 排空处理中的请求（连接）后关闭，或 Close 立即关闭，见 shutdown.go
+type Gateway struct {
+	ctx       context.Context
+	cfg       *Config
+	services  map[string]*service
+	listeners []*listener
+	routes    map[string]*routeState // 监听器名称/路由名称 -> 路由状态
+	admin     *http.Server
+	adminLn   net.Listener
+	redis     *flowcount.RedisClient // 配置了 redis 时创建的客户端，同时设置为 flowcount 的默认客户端
+	stats     *flowcount.Stats       // 流量统计，热加载后保留，见 stats.go
+	apps      *quota.Manager         // 应用与配额，app_quota 中间件与管理接口共用
+
+	mux     sync.Mutex // 启动、热加载、关闭互斥
+	started bool
+	closed  bool
+	done    chan struct{} // 关闭后停止监听配置变化
+}
+
+// service 服务的负载均衡器及其配置
+type service struct {
+	conf *ServiceConfig
+	lb   loadbalance.LoadBalance
+	// 管理接口读取、修改运行时状态使用，见 admin.go
+	source  loadbalance.LoadBalanceConf        // 服务发现配置
+	health  *loadbalance.LoadBalanceHealthConf // 主动健康检查，可能为 nil
+	manage  *loadbalance.LoadBalanceManageConf // 摘除主机、修改权重
+	outlier *loadbalance.OutlierDetectBalance  // 被动健康检查，可能为 nil
+	// 不再使用时需要关闭的资源，如健康检查
+	closers []func()
+}
+
+// close 释放服务的资源，处理中的请求仍然可以使用负载均衡器
+func (s *service) close() {
+	for _, c := range s.closers {
+		c()
+	}
+}
+
+// findListener 获取指定名称的监听器，需要持有 Gateway.mux
+func (g *Gateway) findListener(name string) *listener {
+	for _, l := range g.listeners {
+		if l.conf.Name == name {
+			return l
+		}
+	}
+	return nil
+}
+
+// routeState 获取路由的运行时状态，不存在时创建
+func (g *Gateway) routeState(listenerName, routeName string) *routeState {
+	key := listenerName + "/" + routeName
+	state, ok := g.routes[key]
+	if !ok {
+		state = &routeState{}
+		g.routes[key] = state
+	}
+	return state
+}
+
+// listener 监听器：热加载时监听地址不变，只替换路由器
+type listener struct {
+	conf        *ListenerConfig
+	httpServer  *http.Server
+	tcpServer   *tcp.TCPServer
+	httpHandler *sr.SliceRouterHandler
+	tcpHandler  *tcprouter.TcpSliceRouterHandler
+	ln          net.Listener
+	hijacked    *hijackedConns // http 监听器中被接管的连接（websocket 等）
+	stopped     bool           // 已主动关闭，由 Gateway.mux 保护
+}
+
+// routeState 路由的运行时状态，热加载后同名路由保持不变
+type routeState struct {
+	disabled int32 // 1 表示路由已停用，见 admin.go
+}
+
+// upstreamKey 路由上下文中保存路由转发目标（反向代理）的键
+type upstreamKey struct{}
+
+// routeNameKey 路由上下文中保存请求匹配的路由（监听器名称/路由名称）的键
+type routeNameKey struct{}
+
+// requestRoute 请求匹配的路由，用于检查应用允许的路由
+func requestRoute(c *sr.SliceRouteContext) string {
+	name, _ := c.Get(routeNameKey{}).(string)
+	return name
+}
+
+// Build 按配置组装网关，cfg 需要先经过 Validate（LoadFile、Parse 已校验）
+func Build(ctx context.Context, cfg *Config) (*Gateway, error) {
+	g := &Gateway{ctx: ctx, cfg: cfg, done: make(chan struct{}), routes: map[string]*routeState{}}
+	maxSeries := 0
+	if cfg.Stats != nil {
+		maxSeries = cfg.Stats.MaxSeries
+	}
+	g.stats = flowcount.NewStats(maxSeries)
+	g.apps = quota.NewManager(nil)
+	for _, a := range cfg.Apps {
+		g.apps.Set(a.app())
+	}
+	services, err := buildServices(cfg, nil)
+	if err != nil {
+		return nil, err
+	}
+	g.services = services
+	for _, l := range cfg.Listeners {
+		ls, err := g.newListener(cfg, l)
+		if err != nil {
+			for _, s := range services {
+				s.close()
+			}
+			return nil, err
+		}
+		g.listeners = append(g.listeners, ls)
+	}
+	if cfg.Admin != nil {
+		g.admin = &http.Server{Addr: cfg.Admin.Addr, Handler: g.AdminHandler(cfg.Admin.Token)}
+	}
+	if cfg.Redis != nil {
+		g.redis = cfg.Redis.client()
+		flowcount.SetDefaultRedis(g.redis)
+	}
+	return g, nil
+}
+
+// client 创建 Redis 客户端，不会立即连接
+func (r *RedisConfig) client() *flowcount.RedisClient {
+	return flowcount.NewRedisClient(flowcount.RedisConfig{
+		Addrs:        r.Addrs,
+		MasterName:   r.MasterName,
+		Password:     r.Password,
+		DB:           r.DB,
+		PoolSize:     r.PoolSize,
+		DialTimeout:  r.DialTimeout,
+		ReadTimeout:  r.ReadTimeout,
+		WriteTimeout: r.WriteTimeout,
+		IdleTimeout:  r.IdleTimeout,
+	})
+}
+
+// app 转换为 quota.App
+func (a *AppConfig) app() quota.App {
+	return quota.App{
+		ID:           a.ID,
+		Secret:       a.Secret,
+		Routes:       a.Routes,
+		QPS:          a.QPS,
+		DailyQuota:   a.DailyQuota,
+		MonthlyQuota: a.MonthlyQuota,
+		Disabled:     a.Disabled,
+	}
+}
+
+// Service 获取服务的负载均衡器，服务不存在时返回 nil
+func (g *Gateway) Service(name string) loadbalance.LoadBalance {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+	if s, ok := g.services[name]; ok {
+		return s.lb
+	}
+	return nil
+}
+
+// Start 监听所有地址并在后台提供服务
+// 任意一个地址监听失败时，关闭已经打开的监听器并返回错误
+func (g *Gateway) Start() error {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+	if g.closed {
+		return errors.New("gateway closed")
+	}
+	for _, l := range g.listeners {
+		ln, err := net.Listen("tcp", l.conf.Addr)
+		if err != nil {
+			for _, l := range g.listeners {
+				if l.ln != nil {
+					l.ln.Close()
+					l.ln = nil
+				}
+			}
+			return fmt.Errorf("listener %s: %v", l.conf.Name, err)
+		}
+		l.ln = ln
+	}
+	if g.admin != nil {
+		ln, err := net.Listen("tcp", g.admin.Addr)
+		if err != nil {
+			for _, l := range g.listeners {
+				l.ln.Close()
+				l.ln = nil
+			}
+			return fmt.Errorf("admin listener: %v", err)
+		}
+		g.adminLn = ln
+		go func() {
+			log.Printf("gateway: admin api serving at %s\n", ln.Addr())
+			g.admin.Serve(ln)
+		}()
+	}
+	for _, l := range g.listeners {
+		go g.serve(l, l.conf, l.ln)
+	}
+	g.started = true
+	return nil
+}
+
+// Addr 获取监听器实际监听的地址（配置的端口为 0 时由系统分配），未启动时返回空字符串
+// 管理接口的监听器名称为 admin（监听器不能重名，配置中的 admin 监听器优先）
+func (g *Gateway) Addr(name string) string {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+	if name == "admin" && g.adminLn != nil && g.findListener(name) == nil {
+		return g.adminLn.Addr().String()
+	}
+	for _, l := range g.listeners {
+		if l.conf.Name == name && l.ln != nil {
+			return l.ln.Addr().String()
+		}
+	}
+	return ""
+}
+
+// newListener 创建监听器及其路由器
+func (g *Gateway) newListener(cfg *Config, l *ListenerConfig) (*listener, error) {
+	ls := &listener{conf: l}
+	if l.Protocol == ProtocolTCP {
+		ls.tcpHandler = tcprouter.NewTcpSliceRouterHandler(nil, g.buildTCPRouter(l))
+		ls.tcpServer = &tcp.TCPServer{Addr: l.Addr, BaseCxt: g.ctx, Handler: ls.tcpHandler}
+		return ls, nil
+	}
+	router, err := g.buildHTTPRouter(cfg, l)
+	if err != nil {
+		return nil, err
+	}
+	ls.hijacked = &hijackedConns{}
+	ls.httpHandler = newHTTPHandler(router, ls.hijacked)
+	ls.httpServer = &http.Server{Addr: l.Addr, Handler: ls.httpHandler}
+	return ls, nil
+}
+
+// serve 在后台提供服务，conf 为启动时的配置（热加载会替换 l.conf）
+func (g *Gateway) serve(l *listener, conf *ListenerConfig, ln net.Listener) {
+	log.Printf("gateway: %s listener %s serving at %s\n", conf.Protocol, conf.Name, ln.Addr())
+	var err error
+	switch {
+	case l.tcpServer != nil:
+		err = l.tcpServer.Serve(ln)
+	case conf.CertFile != "":
+		err = l.httpServer.ServeTLS(ln, conf.CertFile, conf.KeyFile)
+	default:
+		err = l.httpServer.Serve(ln)
+	}
+	g.mux.Lock()
+	stopped := l.stopped
+	g.mux.Unlock()
+	if !stopped {
+		log.Printf("gateway: listener %s stopped: %v\n", conf.Name, err)
+	}
+}
+
+// buildServices 创建所有服务的负载均衡器
+// 热加载时，配置没有变化的服务复用 old 中的负载均衡器，保留连接数、驱逐状态等运行时状态；
+// 配置变化的服务重新创建，并保留通过管理接口摘除的主机与修改的权重
+// 创建失败时释放已经新建的服务
+func buildServices(cfg *Config, old map[string]*service) (map[string]*service, error) {
+	services := map[string]*service{}
+	for _, s := range cfg.Services {
+		if o, ok := old[s.Name]; ok && reflect.DeepEqual(o.conf, s) {
+			services[s.Name] = o
+			continue
+		}
+		svc, err := buildService(s)
+		if err != nil {
+			for name, svc := range services {
+				if old[name] != svc {
+					svc.close()
+				}
+			}
+			return nil, fmt.Errorf("service %s: %v", s.Name, err)
+		}
+		if o, ok := old[s.Name]; ok {
+			for _, host := range o.manage.DrainedHosts() {
+				svc.manage.Drain(host, true)
+			}
+			for _, host := range o.hosts() {
+				if weight, ok := o.manage.Weight(host); ok {
+					svc.manage.SetWeight(host, weight)
+				}
+			}
+		}
+		services[s.Name] = svc
+	}
+	return services, nil
+}
+
+// buildService 创建服务的负载均衡器：
+//
+//	服务发现配置 -> 主动健康检查（可选）-> 运行时管理 -> 负载均衡算法 -> 慢启动（可选）-> 被动健康检查（可选）
+func buildService(s *ServiceConfig) (*service, error) {
+	svc := &service{conf: s}
+	format := "%s"
+	if s.Protocol != ProtocolTCP {
+		format = s.Protocol + "://%s"
+	}
+	weights := map[string]string{}
+	for _, h := range s.Discovery.Hosts {
+		weight := h.Weight
+		if weight <= 0 {
+			weight = defaultHostWeight
+		}
+		weights[h.Addr] = strconv.Itoa(weight)
+	}
+
+	var mConf loadbalance.LoadBalanceConf
+	switch s.Discovery.Type {
+	case DiscoveryZookeeper:
+		zkConf, err := loadbalance.NewLoadBalanceZkConf(format, s.Discovery.ZkPath, s.Discovery.ZkHosts, weights)
+		if err != nil {
+			return nil, err
+		}
+		svc.closers = append(svc.closers, zkConf.Close)
+		mConf = zkConf
+	default:
+		mConf = loadbalance.NewLoadBalanceStaticConf(format, weights)
+	}
+	svc.source = mConf
+	if s.HealthCheck != nil {
+		hConf, err := loadbalance.NewLoadBalanceHealthConf(mConf, s.HealthCheck.healthCheck())
+		if err != nil {
+			svc.close()
+			return nil, err
+		}
+		svc.closers = append(svc.closers, hConf.Close)
+		svc.health = hConf
+		mConf = hConf
+	}
+	svc.manage = loadbalance.NewLoadBalanceManageConf(mConf)
+	mConf = svc.manage
+
+	lb := loadbalance.LoadBalanceFactoryWithConf(balancerTypes[s.Balancer], mConf)
+	if s.SlowStart != nil {
+		loadbalance.SetSlowStart(lb, &loadbalance.SlowStart{
+			Window:           s.SlowStart.Window,
+			Aggression:       s.SlowStart.Aggression,
+			MinWeightPercent: s.SlowStart.MinWeightPercent,
+		})
+	}
+	if s.Outlier != nil {
+		svc.outlier = loadbalance.NewOutlierDetectBalance(lb, &loadbalance.OutlierConf{
+			ConsecutiveErrors:  s.Outlier.ConsecutiveErrors,
+			BaseEjectionTime:   s.Outlier.BaseEjectionTime,
+			MaxEjectionTime:    s.Outlier.MaxEjectionTime,
+			MaxEjectionPercent: s.Outlier.MaxEjectionPercent,
+		})
+		// 服务列表变化时清理已移除主机的异常状态
+		svc.outlier.SetConf(mConf)
+		mConf.Attach(svc.outlier)
+		lb = svc.outlier
+	}
+	svc.lb = lb
+	return svc, nil
+}
+
+func (h *HealthCheckConfig) healthCheck() *loadbalance.HealthCheck {
+	return &loadbalance.HealthCheck{
+		Type:               healthCheckTypes[h.Type],
+		Scheme:             h.Scheme,
+		Path:               h.Path,
+		ExpectedStatuses:   h.ExpectedStatuses,
+		BodyMatch:          h.BodyMatch,
+		Service:            h.Service,
+		Send:               h.Send,
+		Expect:             h.Expect,
+		Interval:           h.Interval,
+		Timeout:            h.Timeout,
+		HealthyThreshold:   h.HealthyThreshold,
+		UnhealthyThreshold: h.UnhealthyThreshold,
+		Jitter:             h.Jitter,
+	}
+}
+
+func (s *StickyConfig) stickySession() *proxy.StickySession {
+	if s == nil {
+		return nil
+	}
+	sticky := &proxy.StickySession{
+		CookieName: s.CookieName,
+		Path:       s.Path,
+		MaxAge:     s.MaxAge,
+		Secure:     s.Secure,
+	}
+	if s.Secret != "" {
+		sticky.Secret = []byte(s.Secret)
+	}
+	return sticky
+}
+
+// buildHTTPRouter 创建 http 监听器的路由器
+// 每个请求依次执行：流量统计 -> 全局中间件 -> 路由的中间件栈 -> 路由中间件 -> 路由的反向代理
+func (g *Gateway) buildHTTPRouter(cfg *Config, l *ListenerConfig) (*sr.SliceRouter, error) {
+	router := sr.NewSliceRouter()
+	var tenant timerate.KeyFunc
+	if cfg.Stats != nil && cfg.Stats.TenantKey != "" {
+		// 键的格式已经在 Validate 中校验
+		tenant, _ = timerate.ParseKey(cfg.Stats.TenantKey)
+	}
+	router.UseGlobal(g.httpStatsMiddleware(tenant))
+	router.UseGlobal(g.buildMiddleware(l.Middleware, l.Name)...)
+	for name, stack := range cfg.MiddlewareStacks {
+		router.Stack(name, g.buildMiddleware(stack, l.Name+"/"+name)...)
+	}
+	for _, r := range l.Routes {
+		upstream, err := proxy.NewStickyLoadBalanceReverseProxy(g.ctx, g.services[r.Service].lb, r.Sticky.stickySession())
+		if err != nil {
+			return nil, fmt.Errorf("listener %s route %s: %v", l.Name, r.Name, err)
+		}
+		route := router.Group(r.Path).Host(r.Hosts...).Method(r.Methods...)
+		for k, v := range r.Headers {
+			route.Header(k, v)
+		}
+		for k, v := range r.Queries {
+			route.Query(k, v)
+		}
+		state := g.routeState(l.Name, r.Name)
+		routeName, service := l.Name+"/"+r.Name, r.Service
+		route.Use(func(c *sr.SliceRouteContext) {
+			setStatsRoute(c, routeName, service)
+			c.Set(routeNameKey{}, routeName)
+			if atomic.LoadInt32(&state.disabled) == 1 {
+				http.Error(c.Rw, "route disabled", http.StatusServiceUnavailable)
+				c.Abort()
+				return
+			}
+			c.Set(upstreamKey{}, upstream)
+			c.Next()
+		})
+		route.UseStack(r.Stacks...)
+		route.Use(g.buildMiddleware(r.Middleware, l.Name+"/"+r.Name)...)
+	}
+	return router, nil
+}
+
+// newHTTPHandler 创建 http 监听器的处理器：转发到路由的反向代理，没有匹配的路由时返回 404
+// 被接管的连接记录在 hijacked 中，关闭监听器时等待其结束
+func newHTTPHandler(router *sr.SliceRouter, hijacked *hijackedConns) *sr.SliceRouterHandler {
+	return sr.NewSliceRouterHandler(func(c *sr.SliceRouteContext) http.Handler {
+		upstream, ok := c.Get(upstreamKey{}).(http.Handler)
+		if !ok {
+			return http.NotFoundHandler()
+		}
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			// 记录下游响应状态码，供熔断中间件判断请求是否成功
+			sw := &statusWriter{ResponseWriter: rw, status: http.StatusOK, hijacked: hijacked}
+			upstream.ServeHTTP(sw, req)
+			c.Set("status_code", sw.status)
+		})
+	}, router)
+}
+
+// buildMiddleware 创建中间件，name 为熔断器的默认名称
+func (g *Gateway) buildMiddleware(confs []*MiddlewareConfig, name string) []sr.HandlerFunc {
+	handlers := []sr.HandlerFunc{}
+	for _, m := range confs {
+		switch m.Type {
+		case "rate_limit":
+			handlers = append(handlers, buildRateLimiter(m))
+		case "circuit_breaker":
+			cbName := m.Name
+			if cbName == "" {
+				cbName = name
+			}
+			circuitbreaker.ConfCircuitBreaker(cbName, m.Timeout, m.MaxConcurrent, m.SleepWindow, m.RequestVolume, m.ErrorPercent)
+			handlers = append(handlers, circuitbreaker.CircuitBreaker(cbName, nil))
+		case "strip_prefix":
+			handlers = append(handlers, rewrite.StripPrefixMiddleware(m.Prefix))
+		case "replace_prefix":
+			handlers = append(handlers, rewrite.ReplacePrefixMiddleware(m.Prefix, m.Replacement))
+		case "regex_rewrite":
+			handlers = append(handlers, rewrite.RegexRewriteMiddleware(m.Pattern, m.Replacement))
+		case "host_rewrite":
+			handlers = append(handlers, rewrite.HostRewriteMiddleware(m.Host))
+		case "app_quota":
+			handlers = append(handlers, g.apps.Middleware(requestRoute))
+		}
+	}
+	return handlers
+}
+
+// buildRateLimiter 创建限流中间件，配置了 key 时按键限流
+func buildRateLimiter(m *MiddlewareConfig) sr.HandlerFunc {
+	if m.Key == "" {
+		return timerate.RateLimiter(m.Rate, m.Burst)
+	}
+	// 键的格式已经在 Validate 中校验
+	key, _ := timerate.ParseKey(m.Key)
+	limiter := timerate.NewKeyedLimiter(timerate.Limit{Rate: float64(m.Rate), Burst: m.Burst}, key, m.MaxKeys, m.KeyTTL)
+	for k, o := range m.Overrides {
+		limiter.SetOverride(k, timerate.Limit{Rate: float64(o.Rate), Burst: o.Burst})
+	}
+	return limiter.Middleware()
+}
+
+// buildTCPRouter 创建 tcp 监听器的路由器，每个路由转发到服务的 TCP 反向代理
+// 没有匹配的路由时关闭连接
+func (g *Gateway) buildTCPRouter(l *ListenerConfig) *tcprouter.TcpSliceRouter {
+	router := tcprouter.NewTcpSliceRouter()
+	for _, r := range l.Routes {
+		route := router.Group(r.Name).SourceCIDR(r.SourceCIDR...)
+		if len(r.SNI) > 0 {
+			route.SNI(r.SNI...)
+		}
+		state := g.routeState(l.Name, r.Name)
+		routeName, service := l.Name+"/"+r.Name, r.Service
+		pxy := proxy.NewTcpLoadBalanceReverseProxy(g.ctx, g.services[r.Service].lb)
+		pxy.Deadline = tcpDialDeadline
+		route.Handler(pxy).Use(
+			func(c *tcprouter.TcpSliceRouteContext) {
+				g.tcpStats(c, routeName, service, func() {
+					if atomic.LoadInt32(&state.disabled) == 1 {
+						c.Conn.Close()
+						c.Abort()
+						return
+					}
+					c.Next()
+				})
+			})
+	}
+	return router
+}
+
+// statusWriter 记录响应状态码的 ResponseWriter
+type statusWriter struct {
+	http.ResponseWriter
+	status   int
+	hijacked *hijackedConns
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Flush 支持流式响应
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack 支持 websocket 等协议升级
+func (w *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response writer does not support hijack")
+	}
+	conn, rw, err := h.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	return w.hijacked.track(conn), rw, nil
+}
@@ -0,0 +1,304 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"gateway/middleware/flowcount"
+	sr "gateway/middleware/router/http"
+	"gateway/middleware/servicediscovery/zookeeper"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"reflect"
+	"syscall"
+	"time"
+)
+
+// 配置热加载
+//
+// Reload 使用新配置重新创建路由器与负载均衡器，校验通过后原子替换到运行中的处理器：
+// 	1.配置没有变化的服务复用原负载均衡器，保留连接数、驱逐状态等运行时状态
+// 	2.名称、协议、地址、证书都没有变化的监听器不重新监听，只替换路由器：
+// 		处理中的 http 请求在原路由器上执行完成，之后的请求（包括长连接上的请求）使用新路由器；
+// 		已建立的 WebSocket、TCP 连接不受影响
+// 	3.新增的监听器开始监听；删除的监听器停止接受新连接，在 drain_timeout 内排空处理中的请求（连接）
+// 任意一步失败时（服务发现连接失败、地址被占用等）保持原配置不变，返回错误。
+//
+// 触发方式：WatchSignal（SIGHUP）、WatchFile（文件变化）、WatchZk（zookeeper 节点数据变化）
+
+// Reload 热加载新配置，cfg 需要先经过 Validate（LoadFile、Parse 已校验）
+func (g *Gateway) Reload(cfg *Config) error {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+	if g.closed {
+		return errors.New("gateway closed")
+	}
+	oldServices := g.services
+	services, err := buildServices(cfg, oldServices)
+	if err != nil {
+		return err
+	}
+	// 路由器引用新的负载均衡器
+	g.services = services
+
+	reused := map[string]*listener{}
+	for _, l := range g.listeners {
+		reused[l.conf.Name] = l
+	}
+	// 保留的监听器与其新配置；新增的监听器配置
+	keptConf := map[*listener]*ListenerConfig{}
+	var kept []*listener
+	var addedConf []*ListenerConfig
+	for _, lc := range cfg.Listeners {
+		if l, ok := reused[lc.Name]; ok && l.sameSocket(lc) {
+			delete(reused, lc.Name)
+			kept = append(kept, l)
+			keptConf[l] = lc
+			continue
+		}
+		addedConf = append(addedConf, lc)
+	}
+	// reused 中剩下的是删除或地址变化的监听器
+	removed := reused
+
+	// 失败时回滚：关闭新增的监听，关闭新建的服务并恢复原服务，删除新建的路由状态
+	lns := map[string]net.Listener{}
+	rollback := func() {
+		for _, ln := range lns {
+			ln.Close()
+		}
+		for name, s := range services {
+			if oldServices[name] != s {
+				s.close()
+			}
+		}
+		g.services = oldServices
+		g.pruneRoutes(g.cfg)
+	}
+
+	// 先监听新增的地址，失败时回滚，不影响运行中的监听器
+	if g.started {
+		for _, lc := range addedConf {
+			if old, ok := removed[lc.Name]; ok && old.conf.Addr == lc.Addr {
+				// 同一地址改变了协议或证书，只能先关闭原监听器，该监听器无法回滚
+				old.ln.Close()
+				old.drain(cfg.DrainTimeout)
+				delete(removed, lc.Name)
+			}
+			ln, err := net.Listen("tcp", lc.Addr)
+			if err != nil {
+				rollback()
+				return fmt.Errorf("listener %s: %v", lc.Name, err)
+			}
+			lns[lc.Name] = ln
+		}
+	}
+
+	// 所有地址监听成功后再创建路由器（会创建路由状态），全部成功后再替换
+	added := make([]*listener, 0, len(addedConf))
+	for _, lc := range addedConf {
+		nl, err := g.newListener(cfg, lc)
+		if err != nil {
+			rollback()
+			return err
+		}
+		nl.ln = lns[lc.Name]
+		added = append(added, nl)
+	}
+	httpRouters := map[*listener]*sr.SliceRouter{}
+	for _, l := range kept {
+		if l.httpHandler == nil {
+			continue
+		}
+		router, err := g.buildHTTPRouter(cfg, keptConf[l])
+		if err != nil {
+			rollback()
+			return err
+		}
+		httpRouters[l] = router
+	}
+
+	// 原子替换路由器
+	for _, l := range kept {
+		l.conf = keptConf[l]
+		if l.httpHandler != nil {
+			l.httpHandler.SetRouter(httpRouters[l])
+		} else {
+			l.tcpHandler.SetRouter(g.buildTCPRouter(l.conf))
+		}
+	}
+	for _, l := range removed {
+		l.drain(cfg.DrainTimeout)
+	}
+	// 按配置顺序排列监听器
+	byName := map[string]*listener{}
+	for _, l := range append(kept, added...) {
+		byName[l.conf.Name] = l
+	}
+	listeners := make([]*listener, 0, len(cfg.Listeners))
+	for _, lc := range cfg.Listeners {
+		listeners = append(listeners, byName[lc.Name])
+	}
+	g.listeners = listeners
+	if g.started {
+		for _, l := range added {
+			go g.serve(l, l.conf, l.ln)
+		}
+	}
+	for name, s := range oldServices {
+		if services[name] != s {
+			s.close()
+		}
+	}
+	// 删除已经不存在的路由的状态
+	g.pruneRoutes(cfg)
+	g.reloadRedis(cfg)
+	g.reloadApps(cfg)
+	g.cfg = cfg
+	return nil
+}
+
+// reloadRedis redis 配置变化时替换默认客户端，需要持有 Gateway.mux
+// 删除 redis 配置时恢复连接 127.0.0.1:6379 的客户端
+func (g *Gateway) reloadRedis(cfg *Config) {
+	if reflect.DeepEqual(cfg.Redis, g.cfg.Redis) {
+		return
+	}
+	old := g.redis
+	g.redis = nil
+	if cfg.Redis != nil {
+		g.redis = cfg.Redis.client()
+		flowcount.SetDefaultRedis(g.redis)
+	} else {
+		flowcount.SetDefaultRedis(flowcount.NewRedisClient(flowcount.RedisConfig{}))
+	}
+	if old != nil {
+		old.Close()
+	}
+}
+
+// reloadApps 更新配置有变化的应用，删除配置中已经删除的应用，需要持有 Gateway.mux
+// 配置没有变化的应用保留通过管理接口所做的修改，通过管理接口新增的应用不受影响
+func (g *Gateway) reloadApps(cfg *Config) {
+	old := map[string]*AppConfig{}
+	for _, a := range g.cfg.Apps {
+		old[a.ID] = a
+	}
+	for _, a := range cfg.Apps {
+		if o, ok := old[a.ID]; !ok || !reflect.DeepEqual(o, a) {
+			g.apps.Set(a.app())
+		}
+		delete(old, a.ID)
+	}
+	for id := range old {
+		g.apps.Delete(id)
+	}
+}
+
+// sameSocket 监听器的监听方式是否没有变化，没有变化时可以直接替换路由器
+func (l *listener) sameSocket(c *ListenerConfig) bool {
+	return l.conf.Protocol == c.Protocol && l.conf.Addr == c.Addr &&
+		l.conf.CertFile == c.CertFile && l.conf.KeyFile == c.KeyFile
+}
+
+// pruneRoutes 删除 cfg 中不存在的路由的状态，需要持有 Gateway.mux
+func (g *Gateway) pruneRoutes(cfg *Config) {
+	routes := map[string]bool{}
+	for _, l := range cfg.Listeners {
+		for _, r := range l.Routes {
+			routes[l.Name+"/"+r.Name] = true
+		}
+	}
+	for key := range g.routes {
+		if !routes[key] {
+			delete(g.routes, key)
+		}
+	}
+}
+
+// reloadFrom 加载并热加载配置，失败时记录日志，保持原配置
+func (g *Gateway) reloadFrom(source string, load func() (*Config, error)) {
+	cfg, err := load()
+	if err == nil {
+		err = g.Reload(cfg)
+	}
+	if err != nil {
+		log.Printf("gateway: reload from %s failed, keep current config: %v\n", source, err)
+		return
+	}
+	log.Printf("gateway: reloaded config from %s\n", source)
+}
+
+// WatchSignal 收到 SIGHUP 时重新读取配置文件并热加载，网关关闭后停止监听
+func (g *Gateway) WatchSignal(path string) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+	go func() {
+		defer signal.Stop(sig)
+		for {
+			select {
+			case <-g.done:
+				return
+			case <-sig:
+				g.reloadFrom(path, func() (*Config, error) {
+					return LoadFile(path)
+				})
+			}
+		}
+	}()
+}
+
+// WatchFile 每隔 interval 检查配置文件，内容变化时热加载，网关关闭后停止检查
+func (g *Gateway) WatchFile(path string, interval time.Duration) {
+	last, _ := ioutil.ReadFile(path)
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-g.done:
+				return
+			case <-ticker.C:
+			}
+			data, err := ioutil.ReadFile(path)
+			if err != nil || bytes.Equal(data, last) {
+				continue
+			}
+			last = data
+			g.reloadFrom(path, func() (*Config, error) {
+				return Parse(data)
+			})
+		}
+	}()
+}
+
+// WatchZk 监听 zookeeper 节点数据（YAML 或 JSON 配置），数据变化时热加载
+// 首次读取到的数据与当前配置相同时也会热加载一次，配置没有变化的服务与监听器会被复用
+func (g *Gateway) WatchZk(zkHosts []string, nodePath string) error {
+	zkManager := zookeeper.NewZkManager(zkHosts)
+	if err := zkManager.GetConnect(); err != nil {
+		return err
+	}
+	snapshots, errs := zkManager.WatchPathData(nodePath)
+	source := "zookeeper " + nodePath
+	go func() {
+		defer zkManager.Close()
+		for {
+			select {
+			case <-g.done:
+				return
+			case err := <-errs:
+				log.Printf("gateway: stop watching %s: %v\n", source, err)
+				return
+			case data := <-snapshots:
+				g.reloadFrom(source, func() (*Config, error) {
+					return Parse(data)
+				})
+			}
+		}
+	}()
+	return nil
+}
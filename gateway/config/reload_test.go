@@ -0,0 +1,184 @@
+package config
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// echoServer 按行回显的 TCP 服务，每行加上前缀
+func echoServer(t *testing.T, prefix string) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					conn.Write([]byte(prefix + line))
+				}
+			}()
+		}
+	}()
+	return ln
+}
+
+func reloadConfig(t *testing.T, httpBackend, tcpBackend, extra string) *Config {
+	cfg, err := Parse([]byte(fmt.Sprintf(`
+services:
+  - {name: web, discovery: {hosts: [{addr: %q}]}}
+  - {name: echo, protocol: tcp, discovery: {hosts: [{addr: %q}]}}
+listeners:
+  - name: web
+    addr: 127.0.0.1:0
+    routes: [{path: /, service: web}]
+  - name: raw
+    protocol: tcp
+    addr: 127.0.0.1:0
+    routes: [{service: echo}]
+%s`, httpBackend, tcpBackend, extra)))
+	assert.Nil(t, err)
+	return cfg
+}
+
+// 热加载：新请求、新连接使用新配置，处理中的请求与已建立的连接不受影响
+func TestGatewayReload(t *testing.T) {
+	release := make(chan struct{})
+	backend := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/slow" {
+				<-release
+			}
+			w.Write([]byte(name))
+		}))
+	}
+	a, b := backend("a"), backend("b")
+	defer a.Close()
+	defer b.Close()
+	echo1, echo2 := echoServer(t, "1:"), echoServer(t, "2:")
+	defer echo1.Close()
+	defer echo2.Close()
+	hostA, hostB := strings.TrimPrefix(a.URL, "http://"), strings.TrimPrefix(b.URL, "http://")
+
+	g, err := Build(context.Background(), reloadConfig(t, hostA, echo1.Addr().String(), ""))
+	assert.Nil(t, err)
+	assert.Nil(t, g.Start())
+	defer g.Close()
+	webAddr, rawAddr := g.Addr("web"), g.Addr("raw")
+
+	get := func(path string) string {
+		resp, err := http.Get("http://" + webAddr + path)
+		if !assert.Nil(t, err) {
+			return ""
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return string(body)
+	}
+	echo := func(conn net.Conn, r *bufio.Reader) string {
+		conn.Write([]byte("hi\n"))
+		line, _ := r.ReadString('\n')
+		return line
+	}
+	assert.Equal(t, "a", get("/"))
+
+	// 热加载前建立的 TCP 连接、发出的慢请求
+	conn, err := net.Dial("tcp", rawAddr)
+	assert.Nil(t, err)
+	defer conn.Close()
+	connReader := bufio.NewReader(conn)
+	assert.Equal(t, "1:hi\n", echo(conn, connReader))
+	slow := make(chan string)
+	go func() { slow <- get("/slow") }()
+	time.Sleep(50 * time.Millisecond)
+
+	assert.Nil(t, g.Reload(reloadConfig(t, hostB, echo2.Addr().String(), "")))
+	assert.Equal(t, webAddr, g.Addr("web"))
+	assert.Equal(t, "b", get("/"))
+	close(release)
+	assert.Equal(t, "a", <-slow)
+	assert.Equal(t, "1:hi\n", echo(conn, connReader))
+
+	newConn, err := net.Dial("tcp", rawAddr)
+	assert.Nil(t, err)
+	defer newConn.Close()
+	assert.Equal(t, "2:hi\n", echo(newConn, bufio.NewReader(newConn)))
+
+	// 新增监听器的地址被占用：热加载失败，保持原配置
+	occupied := fmt.Sprintf(`
+  - name: admin
+    addr: %s
+    routes: [{path: /, service: web}]`, hostA)
+	routes := func() []string {
+		g.mux.Lock()
+		defer g.mux.Unlock()
+		keys := []string{}
+		for key := range g.routes {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		return keys
+	}
+	before := routes()
+	assert.NotNil(t, g.Reload(reloadConfig(t, hostA, echo1.Addr().String(), occupied)))
+	assert.Equal(t, "b", get("/"))
+	assert.Equal(t, "", g.Addr("admin"))
+	// 失败的热加载不会留下新路由的状态
+	assert.Equal(t, before, routes())
+}
+
+// 配置文件变化时自动热加载
+func TestGatewayWatchFile(t *testing.T) {
+	a := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("a")) }))
+	defer a.Close()
+	b := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("b")) }))
+	defer b.Close()
+	content := func(backend string) []byte {
+		return []byte(fmt.Sprintf(`
+services: [{name: web, discovery: {hosts: [{addr: %q}]}}]
+listeners: [{name: web, addr: 127.0.0.1:0, routes: [{path: /, service: web}]}]
+`, strings.TrimPrefix(backend, "http://")))
+	}
+	path := filepath.Join(t.TempDir(), "gateway.yaml")
+	assert.Nil(t, os.WriteFile(path, content(a.URL), 0644))
+	cfg, err := LoadFile(path)
+	assert.Nil(t, err)
+	g, err := Build(context.Background(), cfg)
+	assert.Nil(t, err)
+	assert.Nil(t, g.Start())
+	defer g.Close()
+	g.WatchFile(path, 10*time.Millisecond)
+
+	get := func() string {
+		resp, err := http.Get("http://" + g.Addr("web") + "/")
+		if err != nil {
+			return ""
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return string(body)
+	}
+	assert.Equal(t, "a", get())
+	assert.Nil(t, os.WriteFile(path, content(b.URL), 0644))
+	assert.Eventually(t, func() bool { return get() == "b" }, 2*time.Second, 20*time.Millisecond)
+}
@@ -0,0 +1,222 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// 关闭网关与排空连接
+//
+// Shutdown 用于滚动发布：监听器立即停止接受新连接（前置负载均衡器的新连接转到其他实例），
+// 处理中的请求与已建立的连接在 drain_timeout 内正常结束：
+// 	http 监听器：关闭空闲的长连接，等待处理中的请求结束；被接管的连接（websocket 等）同样等待
+// 	tcp 监听器：通过连接上下文通知 Handler，等待连接结束；TCP 代理转发的长连接保持到超时（见 tcp.ForceCloseDone）
+// 超时后强制关闭剩余连接。热加载删除监听器时使用相同的方式排空，见 reload.go。
+
+// drainPollInterval 检查被接管的连接是否全部结束的间隔
+const drainPollInterval = 50 * time.Millisecond
+
+// Shutdown 优雅关闭网关，最长等待 drain_timeout 或直到 ctx 到期，之后强制关闭剩余连接
+// 所有连接都已正常结束时返回 nil，强制关闭了连接时返回 context 的错误
+func (g *Gateway) Shutdown(ctx context.Context) error {
+	g.mux.Lock()
+	if g.closed {
+		g.mux.Unlock()
+		return nil
+	}
+	g.closed = true
+	close(g.done)
+	listeners := g.listeners
+	for _, l := range listeners {
+		l.stopped = true
+	}
+	services := g.services
+	redis := g.redis
+	timeout := g.cfg.DrainTimeout
+	g.mux.Unlock()
+
+	// 排空期间不持有 Gateway.mux，管理接口仍然可用
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	errs := make(chan error, len(listeners)+1)
+	for _, l := range listeners {
+		go func(l *listener) {
+			if err := l.shutdown(ctx); err != nil {
+				errs <- fmt.Errorf("listener %s: %w", l.conf.Name, err)
+				return
+			}
+			errs <- nil
+		}(l)
+	}
+	go func() {
+		if g.admin == nil {
+			errs <- nil
+			return
+		}
+		if err := g.admin.Shutdown(ctx); err != nil && err == ctx.Err() {
+			g.admin.Close()
+		}
+		errs <- nil
+	}()
+	var first error
+	for i := 0; i < len(listeners)+1; i++ {
+		if err := <-errs; err != nil && first == nil {
+			first = err
+		}
+	}
+	for _, s := range services {
+		s.close()
+	}
+	if redis != nil {
+		redis.Close()
+	}
+	return first
+}
+
+// Close 立即关闭所有监听器及处理中的请求（连接），Shutdown 排空期间调用时强制结束排空
+func (g *Gateway) Close() error {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+	if !g.closed {
+		g.closed = true
+		close(g.done)
+	}
+	var errs []error
+	for _, l := range g.listeners {
+		l.stopped = true
+		if err := l.close(); err != nil {
+			errs = append(errs, fmt.Errorf("listener %s: %v", l.conf.Name, err))
+		}
+	}
+	if g.admin != nil {
+		g.admin.Close()
+	}
+	for _, s := range g.services {
+		s.close()
+	}
+	if g.redis != nil {
+		g.redis.Close()
+	}
+	if len(errs) > 0 {
+		return errs[0]
+	}
+	return nil
+}
+
+// drain 在后台排空监听器，最长等待 timeout，需要持有 Gateway.mux
+func (l *listener) drain(timeout time.Duration) {
+	l.stopped = true
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		if err := l.shutdown(ctx); err != nil {
+			log.Printf("gateway: listener %s: force closed connections after %v\n", l.conf.Name, timeout)
+		}
+	}()
+}
+
+// shutdown 停止接受新连接，等待处理中的请求（连接）结束，ctx 到期时强制关闭并返回 ctx 的错误
+// 调用前需要在持有 Gateway.mux 时设置 stopped，调用时不需要持有
+func (l *listener) shutdown(ctx context.Context) error {
+	if l.ln == nil {
+		return nil
+	}
+	// 关闭监听器的错误（如已经被关闭）不影响排空
+	if l.tcpServer != nil {
+		if err := l.tcpServer.Shutdown(ctx); err != nil && err == ctx.Err() {
+			return err
+		}
+		return nil
+	}
+	err := l.httpServer.Shutdown(ctx)
+	if err == nil || err != ctx.Err() {
+		err = l.hijacked.wait(ctx)
+	}
+	if err != nil {
+		l.httpServer.Close()
+		l.hijacked.closeAll()
+	}
+	return err
+}
+
+// close 立即关闭监听器及处理中的请求（连接），需要持有 Gateway.mux
+func (l *listener) close() error {
+	if l.ln == nil {
+		return nil
+	}
+	if l.tcpServer != nil {
+		return l.tcpServer.Close()
+	}
+	l.hijacked.closeAll()
+	return l.httpServer.Close()
+}
+
+// hijackedConns 被接管的连接（websocket 等）
+// http.Server 不再跟踪被接管的连接，Shutdown 也不等待，由网关记录
+type hijackedConns struct {
+	mu    sync.Mutex
+	conns map[*hijackedConn]struct{}
+}
+
+// hijackedConn 关闭时从 hijackedConns 中删除的连接
+type hijackedConn struct {
+	net.Conn
+	owner *hijackedConns
+}
+
+func (c *hijackedConn) Close() error {
+	c.owner.mu.Lock()
+	delete(c.owner.conns, c)
+	c.owner.mu.Unlock()
+	return c.Conn.Close()
+}
+
+// track 记录被接管的连接，返回的连接关闭时删除记录
+func (h *hijackedConns) track(conn net.Conn) net.Conn {
+	c := &hijackedConn{Conn: conn, owner: h}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.conns == nil {
+		h.conns = map[*hijackedConn]struct{}{}
+	}
+	h.conns[c] = struct{}{}
+	return c
+}
+
+func (h *hijackedConns) count() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.conns)
+}
+
+// wait 等待所有被接管的连接关闭，ctx 到期时返回 ctx 的错误
+func (h *hijackedConns) wait(ctx context.Context) error {
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+	for h.count() > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
+// closeAll 关闭所有被接管的连接
+func (h *hijackedConns) closeAll() {
+	h.mu.Lock()
+	conns := h.conns
+	h.conns = nil
+	h.mu.Unlock()
+	for c := range conns {
+		c.Conn.Close()
+	}
+}
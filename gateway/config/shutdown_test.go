@@ -0,0 +1,136 @@
+package config
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 优雅关闭：停止接受新连接，处理中的 http 请求正常结束，超时后强制关闭 tcp 与 websocket 连接
+func TestGatewayShutdown(t *testing.T) {
+	release := make(chan struct{})
+	web := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") == "echo" {
+			// 协议升级后按行回显，模拟 websocket
+			conn, rw, _ := w.(http.Hijacker).Hijack()
+			defer conn.Close()
+			rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+			rw.Flush()
+			for {
+				line, err := rw.ReadString('\n')
+				if err != nil {
+					return
+				}
+				rw.WriteString(line)
+				rw.Flush()
+			}
+		}
+		<-release
+		w.Write([]byte("done"))
+	}))
+	defer web.Close()
+	echo := echoServer(t, "")
+	defer echo.Close()
+	cfg, err := Parse([]byte(fmt.Sprintf(`
+drain_timeout: 300ms
+services:
+  - {name: web, discovery: {hosts: [{addr: %q}]}}
+  - {name: echo, protocol: tcp, discovery: {hosts: [{addr: %q}]}}
+listeners:
+  - {name: web, addr: 127.0.0.1:0, routes: [{path: /, service: web}]}
+  - {name: raw, protocol: tcp, addr: 127.0.0.1:0, routes: [{service: echo}]}
+`, strings.TrimPrefix(web.URL, "http://"), echo.Addr().String())))
+	assert.Nil(t, err)
+	g, err := Build(context.Background(), cfg)
+	assert.Nil(t, err)
+	assert.Nil(t, g.Start())
+	defer g.Close()
+	webAddr, rawAddr := g.Addr("web"), g.Addr("raw")
+
+	// 处理中的慢请求
+	slow := make(chan string)
+	go func() {
+		resp, err := http.Get("http://" + webAddr + "/slow")
+		if err != nil {
+			slow <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		slow <- string(body)
+	}()
+	// 已建立的 tcp 连接
+	raw, err := net.Dial("tcp", rawAddr)
+	assert.Nil(t, err)
+	defer raw.Close()
+	rawReader := bufio.NewReader(raw)
+	raw.Write([]byte("hi\n"))
+	line, _ := rawReader.ReadString('\n')
+	assert.Equal(t, "hi\n", line)
+	// 升级后的连接
+	ws, err := net.Dial("tcp", webAddr)
+	assert.Nil(t, err)
+	defer ws.Close()
+	wsReader := bufio.NewReader(ws)
+	ws.Write([]byte("GET /ws HTTP/1.1\r\nHost: test\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n"))
+	resp, err := http.ReadResponse(wsReader, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+	time.Sleep(50 * time.Millisecond)
+
+	start := time.Now()
+	shutdown := make(chan error)
+	go func() { shutdown <- g.Shutdown(context.Background()) }()
+	time.Sleep(50 * time.Millisecond)
+
+	// 停止接受新连接，已建立的连接仍然可用
+	_, err = net.Dial("tcp", webAddr)
+	assert.NotNil(t, err)
+	_, err = net.Dial("tcp", rawAddr)
+	assert.NotNil(t, err)
+	ws.Write([]byte("ping\n"))
+	line, _ = wsReader.ReadString('\n')
+	assert.Equal(t, "ping\n", line)
+	raw.Write([]byte("still\n"))
+	line, _ = rawReader.ReadString('\n')
+	assert.Equal(t, "still\n", line)
+
+	close(release)
+	assert.Equal(t, "done", <-slow)
+	// tcp 与升级后的连接没有结束：drain_timeout 后强制关闭
+	assert.True(t, errors.Is(<-shutdown, context.DeadlineExceeded))
+	assert.True(t, time.Since(start) >= 300*time.Millisecond)
+	raw.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = rawReader.ReadString('\n')
+	assert.NotNil(t, err)
+	ws.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = wsReader.ReadString('\n')
+	assert.NotNil(t, err)
+}
+
+// 所有请求结束后立即返回
+func TestGatewayShutdownIdle(t *testing.T) {
+	web := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("ok")) }))
+	defer web.Close()
+	g, err := Build(context.Background(), reloadConfig(t, strings.TrimPrefix(web.URL, "http://"), web.Listener.Addr().String(), ""))
+	assert.Nil(t, err)
+	assert.Nil(t, g.Start())
+	resp, err := http.Get("http://" + g.Addr("web") + "/")
+	assert.Nil(t, err)
+	resp.Body.Close()
+
+	start := time.Now()
+	assert.Nil(t, g.Shutdown(context.Background()))
+	assert.True(t, time.Since(start) < time.Second)
+	assert.Nil(t, g.Shutdown(context.Background()))
+	assert.NotNil(t, g.Reload(reloadConfig(t, "127.0.0.1:1", "127.0.0.1:1", "")))
+}
@@ -0,0 +1,147 @@
+package config
+
+import (
+	"bufio"
+	"errors"
+	"gateway/middleware/flowcount"
+	sr "gateway/middleware/router/http"
+	tcprouter "gateway/middleware/router/tcp"
+	"gateway/middleware/timerate"
+	"gateway/proxy"
+	"io"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// 流量统计
+//
+// 每个 http 请求、tcp 连接记录到 Gateway 的 flowcount.Stats，维度：
+// 	service：路由转发到的服务
+// 	route：监听器名称/路由名称，没有匹配的路由时为空
+// 	tenant：stats.tenant_key 从请求中提取的租户，格式同限流的 key，如 header:X-Tenant-ID；tcp 连接为空
+// 	backend：请求转发到的下游主机；tcp 连接为空
+// http 请求在全局中间件之前开始统计，被限流、熔断、停用路由拒绝的请求同样计入。
+// tcp 连接的耗时为连接持续时间，字节数为客户端方向的读写字节数。
+// 统计结果通过管理接口 GET /stats 查询，见 admin.go。
+
+// statsKey 路由上下文中保存当前请求统计维度的键
+type statsKey struct{}
+
+// httpStatsMiddleware 统计 http 请求，tenant 为 nil 时不统计租户维度
+func (g *Gateway) httpStatsMiddleware(tenant timerate.KeyFunc) sr.HandlerFunc {
+	stats := g.stats
+	return func(c *sr.SliceRouteContext) {
+		start := time.Now()
+		key := &flowcount.StatsKey{}
+		if tenant != nil {
+			key.Tenant = tenant(c)
+		}
+		c.Set(statsKey{}, key)
+		var body *countingReader
+		if c.Req.Body != nil && c.Req.Body != http.NoBody {
+			body = &countingReader{ReadCloser: c.Req.Body}
+			c.Req.Body = body
+		}
+		c.Req = proxy.WithUpstreamAddr(c.Req, &key.Backend)
+		w := &statsWriter{ResponseWriter: c.Rw, status: http.StatusOK}
+		c.Rw = w
+		c.Next()
+		sample := flowcount.Sample{Key: *key, Status: w.status, BytesOut: w.written, Latency: time.Since(start)}
+		if body != nil {
+			sample.BytesIn = atomic.LoadInt64(&body.read)
+		}
+		stats.Record(sample)
+	}
+}
+
+// setStatsRoute 记录请求匹配的路由与服务
+func setStatsRoute(c *sr.SliceRouteContext, route, service string) {
+	if key, ok := c.Get(statsKey{}).(*flowcount.StatsKey); ok {
+		key.Route, key.Service = route, service
+	}
+}
+
+// tcpStats 统计 tcp 连接，需要在路由中间件中调用，连接结束后返回
+func (g *Gateway) tcpStats(c *tcprouter.TcpSliceRouteContext, route, service string, next func()) {
+	start := time.Now()
+	conn := &countingConn{Conn: c.Conn}
+	c.Conn = conn
+	next()
+	g.stats.Record(flowcount.Sample{
+		Key:      flowcount.StatsKey{Service: service, Route: route},
+		BytesIn:  atomic.LoadInt64(&conn.read),
+		BytesOut: atomic.LoadInt64(&conn.written),
+		Latency:  time.Since(start),
+	})
+}
+
+// statsWriter 记录响应状态码与响应体字节数的 ResponseWriter
+type statsWriter struct {
+	http.ResponseWriter
+	status      int
+	written     int64
+	wroteHeader bool
+}
+
+func (w *statsWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.status, w.wroteHeader = status, true
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statsWriter) Write(p []byte) (int, error) {
+	w.wroteHeader = true
+	n, err := w.ResponseWriter.Write(p)
+	w.written += int64(n)
+	return n, err
+}
+
+// Flush 支持流式响应
+func (w *statsWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack 支持 websocket 等协议升级，升级后的字节数不再统计
+func (w *statsWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response writer does not support hijack")
+	}
+	return h.Hijack()
+}
+
+// countingReader 记录读取字节数的请求体，反向代理可能在其他协程中读取
+type countingReader struct {
+	io.ReadCloser
+	read int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	atomic.AddInt64(&r.read, int64(n))
+	return n, err
+}
+
+// countingConn 记录读写字节数的连接
+type countingConn struct {
+	net.Conn
+	read    int64
+	written int64
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	atomic.AddInt64(&c.read, int64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	atomic.AddInt64(&c.written, int64(n))
+	return n, err
+}
@@ -0,0 +1,196 @@
+// Package redistest 测试用的进程内 Redis 服务
+//
+// 执行 Lua 脚本的测试使用 miniredis（脚本由 gopher-lua 实际执行），
+// Server 只用于测试 Redis 客户端本身：连接、认证、主从角色、哨兵、故障恢复等 miniredis 不支持的场景。
+package redistest
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// Server 进程内的 RESP 服务，记录收到的命令，支持以下命令：
+// AUTH、SELECT、PING、ROLE、SENTINEL get-master-addr-by-name、INCRBY、EXPIRE（不过期）、GET
+// 角色不是 master 时 INCRBY、EXPIRE 返回 READONLY 错误
+type Server struct {
+	addr     string
+	accepted int32 // 接受的连接数
+
+	mu       sync.Mutex
+	role     string // ROLE 返回的角色
+	ln       net.Listener
+	master   []string // 作为哨兵时的主节点地址
+	commands []string
+	values   map[string]int64
+}
+
+// NewServer 在随机端口启动服务，role 为 ROLE 命令返回的角色（master、slave、sentinel）
+// 测试结束时自动关闭
+func NewServer(t testing.TB, role string) *Server {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{addr: ln.Addr().String(), role: role, values: map[string]int64{}}
+	s.start(ln)
+	t.Cleanup(s.Close)
+	return s
+}
+
+// Addr 服务地址，Close 后不变，Restart 在同一地址上重新监听
+func (s *Server) Addr() string {
+	return s.addr
+}
+
+// Close 停止监听，已建立的连接不受影响
+func (s *Server) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ln != nil {
+		s.ln.Close()
+		s.ln = nil
+	}
+}
+
+// Restart 在原地址上重新监听，保留数据，地址被其他进程占用时返回错误
+func (s *Server) Restart() error {
+	ln, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return err
+	}
+	s.start(ln)
+	return nil
+}
+
+func (s *Server) start(ln net.Listener) {
+	s.mu.Lock()
+	s.ln = ln
+	s.mu.Unlock()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&s.accepted, 1)
+			go s.serve(conn)
+		}
+	}()
+}
+
+// SetMaster 设置作为哨兵时返回的主节点地址
+func (s *Server) SetMaster(addr string) {
+	host, port, _ := net.SplitHostPort(addr)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.master = []string{host, port}
+}
+
+// SetRole 修改 ROLE 返回的角色，模拟主从切换：角色不是 master 时写命令返回 READONLY 错误
+func (s *Server) SetRole(role string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.role = role
+}
+
+// Accepted 接受的连接数
+func (s *Server) Accepted() int {
+	return int(atomic.LoadInt32(&s.accepted))
+}
+
+// Received 收到的命令，参数以空格连接
+func (s *Server) Received() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.commands...)
+}
+
+// Value INCRBY 写入的计数
+func (s *Server) Value(key string) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.values[key]
+}
+
+func (s *Server) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+		conn.Write([]byte(s.exec(args)))
+	}
+}
+
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(line[1 : len(line)-2])
+	if err != nil || line[0] != '*' {
+		return nil, fmt.Errorf("bad command %q", line)
+	}
+	args := make([]string, n)
+	for i := range args {
+		if line, err = r.ReadString('\n'); err != nil {
+			return nil, err
+		}
+		size, _ := strconv.Atoi(line[1 : len(line)-2])
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:size])
+	}
+	return args, nil
+}
+
+func bulk(s string) string {
+	return "$" + strconv.Itoa(len(s)) + "\r\n" + s + "\r\n"
+}
+
+func (s *Server) exec(args []string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.commands = append(s.commands, strings.Join(args, " "))
+	cmd := strings.ToUpper(args[0])
+	if (cmd == "INCRBY" || cmd == "EXPIRE") && s.role != "master" {
+		return "-READONLY You can't write against a read only replica.\r\n"
+	}
+	switch cmd {
+	case "AUTH", "SELECT":
+		return "+OK\r\n"
+	case "PING":
+		return "+PONG\r\n"
+	case "ROLE":
+		return "*1\r\n" + bulk(s.role)
+	case "SENTINEL":
+		if len(s.master) == 0 || len(args) < 3 || args[2] != "mymaster" {
+			return "*-1\r\n"
+		}
+		return "*2\r\n" + bulk(s.master[0]) + bulk(s.master[1])
+	case "INCRBY":
+		n, _ := strconv.ParseInt(args[2], 10, 64)
+		s.values[args[1]] += n
+		return ":" + strconv.FormatInt(s.values[args[1]], 10) + "\r\n"
+	case "EXPIRE":
+		return ":1\r\n"
+	case "GET":
+		v, ok := s.values[args[1]]
+		if !ok {
+			return "$-1\r\n"
+		}
+		return bulk(strconv.FormatInt(v, 10))
+	}
+	return "-ERR unknown command '" + args[0] + "'\r\n"
+}
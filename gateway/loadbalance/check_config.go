@@ -2,9 +2,9 @@ package loadbalance
 
 import (
 	"fmt"
-	"net"
 	"reflect"
 	"sort"
+	"sync"
 	"time"
 )
 
@@ -21,19 +21,30 @@ type LoadBalanceCheckConf struct {
 	confIpWeight map[string]string
 	activeList   []string
 	format       string
+
+	check  *HealthCheck           // 健康检查定义
+	health map[string]*hostHealth // 主机与健康状态的映射表，仅检查协程访问
+
+	mux       sync.RWMutex // 读写锁：检查协程更新可用主机列表时，与读取配置同步
+	closeOnce sync.Once
+	done      chan struct{} // 关闭后停止健康检查
 }
 
 func (s *LoadBalanceCheckConf) Attach(o Observer) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
 	s.observers = append(s.observers, o)
 }
 
 func (s *LoadBalanceCheckConf) NotifyAllObservers() {
-	for _, obs := range s.observers {
+	for _, obs := range s.getObservers() {
 		obs.Update()
 	}
 }
 
 func (s *LoadBalanceCheckConf) GetConf() []string {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
 	confList := []string{}
 	for _, ip := range s.activeList {
 		weight, ok := s.confIpWeight[ip]
@@ -49,55 +60,107 @@ func (s *LoadBalanceCheckConf) GetConf() []string {
 func (s *LoadBalanceCheckConf) WatchConf() {
 	//fmt.Println("watchConf")
 	go func() {
-		confIpErrNum := map[string]int{}
 		for {
-			changedList := []string{}
-			for item, _ := range s.confIpWeight {
-				conn, err := net.DialTimeout("tcp", item, time.Duration(DefaultCheckTimeout)*time.Second)
-				//todo http statuscode
-				if err == nil {
-					conn.Close()
-					if _, ok := confIpErrNum[item]; ok {
-						confIpErrNum[item] = 0
-					}
-				}
-				if err != nil {
-					if _, ok := confIpErrNum[item]; ok {
-						confIpErrNum[item] += 1
-					} else {
-						confIpErrNum[item] = 1
-					}
-				}
-				if confIpErrNum[item] < DefaultCheckMaxErrNum {
-					changedList = append(changedList, item)
-				}
+			s.checkOnce()
+			select {
+			case <-s.done:
+				return
+			case <-time.After(s.check.nextInterval()):
 			}
-			sort.Strings(changedList)
-			sort.Strings(s.activeList)
-			if !reflect.DeepEqual(changedList, s.activeList) {
-				s.UpdateConf(changedList)
-			}
-			time.Sleep(time.Duration(DefaultCheckInterval) * time.Second)
 		}
 	}()
 }
 
+// Close 停止健康检查，配置不再使用时调用
+func (s *LoadBalanceCheckConf) Close() {
+	s.closeOnce.Do(func() {
+		close(s.done)
+	})
+}
+
+// checkOnce 并发检查所有主机，可用主机列表变化时更新配置
+func (s *LoadBalanceCheckConf) checkOnce() {
+	results := map[string]error{}
+	resultMux := sync.Mutex{}
+	wg := sync.WaitGroup{}
+	for item := range s.confIpWeight {
+		wg.Add(1)
+		go func(item string) {
+			defer wg.Done()
+			err := s.check.Check(item)
+			resultMux.Lock()
+			results[item] = err
+			resultMux.Unlock()
+		}(item)
+	}
+	wg.Wait()
+
+	changedList := []string{}
+	for item, err := range results {
+		h, ok := s.health[item]
+		if !ok {
+			h = &hostHealth{healthy: true}
+			s.health[item] = h
+		}
+		s.check.record(h, err)
+		if h.healthy {
+			changedList = append(changedList, item)
+		}
+	}
+	sort.Strings(changedList)
+	s.mux.RLock()
+	activeList := append([]string{}, s.activeList...)
+	s.mux.RUnlock()
+	sort.Strings(activeList)
+	if !reflect.DeepEqual(changedList, activeList) {
+		s.UpdateConf(changedList)
+	}
+}
+
 //更新配置时，通知监听者也更新
 func (s *LoadBalanceCheckConf) UpdateConf(conf []string) {
 	//fmt.Println("UpdateConf", conf)
+	s.mux.Lock()
 	s.activeList = conf
-	for _, obs := range s.observers {
+	s.mux.Unlock()
+	for _, obs := range s.getObservers() {
 		obs.Update()
 	}
 }
 
+// getObservers 获取观察者列表快照，通知时不持有锁，观察者可以回调 GetConf
+func (s *LoadBalanceCheckConf) getObservers() []Observer {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	return append([]Observer{}, s.observers...)
+}
+
+// NewLoadBalanceCheckConf 创建主动健康检查的负载均衡配置，使用默认的 TCP 检查
 func NewLoadBalanceCheckConf(format string, conf map[string]string) (*LoadBalanceCheckConf, error) {
+	return NewLoadBalanceCheckConfWithHealthCheck(format, conf, nil)
+}
+
+// NewLoadBalanceCheckConfWithHealthCheck 创建主动健康检查的负载均衡配置
+// check 为该服务的健康检查定义，为 nil 时使用默认的 TCP 检查
+func NewLoadBalanceCheckConfWithHealthCheck(format string, conf map[string]string, check *HealthCheck) (*LoadBalanceCheckConf, error) {
+	mConf, err := newLoadBalanceCheckConf(format, conf, check)
+	if err != nil {
+		return nil, err
+	}
+	mConf.WatchConf()
+	return mConf, nil
+}
+
+func newLoadBalanceCheckConf(format string, conf map[string]string, check *HealthCheck) (*LoadBalanceCheckConf, error) {
+	check, err := check.withDefaults()
+	if err != nil {
+		return nil, err
+	}
 	aList := []string{}
 	//默认初始化
 	for item, _ := range conf {
 		aList = append(aList, item)
 	}
-	mConf := &LoadBalanceCheckConf{format: format, activeList: aList, confIpWeight: conf}
-	mConf.WatchConf()
-	return mConf, nil
+	return &LoadBalanceCheckConf{format: format, activeList: aList, confIpWeight: conf,
+		check: check, health: map[string]*hostHealth{}, done: make(chan struct{})}, nil
 }
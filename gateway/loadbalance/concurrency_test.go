@@ -0,0 +1,97 @@
+package loadbalance
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 并发压力测试：多个协程同时 Get/Release/ObserveRTT，同时服务发现不断 Update
+// 需配合 go test -race 运行，验证所有负载均衡器并发安全
+//
+// 实现步骤：
+// 	1.构建一个不连接 zk 的观察主体，直接调用 UpdateConf 模拟节点上下线
+// 	2.每种负载均衡器启动多个协程并发获取节点
+// 	3.获取到的节点必须是当前或历史配置中的合法节点
+func TestLoadBalanceConcurrency(t *testing.T) {
+	lbTypes := map[string]LbType{
+		"random":           LbRandom,
+		"roundRobin":       LbRoundRobin,
+		"weightRoundRobin": LbWeightRoundRobin,
+		"consistentHash":   LbConsistentHash,
+		"leastConn":        LbLeastConn,
+		"p2c":              LbP2C,
+		"boundedHash":      LbConsistentHashBounded,
+		"maglev":           LbMaglev,
+	}
+	for name, lbType := range lbTypes {
+		lbType := lbType
+		t.Run(name, func(t *testing.T) {
+			stressLoadBalance(t, lbType)
+		})
+	}
+}
+
+func stressLoadBalance(t *testing.T, lbType LbType) {
+	// 	1.构建一个不连接 zk 的观察主体
+	weights := map[string]string{}
+	valid := map[string]bool{}
+	for i := 0; i < 6; i++ {
+		addr := "127.0.0.1:" + strconv.Itoa(8001+i)
+		weights[addr] = strconv.Itoa(i + 1)
+		valid[addr] = true
+	}
+	mConf := &LoadBalanceZkConf{format: "%s", confIpWeight: weights,
+		activeList: []string{"127.0.0.1:8001", "127.0.0.1:8002", "127.0.0.1:8003"}}
+	rb := LoadBalanceFactoryWithConf(lbType, mConf)
+
+	// 	2.并发获取节点
+	stop := make(chan struct{})
+	errs := make(chan string, 100)
+	wg := sync.WaitGroup{}
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				addr, err := rb.Get("192.168.1." + strconv.Itoa(g) + ":" + strconv.Itoa(i))
+				if err != nil {
+					continue
+				}
+				// 	3.节点必须合法
+				if !valid[addr] {
+					select {
+					case errs <- addr:
+					default:
+					}
+				}
+				ObserveRTT(rb, addr, time.Millisecond)
+				Release(rb, addr)
+			}
+		}(g)
+	}
+
+	// 模拟节点上下线
+	lists := [][]string{
+		{"127.0.0.1:8001", "127.0.0.1:8002"},
+		{"127.0.0.1:8003", "127.0.0.1:8004", "127.0.0.1:8005"},
+		{"127.0.0.1:8006"},
+		{"127.0.0.1:8001", "127.0.0.1:8002", "127.0.0.1:8003", "127.0.0.1:8004", "127.0.0.1:8005", "127.0.0.1:8006"},
+	}
+	for i := 0; i < 20; i++ {
+		mConf.UpdateConf(lists[i%len(lists)])
+		time.Sleep(time.Millisecond)
+	}
+	close(stop)
+	wg.Wait()
+	close(errs)
+	for addr := range errs {
+		t.Errorf("unexpected addr %q", addr)
+	}
+}
@@ -3,6 +3,7 @@ package loadbalance
 import (
 	"errors"
 	"hash/crc32"
+	"math"
 	"sort"
 	"strconv"
 	"strings"
@@ -38,6 +39,16 @@ type ConsistentHashBalance struct {
 	replicas int
 	// 读写锁：扩容或宕机时，读写同步，确保并发安全
 	mux sync.RWMutex
+
+	// 有界负载系数，<= 0 表示不开启
+	// 每个节点的负载上限为：ceil(loadFactor * 平均负载)
+	loadFactor float64
+	// 服务器真实地址与当前负载（未完成请求数）的映射表
+	loads map[string]int64
+	// 所有节点的负载之和
+	totalLoad int64
+	// 负载计数锁：Get 与 Release 都会修改负载
+	loadMux sync.Mutex
 }
 
 // Hash 函数，根据给定数据计算哈希值，返回一个32位无符号数
@@ -63,6 +74,7 @@ func NewConsistentHashBalance(replicas int, fn Hash) *ConsistentHashBalance {
 		hash:     fn,
 		replicas: replicas,
 		hashMap:  make(map[uint32]string),
+		loads:    make(map[string]int64),
 	}
 
 	if ch.hash == nil {
@@ -74,6 +86,28 @@ func NewConsistentHashBalance(replicas int, fn Hash) *ConsistentHashBalance {
 	return ch
 }
 
+// NewBoundedConsistentHashBalance 创建有界负载的一致性hash负载均衡器
+// 参考：Consistent Hashing with Bounded Loads
+// 	每个节点的负载不超过平均负载的 loadFactor 倍（通常取 1.25）
+// 	超出上限时，沿环顺时针寻找下一个未超限的节点
+// 	同一个 key 在负载未超限时仍然落到同一个节点，保持会话亲和性
+// Get 选中节点时负载 +1，请求结束时需要调用 Release 归还
+func NewBoundedConsistentHashBalance(replicas int, fn Hash, loadFactor float64) *ConsistentHashBalance {
+	ch := NewConsistentHashBalance(replicas, fn)
+	ch.SetLoadFactor(loadFactor)
+	return ch
+}
+
+// SetLoadFactor 设置有界负载系数，<= 0 表示关闭有界负载，小于 1 时按 1 处理
+func (c *ConsistentHashBalance) SetLoadFactor(loadFactor float64) {
+	c.loadMux.Lock()
+	defer c.loadMux.Unlock()
+	if loadFactor > 0 && loadFactor < 1 {
+		loadFactor = 1
+	}
+	c.loadFactor = loadFactor
+}
+
 // Add 添加服务器节点，参数为服务器地址 addr，比如使用URL, IP
 // 允许传入 1 或 多个真实节点的名称，格式如：
 //	"http://ip:port/demo", "IP:port", "IP:port"
@@ -88,17 +122,42 @@ func (c *ConsistentHashBalance) Add(servers ...string) error {
 
 	c.mux.Lock()
 	defer c.mux.Unlock()
+	// 写时复制：在新的哈希表上添加节点，完成后整体替换
+	hashKeys := make(UInt32Slice, len(c.hashKeys), len(c.hashKeys)+len(servers)*c.replicas)
+	copy(hashKeys, c.hashKeys)
+	hashMap := make(map[uint32]string, len(c.hashMap)+len(servers)*c.replicas)
+	for k, v := range c.hashMap {
+		hashMap[k] = v
+	}
+	hashKeys = c.addToRing(hashKeys, hashMap, servers...)
+
+	c.loadMux.Lock()
+	defer c.loadMux.Unlock()
+	if c.loads == nil {
+		c.loads = make(map[string]int64)
+	}
+	for _, addr := range servers {
+		if _, ok := c.loads[addr]; !ok {
+			c.loads[addr] = 0
+		}
+	}
+	c.hashKeys, c.hashMap = hashKeys, hashMap
+	return nil
+}
+
+// addToRing 对每一个真实节点 addr，创建 c.replicas 个虚拟节点添加到环上，并排序
+func (c *ConsistentHashBalance) addToRing(hashKeys UInt32Slice, hashMap map[uint32]string, servers ...string) UInt32Slice {
 	for _, addr := range servers {
 		for i := 0; i < c.replicas; i++ {
 			hash := c.hash([]byte(strconv.Itoa(i) + addr))
-			c.hashKeys = append(c.hashKeys, hash)
-			c.hashMap[hash] = addr
+			hashKeys = append(hashKeys, hash)
+			hashMap[hash] = addr
 		}
 	}
 	// 对所有节点的哈希值进行排序
-	// c.hashKeys 数据类型必须实现 Interface 接口，完成方法重写
-	sort.Sort(c.hashKeys)
-	return nil
+	// hashKeys 数据类型必须实现 Interface 接口，完成方法重写
+	sort.Sort(hashKeys)
+	return hashKeys
 }
 
 // Get 获取指定key最靠近它的那个服务器节点。
@@ -109,6 +168,9 @@ func (c *ConsistentHashBalance) Add(servers ...string) error {
 // 	2.通过二分查找最优服务器节点
 // 	3.取出服务器地址，并返回
 func (c *ConsistentHashBalance) Get(key string) (string, error) {
+	// 读锁，允许多读，不允许写
+	c.mux.RLock()
+	defer c.mux.RUnlock()
 	l := len(c.hashKeys)
 	if l == 0 {
 		return "", errors.New("node list is empty")
@@ -130,10 +192,56 @@ func (c *ConsistentHashBalance) Get(key string) (string, error) {
 	}
 
 	// 	3.取出服务器地址，并返回
-	// 读锁，允许多读，不允许写
+	c.loadMux.Lock()
+	defer c.loadMux.Unlock()
+	if c.loadFactor <= 0 {
+		return c.hashMap[c.hashKeys[index]], nil
+	}
+	// 有界负载：从最近的节点开始顺时针查找，选择第一个未超过负载上限的节点
+	maxLoad := c.maxLoad()
+	for i := 0; i < l; i++ {
+		addr := c.hashMap[c.hashKeys[(index+i)%l]]
+		if float64(c.loads[addr]+1) <= maxLoad {
+			c.loads[addr]++
+			c.totalLoad++
+			return addr, nil
+		}
+	}
+	return "", errors.New("all nodes are overloaded")
+}
+
+// Release 请求结束，归还 Get 时占用的负载，仅在开启有界负载时生效
+func (c *ConsistentHashBalance) Release(addr string) {
+	c.loadMux.Lock()
+	defer c.loadMux.Unlock()
+	if c.loadFactor <= 0 {
+		return
+	}
+	if c.loads[addr] > 0 {
+		c.loads[addr]--
+		c.totalLoad--
+	}
+}
+
+// maxLoad 单个节点的负载上限：ceil(loadFactor * (当前总负载 + 1) / 节点数)
+func (c *ConsistentHashBalance) maxLoad() float64 {
+	nodes := len(c.loads)
+	if nodes == 0 {
+		return 0
+	}
+	return math.Ceil(c.loadFactor * float64(c.totalLoad+1) / float64(nodes))
+}
+
+// Available 主机是否在当前哈希环上
+func (c *ConsistentHashBalance) Available(addr string) bool {
 	c.mux.RLock()
 	defer c.mux.RUnlock()
-	return c.hashMap[c.hashKeys[index]], nil
+	for _, a := range c.hashMap {
+		if a == addr {
+			return true
+		}
+	}
+	return false
 }
 
 func (c *ConsistentHashBalance) SetConf(conf LoadBalanceConf) {
@@ -141,20 +249,38 @@ func (c *ConsistentHashBalance) SetConf(conf LoadBalanceConf) {
 }
 
 func (c *ConsistentHashBalance) Update() {
-	if conf, ok := c.conf.(*LoadBalanceZkConf); ok {
+	if conf := c.conf; conf != nil {
 		//fmt.Println("Update get conf:", conf.GetConf())
-		c.hashKeys = nil
-		c.hashMap = nil
+		servers := []string{}
 		for _, ip := range conf.GetConf() {
-			c.Add(strings.Split(ip, ",")...)
+			// 格式："addr,weight"，一致性hash只使用地址
+			servers = append(servers, strings.Split(ip, ",")[0])
+		}
+		// 写时复制：生成新的哈希环，在锁内整体替换，Get 不会读到中间状态
+		hashMap := make(map[uint32]string, len(servers)*c.replicas)
+		hashKeys := c.addToRing(make(UInt32Slice, 0, len(servers)*c.replicas), hashMap, servers...)
+		c.mux.Lock()
+		defer c.mux.Unlock()
+		c.hashKeys, c.hashMap = hashKeys, hashMap
+
+		// 移除已下线节点的负载记录，保留仍然存在的节点的负载
+		active := map[string]bool{}
+		c.loadMux.Lock()
+		if c.loads == nil {
+			c.loads = make(map[string]int64)
+		}
+		for _, addr := range servers {
+			active[addr] = true
+			if _, ok := c.loads[addr]; !ok {
+				c.loads[addr] = 0
+			}
+		}
+		for addr, load := range c.loads {
+			if !active[addr] {
+				delete(c.loads, addr)
+				c.totalLoad -= load
+			}
 		}
+		c.loadMux.Unlock()
 	}
-	//if conf, ok := c.conf.(*LoadBalanceCheckConf); ok {
-	//	//fmt.Println("Update get conf:", conf.GetConf())
-	//	c.hashKeys = nil
-	//	c.hashMap = map[uint32]string{}
-	//	for _, ip := range conf.GetConf() {
-	//		c.Add(strings.Split(ip, ",")...)
-	//	}
-	//}
 }
@@ -1,5 +1,7 @@
 package loadbalance
 
+import "time"
+
 type LbType int
 
 const (
@@ -7,6 +9,10 @@ const (
 	LbRoundRobin
 	LbWeightRoundRobin
 	LbConsistentHash
+	LbLeastConn
+	LbP2C
+	LbConsistentHashBounded
+	LbMaglev
 )
 
 type LoadBalance interface {
@@ -18,6 +24,57 @@ type LoadBalance interface {
 	Update()
 }
 
+// Releaser 可选接口，需要感知请求生命周期的负载均衡器实现此接口
+// 代理在请求（或连接）结束时调用 Release，归还 Get 时占用的资源
+type Releaser interface {
+	Release(addr string)
+}
+
+// Release 请求（或连接）结束时回调负载均衡器，未实现 Releaser 接口则忽略
+func Release(lb LoadBalance, addr string) {
+	if r, ok := lb.(Releaser); ok {
+		r.Release(addr)
+	}
+}
+
+// Reporter 可选接口，被动健康检查：代理上报每次请求的结果，err 为 nil 表示成功
+type Reporter interface {
+	Report(addr string, err error)
+}
+
+// Report 代理请求结束后上报结果，未实现 Reporter 接口则忽略
+func Report(lb LoadBalance, addr string, err error) {
+	if r, ok := lb.(Reporter); ok {
+		r.Report(addr, err)
+	}
+}
+
+// AvailabilityChecker 可选接口，判断主机当前是否可用（在服务列表中、未被驱逐等）
+// 会话保持等需要绕过负载均衡算法、直接指定主机的场景使用
+type AvailabilityChecker interface {
+	Available(addr string) bool
+}
+
+// Available 主机当前是否可用，未实现 AvailabilityChecker 接口时返回 false
+func Available(lb LoadBalance, addr string) bool {
+	if c, ok := lb.(AvailabilityChecker); ok {
+		return c.Available(addr)
+	}
+	return false
+}
+
+// RTTObserver 可选接口，根据下游实际响应耗时选择节点的负载均衡器实现此接口
+type RTTObserver interface {
+	ObserveRTT(addr string, rtt time.Duration)
+}
+
+// ObserveRTT 代理观测到下游响应耗时后回调负载均衡器，未实现 RTTObserver 接口则忽略
+func ObserveRTT(lb LoadBalance, addr string, rtt time.Duration) {
+	if o, ok := lb.(RTTObserver); ok {
+		o.ObserveRTT(addr, rtt)
+	}
+}
+
 func LoadBalanceFactory(lbType LbType) LoadBalance {
 	switch lbType {
 	case LbRandom:
@@ -28,6 +85,14 @@ func LoadBalanceFactory(lbType LbType) LoadBalance {
 		return &RoundRobinBalance{}
 	case LbWeightRoundRobin:
 		return &WeightRoundRobinBalance{}
+	case LbLeastConn:
+		return &LeastConnBalance{}
+	case LbP2C:
+		return NewP2CBalance(0)
+	case LbConsistentHashBounded:
+		return NewBoundedConsistentHashBalance(10, nil, 1.25)
+	case LbMaglev:
+		return NewMaglevBalance(0, nil)
 	default:
 		return &RandomBalance{}
 	}
@@ -48,6 +113,18 @@ func LoadBalanceFactoryWithConf(lbType LbType, mConf LoadBalanceConf) LoadBalanc
 	case LbWeightRoundRobin:
 		lb = &WeightRoundRobinBalance{}
 		initLoadBalance(lb, mConf)
+	case LbLeastConn:
+		lb = &LeastConnBalance{}
+		initLoadBalance(lb, mConf)
+	case LbP2C:
+		lb = NewP2CBalance(0)
+		initLoadBalance(lb, mConf)
+	case LbConsistentHashBounded:
+		lb = NewBoundedConsistentHashBalance(10, nil, 1.25)
+		initLoadBalance(lb, mConf)
+	case LbMaglev:
+		lb = NewMaglevBalance(0, nil)
+		initLoadBalance(lb, mConf)
 	default:
 		lb = &RandomBalance{}
 		initLoadBalance(lb, mConf)
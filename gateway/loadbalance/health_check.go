@@ -0,0 +1,221 @@
+package loadbalance
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"regexp"
+	"time"
+)
+
+// HealthCheckType 健康检查方式
+type HealthCheckType int
+
+const (
+	// HealthCheckTCP TCP 检查：建立连接，可选发送数据并校验响应
+	HealthCheckTCP HealthCheckType = iota
+	// HealthCheckHTTP HTTP 检查：GET 请求指定路径，校验状态码与响应体
+	HealthCheckHTTP
+	// HealthCheckGRPC gRPC 检查：调用 grpc.health.v1.Health/Check
+	HealthCheckGRPC
+)
+
+// HealthCheck 单个服务的健康检查定义
+// 零值表示使用默认配置的 TCP 检查
+type HealthCheck struct {
+	Type HealthCheckType
+
+	// HTTP 检查
+	Scheme           string // 协议，默认 http
+	Path             string // 请求路径，默认 /
+	ExpectedStatuses []int  // 期望的状态码，默认 200
+	BodyMatch        string // 响应体需要匹配的正则表达式，可选
+
+	// gRPC 检查
+	Service string // grpc.health.v1 服务名，空表示整个服务器
+
+	// TCP 检查
+	Send   string // 建立连接后发送的数据，可选
+	Expect string // 期望响应以该数据开头，可选
+
+	Interval           time.Duration // 检查间隔，默认 DefaultCheckInterval 秒
+	Timeout            time.Duration // 单次检查超时时间，默认 DefaultCheckTimeout 秒
+	HealthyThreshold   int           // 连续成功达到该次数，恢复为健康，默认 1
+	UnhealthyThreshold int           // 连续失败达到该次数，认为不健康，默认 DefaultCheckMaxErrNum
+	Jitter             time.Duration // 检查间隔随机增加 [0, Jitter)，避免多个网关同时检查
+
+	bodyRegexp *regexp.Regexp
+}
+
+// hostHealth 单个主机的健康状态
+type hostHealth struct {
+	healthy   bool
+	successes int // 连续成功次数
+	failures  int // 连续失败次数
+}
+
+// withDefaults 返回填充默认值后的检查定义
+func (c *HealthCheck) withDefaults() (*HealthCheck, error) {
+	n := HealthCheck{}
+	if c != nil {
+		n = *c
+	}
+	if n.Scheme == "" {
+		n.Scheme = "http"
+	}
+	if n.Path == "" {
+		n.Path = "/"
+	}
+	if len(n.ExpectedStatuses) == 0 {
+		n.ExpectedStatuses = []int{http.StatusOK}
+	}
+	if n.Interval <= 0 {
+		n.Interval = time.Duration(DefaultCheckInterval) * time.Second
+	}
+	if n.Timeout <= 0 {
+		n.Timeout = time.Duration(DefaultCheckTimeout) * time.Second
+	}
+	if n.HealthyThreshold <= 0 {
+		n.HealthyThreshold = 1
+	}
+	if n.UnhealthyThreshold <= 0 {
+		n.UnhealthyThreshold = DefaultCheckMaxErrNum
+	}
+	if n.BodyMatch != "" {
+		re, err := regexp.Compile(n.BodyMatch)
+		if err != nil {
+			return nil, err
+		}
+		n.bodyRegexp = re
+	}
+	return &n, nil
+}
+
+// Check 对指定主机执行一次健康检查，健康返回 nil
+func (c *HealthCheck) Check(host string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), c.Timeout)
+	defer cancel()
+	switch c.Type {
+	case HealthCheckHTTP:
+		return c.checkHTTP(ctx, host)
+	case HealthCheckGRPC:
+		return c.checkGRPC(ctx, host)
+	default:
+		return c.checkTCP(ctx, host)
+	}
+}
+
+func (c *HealthCheck) checkHTTP(ctx context.Context, host string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.Scheme+"://"+host+c.Path, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	matched := false
+	for _, code := range c.ExpectedStatuses {
+		if resp.StatusCode == code {
+			matched = true
+			break
+		}
+	}
+	if !matched {
+		return fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	if c.bodyRegexp != nil {
+		body, err := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+		if err != nil {
+			return err
+		}
+		if !c.bodyRegexp.Match(body) {
+			return errors.New("response body mismatch")
+		}
+	}
+	return nil
+}
+
+func (c *HealthCheck) checkGRPC(ctx context.Context, host string) error {
+	conn, err := grpc.DialContext(ctx, host,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithBlock())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	resp, err := grpc_health_v1.NewHealthClient(conn).Check(ctx,
+		&grpc_health_v1.HealthCheckRequest{Service: c.Service})
+	if err != nil {
+		return err
+	}
+	if resp.GetStatus() != grpc_health_v1.HealthCheckResponse_SERVING {
+		return fmt.Errorf("grpc health status %v", resp.GetStatus())
+	}
+	return nil
+}
+
+func (c *HealthCheck) checkTCP(ctx context.Context, host string) error {
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", host)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if c.Send == "" && c.Expect == "" {
+		return nil
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if c.Send != "" {
+		if _, err := conn.Write([]byte(c.Send)); err != nil {
+			return err
+		}
+	}
+	if c.Expect != "" {
+		buf := make([]byte, len(c.Expect))
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return err
+		}
+		if string(buf) != c.Expect {
+			return fmt.Errorf("unexpected response %q", buf)
+		}
+	}
+	return nil
+}
+
+// nextInterval 下一次检查前的等待时间：检查间隔 + 随机抖动
+func (c *HealthCheck) nextInterval() time.Duration {
+	if c.Jitter <= 0 {
+		return c.Interval
+	}
+	return c.Interval + time.Duration(rand.Int63n(int64(c.Jitter)))
+}
+
+// record 记录一次检查结果，按阈值更新主机健康状态，状态变化时返回 true
+func (c *HealthCheck) record(h *hostHealth, err error) bool {
+	if err == nil {
+		h.successes++
+		h.failures = 0
+		if !h.healthy && h.successes >= c.HealthyThreshold {
+			h.healthy = true
+			return true
+		}
+		return false
+	}
+	h.failures++
+	h.successes = 0
+	if h.healthy && h.failures >= c.UnhealthyThreshold {
+		h.healthy = false
+		return true
+	}
+	return false
+}
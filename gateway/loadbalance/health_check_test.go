@@ -0,0 +1,131 @@
+package loadbalance
+
+import (
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// HTTP 检查：接受 TCP 连接但返回 500 的主机不健康
+func TestHealthCheckHTTP(t *testing.T) {
+	ok := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/health" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(`{"status":"UP"}`))
+	}))
+	defer ok.Close()
+	fail := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer fail.Close()
+
+	check, err := (&HealthCheck{Type: HealthCheckHTTP, Path: "/health", BodyMatch: `"status":\s*"UP"`}).withDefaults()
+	assert.Nil(t, err)
+	assert.Nil(t, check.Check(strings.TrimPrefix(ok.URL, "http://")))
+	assert.NotNil(t, check.Check(strings.TrimPrefix(fail.URL, "http://")))
+
+	// 响应体不匹配
+	check.BodyMatch = "DOWN"
+	check, _ = check.withDefaults()
+	assert.NotNil(t, check.Check(strings.TrimPrefix(ok.URL, "http://")))
+}
+
+// gRPC 检查：grpc.health.v1 返回 SERVING 才健康
+func TestHealthCheckGRPC(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	s := grpc.NewServer()
+	hs := health.NewServer()
+	grpc_health_v1.RegisterHealthServer(s, hs)
+	go s.Serve(lis)
+	defer s.Stop()
+
+	check, _ := (&HealthCheck{Type: HealthCheckGRPC, Service: "echo", Timeout: time.Second}).withDefaults()
+	hs.SetServingStatus("echo", grpc_health_v1.HealthCheckResponse_SERVING)
+	assert.Nil(t, check.Check(lis.Addr().String()))
+	hs.SetServingStatus("echo", grpc_health_v1.HealthCheckResponse_NOT_SERVING)
+	assert.NotNil(t, check.Check(lis.Addr().String()))
+}
+
+// TCP 检查：发送数据并校验响应
+func TestHealthCheckTCPSendExpect(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer lis.Close()
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			buf := make([]byte, 4)
+			conn.Read(buf)
+			conn.Write([]byte("+PONG\r\n"))
+			conn.Close()
+		}
+	}()
+
+	check, _ := (&HealthCheck{Send: "PING", Expect: "+PONG", Timeout: time.Second}).withDefaults()
+	assert.Nil(t, check.Check(lis.Addr().String()))
+	check.Expect = "-ERR"
+	assert.NotNil(t, check.Check(lis.Addr().String()))
+}
+
+// 健康/不健康阈值：连续失败 2 次下线，连续成功 2 次恢复
+func TestLoadBalanceCheckConfThreshold(t *testing.T) {
+	status := int32(http.StatusOK)
+	rs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(int(atomic.LoadInt32(&status)))
+	}))
+	defer rs.Close()
+	host := strings.TrimPrefix(rs.URL, "http://")
+
+	mConf, err := newLoadBalanceCheckConf("%s", map[string]string{host: "10"},
+		&HealthCheck{Type: HealthCheckHTTP, HealthyThreshold: 2, UnhealthyThreshold: 2, Timeout: time.Second})
+	assert.Nil(t, err)
+
+	atomic.StoreInt32(&status, http.StatusInternalServerError)
+	mConf.checkOnce()
+	assert.Equal(t, 1, len(mConf.GetConf()))
+	mConf.checkOnce()
+	assert.Equal(t, 0, len(mConf.GetConf()))
+
+	atomic.StoreInt32(&status, http.StatusOK)
+	mConf.checkOnce()
+	assert.Equal(t, 0, len(mConf.GetConf()))
+	mConf.checkOnce()
+	assert.Equal(t, []string{host + ",10"}, mConf.GetConf())
+}
+
+// Close 后停止检查
+func TestLoadBalanceCheckConfClose(t *testing.T) {
+	var probes int32
+	rs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&probes, 1)
+	}))
+	defer rs.Close()
+	host := strings.TrimPrefix(rs.URL, "http://")
+
+	mConf, err := NewLoadBalanceCheckConfWithHealthCheck("%s", map[string]string{host: "10"},
+		&HealthCheck{Type: HealthCheckHTTP, Interval: 10 * time.Millisecond, Timeout: time.Second})
+	assert.Nil(t, err)
+	for atomic.LoadInt32(&probes) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	mConf.Close()
+	mConf.Close()
+	time.Sleep(30 * time.Millisecond)
+	n := atomic.LoadInt32(&probes)
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, n, atomic.LoadInt32(&probes))
+}
@@ -0,0 +1,178 @@
+package loadbalance
+
+import (
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LoadBalanceHealthConf 健康检查过滤的负载均衡配置（装饰器）
+// 包装任意一个服务发现配置（zk、静态配置、DNS等），主动检查其中的主机，
+// GetConf 只返回健康的主机，实现服务发现与健康检查的组合：
+// 	1.作为观察者绑定到被包装的配置，服务列表变化时通知自己的观察者
+// 	2.作为观察主体被负载均衡器绑定，健康状态变化时通知负载均衡器
+type LoadBalanceHealthConf struct {
+	observers []Observer      // 观察者列表
+	source    LoadBalanceConf // 被包装的服务发现配置
+
+	check  *HealthCheck           // 健康检查定义
+	health map[string]*hostHealth // 主机与健康状态的映射表：host:port -> 健康状态
+
+	mux       sync.RWMutex
+	once      sync.Once
+	closeOnce sync.Once
+	done      chan struct{} // 关闭后停止健康检查
+}
+
+// NewLoadBalanceHealthConf 创建健康检查过滤的负载均衡配置，并启动检查
+// check 为健康检查定义，为 nil 时使用默认的 TCP 检查
+func NewLoadBalanceHealthConf(source LoadBalanceConf, check *HealthCheck) (*LoadBalanceHealthConf, error) {
+	h, err := newLoadBalanceHealthConf(source, check)
+	if err != nil {
+		return nil, err
+	}
+	h.WatchConf()
+	return h, nil
+}
+
+func newLoadBalanceHealthConf(source LoadBalanceConf, check *HealthCheck) (*LoadBalanceHealthConf, error) {
+	check, err := check.withDefaults()
+	if err != nil {
+		return nil, err
+	}
+	h := &LoadBalanceHealthConf{
+		source: source,
+		check:  check,
+		health: map[string]*hostHealth{},
+		done:   make(chan struct{}),
+	}
+	source.Attach(h)
+	return h, nil
+}
+
+func (h *LoadBalanceHealthConf) Attach(o Observer) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	h.observers = append(h.observers, o)
+}
+
+// GetConf 获取被包装配置中健康的主机
+func (h *LoadBalanceHealthConf) GetConf() []string {
+	h.mux.RLock()
+	defer h.mux.RUnlock()
+	confList := []string{}
+	for _, item := range h.source.GetConf() {
+		if hh, ok := h.health[confHost(item)]; !ok || hh.healthy {
+			confList = append(confList, item)
+		}
+	}
+	return confList
+}
+
+// Health 获取已检查主机的健康状态：host:port -> 是否健康，尚未检查的主机不在结果中
+func (h *LoadBalanceHealthConf) Health() map[string]bool {
+	h.mux.RLock()
+	defer h.mux.RUnlock()
+	health := make(map[string]bool, len(h.health))
+	for host, hh := range h.health {
+		health[host] = hh.healthy
+	}
+	return health
+}
+
+// WatchConf 启动健康检查，健康状态变化时，通知观察者更新
+func (h *LoadBalanceHealthConf) WatchConf() {
+	h.once.Do(func() {
+		go func() {
+			for {
+				h.checkOnce()
+				select {
+				case <-h.done:
+					return
+				case <-time.After(h.check.nextInterval()):
+				}
+			}
+		}()
+	})
+}
+
+// Close 停止健康检查，配置不再使用时（如热加载替换了服务）调用
+func (h *LoadBalanceHealthConf) Close() {
+	h.closeOnce.Do(func() {
+		close(h.done)
+	})
+}
+
+// UpdateConf 更新被包装配置的服务列表
+func (h *LoadBalanceHealthConf) UpdateConf(conf []string) {
+	h.source.UpdateConf(conf)
+}
+
+// Update 被包装配置的服务列表变化时，通知观察者更新
+func (h *LoadBalanceHealthConf) Update() {
+	h.notifyAllObservers()
+}
+
+// checkOnce 并发检查所有主机，健康状态发生变化时通知观察者
+func (h *LoadBalanceHealthConf) checkOnce() {
+	hosts := map[string]bool{}
+	for _, item := range h.source.GetConf() {
+		hosts[confHost(item)] = true
+	}
+	results := map[string]error{}
+	resultMux := sync.Mutex{}
+	wg := sync.WaitGroup{}
+	for host := range hosts {
+		wg.Add(1)
+		go func(host string) {
+			defer wg.Done()
+			err := h.check.Check(host)
+			resultMux.Lock()
+			results[host] = err
+			resultMux.Unlock()
+		}(host)
+	}
+	wg.Wait()
+
+	changed := false
+	h.mux.Lock()
+	health := map[string]*hostHealth{}
+	for host, err := range results {
+		hh, ok := h.health[host]
+		if !ok {
+			hh = &hostHealth{healthy: true}
+		}
+		if h.check.record(hh, err) {
+			changed = true
+		}
+		health[host] = hh
+	}
+	// 已下线的主机不再保留健康状态
+	h.health = health
+	h.mux.Unlock()
+	if changed {
+		h.notifyAllObservers()
+	}
+}
+
+func (h *LoadBalanceHealthConf) notifyAllObservers() {
+	h.mux.RLock()
+	observers := append([]Observer{}, h.observers...)
+	h.mux.RUnlock()
+	for _, obs := range observers {
+		obs.Update()
+	}
+}
+
+// confHost 从 GetConf 的配置项中取出 host:port
+// 配置项格式："addr,weight"，addr 可能是 "host:port" 或 "http://host:port/path"
+func confHost(item string) string {
+	addr := strings.Split(item, ",")[0]
+	if strings.Contains(addr, "://") {
+		if u, err := url.Parse(addr); err == nil {
+			return u.Host
+		}
+	}
+	return addr
+}
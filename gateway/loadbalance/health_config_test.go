@@ -0,0 +1,72 @@
+package loadbalance
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net"
+	"testing"
+	"time"
+)
+
+// 服务发现与健康检查组合：静态配置 + 健康检查过滤，驱动任意负载均衡器
+func TestLoadBalanceHealthConf(t *testing.T) {
+	// 一个可用主机，一个不可用主机
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer ln.Close()
+	down, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	downAddr := down.Addr().String()
+	down.Close()
+
+	source := NewLoadBalanceStaticConf("http://%s/", map[string]string{
+		ln.Addr().String(): "10",
+		downAddr:           "20",
+	})
+	mConf, err := newLoadBalanceHealthConf(source, &HealthCheck{UnhealthyThreshold: 1, Timeout: time.Second})
+	assert.Nil(t, err)
+
+	rb := LoadBalanceFactoryWithConf(LbRoundRobin, mConf)
+	assert.Equal(t, 2, len(mConf.GetConf()))
+
+	// 检查一次：不可用主机被过滤，负载均衡器收到通知
+	mConf.checkOnce()
+	assert.Equal(t, []string{"http://" + ln.Addr().String() + "/,10"}, mConf.GetConf())
+	for i := 0; i < 5; i++ {
+		addr, _ := rb.Get("")
+		assert.Equal(t, "http://"+ln.Addr().String()+"/", addr)
+	}
+
+	// 服务发现下线可用主机，负载均衡器同样收到通知
+	source.UpdateConf([]string{downAddr})
+	assert.Equal(t, 0, len(mConf.GetConf()))
+	addr, _ := rb.Get("")
+	assert.Equal(t, "", addr)
+}
+
+// 运行时管理：摘除主机、修改权重，服务列表变化后仍然生效
+func TestLoadBalanceManageConf(t *testing.T) {
+	source := NewLoadBalanceStaticConf("http://%s/", map[string]string{
+		"127.0.0.1:2003": "10",
+		"127.0.0.1:2004": "20",
+	})
+	mConf := NewLoadBalanceManageConf(source)
+	rb := LoadBalanceFactoryWithConf(LbRoundRobin, mConf)
+
+	mConf.Drain("127.0.0.1:2003", true)
+	assert.Equal(t, []string{"http://127.0.0.1:2004/,20"}, mConf.GetConf())
+	for i := 0; i < 5; i++ {
+		addr, _ := rb.Get("")
+		assert.Equal(t, "http://127.0.0.1:2004/", addr)
+	}
+	assert.False(t, Available(rb, "http://127.0.0.1:2003/"))
+
+	mConf.SetWeight("127.0.0.1:2004", 5)
+	assert.Equal(t, []string{"http://127.0.0.1:2004/,5"}, mConf.GetConf())
+	source.UpdateConf([]string{"127.0.0.1:2003", "127.0.0.1:2004"})
+	assert.Equal(t, []string{"http://127.0.0.1:2004/,5"}, mConf.GetConf())
+
+	mConf.Drain("127.0.0.1:2003", false)
+	mConf.SetWeight("127.0.0.1:2004", 0)
+	assert.Equal(t, []string{"http://127.0.0.1:2003/,10", "http://127.0.0.1:2004/,20"}, mConf.GetConf())
+	assert.True(t, Available(rb, "http://127.0.0.1:2003/"))
+}
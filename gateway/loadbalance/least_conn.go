@@ -0,0 +1,125 @@
+package loadbalance
+
+import (
+	"errors"
+	"strings"
+	"sync"
+)
+
+// LeastConnBalance 最少连接数负载均衡
+// 每次选择当前活跃请求（连接）数最少的服务器节点。
+// 适用于长连接、流式请求等耗时差异较大的场景：
+//	Get 选中节点时，活跃数 +1
+//	Release 请求（连接）结束时，活跃数 -1
+// 活跃数相同时，从上一次选中节点的下一个位置开始比较，避免总是落到第一个节点
+type LeastConnBalance struct {
+	// 服务器节点列表
+	servAddrs []*connNode
+	// 上一次选中的节点索引
+	curIndex int
+
+	// 观察主体
+	conf LoadBalanceConf
+	// 互斥锁：选择节点与释放节点都会修改活跃数
+	mux sync.Mutex
+}
+
+// connNode 带活跃数的服务器节点
+type connNode struct {
+	// 主机地址：host:port
+	addr string
+	// 当前活跃请求（连接）数
+	active int64
+}
+
+// Add 添加服务器节点
+//
+// 格式："host:port", "host:port"...
+func (r *LeastConnBalance) Add(params ...string) error {
+	if len(params) == 0 {
+		return errors.New("params length at least 1")
+	}
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	for i := 0; i < len(params); i++ {
+		r.servAddrs = append(r.servAddrs, &connNode{addr: params[i]})
+	}
+	return nil
+}
+
+// Next 获取活跃数最少的服务器节点，并占用一个活跃数
+func (r *LeastConnBalance) Next() (string, error) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	lens := len(r.servAddrs)
+	if lens == 0 {
+		return "", errors.New("node list is empty")
+	}
+	index := -1
+	for i := 1; i <= lens; i++ {
+		j := (r.curIndex + i) % lens
+		if index == -1 || r.servAddrs[j].active < r.servAddrs[index].active {
+			index = j
+		}
+	}
+	r.curIndex = index
+	r.servAddrs[index].active++
+	return r.servAddrs[index].addr, nil
+}
+
+func (r *LeastConnBalance) Get(key string) (string, error) {
+	return r.Next()
+}
+
+// Release 请求（连接）结束，归还 Get 时占用的活跃数
+func (r *LeastConnBalance) Release(addr string) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	for _, n := range r.servAddrs {
+		if n.addr == addr {
+			if n.active > 0 {
+				n.active--
+			}
+			return
+		}
+	}
+}
+
+// Available 主机是否在当前服务器列表中
+func (r *LeastConnBalance) Available(addr string) bool {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	for _, n := range r.servAddrs {
+		if n.addr == addr {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *LeastConnBalance) SetConf(conf LoadBalanceConf) {
+	r.conf = conf
+}
+
+// Update 更新服务器列表，保留仍然存在的节点的活跃数
+func (r *LeastConnBalance) Update() {
+	if conf := r.conf; conf != nil {
+		r.mux.Lock()
+		defer r.mux.Unlock()
+		old := map[string]*connNode{}
+		for _, n := range r.servAddrs {
+			old[n.addr] = n
+		}
+		servAddrs := []*connNode{}
+		for _, ip := range conf.GetConf() {
+			addr := strings.Split(ip, ",")[0]
+			if n, ok := old[addr]; ok {
+				servAddrs = append(servAddrs, n)
+				continue
+			}
+			servAddrs = append(servAddrs, &connNode{addr: addr})
+		}
+		r.servAddrs = servAddrs
+		r.curIndex = 0
+	}
+}
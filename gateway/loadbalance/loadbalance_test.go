@@ -1,11 +1,13 @@
 package loadbalance
 
 import (
+	"errors"
 	"fmt"
 	"github.com/stretchr/testify/assert"
 	"math/rand"
 	"strconv"
 	"testing"
+	"time"
 )
 
 func TestRoundRobin(t *testing.T) {
@@ -60,6 +62,28 @@ func TestWeightRoundRobinBalance(t *testing.T) {
 
 }
 
+// 服务列表更新时保留仍在列表中的主机的失败记录与有效权重
+func TestWeightRoundRobinBalanceUpdate(t *testing.T) {
+	conf := NewLoadBalanceStaticConf("%s", map[string]string{"127.0.0.1:8001": "6", "127.0.0.1:8002": "3"})
+	rb := LoadBalanceFactoryWithConf(LbWeightRoundRobin, conf).(*WeightRoundRobinBalance)
+	conf.UpdateConf([]string{"127.0.0.1:8001", "127.0.0.1:8002"})
+	for i := 0; i < maxFails; i++ {
+		rb.Callback("127.0.0.1:8001", false)
+	}
+	assert.False(t, rb.Available("127.0.0.1:8001"))
+
+	conf.UpdateConf([]string{"127.0.0.1:8001", "127.0.0.1:8002"})
+	assert.False(t, rb.Available("127.0.0.1:8001"))
+	for i := 0; i < 10; i++ {
+		addr, err := rb.Next()
+		assert.Nil(t, err)
+		assert.Equal(t, "127.0.0.1:8002", addr)
+	}
+	rb.mux.Lock()
+	assert.Equal(t, 6-maxFails, rb.servAddrs[0].effectiveWeight)
+	rb.mux.Unlock()
+}
+
 func print(rb *WeightRoundRobinBalance, addr string) {
 	fmt.Println("主机地址\t\t\t当前权重\t有效权重")
 	// 打印所有服务器当前权重
@@ -111,3 +135,300 @@ func funcName(rb *ConsistentHashBalance) {
 	fmt.Println(rb.Get("192.168.1.1:8007"))
 	fmt.Println(rb.Get("127.0.0.1:8005"))
 }
+
+func TestLeastConnBalance(t *testing.T) {
+	rb := &LeastConnBalance{}
+	rb.Add("127.0.0.1:8001", "127.0.0.1:8002", "127.0.0.1:8003")
+
+	// 三个节点各占用一次
+	seen := map[string]bool{}
+	for i := 0; i < 3; i++ {
+		addr, err := rb.Get("")
+		assert.Nil(t, err)
+		seen[addr] = true
+	}
+	assert.Equal(t, 3, len(seen))
+
+	// 8002 释放后，活跃数最少，下一次必然选中
+	rb.Release("127.0.0.1:8002")
+	addr, _ := rb.Get("")
+	assert.Equal(t, "127.0.0.1:8002", addr)
+
+	// 长连接一直占用 8001，其余请求不会再落到 8001
+	rb.Release("127.0.0.1:8003")
+	rb.Release("127.0.0.1:8002")
+	for i := 0; i < 10; i++ {
+		addr, _ := rb.Get("")
+		assert.NotEqual(t, "127.0.0.1:8001", addr)
+		rb.Release(addr)
+	}
+}
+
+func TestP2CBalance(t *testing.T) {
+	rb := NewP2CBalance(time.Second)
+	rb.Add("127.0.0.1:8001", "127.0.0.1:8002", "127.0.0.1:8003")
+
+	// 8003 响应明显变慢，其余节点正常
+	count := map[string]int{}
+	for i := 0; i < 3000; i++ {
+		addr, err := rb.Get("")
+		assert.Nil(t, err)
+		count[addr]++
+		rtt := 10 * time.Millisecond
+		if addr == "127.0.0.1:8003" {
+			rtt = 200 * time.Millisecond
+		}
+		rb.ObserveRTT(addr, rtt)
+		rb.Release(addr)
+	}
+	fmt.Println(count)
+	assert.Less(t, count["127.0.0.1:8003"], count["127.0.0.1:8001"])
+	assert.Less(t, count["127.0.0.1:8003"], count["127.0.0.1:8002"])
+}
+
+func TestBoundedConsistentHashBalance(t *testing.T) {
+	rb := NewBoundedConsistentHashBalance(10, nil, 1.25)
+	rb.Add("127.0.0.1:8001", "127.0.0.1:8002", "127.0.0.1:8003", "127.0.0.1:8004")
+
+	// 热点URL：请求未结束时持续占用负载
+	hot := "http://127.0.0.1:8002/demo/get"
+	first, err := rb.Get(hot)
+	assert.Nil(t, err)
+	count := map[string]int{first: 1}
+	for i := 1; i < 100; i++ {
+		addr, err := rb.Get(hot)
+		assert.Nil(t, err)
+		count[addr]++
+	}
+	fmt.Println(count)
+	// 每个节点的负载都不超过 ceil(1.25 * 100 / 4) = 32
+	for addr, n := range count {
+		assert.LessOrEqual(t, n, 32, addr)
+	}
+
+	// 负载归还后，同一个 key 仍然落到原来的节点
+	for addr, n := range count {
+		for i := 0; i < n; i++ {
+			rb.Release(addr)
+		}
+	}
+	addr, _ := rb.Get(hot)
+	assert.Equal(t, first, addr)
+}
+
+func TestMaglevBalance(t *testing.T) {
+	rb := NewMaglevBalance(0, nil)
+	rb.Add("127.0.0.1:8001", "1", "127.0.0.1:8002", "1", "127.0.0.1:8003", "2")
+
+	// 权重 1:1:2，查找表槽位按权重分配
+	slots := map[string]int{}
+	for _, i := range rb.lookup {
+		slots[rb.servAddrs[i].addr]++
+	}
+	fmt.Println(slots)
+	assert.InDelta(t, rb.tableSize/4, slots["127.0.0.1:8001"], float64(rb.tableSize)/100)
+	assert.InDelta(t, rb.tableSize/2, slots["127.0.0.1:8003"], float64(rb.tableSize)/100)
+
+	// 同一个 key 总是落到同一个节点
+	addr, err := rb.Get("192.168.1.1:8007")
+	assert.Nil(t, err)
+	for i := 0; i < 10; i++ {
+		next, _ := rb.Get("192.168.1.1:8007")
+		assert.Equal(t, addr, next)
+	}
+}
+
+// disruptionServers 扰动测试：10个节点，移除最后一个
+func disruptionServers() (before, after []string) {
+	for i := 0; i < 10; i++ {
+		before = append(before, "127.0.0.1:"+strconv.Itoa(8001+i))
+	}
+	return before, before[:9]
+}
+
+// reportDisruption 统计移除节点后改变归属的 key 占比，以及节点最大负载与平均负载之比
+// 需在计时结束后调用，ResetTimer 会清除已上报的指标
+func reportDisruption(b *testing.B, before, after LoadBalance, nodes int) {
+	const keys = 100000
+	moved := 0
+	count := map[string]int{}
+	for i := 0; i < keys; i++ {
+		key := "192.168.1." + strconv.Itoa(i%256) + ":" + strconv.Itoa(10000+i)
+		a, _ := before.Get(key)
+		c, _ := after.Get(key)
+		if a != c {
+			moved++
+		}
+		count[a]++
+	}
+	maxLoad := 0
+	for _, n := range count {
+		if n > maxLoad {
+			maxLoad = n
+		}
+	}
+	b.ReportMetric(float64(moved)/keys, "moved/key")
+	b.ReportMetric(float64(maxLoad)/(float64(keys)/float64(nodes)), "max/avg")
+}
+
+// BenchmarkMaglevDisruption Maglev 增删节点的扰动与查找性能
+func BenchmarkMaglevDisruption(b *testing.B) {
+	servers, remain := disruptionServers()
+	before := NewMaglevBalance(0, nil)
+	after := NewMaglevBalance(0, nil)
+	for _, s := range servers {
+		before.Add(s, "1")
+	}
+	for _, s := range remain {
+		after.Add(s, "1")
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		before.Get("192.168.1.1:" + strconv.Itoa(i))
+	}
+	b.StopTimer()
+	reportDisruption(b, before, after, len(servers))
+}
+
+// BenchmarkConsistentHashDisruption hash环（replicas=10）增删节点的扰动与查找性能
+func BenchmarkConsistentHashDisruption(b *testing.B) {
+	servers, remain := disruptionServers()
+	before := NewConsistentHashBalance(10, nil)
+	after := NewConsistentHashBalance(10, nil)
+	before.Add(servers...)
+	after.Add(remain...)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		before.Get("192.168.1.1:" + strconv.Itoa(i))
+	}
+	b.StopTimer()
+	reportDisruption(b, before, after, len(servers))
+}
+
+func TestOutlierDetectBalance(t *testing.T) {
+	rb := &RoundRobinBalance{}
+	rb.Add("127.0.0.1:8001", "127.0.0.1:8002", "127.0.0.1:8003")
+	ob := NewOutlierDetectBalance(rb, &OutlierConf{
+		ConsecutiveErrors:  3,
+		BaseEjectionTime:   time.Minute,
+		MaxEjectionPercent: 50,
+	})
+	for i := 0; i < 3; i++ {
+		addr, _ := ob.Get("")
+		ob.Report(addr, nil)
+	}
+
+	// 8001 连续失败 3 次，被驱逐，不会再被选中
+	for i := 0; i < 3; i++ {
+		ob.Report("127.0.0.1:8001", errors.New("connection refused"))
+	}
+	assert.True(t, ob.Ejected("127.0.0.1:8001"))
+	for i := 0; i < 10; i++ {
+		addr, err := ob.Get("")
+		assert.Nil(t, err)
+		assert.NotEqual(t, "127.0.0.1:8001", addr)
+	}
+
+	// 最多驱逐 50%：3 台主机只能驱逐 1 台
+	for i := 0; i < 3; i++ {
+		ob.Report("127.0.0.1:8002", errors.New("503 Service Unavailable"))
+	}
+	assert.False(t, ob.Ejected("127.0.0.1:8002"))
+	assert.Equal(t, 1, len(ob.EjectedHosts()))
+
+	// 再次驱逐，驱逐时间翻倍
+	ob.hosts["127.0.0.1:8001"].ejectedUntil = time.Now()
+	for i := 0; i < 3; i++ {
+		ob.Report("127.0.0.1:8001", errors.New("connection refused"))
+	}
+	until := ob.EjectedHosts()["127.0.0.1:8001"]
+	assert.True(t, time.Until(until) > time.Minute+30*time.Second)
+
+	// 失败结果同样上报给加权轮询的小黑屋
+	wb := &WeightRoundRobinBalance{}
+	wb.Add("127.0.0.1:8001", "10")
+	Report(NewOutlierDetectBalance(wb, nil), "127.0.0.1:8001", errors.New("connection refused"))
+	assert.Equal(t, 1, len(wb.servAddrs[0].failTimes))
+}
+
+// 服务列表变化后，驱逐上限按当前主机数计算
+func TestOutlierDetectBalanceUpdate(t *testing.T) {
+	conf := NewLoadBalanceStaticConf("%s", map[string]string{
+		"127.0.0.1:8001": "50", "127.0.0.1:8002": "50", "127.0.0.1:8003": "50", "127.0.0.1:8004": "50",
+	})
+	ob := NewOutlierDetectBalance(LoadBalanceFactoryWithConf(LbRoundRobin, conf), &OutlierConf{
+		ConsecutiveErrors:  1,
+		BaseEjectionTime:   time.Minute,
+		MaxEjectionPercent: 50,
+	})
+	ob.SetConf(conf)
+	conf.Attach(ob)
+	ob.Report("127.0.0.1:8001", errors.New("connection refused"))
+	assert.True(t, ob.Ejected("127.0.0.1:8001"))
+
+	// 下线两台主机：剩余 2 台时只能驱逐 1 台，已驱逐的主机保留状态
+	conf.UpdateConf([]string{"127.0.0.1:8001", "127.0.0.1:8002"})
+	assert.Equal(t, 2, len(ob.hosts))
+	ob.Report("127.0.0.1:8002", errors.New("connection refused"))
+	assert.False(t, ob.Ejected("127.0.0.1:8002"))
+	assert.True(t, ob.Ejected("127.0.0.1:8001"))
+
+	// 已下线主机的结果不再登记
+	ob.Report("127.0.0.1:8003", errors.New("connection refused"))
+	assert.Equal(t, 2, len(ob.hosts))
+	addr, err := ob.Get("")
+	assert.Nil(t, err)
+	assert.Equal(t, "127.0.0.1:8002", addr)
+}
+
+func TestSlowStart(t *testing.T) {
+	s := &SlowStart{Window: 100 * time.Second, MinWeightPercent: 10}
+	now := time.Now()
+	assert.Equal(t, 1.0, s.factor(time.Time{}, now))
+	assert.Equal(t, 0.1, s.factor(now, now))
+	assert.InDelta(t, 0.5, s.factor(now.Add(-50*time.Second), now), 0.001)
+	assert.Equal(t, 1.0, s.factor(now.Add(-200*time.Second), now))
+	// 曲线：aggression 为 2 时前期增长更快
+	s.Aggression = 2
+	assert.InDelta(t, 0.5, s.factor(now.Add(-25*time.Second), now), 0.001)
+
+	lbs := map[string]LoadBalance{
+		"weight": LoadBalanceFactory(LbWeightRoundRobin),
+		"random": LoadBalanceFactory(LbRandom),
+		"p2c":    LoadBalanceFactory(LbP2C),
+	}
+	for name, rb := range lbs {
+		conf := NewLoadBalanceStaticConf("%s", map[string]string{})
+		rb.SetConf(conf)
+		conf.Attach(rb)
+		SetSlowStart(rb, &SlowStart{Window: time.Hour, MinWeightPercent: 10})
+		// 首次加载的服务列表不需要预热
+		conf.UpdateConf([]string{"127.0.0.1:8001", "127.0.0.1:8002"})
+		conf.UpdateConf([]string{"127.0.0.1:8001", "127.0.0.1:8002", "127.0.0.1:8003"})
+
+		count := map[string]int{}
+		for i := 0; i < 2100; i++ {
+			addr, err := rb.Get("")
+			assert.Nil(t, err)
+			count[addr]++
+			Release(rb, addr)
+		}
+		// 预热中的 8003 只分到约 1/21 的流量
+		assert.True(t, count["127.0.0.1:8003"] > 0, name)
+		assert.True(t, count["127.0.0.1:8003"] < 300, name, count)
+	}
+
+	// 主机下线后再次上线，重新预热
+	rb := &WeightRoundRobinBalance{}
+	conf := NewLoadBalanceStaticConf("%s", map[string]string{})
+	rb.SetConf(conf)
+	conf.Attach(rb)
+	rb.SetSlowStart(&SlowStart{Window: time.Hour})
+	conf.UpdateConf([]string{"127.0.0.1:8001", "127.0.0.1:8002"})
+	assert.True(t, rb.servAddrs[1].addedAt.IsZero())
+	conf.UpdateConf([]string{"127.0.0.1:8001"})
+	conf.UpdateConf([]string{"127.0.0.1:8001", "127.0.0.1:8002"})
+	assert.False(t, rb.servAddrs[1].addedAt.IsZero())
+}
@@ -0,0 +1,213 @@
+package loadbalance
+
+import (
+	"errors"
+	"hash/crc32"
+	"hash/fnv"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// 默认查找表大小，必须为质数，且远大于节点数
+const defaultMaglevTableSize = 65537
+
+// MaglevBalance Maglev 一致性hash算法实现负载均衡。
+// 参考：Maglev: A Fast and Reliable Software Network Load Balancer
+// 与 hash 环相比：
+// 	查找：预先生成固定大小的查找表，Get 只需一次取模，时间复杂度 O(1)
+// 	均衡性：每个节点占用查找表的槽位数基本一致（按权重成比例），不依赖虚拟节点
+// 	最小扰动：增删节点时，只有少量槽位改变归属
+// 实现步骤：
+// 	1.每个节点根据地址计算 offset 和 skip，生成自己对查找表槽位的偏好序列
+// 	2.各节点按权重轮流，依次占用偏好序列中第一个空闲的槽位，直到查找表填满
+// 	3.对 key 进行哈希计算，取模得到槽位，槽位对应的节点即为结果
+type MaglevBalance struct {
+	// hash 函数，用于计算 key 的哈希值，默认使用 crc32.ChecksumIEEE
+	hash Hash
+	// 查找表大小，质数
+	tableSize int
+	// 服务器节点列表
+	servAddrs []*maglevNode
+	// 查找表：槽位 -> servAddrs 索引
+	lookup []int
+
+	// 观察主体
+	conf LoadBalanceConf
+	// 读写锁：重建查找表时，读写同步，确保并发安全
+	mux sync.RWMutex
+}
+
+// maglevNode 带权重的服务器节点
+type maglevNode struct {
+	// 主机地址：host:port
+	addr string
+	// 权重
+	weight int
+}
+
+// NewMaglevBalance 创建 Maglev 负载均衡器
+// tableSize <= 0 时使用默认大小，非质数时取下一个质数
+func NewMaglevBalance(tableSize int, fn Hash) *MaglevBalance {
+	if tableSize <= 0 {
+		tableSize = defaultMaglevTableSize
+	}
+	for !isPrime(tableSize) {
+		tableSize++
+	}
+	m := &MaglevBalance{
+		hash:      fn,
+		tableSize: tableSize,
+	}
+	if m.hash == nil {
+		m.hash = crc32.ChecksumIEEE
+	}
+	return m
+}
+
+// Add 添加带权重的服务器主机，并重建查找表
+//
+// 格式："host:port", "weight", "host:port", "weight"...
+func (m *MaglevBalance) Add(params ...string) error {
+	nodes, err := newMaglevNodes(params...)
+	if err != nil {
+		return err
+	}
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	// 写时复制：生成新的节点列表与查找表，完成后整体替换
+	servAddrs := make([]*maglevNode, 0, len(m.servAddrs)+len(nodes))
+	servAddrs = append(servAddrs, m.servAddrs...)
+	servAddrs = append(servAddrs, nodes...)
+	m.servAddrs, m.lookup = servAddrs, m.populate(servAddrs)
+	return nil
+}
+
+// newMaglevNodes 解析带权重的服务器主机列表
+func newMaglevNodes(params ...string) ([]*maglevNode, error) {
+	length := len(params)
+	if length == 0 || length%2 != 0 {
+		return nil, errors.New("params' length must be 2 or multiple of 2")
+	}
+	nodes := make([]*maglevNode, 0, length/2)
+	for i := 0; i < length; i += 2 {
+		weight, err := strconv.ParseInt(params[i+1], 10, 32)
+		if err != nil {
+			return nil, err
+		}
+		// 默认权重为1
+		if weight <= 0 {
+			weight = 1
+		}
+		nodes = append(nodes, &maglevNode{addr: params[i], weight: int(weight)})
+	}
+	return nodes, nil
+}
+
+// Get 获取指定 key 对应的服务器节点
+func (m *MaglevBalance) Get(key string) (string, error) {
+	m.mux.RLock()
+	defer m.mux.RUnlock()
+	if len(m.lookup) == 0 {
+		return "", errors.New("node list is empty")
+	}
+	slot := m.hash([]byte(key)) % uint32(len(m.lookup))
+	return m.servAddrs[m.lookup[slot]].addr, nil
+}
+
+// Available 主机是否在当前服务器列表中
+func (m *MaglevBalance) Available(addr string) bool {
+	m.mux.RLock()
+	defer m.mux.RUnlock()
+	for _, n := range m.servAddrs {
+		if n.addr == addr {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *MaglevBalance) SetConf(conf LoadBalanceConf) {
+	m.conf = conf
+}
+
+func (m *MaglevBalance) Update() {
+	if conf := m.conf; conf != nil {
+		servAddrs := []*maglevNode{}
+		for _, ip := range conf.GetConf() {
+			nodes, err := newMaglevNodes(strings.Split(ip, ",")...)
+			if err != nil {
+				continue
+			}
+			servAddrs = append(servAddrs, nodes...)
+		}
+		// 查找表在锁外生成，锁内整体替换，Get 不会读到中间状态
+		lookup := m.populate(servAddrs)
+		m.mux.Lock()
+		m.servAddrs, m.lookup = servAddrs, lookup
+		m.mux.Unlock()
+	}
+}
+
+// populate 根据节点列表生成查找表，不修改 m 的状态
+func (m *MaglevBalance) populate(servAddrs []*maglevNode) []int {
+	n := len(servAddrs)
+	if n == 0 {
+		return nil
+	}
+	size := uint64(m.tableSize)
+	offsets := make([]uint64, n)
+	skips := make([]uint64, n)
+	maxWeight := 0
+	for i, node := range servAddrs {
+		h1 := fnv.New64a()
+		h1.Write([]byte(node.addr))
+		h2 := fnv.New64()
+		h2.Write([]byte(node.addr))
+		offsets[i] = h1.Sum64() % size
+		skips[i] = h2.Sum64()%(size-1) + 1
+		if node.weight > maxWeight {
+			maxWeight = node.weight
+		}
+	}
+
+	lookup := make([]int, m.tableSize)
+	for i := range lookup {
+		lookup[i] = -1
+	}
+	// next[i]：节点 i 偏好序列中下一个待尝试的位置
+	next := make([]uint64, n)
+	// credit[i]：节点 i 累积的可占用槽位数，按权重比例增长
+	credit := make([]float64, n)
+	filled := 0
+	for filled < m.tableSize {
+		for i, node := range servAddrs {
+			credit[i] += float64(node.weight) / float64(maxWeight)
+			for credit[i] >= 1 && filled < m.tableSize {
+				credit[i]--
+				// 偏好序列：(offset + j*skip) % size，找到第一个空闲槽位
+				slot := (offsets[i] + next[i]*skips[i]) % size
+				for lookup[slot] >= 0 {
+					next[i]++
+					slot = (offsets[i] + next[i]*skips[i]) % size
+				}
+				lookup[slot] = i
+				next[i]++
+				filled++
+			}
+		}
+	}
+	return lookup
+}
+
+func isPrime(n int) bool {
+	if n < 2 {
+		return false
+	}
+	for i := 2; i*i <= n; i++ {
+		if n%i == 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,132 @@
+package loadbalance
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// LoadBalanceManageConf 运行时管理的负载均衡配置（装饰器）
+// 包装任意一个负载均衡配置（服务发现、健康检查等），在其结果之上：
+// 	1.摘除（drain）主机：GetConf 不再返回该主机，负载均衡器不再选中，处理中的请求（连接）不受影响
+// 	2.修改主机权重：覆盖服务发现配置中的权重
+// 管理操作保存在装饰器中，被包装配置的服务列表变化后仍然生效。
+type LoadBalanceManageConf struct {
+	observers []Observer      // 观察者列表
+	source    LoadBalanceConf // 被包装的配置
+
+	drained map[string]bool // 被摘除的主机：host:port
+	weights map[string]int  // 主机与覆盖权重的映射表：host:port -> weight
+
+	mux sync.RWMutex
+}
+
+// NewLoadBalanceManageConf 创建运行时管理的负载均衡配置
+func NewLoadBalanceManageConf(source LoadBalanceConf) *LoadBalanceManageConf {
+	m := &LoadBalanceManageConf{
+		source:  source,
+		drained: map[string]bool{},
+		weights: map[string]int{},
+	}
+	source.Attach(m)
+	return m
+}
+
+func (m *LoadBalanceManageConf) Attach(o Observer) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	m.observers = append(m.observers, o)
+}
+
+// GetConf 获取被包装配置中未被摘除的主机，并使用覆盖后的权重
+func (m *LoadBalanceManageConf) GetConf() []string {
+	m.mux.RLock()
+	defer m.mux.RUnlock()
+	confList := []string{}
+	for _, item := range m.source.GetConf() {
+		host := confHost(item)
+		if m.drained[host] {
+			continue
+		}
+		if weight, ok := m.weights[host]; ok {
+			item = strings.Split(item, ",")[0] + "," + strconv.Itoa(weight)
+		}
+		confList = append(confList, item)
+	}
+	return confList
+}
+
+// WatchConf 被包装的配置自行监听变化，无需监听
+func (m *LoadBalanceManageConf) WatchConf() {
+}
+
+// UpdateConf 更新被包装配置的服务列表
+func (m *LoadBalanceManageConf) UpdateConf(conf []string) {
+	m.source.UpdateConf(conf)
+}
+
+// Update 被包装配置的服务列表变化时，通知观察者更新
+func (m *LoadBalanceManageConf) Update() {
+	m.notifyAllObservers()
+}
+
+// Drain 摘除或恢复主机，host 为 host:port
+func (m *LoadBalanceManageConf) Drain(host string, drained bool) {
+	m.mux.Lock()
+	if drained {
+		m.drained[host] = true
+	} else {
+		delete(m.drained, host)
+	}
+	m.mux.Unlock()
+	m.notifyAllObservers()
+}
+
+// Drained 主机是否被摘除
+func (m *LoadBalanceManageConf) Drained(host string) bool {
+	m.mux.RLock()
+	defer m.mux.RUnlock()
+	return m.drained[host]
+}
+
+// DrainedHosts 获取所有被摘除的主机
+func (m *LoadBalanceManageConf) DrainedHosts() []string {
+	m.mux.RLock()
+	defer m.mux.RUnlock()
+	hosts := []string{}
+	for host := range m.drained {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	return hosts
+}
+
+// SetWeight 覆盖主机的权重，weight <= 0 时恢复使用被包装配置中的权重
+func (m *LoadBalanceManageConf) SetWeight(host string, weight int) {
+	m.mux.Lock()
+	if weight > 0 {
+		m.weights[host] = weight
+	} else {
+		delete(m.weights, host)
+	}
+	m.mux.Unlock()
+	m.notifyAllObservers()
+}
+
+// Weight 获取主机的覆盖权重，没有覆盖时返回 false
+func (m *LoadBalanceManageConf) Weight(host string) (int, bool) {
+	m.mux.RLock()
+	defer m.mux.RUnlock()
+	weight, ok := m.weights[host]
+	return weight, ok
+}
+
+func (m *LoadBalanceManageConf) notifyAllObservers() {
+	m.mux.RLock()
+	observers := append([]Observer{}, m.observers...)
+	m.mux.RUnlock()
+	for _, obs := range observers {
+		obs.Update()
+	}
+}
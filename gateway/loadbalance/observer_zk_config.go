@@ -3,6 +3,7 @@ package loadbalance
 import (
 	"fmt"
 	"gateway/middleware/servicediscovery/zookeeper"
+	"sync"
 )
 
 // LoadBalanceConf 负载均衡配置（抽象主体）
@@ -27,6 +28,11 @@ type LoadBalanceZkConf struct {
 	activeList   []string          // 可用主机列表
 
 	format string // 格式化
+
+	mux sync.RWMutex // 读写锁：监听协程更新可用主机列表时，与读取配置同步
+
+	closeOnce sync.Once
+	done      chan struct{} // 关闭后停止监听，并关闭监听使用的 zk 连接
 }
 
 // NewLoadBalanceZkConf 创建负载均衡zk配置实例
@@ -39,7 +45,7 @@ func NewLoadBalanceZkConf(format, path string, zkHosts []string, conf map[string
 		return nil, err
 	}
 	// 创建具体主体
-	mConf := &LoadBalanceZkConf{format: format, activeList: zList, confIpWeight: conf, zkHosts: zkHosts, path: path}
+	mConf := &LoadBalanceZkConf{format: format, activeList: zList, confIpWeight: conf, zkHosts: zkHosts, path: path, done: make(chan struct{})}
 	// 启动监听
 	mConf.WatchConf()
 	return mConf, nil
@@ -47,18 +53,22 @@ func NewLoadBalanceZkConf(format, path string, zkHosts []string, conf map[string
 
 // Attach 绑定到观察者列表
 func (s *LoadBalanceZkConf) Attach(o Observer) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
 	s.observers = append(s.observers, o)
 }
 
 // NotifyAllObservers 通知所有观察者
 func (s *LoadBalanceZkConf) NotifyAllObservers() {
-	for _, obs := range s.observers {
+	for _, obs := range s.getObservers() {
 		obs.Update()
 	}
 }
 
 // GetConf 获取服务器配置
 func (s *LoadBalanceZkConf) GetConf() []string {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
 	confList := []string{}
 	for _, ip := range s.activeList {
 		weight, ok := s.confIpWeight[ip]
@@ -80,6 +90,8 @@ func (s *LoadBalanceZkConf) WatchConf() {
 		defer zkManager.Close()
 		for {
 			select {
+			case <-s.done:
+				return
 			case changeErr := <-chanErr:
 				fmt.Println("changeErr", changeErr)
 			case changedList := <-chanList:
@@ -90,14 +102,30 @@ func (s *LoadBalanceZkConf) WatchConf() {
 	}()
 }
 
+// Close 停止监听并关闭 zk 连接，配置不再使用时（如热加载替换了服务）调用
+func (s *LoadBalanceZkConf) Close() {
+	s.closeOnce.Do(func() {
+		close(s.done)
+	})
+}
+
 // UpdateConf 更新配置时，通知监听者也更新
 func (s *LoadBalanceZkConf) UpdateConf(conf []string) {
+	s.mux.Lock()
 	s.activeList = conf
-	for _, obs := range s.observers {
+	s.mux.Unlock()
+	for _, obs := range s.getObservers() {
 		obs.Update()
 	}
 }
 
+// getObservers 获取观察者列表快照，通知时不持有锁，观察者可以回调 GetConf
+func (s *LoadBalanceZkConf) getObservers() []Observer {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	return append([]Observer{}, s.observers...)
+}
+
 // LoadBalanceObserver 观察者实现（具体观察者）
 type LoadBalanceObserver struct {
 	ZkConf *LoadBalanceZkConf
@@ -2,7 +2,9 @@ package loadbalance
 
 import (
 	"fmt"
+	"runtime"
 	"testing"
+	"time"
 )
 
 // 以观察者模式构建负载均衡配置
@@ -25,3 +27,19 @@ func TestNewLoadBalanceObserver(t *testing.T) {
 
 	select {}
 }
+
+// Close 停止监听协程并关闭 zk 连接，zk 服务器不可用时也能停止
+func TestLoadBalanceZkConfClose(t *testing.T) {
+	before := runtime.NumGoroutine()
+	s := &LoadBalanceZkConf{format: "%s", path: "/realserver", zkHosts: []string{"127.0.0.1:1"}, done: make(chan struct{})}
+	s.WatchConf()
+	s.Close()
+	s.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			t.Fatalf("watch goroutines leaked: %d > %d", runtime.NumGoroutine(), before)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
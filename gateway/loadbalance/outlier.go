@@ -0,0 +1,249 @@
+package loadbalance
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// 默认连续失败次数：达到该值时驱逐主机
+	defaultConsecutiveErrors = 5
+	// 默认基础驱逐时间
+	defaultBaseEjectionTime = 30 * time.Second
+	// 默认最长驱逐时间
+	defaultMaxEjectionTime = 300 * time.Second
+	// 默认最多驱逐的主机百分比
+	defaultMaxEjectionPercent = 10
+)
+
+// OutlierConf 被动健康检查（异常主机驱逐）配置，零值字段使用默认值
+type OutlierConf struct {
+	// 连续失败次数达到该值，驱逐主机
+	ConsecutiveErrors int
+	// 基础驱逐时间，第 n 次驱逐的时间为 BaseEjectionTime * 2^(n-1)
+	BaseEjectionTime time.Duration
+	// 最长驱逐时间；主机恢复后持续正常超过该时间，驱逐次数清零
+	MaxEjectionTime time.Duration
+	// 最多驱逐的主机百分比，至少保留一台主机不被驱逐
+	MaxEjectionPercent int
+}
+
+// OutlierDetectBalance 被动健康检查负载均衡（装饰器）
+// 包装任意一种负载均衡器，根据代理上报的真实请求结果（5xx、连接错误、gRPC Unavailable）
+// 驱逐异常主机，不依赖具体的负载均衡算法：
+// 	1.同一主机连续失败 ConsecutiveErrors 次，驱逐一段时间，驱逐时间按次数指数增长
+// 	2.被驱逐的主机数不超过 MaxEjectionPercent
+// 	3.Get 选中被驱逐的主机时，归还后重新选择；重试用尽时仍返回最后一次结果
+// 设置了服务列表配置（SetConf）时，只跟踪当前服务列表中的主机，驱逐百分比按当前主机数计算。
+type OutlierDetectBalance struct {
+	LoadBalance
+	conf   OutlierConf
+	source LoadBalanceConf // 服务列表配置，为 nil 时登记所有出现过的主机
+
+	hosts map[string]*outlierHost // 主机地址与异常状态的映射表
+	mux   sync.Mutex
+}
+
+// outlierHost 单个主机的异常状态
+type outlierHost struct {
+	failures     int       // 连续失败次数
+	ejections    int       // 累计驱逐次数
+	ejectedUntil time.Time // 驱逐截止时间
+	ejectedAt    time.Time // 最近一次驱逐时间
+}
+
+// NewOutlierDetectBalance 为负载均衡器增加被动健康检查，conf 为 nil 时使用默认配置
+func NewOutlierDetectBalance(lb LoadBalance, conf *OutlierConf) *OutlierDetectBalance {
+	c := OutlierConf{}
+	if conf != nil {
+		c = *conf
+	}
+	if c.ConsecutiveErrors <= 0 {
+		c.ConsecutiveErrors = defaultConsecutiveErrors
+	}
+	if c.BaseEjectionTime <= 0 {
+		c.BaseEjectionTime = defaultBaseEjectionTime
+	}
+	if c.MaxEjectionTime <= 0 {
+		c.MaxEjectionTime = defaultMaxEjectionTime
+	}
+	if c.MaxEjectionPercent <= 0 {
+		c.MaxEjectionPercent = defaultMaxEjectionPercent
+	}
+	return &OutlierDetectBalance{
+		LoadBalance: lb,
+		conf:        c,
+		hosts:       map[string]*outlierHost{},
+	}
+}
+
+// Get 获取未被驱逐的主机
+func (o *OutlierDetectBalance) Get(key string) (string, error) {
+	o.mux.Lock()
+	attempts := len(o.hosts) + 1
+	o.mux.Unlock()
+	var addr string
+	var err error
+	for i := 0; i < attempts; i++ {
+		k := key
+		if i > 0 {
+			// 一致性hash等算法：换一个 key，才能落到其他节点
+			k = key + "#" + strconv.Itoa(i)
+		}
+		addr, err = o.LoadBalance.Get(k)
+		if err != nil || !o.Ejected(addr) {
+			return addr, err
+		}
+		if i < attempts-1 {
+			Release(o.LoadBalance, addr)
+		}
+	}
+	return addr, err
+}
+
+// Ejected 主机当前是否被驱逐
+func (o *OutlierDetectBalance) Ejected(addr string) bool {
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	h := o.host(addr)
+	return h != nil && time.Now().Before(h.ejectedUntil)
+}
+
+// host 获取主机的异常状态
+// 没有服务列表配置时，首次出现的主机自动登记，用于计算驱逐百分比；
+// 有配置时不在当前服务列表中的主机（已下线、已摘除）返回 nil
+func (o *OutlierDetectBalance) host(addr string) *outlierHost {
+	h, ok := o.hosts[addr]
+	if !ok && o.source == nil {
+		h = &outlierHost{}
+		o.hosts[addr] = h
+	}
+	return h
+}
+
+// SetConf 设置服务列表配置，需要同时将装饰器注册为配置的观察者（Attach），
+// 服务列表变化时 Update 清理已移除主机的异常状态
+// 被包装的负载均衡器自行观察配置，不经过装饰器
+func (o *OutlierDetectBalance) SetConf(conf LoadBalanceConf) {
+	o.mux.Lock()
+	o.source = conf
+	o.mux.Unlock()
+	o.Update()
+}
+
+// Update 按当前服务列表更新跟踪的主机：保留已有主机的异常状态，登记新增主机，删除已移除的主机
+// 没有设置服务列表配置时透传给被包装的负载均衡器
+func (o *OutlierDetectBalance) Update() {
+	o.mux.Lock()
+	source := o.source
+	o.mux.Unlock()
+	if source == nil {
+		o.LoadBalance.Update()
+		return
+	}
+	hosts := map[string]*outlierHost{}
+	for _, item := range source.GetConf() {
+		// 格式："addr,weight"，与负载均衡器返回的地址一致
+		hosts[strings.Split(item, ",")[0]] = nil
+	}
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	for addr := range hosts {
+		if h, ok := o.hosts[addr]; ok {
+			hosts[addr] = h
+		} else {
+			hosts[addr] = &outlierHost{}
+		}
+	}
+	o.hosts = hosts
+}
+
+// EjectedHosts 当前被驱逐的主机与驱逐截止时间
+func (o *OutlierDetectBalance) EjectedHosts() map[string]time.Time {
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	now := time.Now()
+	ejected := map[string]time.Time{}
+	for addr, h := range o.hosts {
+		if now.Before(h.ejectedUntil) {
+			ejected[addr] = h.ejectedUntil
+		}
+	}
+	return ejected
+}
+
+// Report 代理上报一次请求结果，err 为 nil 表示成功
+func (o *OutlierDetectBalance) Report(addr string, err error) {
+	o.record(addr, err)
+	Report(o.LoadBalance, addr, err)
+}
+
+func (o *OutlierDetectBalance) record(addr string, err error) {
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	now := time.Now()
+	h := o.host(addr)
+	if h == nil {
+		return
+	}
+	if err == nil {
+		h.failures = 0
+		// 恢复后持续正常，驱逐次数清零
+		if h.ejections > 0 && now.Sub(h.ejectedAt) > o.conf.MaxEjectionTime {
+			h.ejections = 0
+		}
+		return
+	}
+	h.failures++
+	if h.failures < o.conf.ConsecutiveErrors || now.Before(h.ejectedUntil) {
+		return
+	}
+	// 检查驱逐上限
+	ejected := 0
+	for _, other := range o.hosts {
+		if now.Before(other.ejectedUntil) {
+			ejected++
+		}
+	}
+	maxEjected := len(o.hosts) * o.conf.MaxEjectionPercent / 100
+	if maxEjected < 1 {
+		maxEjected = 1
+	}
+	if maxEjected > len(o.hosts)-1 {
+		maxEjected = len(o.hosts) - 1
+	}
+	if ejected >= maxEjected {
+		return
+	}
+	// 驱逐时间：BaseEjectionTime * 2^(n-1)，不超过 MaxEjectionTime
+	ejection := o.conf.BaseEjectionTime << uint(h.ejections)
+	if ejection > o.conf.MaxEjectionTime || ejection <= 0 {
+		ejection = o.conf.MaxEjectionTime
+	}
+	h.ejections++
+	h.failures = 0
+	h.ejectedAt = now
+	h.ejectedUntil = now.Add(ejection)
+}
+
+// Available 主机未被驱逐，并且在被包装的负载均衡器中可用
+func (o *OutlierDetectBalance) Available(addr string) bool {
+	return !o.Ejected(addr) && Available(o.LoadBalance, addr)
+}
+
+// Release 透传给被包装的负载均衡器
+func (o *OutlierDetectBalance) Release(addr string) {
+	Release(o.LoadBalance, addr)
+}
+
+// SetSlowStart 透传给被包装的负载均衡器
+func (o *OutlierDetectBalance) SetSlowStart(s *SlowStart) {
+	SetSlowStart(o.LoadBalance, s)
+}
+
+// ObserveRTT 透传给被包装的负载均衡器
+func (o *OutlierDetectBalance) ObserveRTT(addr string, rtt time.Duration) {
+	ObserveRTT(o.LoadBalance, addr, rtt)
+}
@@ -0,0 +1,221 @@
+package loadbalance
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// 默认 EWMA 衰减时间常数：越大越平滑，越小对最新耗时越敏感
+	defaultP2CDecay = 10 * time.Second
+	// 尚未观测到耗时的节点，有未完成请求时使用的默认耗时
+	defaultP2CPenalty = time.Second
+)
+
+// P2CBalance 两次随机选择（Power of Two Choices）负载均衡，按 peak EWMA 耗时打分。
+// 每次随机抽取两个节点，选择得分较低的一个：
+//	得分 = peak EWMA 耗时 * (未完成请求数 + 1)
+// peak EWMA：
+//	观测到的耗时大于当前值时，直接取观测值（对变慢的节点立即反应）
+// 	否则按距上次观测的时间指数衰减：ewma = ewma*w + rtt*(1-w)，w = e^(-Δt/decay)
+// 耗时由反向代理通过 ObserveRTT 回调，未完成请求数由 Get/Release 维护
+type P2CBalance struct {
+	// 服务器节点列表
+	servAddrs []*p2cNode
+	// 衰减时间常数
+	decay time.Duration
+	// 慢启动配置，nil 表示不预热
+	slowStart *SlowStart
+
+	// 观察主体
+	conf LoadBalanceConf
+	// 互斥锁：节点统计信息会被多个请求同时修改
+	mux sync.Mutex
+	rnd *rand.Rand
+}
+
+// p2cNode 带耗时统计的服务器节点
+type p2cNode struct {
+	// 主机地址：host:port
+	addr string
+	// peak EWMA 耗时，单位纳秒，0 表示尚未观测
+	ewma float64
+	// 上一次观测耗时的时间点
+	stamp time.Time
+	// 未完成请求数
+	pending int64
+	// 服务发现新增主机的上线时间，用于慢启动；零值表示不需要预热
+	addedAt time.Time
+}
+
+// NewP2CBalance 创建 P2C 负载均衡器，decay <= 0 时使用默认衰减时间常数
+func NewP2CBalance(decay time.Duration) *P2CBalance {
+	if decay <= 0 {
+		decay = defaultP2CDecay
+	}
+	return &P2CBalance{
+		decay: decay,
+		rnd:   rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// Add 添加服务器节点
+//
+// 格式："host:port", "host:port"...
+func (r *P2CBalance) Add(params ...string) error {
+	if len(params) == 0 {
+		return errors.New("params length at least 1")
+	}
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	for i := 0; i < len(params); i++ {
+		r.servAddrs = append(r.servAddrs, &p2cNode{addr: params[i]})
+	}
+	return nil
+}
+
+// Next 随机抽取两个节点，选择得分较低的节点，并占用一个未完成请求数
+// 开启慢启动时，预热中的节点按 1-预热比例 的概率放弃竞争，由另一个节点胜出
+func (r *P2CBalance) Next() (string, error) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	lens := len(r.servAddrs)
+	if lens == 0 {
+		return "", errors.New("node list is empty")
+	}
+	n := r.servAddrs[0]
+	if lens > 1 {
+		i := r.random().Intn(lens)
+		j := r.random().Intn(lens - 1)
+		if j >= i {
+			j++
+		}
+		n = r.servAddrs[i]
+		m := r.servAddrs[j]
+		now := time.Now()
+		nCold := r.random().Float64() >= r.slowStart.factor(n.addedAt, now)
+		mCold := r.random().Float64() >= r.slowStart.factor(m.addedAt, now)
+		if nCold != mCold {
+			if nCold {
+				n = m
+			}
+		} else if m.score() < n.score() {
+			n = m
+		}
+	}
+	n.pending++
+	return n.addr, nil
+}
+
+func (r *P2CBalance) Get(key string) (string, error) {
+	return r.Next()
+}
+
+// Release 请求结束，归还 Get 时占用的未完成请求数
+func (r *P2CBalance) Release(addr string) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if n := r.find(addr); n != nil && n.pending > 0 {
+		n.pending--
+	}
+}
+
+// ObserveRTT 记录一次下游响应耗时，更新 peak EWMA
+func (r *P2CBalance) ObserveRTT(addr string, rtt time.Duration) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	n := r.find(addr)
+	if n == nil {
+		return
+	}
+	now := time.Now()
+	v := float64(rtt)
+	if v > n.ewma {
+		n.ewma = v
+	} else {
+		decay := r.decay
+		if decay <= 0 {
+			decay = defaultP2CDecay
+		}
+		w := math.Exp(-float64(now.Sub(n.stamp)) / float64(decay))
+		n.ewma = n.ewma*w + v*(1-w)
+	}
+	n.stamp = now
+}
+
+// Available 主机是否在当前服务器列表中
+func (r *P2CBalance) Available(addr string) bool {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	return r.find(addr) != nil
+}
+
+func (r *P2CBalance) SetConf(conf LoadBalanceConf) {
+	r.conf = conf
+}
+
+// SetSlowStart 设置慢启动，服务发现新增的主机逐渐增加被选中的概率
+func (r *P2CBalance) SetSlowStart(s *SlowStart) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	r.slowStart = s
+}
+
+// Update 更新服务器列表，保留仍然存在的节点的耗时统计
+// 新增的主机记录上线时间用于慢启动，首次加载的服务列表不需要预热
+func (r *P2CBalance) Update() {
+	if conf := r.conf; conf != nil {
+		r.mux.Lock()
+		defer r.mux.Unlock()
+		old := map[string]*p2cNode{}
+		for _, n := range r.servAddrs {
+			old[n.addr] = n
+		}
+		now := time.Now()
+		servAddrs := []*p2cNode{}
+		for _, ip := range conf.GetConf() {
+			addr := strings.Split(ip, ",")[0]
+			if n, ok := old[addr]; ok {
+				servAddrs = append(servAddrs, n)
+				continue
+			}
+			n := &p2cNode{addr: addr}
+			if len(old) > 0 {
+				n.addedAt = now
+			}
+			servAddrs = append(servAddrs, n)
+		}
+		r.servAddrs = servAddrs
+	}
+}
+
+func (r *P2CBalance) find(addr string) *p2cNode {
+	for _, n := range r.servAddrs {
+		if n.addr == addr {
+			return n
+		}
+	}
+	return nil
+}
+
+// random 兼容直接以 &P2CBalance{} 方式创建的实例
+func (r *P2CBalance) random() *rand.Rand {
+	if r.rnd == nil {
+		r.rnd = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+	return r.rnd
+}
+
+// score 节点得分，越低越优先
+// 尚未观测到耗时的节点：空闲时得分为 0，优先探测；繁忙时按默认耗时计算
+func (n *p2cNode) score() float64 {
+	ewma := n.ewma
+	if ewma == 0 && n.pending > 0 {
+		ewma = float64(defaultP2CPenalty)
+	}
+	return ewma * float64(n.pending+1)
+}
@@ -5,59 +5,142 @@ import (
 	"fmt"
 	"math/rand"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type RandomBalance struct {
 	// 服务器主机地址 host:port
-	servAddrs []string
-	// 当前轮询的节点索引
-	curIndex int
+	// 写时复制：保存 []string 快照，修改时整体替换，读取时无需加锁
+	servAddrs atomic.Value
+	// 服务发现新增主机的上线时间，用于慢启动：保存 map[string]time.Time 快照
+	addedAt atomic.Value
+	// 慢启动配置：保存 *SlowStart，nil 表示不预热
+	slowStart atomic.Value
 
 	// 观察主体
 	conf LoadBalanceConf
+	// 写锁：串行化 Add 与 Update
+	mux sync.Mutex
 }
 
 func (r *RandomBalance) Add(params ...string) error {
 	if len(params) == 0 {
 		return errors.New("params length at least 1")
 	}
-	for i := 0; i < len(params); i++ {
-		r.servAddrs = append(r.servAddrs, params[i])
-	}
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	old := r.nodes()
+	servAddrs := make([]string, 0, len(old)+len(params))
+	servAddrs = append(servAddrs, old...)
+	servAddrs = append(servAddrs, params...)
+	r.servAddrs.Store(servAddrs)
 	return nil
 }
 
 func (r *RandomBalance) Next() string {
-	lens := len(r.servAddrs)
+	servAddrs := r.nodes()
+	lens := len(servAddrs)
 	if lens == 0 {
 		return ""
 	}
 
-	r.curIndex = rand.Intn(len(r.servAddrs)) // 0, 1, 2
-	return r.servAddrs[r.curIndex]
+	// 慢启动：预热中的主机按预热比例降低被选中的概率
+	if s, _ := r.slowStart.Load().(*SlowStart); s != nil {
+		addedAt, _ := r.addedAt.Load().(map[string]time.Time)
+		if len(addedAt) > 0 {
+			return r.weightedNext(servAddrs, addedAt, s)
+		}
+	}
+
+	// 全局随机数生成器是并发安全的
+	return servAddrs[rand.Intn(lens)] // 0, 1, 2
+}
+
+// weightedNext 按预热比例加权随机选择主机
+func (r *RandomBalance) weightedNext(servAddrs []string, addedAt map[string]time.Time, s *SlowStart) string {
+	now := time.Now()
+	factors := make([]float64, len(servAddrs))
+	total := 0.0
+	for i, addr := range servAddrs {
+		factors[i] = s.factor(addedAt[addr], now)
+		total += factors[i]
+	}
+	x := rand.Float64() * total
+	for i, f := range factors {
+		if x < f {
+			return servAddrs[i]
+		}
+		x -= f
+	}
+	return servAddrs[len(servAddrs)-1]
 }
 
 func (r *RandomBalance) Get(key string) (string, error) {
-	return r.Next(), nil
+	addr := r.Next()
+	if addr == "" {
+		return "", errors.New("node list is empty")
+	}
+	return addr, nil
+}
+
+// Available 主机是否在当前服务器列表中
+func (r *RandomBalance) Available(addr string) bool {
+	for _, a := range r.nodes() {
+		if a == addr {
+			return true
+		}
+	}
+	return false
 }
 
 func (r *RandomBalance) SetConf(conf LoadBalanceConf) {
 	r.conf = conf
 }
 
+// SetSlowStart 设置慢启动，服务发现新增的主机逐渐增加被选中的概率
+func (r *RandomBalance) SetSlowStart(s *SlowStart) {
+	r.slowStart.Store(s)
+}
+
+// Update 更新服务器列表
+// 新增的主机记录上线时间用于慢启动，首次加载的服务列表不需要预热
 func (r *RandomBalance) Update() {
-	if conf, ok := r.conf.(*LoadBalanceZkConf); ok {
+	if conf := r.conf; conf != nil {
 		fmt.Println("Update get conf:", conf.GetConf())
-		r.servAddrs = []string{}
+		servAddrs := []string{}
 		for _, ip := range conf.GetConf() {
-			r.Add(strings.Split(ip, ",")...)
+			// 格式："addr,weight"，随机只使用地址
+			servAddrs = append(servAddrs, strings.Split(ip, ",")[0])
+		}
+		now := time.Now()
+		r.mux.Lock()
+		old := map[string]bool{}
+		for _, addr := range r.nodes() {
+			old[addr] = true
+		}
+		oldAddedAt, _ := r.addedAt.Load().(map[string]time.Time)
+		s, _ := r.slowStart.Load().(*SlowStart)
+		addedAt := map[string]time.Time{}
+		for _, addr := range servAddrs {
+			if old[addr] {
+				// 预热中的主机保留上线时间，预热完成的主机不再记录，恢复均匀随机
+				if t, ok := oldAddedAt[addr]; ok && s.factor(t, now) < 1 {
+					addedAt[addr] = t
+				}
+			} else if len(old) > 0 {
+				addedAt[addr] = now
+			}
 		}
+		r.servAddrs.Store(servAddrs)
+		r.addedAt.Store(addedAt)
+		r.mux.Unlock()
 	}
-	//if conf, ok := r.conf.(*LoadBalanceCheckConf); ok {
-	//	fmt.Println("Update get conf:", conf.GetConf())
-	//	r.servAddrs = nil
-	//	for _, ip := range conf.GetConf() {
-	//		r.Add(strings.Split(ip, ",")...)
-	//	}
-	//}
+}
+
+// nodes 获取当前服务器列表快照，只读
+func (r *RandomBalance) nodes() []string {
+	servAddrs, _ := r.servAddrs.Load().([]string)
+	return servAddrs
 }
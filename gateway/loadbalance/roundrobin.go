@@ -4,30 +4,53 @@ import (
 	"errors"
 	"fmt"
 	"strings"
+	"sync"
+	"sync/atomic"
 )
 
 type RoundRobinBalance struct {
 	// 服务器主机地址 host:port
-	servAddrs []string
-	// 当前轮询的节点索引
-	curIndex int
+	// 写时复制：保存 []string 快照，修改时整体替换，读取时无需加锁
+	servAddrs atomic.Value
+	// 当前轮询的节点索引，原子递增
+	curIndex uint64
 
 	// 观察主体
 	conf LoadBalanceConf
+	// 写锁：串行化 Add 与 Update
+	mux sync.Mutex
 }
 
 func (r *RoundRobinBalance) Add(params ...string) error {
 	if len(params) == 0 {
 		return errors.New("params length at least 1")
 	}
-	for i := 0; i < len(params); i++ {
-		r.servAddrs = append(r.servAddrs, params[i])
-	}
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	old := r.nodes()
+	servAddrs := make([]string, 0, len(old)+len(params))
+	servAddrs = append(servAddrs, old...)
+	servAddrs = append(servAddrs, params...)
+	r.servAddrs.Store(servAddrs)
 	return nil
 }
 
 func (r *RoundRobinBalance) Get(key string) (string, error) {
-	return r.Next(), nil
+	addr := r.Next()
+	if addr == "" {
+		return "", errors.New("node list is empty")
+	}
+	return addr, nil
+}
+
+// Available 主机是否在当前服务器列表中
+func (r *RoundRobinBalance) Available(addr string) bool {
+	for _, a := range r.nodes() {
+		if a == addr {
+			return true
+		}
+	}
+	return false
 }
 
 func (r *RoundRobinBalance) SetConf(conf LoadBalanceConf) {
@@ -35,33 +58,32 @@ func (r *RoundRobinBalance) SetConf(conf LoadBalanceConf) {
 }
 
 func (r *RoundRobinBalance) Next() string {
-	lens := len(r.servAddrs)
+	servAddrs := r.nodes()
+	lens := len(servAddrs)
 	if lens == 0 {
 		return ""
 	}
 
-	//if r.curIndex >= lens {
-	//	r.curIndex = 0
-	//}
-	addr := r.servAddrs[r.curIndex]
-	//r.curIndex++
-	r.curIndex = (r.curIndex + 1) % lens
-	return addr
+	index := atomic.AddUint64(&r.curIndex, 1) - 1
+	return servAddrs[index%uint64(lens)]
 }
 
 func (r *RoundRobinBalance) Update() {
-	if conf, ok := r.conf.(*LoadBalanceZkConf); ok {
+	if conf := r.conf; conf != nil {
 		fmt.Println("Update get conf:", conf.GetConf())
-		r.servAddrs = []string{}
+		servAddrs := []string{}
 		for _, ip := range conf.GetConf() {
-			r.Add(strings.Split(ip, ",")...)
+			// 格式："addr,weight"，轮询只使用地址
+			servAddrs = append(servAddrs, strings.Split(ip, ",")[0])
 		}
+		r.mux.Lock()
+		r.servAddrs.Store(servAddrs)
+		r.mux.Unlock()
 	}
-	//if conf, ok := r.conf.(*LoadBalanceCheckConf); ok {
-	//	fmt.Println("Update get conf:", conf.GetConf())
-	//	r.servAddrs = nil
-	//	for _, ip := range conf.GetConf() {
-	//		r.Add(strings.Split(ip, ",")...)
-	//	}
-	//}
+}
+
+// nodes 获取当前服务器列表快照，只读
+func (r *RoundRobinBalance) nodes() []string {
+	servAddrs, _ := r.servAddrs.Load().([]string)
+	return servAddrs
 }
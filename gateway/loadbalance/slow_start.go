@@ -0,0 +1,78 @@
+package loadbalance
+
+import (
+	"math"
+	"time"
+)
+
+const (
+	// 默认最小权重百分比：预热开始时，新主机至少分到 10% 的权重
+	defaultSlowStartMinPercent = 10
+	// 慢启动开启时，整数权重放大的倍数，避免权重较小时预热比例被取整吞掉
+	slowStartWeightScale = 100
+)
+
+// SlowStart 新上线主机的慢启动（预热）配置
+// 服务发现新增的主机，有效权重在 Window 时间内从最小权重逐渐增长到完整权重：
+//	factor = max(MinWeightPercent/100, (已上线时长/Window)^(1/Aggression))
+// Aggression 为 1 时线性增长；大于 1 时前期增长更快；小于 1 时前期增长更慢
+// 主机从服务列表中移除后再次加入，重新预热
+type SlowStart struct {
+	// 预热时长，<= 0 表示不预热
+	Window time.Duration
+	// 预热曲线，<= 0 时按 1（线性）处理
+	Aggression float64
+	// 最小权重百分比，<= 0 时使用默认值
+	MinWeightPercent int
+}
+
+// SlowStarter 可选接口，支持新主机慢启动的负载均衡器实现此接口
+type SlowStarter interface {
+	SetSlowStart(s *SlowStart)
+}
+
+// SetSlowStart 为负载均衡器设置慢启动，s 为 nil 时关闭；未实现 SlowStarter 接口则忽略
+func SetSlowStart(lb LoadBalance, s *SlowStart) {
+	if ss, ok := lb.(SlowStarter); ok {
+		ss.SetSlowStart(s)
+	}
+}
+
+// factor 主机当前的权重比例，取值 (0, 1]
+// addedAt 为零值表示主机不需要预热（初始服务列表、手动 Add 的主机）
+func (s *SlowStart) factor(addedAt, now time.Time) float64 {
+	if s == nil || s.Window <= 0 || addedAt.IsZero() {
+		return 1
+	}
+	elapsed := now.Sub(addedAt)
+	if elapsed >= s.Window {
+		return 1
+	}
+	aggression := s.Aggression
+	if aggression <= 0 {
+		aggression = 1
+	}
+	minPercent := s.MinWeightPercent
+	if minPercent <= 0 {
+		minPercent = defaultSlowStartMinPercent
+	}
+	minFactor := math.Min(float64(minPercent)/100, 1)
+	f := math.Pow(float64(elapsed)/float64(s.Window), 1/aggression)
+	return math.Max(f, minFactor)
+}
+
+// weight 按预热比例计算整数权重，开启慢启动时权重统一放大 slowStartWeightScale 倍
+// 正权重至少为 1，保证预热中的主机仍然可以被选中
+func (s *SlowStart) weight(weight int, addedAt, now time.Time) int {
+	if s == nil || s.Window <= 0 {
+		return weight
+	}
+	if weight <= 0 {
+		return weight * slowStartWeightScale
+	}
+	w := int(float64(weight*slowStartWeightScale) * s.factor(addedAt, now))
+	if w < 1 {
+		w = 1
+	}
+	return w
+}
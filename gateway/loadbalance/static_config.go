@@ -0,0 +1,61 @@
+package loadbalance
+
+import (
+	"fmt"
+	"sync"
+)
+
+// LoadBalanceStaticConf 静态负载均衡配置（具体主体）
+// 服务器列表来自配置文件、DNS 解析结果等外部来源，通过 UpdateConf 手动更新
+type LoadBalanceStaticConf struct {
+	observers    []Observer        // 观察者列表
+	confIpWeight map[string]string // IP与权重的映射表：IP -> weight
+	activeList   []string          // 可用主机列表
+	format       string            // 格式化
+
+	mux sync.RWMutex
+}
+
+// NewLoadBalanceStaticConf 创建静态负载均衡配置，conf 中的所有主机默认可用
+func NewLoadBalanceStaticConf(format string, conf map[string]string) *LoadBalanceStaticConf {
+	aList := []string{}
+	for item := range conf {
+		aList = append(aList, item)
+	}
+	return &LoadBalanceStaticConf{format: format, activeList: aList, confIpWeight: conf}
+}
+
+func (s *LoadBalanceStaticConf) Attach(o Observer) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.observers = append(s.observers, o)
+}
+
+func (s *LoadBalanceStaticConf) GetConf() []string {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	confList := []string{}
+	for _, ip := range s.activeList {
+		weight, ok := s.confIpWeight[ip]
+		if !ok {
+			weight = "50" //默认weight
+		}
+		confList = append(confList, fmt.Sprintf(s.format, ip)+","+weight)
+	}
+	return confList
+}
+
+// WatchConf 静态配置没有变化来源，无需监听
+func (s *LoadBalanceStaticConf) WatchConf() {
+}
+
+// UpdateConf 更新可用主机列表，通知所有观察者
+func (s *LoadBalanceStaticConf) UpdateConf(conf []string) {
+	s.mux.Lock()
+	s.activeList = conf
+	observers := append([]Observer{}, s.observers...)
+	s.mux.Unlock()
+	for _, obs := range observers {
+		obs.Update()
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -21,8 +22,15 @@ type WeightRoundRobinBalance struct {
 	// 当前轮询的节点索引
 	curIndex int
 
+	// 慢启动配置，nil 表示不预热
+	slowStart *SlowStart
+
 	// 观察主体
 	conf LoadBalanceConf
+	// 互斥锁：与其他负载均衡器不同，平滑加权轮询每次选择都要修改所有节点的当前权重，
+	// 选择本身就是写操作，无法用只读的写时复制快照实现，因此 Next 仍然加锁
+	// Update 先生成新的节点列表，再在锁内整体替换，仍在列表中的主机保留当前权重、有效权重与失败记录
+	mux sync.Mutex
 }
 
 // node 每个服务器节点有不同的权重，并且在每一轮访问后可能会发生变化
@@ -52,21 +60,37 @@ type node struct {
 	failTimeout time.Duration
 	// 失败时间点，按时间正序排列，只保留 failTimeout 时间内的记录
 	failTimes []time.Time
+
+	// 服务发现新增主机的上线时间，用于慢启动；零值表示不需要预热
+	addedAt time.Time
 }
 
 // Add 添加带权重的服务器主机
 //
 // 格式："host:port", "weight", "host:port", "weight", "host:port", "weight"...
 func (r *WeightRoundRobinBalance) Add(params ...string) error {
+	nodes, err := newWeightNodes(params...)
+	if err != nil {
+		return err
+	}
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	r.servAddrs = append(r.servAddrs, nodes...)
+	return nil
+}
+
+// newWeightNodes 解析带权重的服务器主机列表
+func newWeightNodes(params ...string) ([]*node, error) {
 	length := len(params)
 	if length == 0 || length%2 != 0 {
-		return errors.New("params' length must be 2 or multiple of 2")
+		return nil, errors.New("params' length must be 2 or multiple of 2")
 	}
+	nodes := make([]*node, 0, length/2)
 	for i := 0; i < length; i += 2 {
 		addr := params[i]
 		weight, err := strconv.ParseInt(params[i+1], 10, 32)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		// 默认权重为1
 		if weight <= 0 {
@@ -79,9 +103,9 @@ func (r *WeightRoundRobinBalance) Add(params ...string) error {
 			maxFails:        maxFails,
 			failTimeout:     failTimeout,
 		}
-		r.servAddrs = append(r.servAddrs, n)
+		nodes = append(nodes, n)
 	}
-	return nil
+	return nodes, nil
 }
 
 // Next 获取下一个服务器地址：找到权重最大的服务器
@@ -98,7 +122,12 @@ func (r *WeightRoundRobinBalance) Add(params ...string) error {
 // 	2.循环计算每个服务器的权重：临时权重 + 有效权重，选择最大的临时权重节点
 // 	3.记录所有有效权重之和：effectiveTotal
 // 	4.对选中节点进行降权
+//
+// 开启慢启动时，预热中的节点按预热比例降低有效权重
 func (r *WeightRoundRobinBalance) Next() (string, error) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	now := time.Now()
 	var index = 0
 	// 所有节点的有效权重之和（作为降权参数）
 	var effectiveTotal = 0
@@ -120,13 +149,14 @@ func (r *WeightRoundRobinBalance) Next() (string, error) {
 			}
 		}
 
-		w.currentWeight += w.effectiveWeight
+		effectiveWeight := r.slowStart.weight(w.effectiveWeight, w.addedAt, now)
+		w.currentWeight += effectiveWeight
 		if maxNode == nil || w.currentWeight > maxNode.currentWeight {
 			maxNode = w
 			index = i
 		}
 		// 	3.记录所有有效权重之和：effectiveTotal
-		effectiveTotal += w.effectiveWeight
+		effectiveTotal += effectiveWeight
 	}
 	if maxNode == nil {
 		// 服务器列表为空，返回error
@@ -142,28 +172,78 @@ func (r *WeightRoundRobinBalance) Get(key string) (string, error) {
 	return r.Next()
 }
 
+// Available 主机是否在当前服务器列表中，并且不在小黑屋
+func (r *WeightRoundRobinBalance) Available(addr string) bool {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	for _, w := range r.servAddrs {
+		if w.addr == addr {
+			refreshErrRecords(w)
+			return maxFails-len(w.failTimes) > 0
+		}
+	}
+	return false
+}
+
 func (r *WeightRoundRobinBalance) SetConf(conf LoadBalanceConf) {
 	r.conf = conf
 }
 
+// SetSlowStart 设置慢启动，服务发现新增的主机逐渐增加权重
+func (r *WeightRoundRobinBalance) SetSlowStart(s *SlowStart) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	r.slowStart = s
+}
+
+// Update 更新服务器列表
+// 新增的主机记录上线时间用于慢启动，首次加载的服务列表不需要预热
 func (r *WeightRoundRobinBalance) Update() {
-	if conf, ok := r.conf.(*LoadBalanceZkConf); ok {
+	if conf := r.conf; conf != nil {
 		fmt.Println("WeightRoundRobinBalance get conf:", conf.GetConf())
-		r.servAddrs = nil
+		servAddrs := []*node{}
 		for _, ip := range conf.GetConf() {
-			r.Add(strings.Split(ip, ",")...)
+			nodes, err := newWeightNodes(strings.Split(ip, ",")...)
+			if err != nil {
+				continue
+			}
+			servAddrs = append(servAddrs, nodes...)
+		}
+		now := time.Now()
+		r.mux.Lock()
+		old := map[string]*node{}
+		for _, n := range r.servAddrs {
+			old[n.addr] = n
 		}
+		for _, n := range servAddrs {
+			if o, ok := old[n.addr]; ok {
+				n.keep(o)
+			} else if len(r.servAddrs) > 0 {
+				n.addedAt = now
+			}
+		}
+		r.servAddrs = servAddrs
+		r.curIndex = 0
+		r.mux.Unlock()
+	}
+}
+
+// keep 保留原节点的运行时状态：健康检查、管理接口触发的更新不会让故障节点立即恢复全部权重
+// 权重变化时有效权重按差值调整，不超过新的权重
+func (n *node) keep(o *node) {
+	n.currentWeight = o.currentWeight
+	n.effectiveWeight = o.effectiveWeight + n.weight - o.weight
+	if n.effectiveWeight > n.weight {
+		n.effectiveWeight = n.weight
 	}
-	//if conf, ok := r.conf.(*LoadBalanceCheckConf); ok {
-	//	fmt.Println("WeightRoundRobinBalance get conf:", conf.GetConf())
-	//	r.servAddrs = nil
-	//	for _, ip := range conf.GetConf() {
-	//		r.Add(strings.Split(ip, ",")...)
-	//	}
-	//}
+	n.maxFails = o.maxFails
+	n.failTimes = o.failTimes
+	n.addedAt = o.addedAt
 }
 
 func (r *WeightRoundRobinBalance) Callback(addr string, flag bool) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
 	for i := 0; i < len(r.servAddrs); i++ {
 		w := r.servAddrs[i]
 		if w.addr == addr {
@@ -190,6 +270,11 @@ func (r *WeightRoundRobinBalance) Callback(addr string, flag bool) {
 	}
 }
 
+// Report 代理上报请求结果，驱动 Callback 的失败计数
+func (r *WeightRoundRobinBalance) Report(addr string, err error) {
+	r.Callback(addr, err == nil)
+}
+
 // refreshErrRecords 刷新错误记录，把过去超过 failTimeout 的错误记录删除
 // 过滤掉数组中超期的错误记录
 // 数组中错误记录按从小到大排序，越靠前超期可能性越大
@@ -7,6 +7,7 @@ import (
 	"log"
 	"net"
 	"net/http"
+	"sort"
 )
 
 // ConfCircuitBreaker 配置 hystrix common.
@@ -77,3 +78,41 @@ func OpenStream(host string) {
 		log.Fatal(http.ListenAndServe(host, hystrixStreamHandler))
 	}()
 }
+
+// CircuitState 熔断器当前状态与配置
+type CircuitState struct {
+	Name                   string `json:"name"`
+	Open                   bool   `json:"open"`                     // 是否已熔断
+	Timeout                int64  `json:"timeout"`                  // 单次请求超时时间（ms）
+	MaxConcurrentRequests  int    `json:"max_concurrent_requests"`  // 最大并发量
+	SleepWindow            int64  `json:"sleep_window"`             // 熔断后多久尝试恢复（ms）
+	RequestVolumeThreshold uint64 `json:"request_volume_threshold"` // 验证熔断的请求数量
+	ErrorPercentThreshold  int    `json:"error_percent_threshold"`  // 验证熔断的错误百分比
+}
+
+// CircuitStates 获取所有已配置熔断器的状态，按名称排序
+func CircuitStates() []CircuitState {
+	settings := hystrix.GetCircuitSettings()
+	names := make([]string, 0, len(settings))
+	for name := range settings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	states := make([]CircuitState, 0, len(names))
+	for _, name := range names {
+		s := settings[name]
+		state := CircuitState{
+			Name:                   name,
+			Timeout:                s.Timeout.Milliseconds(),
+			MaxConcurrentRequests:  s.MaxConcurrentRequests,
+			SleepWindow:            s.SleepWindow.Milliseconds(),
+			RequestVolumeThreshold: s.RequestVolumeThreshold,
+			ErrorPercentThreshold:  s.ErrorPercentThreshold,
+		}
+		if cb, _, err := hystrix.GetCircuit(name); err == nil {
+			state.Open = cb.IsOpen()
+		}
+		states = append(states, state)
+	}
+	return states
+}
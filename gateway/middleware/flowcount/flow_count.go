@@ -1,73 +1,74 @@
 package flowcount
 
 import (
-	"fmt"
 	"gateway/middleware/router/tcp"
 	"sync/atomic"
 	"time"
 )
 
+// FlowCountService 单个应用的流量统计，基于 Stats 的滚动窗口
+// 需要按服务、路由、租户、下游主机统计时直接使用 Stats
 type FlowCountService struct {
-	AppID       string        // 应用ID
-	Interval    time.Duration // 采集频率
-	TotalCount  int64         // 当前总共请求数
-	QPS         int64         // QPS
-	Unix        int64         // 上次unix时间戳
-	TickerCount int64         // 当前流量
+	AppID    string        // 应用ID
+	Interval time.Duration // 计算 QPS 的时间范围，最长 1 分钟
+
+	stats      *Stats
+	totalCount int64 // 创建以来的请求数
 }
 
 func NewFlowCountService(appID string, interval time.Duration) (*FlowCountService, error) {
-	reqCounter := &FlowCountService{
-		AppID:       appID,
-		Interval:    interval,
-		QPS:         0,
-		Unix:        0,
-		TickerCount: 0,
-	}
-	go func() {
-		defer func() {
-			if err := recover(); err != nil {
-				fmt.Println(err)
-			}
-		}()
-		ticker := time.NewTicker(interval)
-		for {
-			<-ticker.C
-			// 原子操作
-			tickerCount := atomic.LoadInt64(&reqCounter.TickerCount)
-			atomic.StoreInt64(&reqCounter.TickerCount, 0)
-			nowUnix := time.Now().Unix()
-			if reqCounter.Unix == 0 {
-				reqCounter.Unix = time.Now().Unix()
-				continue
-			}
-			if nowUnix > reqCounter.Unix {
-				reqCounter.QPS = tickerCount / (nowUnix - reqCounter.Unix)
-				reqCounter.TotalCount = reqCounter.TotalCount + tickerCount
-				reqCounter.Unix = time.Now().Unix()
-			}
-		}
-	}()
-	return reqCounter, nil
+	return &FlowCountService{
+		AppID:    appID,
+		Interval: interval,
+		stats:    NewStats(1),
+	}, nil
 }
 
-// Increase 原子增加
+// Increase 记录一次请求
 func (o *FlowCountService) Increase() {
-	go func() {
-		defer func() {
-			if err := recover(); err != nil {
-				fmt.Println(err)
-			}
-		}()
-		atomic.AddInt64(&o.TickerCount, 1)
-	}()
+	atomic.AddInt64(&o.totalCount, 1)
+	o.stats.Record(Sample{Key: StatsKey{Service: o.AppID}})
+}
+
+// TotalCount 创建以来的请求数
+func (o *FlowCountService) TotalCount() int64 {
+	return atomic.LoadInt64(&o.totalCount)
+}
+
+// QPS 最近 Interval 内的平均每秒请求数
+func (o *FlowCountService) QPS() float64 {
+	result, _ := o.stats.Query(StatsQuery{Window: WindowMinute})
+	if len(result) == 0 {
+		return 0
+	}
+	buckets := result[0].Buckets
+	n := int((o.Interval + time.Second - 1) / time.Second)
+	if n < 1 {
+		n = 1
+	}
+	if n > len(buckets) {
+		n = len(buckets)
+	}
+	// 最后一个桶（当前秒）只经过了一部分时间
+	var requests int64
+	for _, b := range buckets[len(buckets)-n:] {
+		requests += b.Requests
+	}
+	elapsed := time.Duration(n-1)*time.Second + time.Duration(o.stats.now().UnixNano()%int64(time.Second))
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(requests) / elapsed.Seconds()
+}
+
+// Stats 底层的流量统计，可以查询最近 1 分钟、1 小时、1 天的明细
+func (o *FlowCountService) Stats() *Stats {
+	return o.stats
 }
 
 func FlowCountMiddleWare(counter *FlowCountService) func(c *tcp.TcpSliceRouteContext) {
 	return func(c *tcp.TcpSliceRouteContext) {
 		counter.Increase()
-		fmt.Println("QPS:", counter.QPS)
-		fmt.Println("TotalCount:", counter.TotalCount)
 		c.Next()
 	}
 }
@@ -32,10 +32,10 @@ func init() {
 }
 
 func (counter *FlowLimiter) GetLimiter(serverName string, qps float64) (*rate.Limiter, error) {
-	for _, item := range counter.FlowLmiterSlice {
-		if item.ServiceName == serverName {
-			return item.Limter, nil
-		}
+	counter.Locker.Lock()
+	defer counter.Locker.Unlock()
+	if item, ok := counter.FlowLmiterMap[serverName]; ok {
+		return item.Limter, nil
 	}
 
 	newLimiter := rate.NewLimiter(rate.Limit(qps), int(qps*3))
@@ -44,8 +44,30 @@ func (counter *FlowLimiter) GetLimiter(serverName string, qps float64) (*rate.Li
 		Limter:      newLimiter,
 	}
 	counter.FlowLmiterSlice = append(counter.FlowLmiterSlice, item)
-	counter.Locker.Lock()
-	defer counter.Locker.Unlock()
 	counter.FlowLmiterMap[serverName] = item
 	return newLimiter, nil
 }
+
+// LimiterState 限流器当前设置
+type LimiterState struct {
+	ServiceName string  `json:"service_name"`
+	Limit       float64 `json:"limit"`  // 每秒请求数
+	Burst       int     `json:"burst"`  // 突发请求数
+	Tokens      float64 `json:"tokens"` // 当前可用令牌数
+}
+
+// States 获取所有限流器的当前设置，按创建顺序排列
+func (counter *FlowLimiter) States() []LimiterState {
+	counter.Locker.RLock()
+	defer counter.Locker.RUnlock()
+	states := make([]LimiterState, 0, len(counter.FlowLmiterSlice))
+	for _, item := range counter.FlowLmiterSlice {
+		states = append(states, LimiterState{
+			ServiceName: item.ServiceName,
+			Limit:       float64(item.Limter.Limit()),
+			Burst:       item.Limter.Burst(),
+			Tokens:      item.Limter.Tokens(),
+		})
+	}
+	return states
+}
@@ -1,27 +1,355 @@
 package flowcount
 
 import (
+	"context"
+	"errors"
 	"github.com/garyburd/redigo/redis"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
-func RedisConfPipeline(pip ...func(c redis.Conn)) error {
-	c, err := redis.Dial("tcp", "127.0.0.1:6379")
+// Redis 客户端
+//
+// 流量统计等功能共用一个带连接池的 RedisClient（DefaultRedis），不再每次调用都新建连接：
+// 	1.Addrs 为地址列表，依次尝试，使用第一个可以连接的主节点（从节点跳过），
+// 	  主从切换后原主节点返回 READONLY、MASTERDOWN 错误，丢弃该连接，重新连接新的主节点；
+// 	  不支持 Redis Cluster 的槽路由，集群需要通过代理访问
+// 	2.MasterName 不为空时 Addrs 为哨兵地址，通过 SENTINEL get-master-addr-by-name 获取主节点
+// 	3.连接失败、超时时标记为不健康并返回错误，调用方降级处理，不会 panic；
+// 	  Health 获取健康状态，用于管理接口
+
+// Redis 默认参数
+const (
+	DefaultRedisAddr        = "127.0.0.1:6379"
+	DefaultRedisPoolSize    = 16
+	DefaultRedisDialTimeout = time.Second
+	DefaultRedisIOTimeout   = time.Second
+	DefaultRedisIdleTimeout = 5 * time.Minute
+)
+
+// RedisConfig Redis 连接参数，零值使用默认参数
+type RedisConfig struct {
+	Addrs        []string      // 节点地址列表，MasterName 不为空时为哨兵地址，默认 DefaultRedisAddr
+	MasterName   string        // 哨兵监控的主节点名称
+	Password     string        // 密码
+	DB           int           // 数据库
+	PoolSize     int           // 最大连接数，默认 DefaultRedisPoolSize
+	DialTimeout  time.Duration // 连接超时，默认 DefaultRedisDialTimeout
+	ReadTimeout  time.Duration // 读超时，默认 DefaultRedisIOTimeout
+	WriteTimeout time.Duration // 写超时，默认 DefaultRedisIOTimeout
+	IdleTimeout  time.Duration // 空闲连接关闭时间，默认 DefaultRedisIdleTimeout
+}
+
+// RedisHealth Redis 健康状态
+type RedisHealth struct {
+	Addr        string    `json:"addr"` // 当前连接的节点
+	Healthy     bool      `json:"healthy"`
+	Error       string    `json:"error,omitempty"` // 不健康时最近一次错误
+	Since       time.Time `json:"since"`           // 健康状态最近一次变化的时间
+	ActiveConns int       `json:"active_conns"`
+	IdleConns   int       `json:"idle_conns"`
+}
+
+// RedisClient 带连接池的 Redis 客户端，并发安全
+type RedisClient struct {
+	conf RedisConfig
+	pool *redis.Pool
+	next uint32 // 下一次从 Addrs 中的哪个地址开始尝试，优先使用上次连接成功的节点
+
+	mu      sync.Mutex
+	addr    string
+	healthy bool
+	lastErr error
+	since   time.Time
+}
+
+// NewRedisClient 创建 Redis 客户端，不会立即连接，第一次使用时才建立连接
+func NewRedisClient(conf RedisConfig) *RedisClient {
+	if len(conf.Addrs) == 0 {
+		conf.Addrs = []string{DefaultRedisAddr}
+	}
+	if conf.PoolSize <= 0 {
+		conf.PoolSize = DefaultRedisPoolSize
+	}
+	if conf.DialTimeout <= 0 {
+		conf.DialTimeout = DefaultRedisDialTimeout
+	}
+	if conf.ReadTimeout <= 0 {
+		conf.ReadTimeout = DefaultRedisIOTimeout
+	}
+	if conf.WriteTimeout <= 0 {
+		conf.WriteTimeout = DefaultRedisIOTimeout
+	}
+	if conf.IdleTimeout <= 0 {
+		conf.IdleTimeout = DefaultRedisIdleTimeout
+	}
+	r := &RedisClient{conf: conf, healthy: true, since: time.Now()}
+	r.pool = &redis.Pool{
+		MaxIdle:     conf.PoolSize,
+		MaxActive:   conf.PoolSize,
+		IdleTimeout: conf.IdleTimeout,
+		Wait:        true,
+		Dial:        r.dial,
+		TestOnBorrow: func(c redis.Conn, t time.Time) error {
+			if time.Since(t) < time.Minute {
+				return nil
+			}
+			_, err := c.Do("PING")
+			return err
+		},
+	}
+	return r
+}
+
+// Config 客户端使用的连接参数（已填充默认值）
+func (r *RedisClient) Config() RedisConfig {
+	return r.conf
+}
+
+// Pool 连接池，用于需要直接使用连接的场景，如 timerate.RedisLimiter
+func (r *RedisClient) Pool() *redis.Pool {
+	return r.pool
+}
+
+// dial 依次尝试所有地址，返回第一个主节点的连接
+func (r *RedisClient) dial() (redis.Conn, error) {
+	addrs := r.conf.Addrs
+	start := int(atomic.LoadUint32(&r.next))
+	var lastErr error
+	for i := range addrs {
+		index := (start + i) % len(addrs)
+		c, addr, err := r.dialAddr(addrs[index])
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		atomic.StoreUint32(&r.next, uint32(index))
+		r.mu.Lock()
+		r.addr = addr
+		r.mu.Unlock()
+		return &masterConn{Conn: c}, nil
+	}
+	r.record(lastErr)
+	return nil, lastErr
+}
+
+func (r *RedisClient) dialAddr(addr string) (redis.Conn, string, error) {
+	if r.conf.MasterName != "" {
+		master, err := r.sentinelMaster(addr)
+		if err != nil {
+			return nil, "", err
+		}
+		addr = master
+	}
+	c, err := redis.Dial("tcp", addr,
+		redis.DialConnectTimeout(r.conf.DialTimeout),
+		redis.DialReadTimeout(r.conf.ReadTimeout),
+		redis.DialWriteTimeout(r.conf.WriteTimeout),
+		redis.DialPassword(r.conf.Password),
+		redis.DialDatabase(r.conf.DB))
+	if err != nil {
+		return nil, "", err
+	}
+	// 多个节点时跳过从节点：主从切换后原主节点变为从节点，写入会失败
+	if len(r.conf.Addrs) > 1 || r.conf.MasterName != "" {
+		role, err := redis.Values(c.Do("ROLE"))
+		if err == nil && len(role) > 0 {
+			if name, _ := redis.String(role[0], nil); name != "master" {
+				c.Close()
+				return nil, "", errors.New("redis " + addr + " is " + name + ", not master")
+			}
+		}
+	}
+	return c, addr, nil
+}
+
+// masterConn 主节点连接：返回 READONLY、MASTERDOWN 错误时（主从切换后原主节点变为从节点）标记连接失效，
+// 连接池关闭失效的连接，之后重新通过 dial 连接主节点
+type masterConn struct {
+	redis.Conn
+	err error
+}
+
+func (c *masterConn) Do(commandName string, args ...interface{}) (interface{}, error) {
+	reply, err := c.Conn.Do(commandName, args...)
+	c.check(err)
+	return reply, err
+}
+
+func (c *masterConn) Receive() (interface{}, error) {
+	reply, err := c.Conn.Receive()
+	c.check(err)
+	return reply, err
+}
+
+func (c *masterConn) Err() error {
+	if c.err != nil {
+		return c.err
+	}
+	return c.Conn.Err()
+}
+
+func (c *masterConn) check(err error) {
+	if notMaster(err) {
+		c.err = err
+	}
+}
+
+// notMaster 是否为节点不再是可写主节点的错误
+func notMaster(err error) bool {
+	e, ok := err.(redis.Error)
+	return ok && (strings.HasPrefix(string(e), "READONLY") || strings.HasPrefix(string(e), "MASTERDOWN"))
+}
+
+// sentinelMaster 从哨兵获取主节点地址
+func (r *RedisClient) sentinelMaster(sentinel string) (string, error) {
+	c, err := redis.Dial("tcp", sentinel,
+		redis.DialConnectTimeout(r.conf.DialTimeout),
+		redis.DialReadTimeout(r.conf.ReadTimeout),
+		redis.DialWriteTimeout(r.conf.WriteTimeout))
+	if err != nil {
+		return "", err
+	}
+	defer c.Close()
+	master, err := redis.Strings(c.Do("SENTINEL", "get-master-addr-by-name", r.conf.MasterName))
+	if err != nil {
+		return "", err
+	}
+	if len(master) != 2 {
+		return "", errors.New("sentinel " + sentinel + ": unknown master " + r.conf.MasterName)
+	}
+	return net.JoinHostPort(master[0], master[1]), nil
+}
+
+// get 从连接池获取连接，连接池耗尽时最多等待一个连接超时时间
+func (r *RedisClient) get() (redis.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), r.conf.DialTimeout)
+	defer cancel()
+	return r.pool.GetContext(ctx)
+}
+
+// Do 执行一条命令
+func (r *RedisClient) Do(commandName string, args ...interface{}) (interface{}, error) {
+	c, err := r.get()
 	if err != nil {
+		r.record(err)
+		return nil, err
+	}
+	defer c.Close()
+	reply, err := c.Do(commandName, args...)
+	r.record(err)
+	return reply, err
+}
+
+// Pipeline 在一个连接上批量发送命令（pip 中调用 Send），返回第一个错误
+func (r *RedisClient) Pipeline(pip ...func(c redis.Conn)) error {
+	c, err := r.get()
+	if err != nil {
+		r.record(err)
 		return err
 	}
 	defer c.Close()
 	for _, f := range pip {
 		f(c)
 	}
-	c.Flush()
-	return nil
+	// 空命令：发送缓冲区中的命令并读取所有响应
+	_, err = c.Do("")
+	r.record(err)
+	return err
 }
 
-func RedisConfDo(commandName string, args ...interface{}) (interface{}, error) {
-	c, err := redis.Dial("tcp", "127.0.0.1:6379")
+// Eval 执行 Lua 脚本：先使用 EVALSHA，脚本未加载时使用 EVAL
+func (r *RedisClient) Eval(script *redis.Script, keysAndArgs ...interface{}) (interface{}, error) {
+	c, err := r.get()
 	if err != nil {
+		r.record(err)
 		return nil, err
 	}
 	defer c.Close()
-	return c.Do(commandName, args...)
+	reply, err := script.Do(c, keysAndArgs...)
+	r.record(err)
+	return reply, err
+}
+
+// Ping 检查 Redis 是否可用
+func (r *RedisClient) Ping() error {
+	_, err := r.Do("PING")
+	return err
+}
+
+// record 记录调用结果：连接、超时等错误标记为不健康，命令本身的错误（redis.Error）不影响健康状态
+// READONLY、MASTERDOWN 虽然是 redis.Error，但表示节点不可写，同样标记为不健康
+func (r *RedisClient) record(err error) {
+	if _, ok := err.(redis.Error); ok && !notMaster(err) {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	healthy := err == nil
+	if healthy != r.healthy {
+		r.since = time.Now()
+		if healthy {
+			log.Printf("redis %s recovered\n", r.addr)
+		} else {
+			log.Printf("redis unavailable: %v\n", err)
+		}
+	}
+	r.healthy = healthy
+	r.lastErr = err
+}
+
+// Health 获取健康状态
+func (r *RedisClient) Health() RedisHealth {
+	stats := r.pool.Stats()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	h := RedisHealth{
+		Addr:        r.addr,
+		Healthy:     r.healthy,
+		Since:       r.since,
+		ActiveConns: stats.ActiveCount,
+		IdleConns:   stats.IdleCount,
+	}
+	if h.Addr == "" {
+		h.Addr = r.conf.Addrs[0]
+	}
+	if r.lastErr != nil {
+		h.Error = r.lastErr.Error()
+	}
+	return h
+}
+
+// Close 关闭连接池
+func (r *RedisClient) Close() error {
+	return r.pool.Close()
+}
+
+var defaultRedis atomic.Value // *RedisClient
+
+func init() {
+	defaultRedis.Store(NewRedisClient(RedisConfig{}))
+}
+
+// DefaultRedis 流量统计默认使用的 Redis 客户端，默认连接 DefaultRedisAddr
+func DefaultRedis() *RedisClient {
+	return defaultRedis.Load().(*RedisClient)
+}
+
+// SetDefaultRedis 替换默认的 Redis 客户端，返回原客户端，由调用方在不再使用后关闭
+func SetDefaultRedis(r *RedisClient) *RedisClient {
+	return defaultRedis.Swap(r).(*RedisClient)
+}
+
+// RedisConfPipeline 使用默认客户端批量发送命令
+func RedisConfPipeline(pip ...func(c redis.Conn)) error {
+	return DefaultRedis().Pipeline(pip...)
+}
+
+// RedisConfDo 使用默认客户端执行一条命令
+func RedisConfDo(commandName string, args ...interface{}) (interface{}, error) {
+	return DefaultRedis().Do(commandName, args...)
 }
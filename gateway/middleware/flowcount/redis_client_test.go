@@ -0,0 +1,143 @@
+package flowcount
+
+import (
+	"fmt"
+	"gateway/internal/redistest"
+	"github.com/stretchr/testify/assert"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// 连接复用，连接时认证并选择数据库
+func TestRedisClientPool(t *testing.T) {
+	s := redistest.NewServer(t, "master")
+	r := NewRedisClient(RedisConfig{Addrs: []string{s.Addr()}, Password: "secret", DB: 2})
+	defer r.Close()
+	for i := 0; i < 5; i++ {
+		assert.Nil(t, r.Ping())
+	}
+	assert.Equal(t, 1, s.Accepted())
+	assert.Equal(t, []string{"AUTH secret", "SELECT 2", "PING"}, s.Received()[:3])
+
+	h := r.Health()
+	assert.True(t, h.Healthy)
+	assert.Equal(t, s.Addr(), h.Addr)
+	assert.Equal(t, 1, h.IdleConns)
+
+	// 命令本身的错误不影响健康状态
+	_, err := r.Do("UNKNOWN")
+	assert.NotNil(t, err)
+	assert.True(t, r.Health().Healthy)
+}
+
+// 地址列表：跳过无法连接的节点与从节点
+func TestRedisClientFailover(t *testing.T) {
+	replica := redistest.NewServer(t, "slave")
+	master := redistest.NewServer(t, "master")
+	r := NewRedisClient(RedisConfig{Addrs: []string{"127.0.0.1:1", replica.Addr(), master.Addr()}})
+	defer r.Close()
+	assert.Nil(t, r.Ping())
+	assert.Equal(t, master.Addr(), r.Health().Addr)
+	assert.NotContains(t, replica.Received(), "PING")
+}
+
+// 哨兵：获取主节点地址后连接主节点
+func TestRedisClientSentinel(t *testing.T) {
+	master := redistest.NewServer(t, "master")
+	sentinel := redistest.NewServer(t, "sentinel")
+	sentinel.SetMaster(master.Addr())
+
+	r := NewRedisClient(RedisConfig{Addrs: []string{sentinel.Addr()}, MasterName: "mymaster"})
+	defer r.Close()
+	assert.Nil(t, r.Ping())
+	assert.Equal(t, master.Addr(), r.Health().Addr)
+	assert.Contains(t, sentinel.Received(), "SENTINEL get-master-addr-by-name mymaster")
+
+	_, err := NewRedisClient(RedisConfig{Addrs: []string{sentinel.Addr()}, MasterName: "unknown"}).Do("PING")
+	assert.NotNil(t, err)
+}
+
+// Redis 不可用时返回错误、标记为不健康，恢复后自动重连
+func TestRedisClientUnavailable(t *testing.T) {
+	s := redistest.NewServer(t, "master")
+	s.Close()
+	r := NewRedisClient(RedisConfig{Addrs: []string{s.Addr()}, DialTimeout: 100 * time.Millisecond})
+	defer r.Close()
+	assert.NotNil(t, r.Ping())
+	assert.NotNil(t, r.Pipeline())
+	h := r.Health()
+	assert.False(t, h.Healthy)
+	assert.NotEmpty(t, h.Error)
+
+	if err := s.Restart(); err != nil {
+		t.Skip("address reused by another process")
+	}
+	assert.Nil(t, r.Ping())
+	assert.True(t, r.Health().Healthy)
+}
+
+// Redis 不可用时流量统计不会中断，计数留到恢复后上报
+func TestRedisFlowCountUnavailable(t *testing.T) {
+	s := redistest.NewServer(t, "master")
+	client := NewRedisClient(RedisConfig{Addrs: []string{"127.0.0.1:1"}, DialTimeout: 100 * time.Millisecond})
+	counter, err := NewRedisFlowCountServiceWithClient("app", time.Hour, client)
+	assert.Nil(t, err)
+	defer counter.Stop()
+	atomic.AddInt64(&counter.TickerCount, 3)
+	counter.tick()
+	assert.Equal(t, int64(3), atomic.LoadInt64(&counter.TickerCount))
+
+	counter.client = NewRedisClient(RedisConfig{Addrs: []string{s.Addr()}})
+	defer counter.client.Close()
+	counter.tick()
+	assert.Equal(t, int64(0), atomic.LoadInt64(&counter.TickerCount))
+	assert.Equal(t, int64(3), counter.TotalCount())
+	key := fmt.Sprintf("totalcall_%s_app", time.Now().In(CountLocation).Format("2006-01-02"))
+	assert.Equal(t, int64(3), s.Value(key))
+}
+
+// 主从切换：原主节点变为从节点后丢弃已有连接，重新连接新的主节点
+func TestRedisClientRoleChange(t *testing.T) {
+	old := redistest.NewServer(t, "master")
+	master := redistest.NewServer(t, "slave")
+	r := NewRedisClient(RedisConfig{Addrs: []string{old.Addr(), master.Addr()}})
+	defer r.Close()
+	_, err := r.Do("INCRBY", "key", 1)
+	assert.Nil(t, err)
+	assert.Equal(t, old.Addr(), r.Health().Addr)
+
+	old.SetRole("slave")
+	master.SetRole("master")
+	_, err = r.Do("INCRBY", "key", 1)
+	assert.NotNil(t, err)
+	assert.False(t, r.Health().Healthy)
+
+	_, err = r.Do("INCRBY", "key", 1)
+	assert.Nil(t, err)
+	h := r.Health()
+	assert.True(t, h.Healthy)
+	assert.Equal(t, master.Addr(), h.Addr)
+	assert.Equal(t, int64(1), master.Value("key"))
+	assert.Equal(t, 2, old.Accepted())
+}
+
+// 统计协程写入 QPS、TotalCount 时，请求协程并发读取（go test -race）
+func TestRedisFlowCountConcurrent(t *testing.T) {
+	s := redistest.NewServer(t, "master")
+	client := NewRedisClient(RedisConfig{Addrs: []string{s.Addr()}})
+	defer client.Close()
+	counter, err := NewRedisFlowCountServiceWithClient("app", time.Millisecond, client)
+	assert.Nil(t, err)
+	defer counter.Stop()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for counter.TotalCount() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("total count not updated")
+		}
+		counter.Increase()
+		counter.QPS()
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -4,85 +4,139 @@ import (
 	"fmt"
 	router "gateway/middleware/router/http"
 	"github.com/garyburd/redigo/redis"
+	"sync"
 	"sync/atomic"
 	"time"
 )
 
+// CountLocation 按自然日、自然月统计使用的时区，系统缺少时区数据时使用 UTC+8
+var CountLocation = loadLocation("Asia/Chongqing", 8*3600)
+
+func loadLocation(name string, offset int) *time.Location {
+	if loc, err := time.LoadLocation(name); err == nil {
+		return loc
+	}
+	return time.FixedZone(name, offset)
+}
+
+// DailyCountKey 应用当天请求总数的键：totalcall_<日期>_<appID>，如 totalcall_2006-01-02_app
+func DailyCountKey(appID string, t time.Time) string {
+	return fmt.Sprintf("%s_%s_%s", "totalcall", t.In(CountLocation).Format("2006-01-02"), appID)
+}
+
+// MonthlyCountKey 应用当月请求总数的键：totalcall_<月份>_<appID>，如 totalcall_2006-01_app
+func MonthlyCountKey(appID string, t time.Time) string {
+	return fmt.Sprintf("%s_%s_%s", "totalcall", t.In(CountLocation).Format("2006-01"), appID)
+}
+
 type RedisFlowCountService struct {
 	AppID       string
 	Interval    time.Duration
-	QPS         int64
-	Unix        int64
-	TickerCount int64
-	TotalCount  int64
+	TickerCount int64 // 本周期的计数，原子操作
+
+	qps        int64 // 原子操作，由统计协程写入
+	totalCount int64 // 原子操作，由统计协程写入
+	unix       int64 // 上一次计算 QPS 的时间，只由统计协程访问
+
+	client   *RedisClient // 为 nil 时使用 DefaultRedis
+	done     chan struct{}
+	stopOnce sync.Once
 }
 
+// NewRedisFlowCountService 使用默认的 Redis 客户端统计流量，见 DefaultRedis
 func NewRedisFlowCountService(appID string, interval time.Duration) (*RedisFlowCountService, error) {
+	return NewRedisFlowCountServiceWithClient(appID, interval, nil)
+}
+
+// NewRedisFlowCountServiceWithClient 使用指定的 Redis 客户端统计流量
+// Redis 不可用时本地计数留到下一次上报，不会丢失，也不会中断统计
+func NewRedisFlowCountServiceWithClient(appID string, interval time.Duration, client *RedisClient) (*RedisFlowCountService, error) {
 	reqCounter := &RedisFlowCountService{
 		AppID:    appID,
 		Interval: interval,
-		QPS:      0,
-		Unix:     0,
+		client:   client,
+		done:     make(chan struct{}),
 	}
 	go func() {
-		defer func() {
-			if err := recover(); err != nil {
-				fmt.Println(err)
-			}
-		}()
 		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
 		for {
-			<-ticker.C
-			tickerCount := atomic.LoadInt64(&reqCounter.TickerCount) //获取数据
-			atomic.StoreInt64(&reqCounter.TickerCount, 0)            //重置数据
-
-			tl, _ := time.LoadLocation("Asia/Chongqing")
-			today := time.Now().In(tl).Format("2006-01-02")
-			totalAppKey := fmt.Sprintf("%s_%s_%s", "totalcall", today, appID)
-			if err := RedisConfPipeline(func(c redis.Conn) {
-				c.Send("INCRBY", totalAppKey, tickerCount)
-				c.Send("EXPIRE", totalAppKey, 86400)
-			}); err != nil {
-				panic(err)
-			}
-
-			totalCount, err := redis.Int64(RedisConfDo("GET", totalAppKey))
-			if err != nil {
-				panic(err)
-			}
-			nowUnix := time.Now().Unix()
-			if reqCounter.Unix == 0 {
-				reqCounter.Unix = time.Now().Unix()
-				continue
-			}
-			tickerCount = totalCount - reqCounter.TotalCount
-			if nowUnix > reqCounter.Unix {
-				reqCounter.TotalCount = totalCount
-				reqCounter.QPS = tickerCount / (nowUnix - reqCounter.Unix)
-				reqCounter.Unix = time.Now().Unix()
+			select {
+			case <-ticker.C:
+				reqCounter.tick()
+			case <-reqCounter.done:
+				return
 			}
 		}
 	}()
 	return reqCounter, nil
 }
 
+// tick 把本周期的计数累加到 Redis 中当天的总数，并计算 QPS
+func (o *RedisFlowCountService) tick() {
+	client := o.client
+	if client == nil {
+		client = DefaultRedis()
+	}
+	tickerCount := atomic.SwapInt64(&o.TickerCount, 0)
+	totalAppKey := DailyCountKey(o.AppID, time.Now())
+	if err := client.Pipeline(func(c redis.Conn) {
+		c.Send("INCRBY", totalAppKey, tickerCount)
+		c.Send("EXPIRE", totalAppKey, 86400)
+	}); err != nil {
+		atomic.AddInt64(&o.TickerCount, tickerCount)
+		return
+	}
+
+	totalCount, err := redis.Int64(client.Do("GET", totalAppKey))
+	if err != nil {
+		return
+	}
+	nowUnix := time.Now().Unix()
+	if o.unix == 0 {
+		o.unix = nowUnix
+		atomic.StoreInt64(&o.totalCount, totalCount)
+		return
+	}
+	tickerCount = totalCount - atomic.LoadInt64(&o.totalCount)
+	if tickerCount < 0 {
+		// 跨天后重新计数
+		tickerCount = totalCount
+	}
+	if nowUnix > o.unix {
+		atomic.StoreInt64(&o.totalCount, totalCount)
+		atomic.StoreInt64(&o.qps, tickerCount/(nowUnix-o.unix))
+		o.unix = nowUnix
+	}
+}
+
+// QPS 最近一个统计周期的平均每秒请求数
+func (o *RedisFlowCountService) QPS() int64 {
+	return atomic.LoadInt64(&o.qps)
+}
+
+// TotalCount Redis 中当天的请求总数，上一次统计时读取
+func (o *RedisFlowCountService) TotalCount() int64 {
+	return atomic.LoadInt64(&o.totalCount)
+}
+
+// Stop 停止统计
+func (o *RedisFlowCountService) Stop() {
+	o.stopOnce.Do(func() {
+		close(o.done)
+	})
+}
+
 func RedisFlowCountMiddleWare(counter *RedisFlowCountService) func(c *router.SliceRouteContext) {
 	return func(c *router.SliceRouteContext) {
 		counter.Increase()
-		fmt.Println("QPS:", counter.QPS)
-		fmt.Println("TotalCount:", counter.TotalCount)
+		fmt.Println("QPS:", counter.QPS())
+		fmt.Println("TotalCount:", counter.TotalCount())
 		c.Next()
 	}
 }
 
 // Increase 原子增加
 func (o *RedisFlowCountService) Increase() {
-	go func() {
-		defer func() {
-			if err := recover(); err != nil {
-				fmt.Println(err)
-			}
-		}()
-		atomic.AddInt64(&o.TickerCount, 1)
-	}()
+	atomic.AddInt64(&o.TickerCount, 1)
 }
@@ -3,7 +3,7 @@ package flowcount
 import (
 	"gateway/middleware/circuitbreaker"
 	router "gateway/middleware/router/http"
-	proxy "gateway/proxy/http_proxy/http"
+	"gateway/proxy"
 	"log"
 	"net/http"
 	"net/url"
@@ -0,0 +1,403 @@
+package flowcount
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// 多维度流量统计
+//
+// Stats 按 服务、路由、租户、下游主机 记录请求，每个维度组合（StatsKey）保存三个固定大小的滚动窗口：
+// 	minute：最近 1 分钟，60 个 1 秒的桶
+// 	hour：最近 1 小时，60 个 1 分钟的桶
+// 	day：最近 1 天，24 个 1 小时的桶
+// 每个桶记录请求数、状态码分类（1xx-5xx）、请求/响应字节数、耗时直方图（边界见 LatencyBuckets）。
+// 每个维度组合约占用 25KB 内存，组合数超过上限（NewStats 的 maxSeries）时淘汰一天没有请求的组合，
+// 仍然超过时新的组合计入 StatsKey{Service: OtherSeries}。
+//
+// Query 按维度过滤、分组合计，返回窗口内的总计与每个桶的明细（如一天内每小时的请求数）。
+
+// 统计窗口
+const (
+	WindowMinute = "minute"
+	WindowHour   = "hour"
+	WindowDay    = "day"
+)
+
+// DefaultMaxSeries 默认的维度组合数上限
+const DefaultMaxSeries = 1000
+
+// OtherSeries 维度组合数超过上限后，新的组合计入的服务名称
+const OtherSeries = "_other"
+
+// LatencyBuckets 耗时直方图的桶边界，最后一个桶记录超过最大边界的请求
+var LatencyBuckets = []time.Duration{
+	5 * time.Millisecond, 10 * time.Millisecond, 25 * time.Millisecond, 50 * time.Millisecond,
+	100 * time.Millisecond, 250 * time.Millisecond, 500 * time.Millisecond,
+	time.Second, 2500 * time.Millisecond, 5 * time.Second, 10 * time.Second,
+}
+
+// windowSpecs 窗口的桶宽度与桶数量
+var windowSpecs = map[string]struct {
+	width time.Duration
+	size  int
+}{
+	WindowMinute: {time.Second, 60},
+	WindowHour:   {time.Minute, 60},
+	WindowDay:    {time.Hour, 24},
+}
+
+// StatsKey 统计维度，为空表示请求没有该维度（如 tcp 连接没有下游主机）
+type StatsKey struct {
+	Service string `json:"service,omitempty"`
+	Route   string `json:"route,omitempty"`
+	Tenant  string `json:"tenant,omitempty"`
+	Backend string `json:"backend,omitempty"`
+}
+
+// Sample 一次请求（tcp 连接）的统计数据
+type Sample struct {
+	Key      StatsKey
+	Status   int // http 状态码，tcp 连接为 0
+	BytesIn  int64
+	BytesOut int64
+	Latency  time.Duration
+}
+
+// counters 一个桶内的统计
+type counters struct {
+	requests   int64
+	status     [6]int64 // 下标为状态码 / 100，0 为没有状态码（tcp 连接）
+	bytesIn    int64
+	bytesOut   int64
+	latencySum time.Duration
+	latency    [12]int64 // 与 LatencyBuckets 对应，最后一个为超过最大边界的请求数
+}
+
+func (c *counters) add(s *Sample) {
+	c.requests++
+	class := s.Status / 100
+	if class < 0 || class >= len(c.status) {
+		class = 0
+	}
+	c.status[class]++
+	c.bytesIn += s.BytesIn
+	c.bytesOut += s.BytesOut
+	c.latencySum += s.Latency
+	i := sort.Search(len(LatencyBuckets), func(i int) bool { return s.Latency <= LatencyBuckets[i] })
+	c.latency[i]++
+}
+
+func (c *counters) merge(o *counters) {
+	c.requests += o.requests
+	for i := range c.status {
+		c.status[i] += o.status[i]
+	}
+	c.bytesIn += o.bytesIn
+	c.bytesOut += o.bytesOut
+	c.latencySum += o.latencySum
+	for i := range c.latency {
+		c.latency[i] += o.latency[i]
+	}
+}
+
+// ring 滚动窗口：桶按时间序号取模循环使用，序号不一致的桶已经过期
+type ring struct {
+	width   time.Duration
+	buckets []counters
+	index   []int64 // 每个桶当前保存的时间序号（时间 / width）
+}
+
+func newRing(window string) *ring {
+	spec := windowSpecs[window]
+	return &ring{width: spec.width, buckets: make([]counters, spec.size), index: make([]int64, spec.size)}
+}
+
+func (r *ring) add(now time.Time, s *Sample) {
+	idx := now.UnixNano() / int64(r.width)
+	i := int(idx % int64(len(r.buckets)))
+	if r.index[i] != idx {
+		r.buckets[i] = counters{}
+		r.index[i] = idx
+	}
+	r.buckets[i].add(s)
+}
+
+// mergeInto 把窗口内的桶按时间顺序（最早的在前）合计到 dst
+func (r *ring) mergeInto(now time.Time, dst []counters) {
+	idx := now.UnixNano() / int64(r.width)
+	n := int64(len(r.buckets))
+	for j := int64(0); j < n; j++ {
+		want := idx - n + 1 + j
+		i := int(want % n)
+		if r.index[i] == want {
+			dst[j].merge(&r.buckets[i])
+		}
+	}
+}
+
+// series 一个维度组合的统计
+type series struct {
+	mu      sync.Mutex
+	windows map[string]*ring
+	last    time.Time
+}
+
+// Stats 多维度流量统计，并发安全
+type Stats struct {
+	maxSeries int
+	now       func() time.Time
+
+	mu     sync.RWMutex
+	series map[StatsKey]*series
+}
+
+// NewStats 创建流量统计，maxSeries 小于等于 0 时使用 DefaultMaxSeries
+func NewStats(maxSeries int) *Stats {
+	if maxSeries <= 0 {
+		maxSeries = DefaultMaxSeries
+	}
+	return &Stats{maxSeries: maxSeries, now: time.Now, series: map[StatsKey]*series{}}
+}
+
+// Record 记录一次请求
+func (s *Stats) Record(sample Sample) {
+	now := s.now()
+	se := s.get(sample.Key, now)
+	se.mu.Lock()
+	defer se.mu.Unlock()
+	for _, r := range se.windows {
+		r.add(now, &sample)
+	}
+	se.last = now
+}
+
+// get 获取维度组合的统计，不存在时创建
+func (s *Stats) get(key StatsKey, now time.Time) *series {
+	s.mu.RLock()
+	se, ok := s.series[key]
+	s.mu.RUnlock()
+	if ok {
+		return se
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if se, ok := s.series[key]; ok {
+		return se
+	}
+	if len(s.series) >= s.maxSeries {
+		s.evictIdleLocked(now)
+	}
+	if len(s.series) >= s.maxSeries {
+		key = StatsKey{Service: OtherSeries}
+		if se, ok := s.series[key]; ok {
+			return se
+		}
+	}
+	se = &series{windows: map[string]*ring{}}
+	for window := range windowSpecs {
+		se.windows[window] = newRing(window)
+	}
+	s.series[key] = se
+	return se
+}
+
+// evictIdleLocked 淘汰一天内没有请求的维度组合
+func (s *Stats) evictIdleLocked(now time.Time) {
+	for key, se := range s.series {
+		se.mu.Lock()
+		idle := now.Sub(se.last) > 24*time.Hour
+		se.mu.Unlock()
+		if idle {
+			delete(s.series, key)
+		}
+	}
+}
+
+// Len 维度组合数
+func (s *Stats) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.series)
+}
+
+// StatsQuery 查询条件
+type StatsQuery struct {
+	Window string // WindowMinute、WindowHour、WindowDay，默认 WindowMinute
+	// 过滤条件，为空表示不过滤
+	Service string
+	Route   string
+	Tenant  string
+	Backend string
+	// 分组维度：service、route、tenant、backend；为空时所有匹配的请求合计为一组
+	GroupBy []string
+}
+
+// StatsSummary 一段时间内的请求统计
+type StatsSummary struct {
+	Requests   int64            `json:"requests"`
+	QPS        float64          `json:"qps"`
+	Status     map[string]int64 `json:"status"` // 状态码分类的请求数，如 2xx、5xx；tcp 连接计入 none
+	BytesIn    int64            `json:"bytes_in"`
+	BytesOut   int64            `json:"bytes_out"`
+	LatencyAvg float64          `json:"latency_avg_ms"`
+	LatencyP50 float64          `json:"latency_p50_ms"` // 分位数为所在直方图桶的上边界
+	LatencyP90 float64          `json:"latency_p90_ms"`
+	LatencyP99 float64          `json:"latency_p99_ms"`
+	Histogram  []int64          `json:"latency_histogram"` // 与 LatencyBuckets 对应，最后一个为超过最大边界的请求数
+}
+
+// StatsBucket 窗口中一个桶的统计
+type StatsBucket struct {
+	Start time.Time `json:"start"`
+	StatsSummary
+}
+
+// StatsSeries 一个分组的统计：窗口内总计与每个桶的明细，按时间顺序排列
+type StatsSeries struct {
+	Key     StatsKey      `json:"key"`
+	Total   StatsSummary  `json:"total"`
+	Buckets []StatsBucket `json:"buckets"`
+}
+
+// Query 查询统计，结果按请求数从多到少排列
+func (s *Stats) Query(q StatsQuery) ([]StatsSeries, error) {
+	if q.Window == "" {
+		q.Window = WindowMinute
+	}
+	spec, ok := windowSpecs[q.Window]
+	if !ok {
+		return nil, fmt.Errorf("unknown window %q", q.Window)
+	}
+	for _, dim := range q.GroupBy {
+		switch dim {
+		case "service", "route", "tenant", "backend":
+		default:
+			return nil, fmt.Errorf("unknown group by dimension %q", dim)
+		}
+	}
+	now := s.now()
+	groups := map[StatsKey][]counters{}
+	s.mu.RLock()
+	for key, se := range s.series {
+		if !q.match(key) {
+			continue
+		}
+		group := q.group(key)
+		buckets, ok := groups[group]
+		if !ok {
+			buckets = make([]counters, spec.size)
+			groups[group] = buckets
+		}
+		se.mu.Lock()
+		se.windows[q.Window].mergeInto(now, buckets)
+		se.mu.Unlock()
+	}
+	s.mu.RUnlock()
+
+	// 当前的桶只经过了一部分时间
+	current := time.Duration(now.UnixNano() % int64(spec.width))
+	elapsed := time.Duration(spec.size-1)*spec.width + current
+	first := now.Truncate(spec.width).Add(-time.Duration(spec.size-1) * spec.width)
+	result := make([]StatsSeries, 0, len(groups))
+	for key, buckets := range groups {
+		var total counters
+		ss := StatsSeries{Key: key, Buckets: make([]StatsBucket, len(buckets))}
+		for i := range buckets {
+			total.merge(&buckets[i])
+			width := spec.width
+			if i == len(buckets)-1 {
+				width = current
+			}
+			ss.Buckets[i] = StatsBucket{Start: first.Add(time.Duration(i) * spec.width), StatsSummary: buckets[i].summary(width)}
+		}
+		ss.Total = total.summary(elapsed)
+		result = append(result, ss)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Total.Requests != result[j].Total.Requests {
+			return result[i].Total.Requests > result[j].Total.Requests
+		}
+		return fmt.Sprint(result[i].Key) < fmt.Sprint(result[j].Key)
+	})
+	return result, nil
+}
+
+func (q *StatsQuery) match(key StatsKey) bool {
+	return (q.Service == "" || q.Service == key.Service) &&
+		(q.Route == "" || q.Route == key.Route) &&
+		(q.Tenant == "" || q.Tenant == key.Tenant) &&
+		(q.Backend == "" || q.Backend == key.Backend)
+}
+
+// group 分组的键：只保留分组维度
+func (q *StatsQuery) group(key StatsKey) StatsKey {
+	var group StatsKey
+	for _, dim := range q.GroupBy {
+		switch dim {
+		case "service":
+			group.Service = key.Service
+		case "route":
+			group.Route = key.Route
+		case "tenant":
+			group.Tenant = key.Tenant
+		case "backend":
+			group.Backend = key.Backend
+		}
+	}
+	return group
+}
+
+// summary 计算统计结果，elapsed 为统计的时间长度，用于计算 QPS
+func (c *counters) summary(elapsed time.Duration) StatsSummary {
+	s := StatsSummary{
+		Requests:  c.requests,
+		Status:    map[string]int64{},
+		BytesIn:   c.bytesIn,
+		BytesOut:  c.bytesOut,
+		Histogram: append([]int64(nil), c.latency[:]...),
+	}
+	if elapsed > 0 {
+		s.QPS = float64(c.requests) / elapsed.Seconds()
+	}
+	for class, n := range c.status {
+		if n == 0 {
+			continue
+		}
+		if class == 0 {
+			s.Status["none"] = n
+		} else {
+			s.Status[strconv.Itoa(class)+"xx"] = n
+		}
+	}
+	if c.requests > 0 {
+		s.LatencyAvg = milliseconds(c.latencySum / time.Duration(c.requests))
+		s.LatencyP50 = c.percentile(0.5)
+		s.LatencyP90 = c.percentile(0.9)
+		s.LatencyP99 = c.percentile(0.99)
+	}
+	return s
+}
+
+// percentile 耗时分位数（毫秒），超过最大边界时返回最大边界
+func (c *counters) percentile(p float64) float64 {
+	target := int64(float64(c.requests)*p + 0.5)
+	if target < 1 {
+		target = 1
+	}
+	var sum int64
+	for i, n := range c.latency {
+		sum += n
+		if sum >= target && i < len(LatencyBuckets) {
+			return milliseconds(LatencyBuckets[i])
+		}
+	}
+	return milliseconds(LatencyBuckets[len(LatencyBuckets)-1])
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
@@ -0,0 +1,143 @@
+package flowcount
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func newTestStats(maxSeries int, now *time.Time) *Stats {
+	s := NewStats(maxSeries)
+	s.now = func() time.Time { return *now }
+	return s
+}
+
+func query(t *testing.T, s *Stats, q StatsQuery) []StatsSeries {
+	result, err := s.Query(q)
+	assert.Nil(t, err)
+	return result
+}
+
+// 状态码分类、字节数、耗时分位数
+func TestStatsSummary(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	s := newTestStats(0, &now)
+	orders := StatsKey{Service: "orders", Route: "web/orders", Tenant: "acme", Backend: "10.0.0.1:80"}
+	for i := 0; i < 98; i++ {
+		s.Record(Sample{Key: orders, Status: 200, BytesIn: 10, BytesOut: 100, Latency: 20 * time.Millisecond})
+	}
+	s.Record(Sample{Key: orders, Status: 404, Latency: 3 * time.Millisecond})
+	s.Record(Sample{Key: orders, Status: 502, Latency: 20 * time.Second})
+	now = now.Add(500 * time.Millisecond)
+
+	result := query(t, s, StatsQuery{})
+	assert.Equal(t, 1, len(result))
+	total := result[0].Total
+	assert.Equal(t, int64(100), total.Requests)
+	assert.Equal(t, map[string]int64{"2xx": 98, "4xx": 1, "5xx": 1}, total.Status)
+	assert.Equal(t, int64(980), total.BytesIn)
+	assert.Equal(t, int64(9800), total.BytesOut)
+	assert.Equal(t, 25.0, total.LatencyP50)
+	assert.Equal(t, 25.0, total.LatencyP90)
+	assert.Equal(t, 25.0, total.LatencyP99)
+	assert.Equal(t, int64(1), total.Histogram[0])
+	assert.Equal(t, int64(1), total.Histogram[len(LatencyBuckets)])
+	// 窗口内经过了 59.5 秒
+	assert.InDelta(t, 100/59.5, total.QPS, 0.001)
+	assert.Equal(t, 60, len(result[0].Buckets))
+	assert.Equal(t, int64(100), result[0].Buckets[59].Requests)
+	assert.Equal(t, time.Unix(1700000000, 0), result[0].Buckets[59].Start)
+}
+
+// 滚动窗口：过期的桶不再计入，更长的窗口按分钟、小时明细
+func TestStatsWindows(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	s := newTestStats(0, &now)
+	key := StatsKey{Service: "orders"}
+	for i := 0; i < 3; i++ {
+		s.Record(Sample{Key: key, Status: 200})
+	}
+	now = now.Add(2 * time.Minute)
+	s.Record(Sample{Key: key, Status: 200})
+
+	assert.Equal(t, int64(1), query(t, s, StatsQuery{Window: WindowMinute})[0].Total.Requests)
+	hour := query(t, s, StatsQuery{Window: WindowHour})[0]
+	assert.Equal(t, int64(4), hour.Total.Requests)
+	assert.Equal(t, int64(3), hour.Buckets[57].Requests)
+	assert.Equal(t, int64(1), hour.Buckets[59].Requests)
+
+	now = now.Add(2 * time.Hour)
+	assert.Equal(t, int64(0), query(t, s, StatsQuery{Window: WindowMinute})[0].Total.Requests)
+	assert.Equal(t, int64(0), query(t, s, StatsQuery{Window: WindowHour})[0].Total.Requests)
+	day := query(t, s, StatsQuery{Window: WindowDay})[0]
+	assert.Equal(t, int64(4), day.Total.Requests)
+	assert.Equal(t, int64(4), day.Buckets[21].Requests)
+
+	now = now.Add(24 * time.Hour)
+	assert.Equal(t, int64(0), query(t, s, StatsQuery{Window: WindowDay})[0].Total.Requests)
+}
+
+// 按维度过滤、分组
+func TestStatsQuery(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	s := newTestStats(0, &now)
+	record := func(n int, key StatsKey) {
+		for i := 0; i < n; i++ {
+			s.Record(Sample{Key: key, Status: 200})
+		}
+	}
+	record(3, StatsKey{Service: "orders", Route: "web/orders", Tenant: "acme", Backend: "a"})
+	record(2, StatsKey{Service: "orders", Route: "web/orders", Tenant: "acme", Backend: "b"})
+	record(4, StatsKey{Service: "orders", Route: "web/orders", Tenant: "globex", Backend: "a"})
+	record(1, StatsKey{Service: "users", Route: "web/users", Tenant: "acme", Backend: "c"})
+
+	assert.Equal(t, int64(10), query(t, s, StatsQuery{})[0].Total.Requests)
+
+	byTenant := query(t, s, StatsQuery{GroupBy: []string{"tenant"}})
+	assert.Equal(t, 2, len(byTenant))
+	assert.Equal(t, StatsKey{Tenant: "acme"}, byTenant[0].Key)
+	assert.Equal(t, int64(6), byTenant[0].Total.Requests)
+	assert.Equal(t, int64(4), byTenant[1].Total.Requests)
+
+	byBackend := query(t, s, StatsQuery{Service: "orders", GroupBy: []string{"service", "backend"}})
+	assert.Equal(t, []StatsKey{{Service: "orders", Backend: "a"}, {Service: "orders", Backend: "b"}}, []StatsKey{byBackend[0].Key, byBackend[1].Key})
+	assert.Equal(t, int64(7), byBackend[0].Total.Requests)
+
+	assert.Equal(t, 0, len(query(t, s, StatsQuery{Tenant: "initech"})))
+	_, err := s.Query(StatsQuery{Window: "week"})
+	assert.NotNil(t, err)
+	_, err = s.Query(StatsQuery{GroupBy: []string{"method"}})
+	assert.NotNil(t, err)
+}
+
+// 维度组合数上限：淘汰空闲的组合，仍然超过时计入 OtherSeries
+func TestStatsMaxSeries(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	s := newTestStats(2, &now)
+	s.Record(Sample{Key: StatsKey{Tenant: "a"}})
+	s.Record(Sample{Key: StatsKey{Tenant: "b"}})
+	s.Record(Sample{Key: StatsKey{Tenant: "c"}})
+	s.Record(Sample{Key: StatsKey{Tenant: "d"}})
+	result := query(t, s, StatsQuery{Service: OtherSeries})
+	assert.Equal(t, int64(2), result[0].Total.Requests)
+
+	now = now.Add(25 * time.Hour)
+	s.Record(Sample{Key: StatsKey{Tenant: "e"}})
+	assert.Equal(t, 1, s.Len())
+}
+
+func TestFlowCountService(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	counter, _ := NewFlowCountService("app", 2*time.Second)
+	counter.stats.now = func() time.Time { return now }
+	for i := 0; i < 10; i++ {
+		counter.Increase()
+	}
+	now = now.Add(time.Second)
+	for i := 0; i < 5; i++ {
+		counter.Increase()
+	}
+	now = now.Add(500 * time.Millisecond)
+	assert.Equal(t, int64(15), counter.TotalCount())
+	assert.InDelta(t, 15/1.5, counter.QPS(), 0.001)
+}
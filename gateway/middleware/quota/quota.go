@@ -0,0 +1,347 @@
+package quota
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"gateway/middleware/flowcount"
+	sr "gateway/middleware/router/http"
+	"gateway/middleware/timerate"
+	"github.com/garyburd/redigo/redis"
+	"golang.org/x/time/rate"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// 应用鉴权与配额
+//
+// 接入网关的应用（租户）使用 app ID 与密钥访问 API，每个请求依次检查：
+// 	1.鉴权：请求头 X-App-ID、X-App-Secret，缺少或不匹配时返回 401；密钥请求头不会转发到下游
+// 	2.应用已停用、路由不在允许的路由列表中时返回 403
+// 	3.QPS 限制：每个网关实例本地限流，超过时返回 429
+// 	4.日配额、月配额：计数保存在 Redis 中，多个网关实例共用，用完时返回 429 与 Retry-After（到下一个自然日/月）；
+// 	  计数的键与 flowcount.RedisFlowCountService 相同（见 flowcount.DailyCountKey、MonthlyCountKey），
+// 	  同一个应用不要再使用 RedisFlowCountService 统计，否则会重复计数
+// 通过鉴权的请求携带 X-Quota-* 响应头，并在路由上下文中保存 app ID（AppKey）。
+// Redis 不可用时不检查配额、不计数（放行），之后每隔 RetryInterval 重新尝试 Redis。
+
+// 鉴权请求头
+const (
+	AppIDHeader     = "X-App-ID"
+	AppSecretHeader = "X-App-Secret"
+)
+
+// 超过的配额
+const (
+	QuotaDaily   = "daily"
+	QuotaMonthly = "monthly"
+)
+
+// 计数的过期时间：最后一次计数之后保留一个自然日/月，用于查询用量
+const (
+	dailyTTL   = 24 * time.Hour
+	monthlyTTL = 31 * 24 * time.Hour
+)
+
+// quotaScript 检查并增加日、月计数，任一计数达到配额时不增加
+// KEYS[1]：当天计数；KEYS[2]：当月计数；ARGV：日配额、月配额（0 表示不限制）、日计数、月计数过期秒数
+// 返回：{超过的配额（0 未超过，1 日配额，2 月配额）、当天计数、当月计数}
+var quotaScript = redis.NewScript(2, `
+local daily = tonumber(redis.call('GET', KEYS[1]) or '0')
+local monthly = tonumber(redis.call('GET', KEYS[2]) or '0')
+local dailyQuota = tonumber(ARGV[1])
+local monthlyQuota = tonumber(ARGV[2])
+if dailyQuota > 0 and daily >= dailyQuota then
+	return {1, daily, monthly}
+end
+if monthlyQuota > 0 and monthly >= monthlyQuota then
+	return {2, daily, monthly}
+end
+daily = redis.call('INCR', KEYS[1])
+redis.call('EXPIRE', KEYS[1], ARGV[3])
+monthly = redis.call('INCR', KEYS[2])
+redis.call('EXPIRE', KEYS[2], ARGV[4])
+return {0, daily, monthly}
+`)
+
+// App 接入网关的应用
+type App struct {
+	ID     string `json:"app_id"`
+	Secret string `json:"secret,omitempty"`
+	// 允许访问的路由（监听器名称/路由名称），为空时允许所有使用配额中间件的路由
+	Routes       []string `json:"routes,omitempty"`
+	QPS          int      `json:"qps"`           // 每秒请求数，0 表示不限制
+	DailyQuota   int64    `json:"daily_quota"`   // 每个自然日的请求数，0 表示不限制
+	MonthlyQuota int64    `json:"monthly_quota"` // 每个自然月的请求数，0 表示不限制
+	Disabled     bool     `json:"disabled"`
+}
+
+// Validate 校验应用参数
+func (a *App) Validate() error {
+	if a.ID == "" {
+		return errors.New("app_id is required")
+	}
+	if a.QPS < 0 || a.DailyQuota < 0 || a.MonthlyQuota < 0 {
+		return errors.New("qps, daily_quota and monthly_quota must not be negative")
+	}
+	return nil
+}
+
+// Usage 应用的用量
+type Usage struct {
+	Daily   int64 `json:"daily"`   // 当天请求数
+	Monthly int64 `json:"monthly"` // 当月请求数
+}
+
+// Result 配额检查结果
+type Result struct {
+	Allowed  bool
+	Exceeded string // 超过的配额：QuotaDaily、QuotaMonthly
+	Usage           // 本次请求计数之后的用量
+}
+
+// AppKey 路由上下文中保存通过鉴权的 app ID 的键
+type AppKey struct{}
+
+// Manager 应用管理与配额检查，并发安全，运行时可以增删、修改应用
+type Manager struct {
+	RetryInterval time.Duration // Redis 出错后重新尝试的间隔，默认 timerate.DefaultRetryInterval
+
+	client  *flowcount.RedisClient // 为 nil 时使用 flowcount.DefaultRedis
+	now     func() time.Time
+	backoff timerate.RedisBackoff // Redis 不可用时不检查配额
+
+	mu   sync.RWMutex
+	apps map[string]*appState
+}
+
+// appState 应用及其本地限流器
+type appState struct {
+	app     App
+	routes  map[string]bool
+	limiter *rate.Limiter // QPS 为 0 时为 nil
+}
+
+// NewManager 创建应用管理，client 为 nil 时使用 flowcount.DefaultRedis
+func NewManager(client *flowcount.RedisClient) *Manager {
+	return &Manager{
+		RetryInterval: timerate.DefaultRetryInterval,
+		client:        client,
+		now:           time.Now,
+		backoff:       timerate.RedisBackoff{Name: "quota", Fallback: "skip quota check"},
+		apps:          map[string]*appState{},
+	}
+}
+
+// NewSecret 生成随机密钥
+func NewSecret() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Set 新增或替换应用，Secret 为空时生成随机密钥；返回保存的应用
+// 替换时 QPS 没有变化的应用保留本地限流器的状态
+func (m *Manager) Set(app App) (App, error) {
+	if err := app.Validate(); err != nil {
+		return App{}, err
+	}
+	if app.Secret == "" {
+		app.Secret = NewSecret()
+	}
+	app.Routes = append([]string(nil), app.Routes...)
+	state := &appState{app: app, routes: map[string]bool{}}
+	for _, r := range app.Routes {
+		state.routes[r] = true
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if old, ok := m.apps[app.ID]; ok && old.app.QPS == app.QPS {
+		state.limiter = old.limiter
+	} else if app.QPS > 0 {
+		state.limiter = rate.NewLimiter(rate.Limit(app.QPS), app.QPS)
+	}
+	m.apps[app.ID] = state
+	return app, nil
+}
+
+// Get 获取应用
+func (m *Manager) Get(id string) (App, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	state, ok := m.apps[id]
+	if !ok {
+		return App{}, false
+	}
+	return state.app, true
+}
+
+// Apps 所有应用，按 app ID 排序
+func (m *Manager) Apps() []App {
+	m.mu.RLock()
+	apps := make([]App, 0, len(m.apps))
+	for _, state := range m.apps {
+		apps = append(apps, state.app)
+	}
+	m.mu.RUnlock()
+	sort.Slice(apps, func(i, j int) bool {
+		return apps[i].ID < apps[j].ID
+	})
+	return apps
+}
+
+// Delete 删除应用，不存在时返回 false；Redis 中的计数保留到过期
+func (m *Manager) Delete(id string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, ok := m.apps[id]
+	delete(m.apps, id)
+	return ok
+}
+
+func (m *Manager) redis() *flowcount.RedisClient {
+	if m.client != nil {
+		return m.client
+	}
+	return flowcount.DefaultRedis()
+}
+
+// Usage 从 Redis 中读取应用的用量
+func (m *Manager) Usage(id string) (Usage, error) {
+	now := m.now()
+	counts, err := redis.Values(m.redis().Do("MGET", flowcount.DailyCountKey(id, now), flowcount.MonthlyCountKey(id, now)))
+	if err != nil {
+		return Usage{}, err
+	}
+	var usage Usage
+	if len(counts) == 2 {
+		usage.Daily, _ = redis.Int64(counts[0], nil)
+		usage.Monthly, _ = redis.Int64(counts[1], nil)
+	}
+	return usage, nil
+}
+
+// Consume 检查应用的配额并计数一个请求，Redis 出错时返回错误
+func (m *Manager) Consume(app App) (Result, error) {
+	now := m.now()
+	reply, err := redis.Int64s(m.redis().Eval(quotaScript,
+		flowcount.DailyCountKey(app.ID, now), flowcount.MonthlyCountKey(app.ID, now),
+		app.DailyQuota, app.MonthlyQuota, int64(dailyTTL/time.Second), int64(monthlyTTL/time.Second)))
+	if err != nil {
+		return Result{}, err
+	}
+	if len(reply) != 3 {
+		return Result{}, fmt.Errorf("unexpected quota script reply %v", reply)
+	}
+	r := Result{Allowed: reply[0] == 0, Usage: Usage{Daily: reply[1], Monthly: reply[2]}}
+	switch reply[0] {
+	case 1:
+		r.Exceeded = QuotaDaily
+	case 2:
+		r.Exceeded = QuotaMonthly
+	}
+	return r, nil
+}
+
+// consume 检查配额，Redis 不可用时放行，返回的 ok 表示是否检查了配额
+func (m *Manager) consume(app App) (r Result, ok bool) {
+	if !m.backoff.Do(m.now(), m.RetryInterval, func() (err error) {
+		r, err = m.Consume(app)
+		return err
+	}) {
+		return Result{Allowed: true}, false
+	}
+	return r, true
+}
+
+// Degraded 是否因为 Redis 不可用暂停了配额检查
+func (m *Manager) Degraded() bool {
+	return m.backoff.Degraded()
+}
+
+// authenticate 校验 app ID 与密钥
+func (m *Manager) authenticate(id, secret string) (*appState, bool) {
+	m.mu.RLock()
+	state, ok := m.apps[id]
+	m.mu.RUnlock()
+	if !ok || subtle.ConstantTimeCompare([]byte(state.app.Secret), []byte(secret)) != 1 {
+		return nil, false
+	}
+	return state, true
+}
+
+// Middleware 鉴权与配额中间件，route 返回请求匹配的路由名称（监听器名称/路由名称），
+// 为 nil 时不检查应用允许的路由
+func (m *Manager) Middleware(route timerate.KeyFunc) sr.HandlerFunc {
+	return func(c *sr.SliceRouteContext) {
+		id, secret := c.Req.Header.Get(AppIDHeader), c.Req.Header.Get(AppSecretHeader)
+		if id == "" || secret == "" {
+			reject(c, http.StatusUnauthorized, "app credentials required")
+			return
+		}
+		state, ok := m.authenticate(id, secret)
+		if !ok {
+			reject(c, http.StatusUnauthorized, "invalid app credentials")
+			return
+		}
+		c.Req.Header.Del(AppSecretHeader)
+		app := state.app
+		if app.Disabled {
+			reject(c, http.StatusForbidden, "app disabled")
+			return
+		}
+		if route != nil && len(state.routes) > 0 && !state.routes[route(c)] {
+			reject(c, http.StatusForbidden, "route not allowed")
+			return
+		}
+		if state.limiter != nil && !state.limiter.Allow() {
+			c.Rw.Header().Set("Retry-After", "1")
+			reject(c, http.StatusTooManyRequests, "rate limit exceeded")
+			return
+		}
+		r, checked := m.consume(app)
+		if checked {
+			setHeaders(c.Rw.Header(), app, r.Usage)
+		}
+		if !r.Allowed {
+			now := m.now().In(flowcount.CountLocation)
+			reset := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, now.Location())
+			if r.Exceeded == QuotaMonthly {
+				reset = time.Date(now.Year(), now.Month()+1, 1, 0, 0, 0, 0, now.Location())
+			}
+			c.Rw.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(reset.Sub(now).Seconds()))))
+			reject(c, http.StatusTooManyRequests, r.Exceeded+" quota exceeded")
+			return
+		}
+		c.Set(AppKey{}, app.ID)
+		c.Next()
+	}
+}
+
+// setHeaders 设置配额与剩余请求数响应头 X-Quota-{Daily,Monthly}-{Limit,Remaining}，只包含配置了配额的周期
+func setHeaders(header http.Header, app App, usage Usage) {
+	set := func(period string, quota, used int64) {
+		if quota <= 0 {
+			return
+		}
+		remaining := quota - used
+		if remaining < 0 {
+			remaining = 0
+		}
+		header.Set("X-Quota-"+period+"-Limit", strconv.FormatInt(quota, 10))
+		header.Set("X-Quota-"+period+"-Remaining", strconv.FormatInt(remaining, 10))
+	}
+	set("Daily", app.DailyQuota, usage.Daily)
+	set("Monthly", app.MonthlyQuota, usage.Monthly)
+}
+
+func reject(c *sr.SliceRouteContext, status int, msg string) {
+	http.Error(c.Rw, msg, status)
+	c.Abort()
+}
@@ -0,0 +1,157 @@
+package quota
+
+import (
+	"gateway/middleware/flowcount"
+	sr "gateway/middleware/router/http"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// newTestClient 连接 miniredis 的客户端，配额脚本由 miniredis 内置的 Lua 解释器执行
+func newTestClient(t *testing.T) (*miniredis.Miniredis, *flowcount.RedisClient) {
+	s := miniredis.RunT(t)
+	client := flowcount.NewRedisClient(flowcount.RedisConfig{Addrs: []string{s.Addr()}})
+	t.Cleanup(func() { client.Close() })
+	return s, client
+}
+
+func quotaHandler(m *Manager) http.Handler {
+	router := sr.NewSliceRouter()
+	mw := m.Middleware(func(c *sr.SliceRouteContext) string {
+		return "web" + c.RoutePath()
+	})
+	router.Group("/orders").Use(mw)
+	router.Group("/users").Use(mw)
+	return sr.NewSliceRouterHandler(func(c *sr.SliceRouteContext) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			rw.Write([]byte(c.Get(AppKey{}).(string) + " " + req.Header.Get(AppSecretHeader)))
+		})
+	}, router)
+}
+
+func serve(h http.Handler, path, id, secret string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	if id != "" {
+		req.Header.Set(AppIDHeader, id)
+		req.Header.Set(AppSecretHeader, secret)
+	}
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, req)
+	return rw
+}
+
+func TestManager(t *testing.T) {
+	m := NewManager(nil)
+	app, err := m.Set(App{ID: "b"})
+	assert.Nil(t, err)
+	assert.Len(t, app.Secret, 32)
+	_, err = m.Set(App{ID: "a", Secret: "s", DailyQuota: 10})
+	assert.Nil(t, err)
+	_, err = m.Set(App{ID: "c", QPS: -1})
+	assert.NotNil(t, err)
+	_, err = m.Set(App{})
+	assert.NotNil(t, err)
+
+	apps := m.Apps()
+	assert.Equal(t, 2, len(apps))
+	assert.Equal(t, "a", apps[0].ID)
+	got, ok := m.Get("b")
+	assert.True(t, ok)
+	assert.Equal(t, app, got)
+	assert.True(t, m.Delete("b"))
+	assert.False(t, m.Delete("b"))
+	_, ok = m.Get("b")
+	assert.False(t, ok)
+}
+
+// 鉴权、停用、允许的路由、QPS 限制
+func TestQuotaMiddlewareAuth(t *testing.T) {
+	_, client := newTestClient(t)
+	m := NewManager(client)
+	m.Set(App{ID: "acme", Secret: "secret", Routes: []string{"web/orders"}, QPS: 2})
+	h := quotaHandler(m)
+
+	rw := serve(h, "/orders", "", "")
+	assert.Equal(t, http.StatusUnauthorized, rw.Code)
+	rw = serve(h, "/orders", "acme", "wrong")
+	assert.Equal(t, http.StatusUnauthorized, rw.Code)
+	rw = serve(h, "/orders", "globex", "secret")
+	assert.Equal(t, http.StatusUnauthorized, rw.Code)
+
+	// 密钥请求头不会转发到下游
+	rw = serve(h, "/orders", "acme", "secret")
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, "acme ", rw.Body.String())
+	rw = serve(h, "/users", "acme", "secret")
+	assert.Equal(t, http.StatusForbidden, rw.Code)
+	rw = serve(h, "/orders", "acme", "secret")
+	assert.Equal(t, http.StatusOK, rw.Code)
+	rw = serve(h, "/orders", "acme", "secret")
+	assert.Equal(t, http.StatusTooManyRequests, rw.Code)
+	assert.Equal(t, "1", rw.Header().Get("Retry-After"))
+
+	m.Set(App{ID: "acme", Secret: "secret", Disabled: true})
+	rw = serve(h, "/users", "acme", "secret")
+	assert.Equal(t, http.StatusForbidden, rw.Code)
+	m.Set(App{ID: "acme", Secret: "secret"})
+	rw = serve(h, "/users", "acme", "secret")
+	assert.Equal(t, http.StatusOK, rw.Code)
+}
+
+// 日配额、月配额用完时返回 429，Retry-After 为到下一个自然日/月的秒数
+func TestQuotaMiddlewareQuota(t *testing.T) {
+	s, client := newTestClient(t)
+	m := NewManager(client)
+	now := time.Date(2026, 10, 17, 23, 0, 0, 0, flowcount.CountLocation)
+	m.now = func() time.Time { return now }
+	m.Set(App{ID: "acme", Secret: "secret", DailyQuota: 2, MonthlyQuota: 3})
+	h := quotaHandler(m)
+
+	rw := serve(h, "/orders", "acme", "secret")
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, "2", rw.Header().Get("X-Quota-Daily-Limit"))
+	assert.Equal(t, "1", rw.Header().Get("X-Quota-Daily-Remaining"))
+	assert.Equal(t, "2", rw.Header().Get("X-Quota-Monthly-Remaining"))
+	assert.Equal(t, http.StatusOK, serve(h, "/orders", "acme", "secret").Code)
+	rw = serve(h, "/orders", "acme", "secret")
+	assert.Equal(t, http.StatusTooManyRequests, rw.Code)
+	assert.Equal(t, "daily quota exceeded\n", rw.Body.String())
+	assert.Equal(t, "3600", rw.Header().Get("Retry-After"))
+	assert.Equal(t, "0", rw.Header().Get("X-Quota-Daily-Remaining"))
+
+	usage, err := m.Usage("acme")
+	assert.Nil(t, err)
+	assert.Equal(t, Usage{Daily: 2, Monthly: 2}, usage)
+	s.CheckGet(t, "totalcall_2026-10-17_acme", "2")
+	s.CheckGet(t, "totalcall_2026-10_acme", "2")
+	assert.Equal(t, 24*time.Hour, s.TTL("totalcall_2026-10-17_acme"))
+
+	now = now.Add(2 * time.Hour)
+	assert.Equal(t, http.StatusOK, serve(h, "/orders", "acme", "secret").Code)
+	rw = serve(h, "/orders", "acme", "secret")
+	assert.Equal(t, http.StatusTooManyRequests, rw.Code)
+	assert.Equal(t, "monthly quota exceeded\n", rw.Body.String())
+	assert.Equal(t, strconv.Itoa(14*86400-3600), rw.Header().Get("Retry-After"))
+}
+
+// Redis 不可用时放行，不检查配额
+func TestQuotaMiddlewareUnavailable(t *testing.T) {
+	client := flowcount.NewRedisClient(flowcount.RedisConfig{Addrs: []string{"127.0.0.1:1"}, DialTimeout: 100 * time.Millisecond})
+	defer client.Close()
+	m := NewManager(client)
+	m.Set(App{ID: "acme", Secret: "secret", DailyQuota: 1})
+	h := quotaHandler(m)
+	for i := 0; i < 3; i++ {
+		rw := serve(h, "/orders", "acme", "secret")
+		assert.Equal(t, http.StatusOK, rw.Code)
+		assert.Empty(t, rw.Header().Get("X-Quota-Daily-Limit"))
+	}
+	assert.True(t, m.Degraded())
+	_, err := m.Usage("acme")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,73 @@
+package rewrite
+
+import (
+	sr "gateway/middleware/router/http"
+	"gateway/proxy"
+	"regexp"
+	"strings"
+)
+
+// URL 改写中间件
+//
+// 在反向代理（director）之前修改请求路径与 Host 请求头，
+// 代理转发时再与下游地址的路径合并（joinURLPath），例如：
+// 	StripPrefixMiddleware("/api")：/api/orders/1 -> /orders/1
+// 	ReplacePrefixMiddleware("/api/v1", "/v2")：/api/v1/orders -> /v2/orders
+// 	RegexRewriteMiddleware(`^/users/(\d+)/profile$`, "/profile?uid=$1")：/users/7/profile -> /profile?uid=7
+// 	HostRewriteMiddleware("orders.internal")：转发到下游时 Host 请求头为 orders.internal
+
+// StripPrefixMiddleware 去掉请求路径的前缀，去掉后为空时改写为 /
+func StripPrefixMiddleware(prefix string) func(c *sr.SliceRouteContext) {
+	return ReplacePrefixMiddleware(prefix, "")
+}
+
+// ReplacePrefixMiddleware 将请求路径的前缀替换为 replacement，不匹配前缀的请求不做修改
+func ReplacePrefixMiddleware(prefix, replacement string) func(c *sr.SliceRouteContext) {
+	return func(c *sr.SliceRouteContext) {
+		if p := c.Req.URL.Path; strings.HasPrefix(p, prefix) {
+			setPath(c, replacement+p[len(prefix):])
+		}
+		c.Next()
+	}
+}
+
+// RegexRewriteMiddleware 按正则表达式改写请求路径，replacement 中可以使用 $1、${name} 引用捕获组
+// replacement 含有 ? 时，问号之后的部分追加到查询参数中
+// 正则表达式错误属于配置错误，直接 panic
+func RegexRewriteMiddleware(pattern, replacement string) func(c *sr.SliceRouteContext) {
+	re := regexp.MustCompile(pattern)
+	return func(c *sr.SliceRouteContext) {
+		p := c.Req.URL.Path
+		if match := re.FindStringSubmatchIndex(p); match != nil {
+			dst := re.ExpandString(nil, replacement, p, match)
+			rewritten := p[:match[0]] + string(dst) + p[match[1]:]
+			if i := strings.IndexByte(rewritten, '?'); i >= 0 {
+				query := rewritten[i+1:]
+				if c.Req.URL.RawQuery != "" {
+					query += "&" + c.Req.URL.RawQuery
+				}
+				c.Req.URL.RawQuery = query
+				rewritten = rewritten[:i]
+			}
+			setPath(c, rewritten)
+		}
+		c.Next()
+	}
+}
+
+// HostRewriteMiddleware 转发到下游时使用指定的 Host 请求头，而不是下游主机地址
+func HostRewriteMiddleware(host string) func(c *sr.SliceRouteContext) {
+	return func(c *sr.SliceRouteContext) {
+		c.Req = proxy.WithHostOverride(c.Req, host)
+		c.Next()
+	}
+}
+
+// setPath 修改请求路径，清空原始编码路径，由 URL 重新编码
+func setPath(c *sr.SliceRouteContext, path string) {
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	c.Req.URL.Path = path
+	c.Req.URL.RawPath = ""
+}
@@ -0,0 +1,55 @@
+package rewrite
+
+import (
+	"context"
+	"gateway/loadbalance"
+	sr "gateway/middleware/router/http"
+	"gateway/proxy"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// 测试前缀去除、前缀替换、正则改写、Host 改写与反向代理的整合
+func TestURLRewrite(t *testing.T) {
+	rs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Host + " " + r.URL.RequestURI()))
+	}))
+	defer rs.Close()
+	rb := loadbalance.LoadBalanceFactory(loadbalance.LbRoundRobin)
+	rb.Add(rs.URL + "/")
+	rsHost := rs.Listener.Addr().String()
+
+	router := sr.NewSliceRouter()
+	pxy := proxy.NewLoadBalanceReverseProxy(context.Background(), rb)
+	proxyHandler := func(c *sr.SliceRouteContext) {
+		pxy.ServeHTTP(c.Rw, c.Req)
+	}
+	router.Group("/api").Use(StripPrefixMiddleware("/api"), proxyHandler)
+	router.Group("/v1").Use(ReplacePrefixMiddleware("/v1", "/v2"), proxyHandler)
+	router.Group("/users").Use(RegexRewriteMiddleware(`^/users/(\d+)/profile$`, "/profile?uid=$1"), proxyHandler)
+	router.Group("/orders").Use(HostRewriteMiddleware("orders.internal"), proxyHandler)
+	gw := httptest.NewServer(sr.NewSliceRouterHandler(nil, router))
+	defer gw.Close()
+
+	cases := map[string]string{
+		"/api/orders/1":          rsHost + " /orders/1",
+		"/api":                   rsHost + " /",
+		"/v1/orders?page=2":      rsHost + " /v2/orders?page=2",
+		"/users/7/profile?tab=a": rsHost + " /profile?uid=7&tab=a",
+		"/users/7/settings":      rsHost + " /users/7/settings",
+		"/orders/1":              "orders.internal /orders/1",
+	}
+	for uri, want := range cases {
+		resp, err := http.Get(gw.URL + uri)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != want {
+			t.Errorf("%s: want %q, got %q", uri, want, body)
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package http
+
+// 中间件组合
+//
+// 	UseGlobal：全局中间件，在所有路由之前执行，没有匹配的路由时也会执行（如日志、追踪）
+// 	Stack：命名中间件栈，定义一组可复用的中间件（如 auth + 日志 + 限流），可以绑定到多个路由
+// 	UseStack：将命名中间件栈追加到路由的中间件列表中
+//
+// 每个请求执行的中间件顺序：全局中间件 -> 路由中间件（按 Use、UseStack 调用顺序）-> 核心处理器
+
+// UseGlobal 添加全局中间件
+func (g *SliceRouter) UseGlobal(middlewares ...HandlerFunc) *SliceRouter {
+	g.global = append(g.global, middlewares...)
+	return g
+}
+
+// Stack 定义命名中间件栈，同名时追加到已有的栈
+// 需要在 UseStack 之前定义，UseStack 时复制栈中的中间件
+func (g *SliceRouter) Stack(name string, middlewares ...HandlerFunc) *SliceRouter {
+	if g.stacks == nil {
+		g.stacks = map[string][]HandlerFunc{}
+	}
+	g.stacks[name] = append(g.stacks[name], middlewares...)
+	return g
+}
+
+// UseStack 将命名中间件栈添加到路由的中间件列表中
+// 中间件栈未定义属于注册错误，直接 panic
+func (route *sliceRoute) UseStack(names ...string) *sliceRoute {
+	for _, name := range names {
+		stack, ok := route.SliceRouter.stacks[name]
+		if !ok {
+			panic("middleware stack not defined: " + name)
+		}
+		route.Use(stack...)
+	}
+	return route
+}
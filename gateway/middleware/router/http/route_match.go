@@ -0,0 +1,170 @@
+package http
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// 路由匹配条件
+//
+// 路由除了请求路径，还可以限定主机、请求方法、请求头与查询参数，所有条件同时满足才算匹配。
+// 多个路由同时匹配时，按以下优先级选择（依次比较，相同时比较下一项）：
+// 	1.主机：精确主机 > 通配符主机（后缀越长越优先）> 未限定主机
+// 	2.路径：最长前缀匹配，通配参数匹配的部分不计入长度
+// 	3.参数：路径参数越少越优先，即静态路径优先于命名参数，命名参数优先于通配参数
+// 	4.其他条件：限定的方法、请求头、查询参数条件越多越优先
+// 	5.注册顺序：先注册的路由优先
+
+// 主机匹配的优先级
+const (
+	hostMatchAny = iota
+	hostMatchWildcard
+	hostMatchExact
+)
+
+// routeMatch 路由匹配结果，用于比较多个匹配路由的优先级
+type routeMatch struct {
+	hostKind   int // 主机匹配的优先级
+	hostLen    int // 匹配的主机（通配符后缀）长度
+	pathLen    int // 匹配的路径前缀长度
+	paramCount int // 路径参数个数
+	condCount  int // 方法、请求头、查询参数条件个数
+	order      int // 路由注册顺序
+}
+
+// better 比较两个匹配结果，m 的优先级更高时返回 true
+func (m routeMatch) better(o routeMatch) bool {
+	if m.hostKind != o.hostKind {
+		return m.hostKind > o.hostKind
+	}
+	if m.hostLen != o.hostLen {
+		return m.hostLen > o.hostLen
+	}
+	if m.pathLen != o.pathLen {
+		return m.pathLen > o.pathLen
+	}
+	if m.paramCount != o.paramCount {
+		return m.paramCount < o.paramCount
+	}
+	if m.condCount != o.condCount {
+		return m.condCount > o.condCount
+	}
+	return m.order < o.order
+}
+
+// Host 限定请求主机，可以指定多个，满足其一即可
+// 支持通配符：*.example.com 匹配 example.com 的任意子域名，不匹配 example.com 本身
+func (route *sliceRoute) Host(hosts ...string) *sliceRoute {
+	for _, h := range hosts {
+		route.hosts = append(route.hosts, strings.ToLower(h))
+	}
+	return route
+}
+
+// Method 限定请求方法，可以指定多个，满足其一即可
+func (route *sliceRoute) Method(methods ...string) *sliceRoute {
+	for _, m := range methods {
+		route.methods = append(route.methods, strings.ToUpper(m))
+	}
+	return route
+}
+
+// Header 限定请求头，value 为空时只要求请求头存在
+func (route *sliceRoute) Header(key, value string) *sliceRoute {
+	if route.headers == nil {
+		route.headers = map[string]string{}
+	}
+	route.headers[http.CanonicalHeaderKey(key)] = value
+	return route
+}
+
+// Query 限定查询参数，value 为空时只要求参数存在
+func (route *sliceRoute) Query(key, value string) *sliceRoute {
+	if route.queries == nil {
+		route.queries = map[string]string{}
+	}
+	route.queries[key] = value
+	return route
+}
+
+// match 检查请求是否满足路由的主机、请求方法、请求头、查询参数条件，返回匹配结果
+// 路径由路由树匹配，见 route_tree.go
+func (route *sliceRoute) match(req *http.Request) (routeMatch, bool) {
+	m := routeMatch{}
+	// 主机
+	if len(route.hosts) > 0 {
+		kind, length, ok := matchHost(route.hosts, req.Host)
+		if !ok {
+			return m, false
+		}
+		m.hostKind, m.hostLen = kind, length
+	}
+
+	// 请求方法
+	if len(route.methods) > 0 {
+		ok := false
+		for _, method := range route.methods {
+			if method == req.Method {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return m, false
+		}
+		m.condCount++
+	}
+
+	// 请求头
+	for key, value := range route.headers {
+		values, ok := req.Header[key]
+		if !ok || (value != "" && !containsString(values, value)) {
+			return m, false
+		}
+		m.condCount++
+	}
+
+	// 查询参数
+	if len(route.queries) > 0 {
+		query := req.URL.Query()
+		for key, value := range route.queries {
+			values, ok := query[key]
+			if !ok || (value != "" && !containsString(values, value)) {
+				return m, false
+			}
+			m.condCount++
+		}
+	}
+	return m, true
+}
+
+// matchHost 匹配请求主机，忽略端口与大小写
+// 返回匹配优先级最高的结果：精确匹配优先，通配符中后缀最长的优先
+func matchHost(hosts []string, reqHost string) (kind, length int, ok bool) {
+	host := strings.ToLower(reqHost)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	for _, h := range hosts {
+		if h == host {
+			return hostMatchExact, len(h), true
+		}
+		if strings.HasPrefix(h, "*.") {
+			suffix := h[1:]
+			if len(host) > len(suffix) && strings.HasSuffix(host, suffix) && len(suffix) > length {
+				kind, length, ok = hostMatchWildcard, len(suffix), true
+			}
+		}
+	}
+	return
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,203 @@
+package http
+
+import "strings"
+
+// 路由树：压缩前缀树（radix tree），按请求路径查找路由
+//
+// 路由路径支持以下写法：
+// 	/users          静态路径，前缀匹配：同时匹配 /users、/users/1、/users_list
+// 	/users/:id      命名参数，匹配一个路径片段（不含 /），如 /users/1
+// 	/static/*file   通配参数，匹配剩余的全部路径，只能出现在路由路径的最后
+// 参数只能出现在片段开头（紧跟 / 之后），否则按普通字符处理
+//
+// 查找时沿请求路径向下遍历，经过的所有路由都是候选路由（前缀匹配），
+// 再由 NewSliceRouterContext 按匹配条件与优先级选择一个
+
+// Param 路由参数：命名参数或通配参数的名称与值
+type Param struct {
+	Key   string
+	Value string
+}
+
+// Params 路由参数列表，按在路由路径中出现的顺序排列
+type Params []Param
+
+// ByName 获取指定名称的参数值，不存在时返回空字符串
+func (ps Params) ByName(name string) string {
+	for _, p := range ps {
+		if p.Key == name {
+			return p.Value
+		}
+	}
+	return ""
+}
+
+// routeNode 路由树节点
+type routeNode struct {
+	// 静态路径片段，压缩存储
+	path string
+	// 静态子节点，首字符互不相同
+	children []*routeNode
+	// 命名参数子节点
+	param *routeNode
+	// 通配参数子节点
+	catchAll *routeNode
+	// 路由路径在该节点结束的路由，可能有多个（匹配条件不同）
+	routes []*sliceRoute
+}
+
+// routeCandidate 路径匹配的候选路由
+type routeCandidate struct {
+	route   *sliceRoute
+	pathLen int      // 匹配的路径长度，不含通配参数部分
+	values  []string // 参数值，与 route.paramNames 一一对应
+}
+
+// parseRoutePath 解析路由路径，返回参数名列表
+func parseRoutePath(path string) []string {
+	names := []string{}
+	for i := 0; i < len(path); i++ {
+		if !isParamStart(path, i) {
+			continue
+		}
+		end := strings.IndexByte(path[i:], '/')
+		if end < 0 || path[i] == '*' {
+			end = len(path) - i
+		}
+		names = append(names, path[i+1:i+end])
+		i += end - 1
+	}
+	return names
+}
+
+// isParamStart 路由路径第 i 个字符是否是参数的开始
+func isParamStart(path string, i int) bool {
+	return (path[i] == ':' || path[i] == '*') && i > 0 && path[i-1] == '/'
+}
+
+// insert 将路由添加到路由树
+func (n *routeNode) insert(route *sliceRoute) {
+	cur := n
+	path := route.path
+	i, start := 0, 0
+	for i < len(path) {
+		if !isParamStart(path, i) {
+			i++
+			continue
+		}
+		// 参数之前的静态片段
+		if i > start {
+			cur = cur.insertStatic(path[start:i])
+		}
+		if path[i] == '*' {
+			// 通配参数必须是最后一段
+			if cur.catchAll == nil {
+				cur.catchAll = &routeNode{}
+			}
+			cur = cur.catchAll
+			start = len(path)
+			break
+		}
+		if cur.param == nil {
+			cur.param = &routeNode{}
+		}
+		cur = cur.param
+		end := strings.IndexByte(path[i:], '/')
+		if end < 0 {
+			end = len(path) - i
+		}
+		i += end
+		start = i
+	}
+	if start < len(path) {
+		cur = cur.insertStatic(path[start:])
+	}
+	cur.routes = append(cur.routes, route)
+}
+
+// insertStatic 插入静态路径片段，必要时拆分已有节点，返回片段结束处的节点
+func (n *routeNode) insertStatic(path string) *routeNode {
+	cur := n
+	for path != "" {
+		child := cur.staticChild(path[0])
+		if child == nil {
+			child = &routeNode{path: path}
+			cur.children = append(cur.children, child)
+			return child
+		}
+		l := commonPrefixLen(child.path, path)
+		if l < len(child.path) {
+			// 拆分节点：公共前缀保留在原节点，剩余部分下沉为子节点
+			*child = routeNode{
+				path: child.path[:l],
+				children: []*routeNode{{
+					path:     child.path[l:],
+					children: child.children,
+					param:    child.param,
+					catchAll: child.catchAll,
+					routes:   child.routes,
+				}},
+			}
+		}
+		cur = child
+		path = path[l:]
+	}
+	return cur
+}
+
+// staticChild 查找首字符相同的静态子节点
+func (n *routeNode) staticChild(c byte) *routeNode {
+	for _, child := range n.children {
+		if child.path[0] == c {
+			return child
+		}
+	}
+	return nil
+}
+
+// lookup 查找请求路径经过的所有路由
+// path 为剩余未匹配的请求路径，consumed 为已匹配的长度，values 为已匹配的参数值
+func (n *routeNode) lookup(path string, consumed int, values []string, out []routeCandidate) []routeCandidate {
+	for _, r := range n.routes {
+		out = append(out, routeCandidate{route: r, pathLen: consumed, values: values})
+	}
+	// 静态子节点优先
+	if path != "" {
+		if child := n.staticChild(path[0]); child != nil && strings.HasPrefix(path, child.path) {
+			out = child.lookup(path[len(child.path):], consumed+len(child.path), values, out)
+		}
+	}
+	// 命名参数：匹配一个非空的路径片段
+	if n.param != nil {
+		end := strings.IndexByte(path, '/')
+		if end < 0 {
+			end = len(path)
+		}
+		if end > 0 {
+			out = n.param.lookup(path[end:], consumed+end, appendValue(values, path[:end]), out)
+		}
+	}
+	// 通配参数：匹配剩余的全部路径，匹配长度不计入通配部分
+	if n.catchAll != nil {
+		v := appendValue(values, path)
+		for _, r := range n.catchAll.routes {
+			out = append(out, routeCandidate{route: r, pathLen: consumed, values: v})
+		}
+	}
+	return out
+}
+
+// appendValue 复制后追加参数值，不同分支之间互不影响
+func appendValue(values []string, v string) []string {
+	n := make([]string, len(values), len(values)+1)
+	copy(n, values)
+	return append(n, v)
+}
+
+func commonPrefixLen(a, b string) int {
+	i := 0
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+	return i
+}
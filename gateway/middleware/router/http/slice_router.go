@@ -3,12 +3,9 @@ package http
 import (
 	"context"
 	"net/http"
-	"strings"
+	"sync/atomic"
 )
 
-// 最多 63 个中间件
-const AbortIndex int8 = 63
-
 // HandlerFunc 路由处理函数，以列表的形式存在
 type HandlerFunc func(*SliceRouteContext)
 
@@ -16,6 +13,13 @@ type HandlerFunc func(*SliceRouteContext)
 // 每个路由对应一个路径、多个处理器
 type SliceRouter struct {
 	groups []*sliceRoute
+	// 路由树，按请求路径查找路由
+	tree *routeNode
+
+	// 全局中间件，在所有路由的中间件之前执行，见 middleware_stack.go
+	global []HandlerFunc
+	// 命名中间件栈：名称 -> 中间件列表
+	stacks map[string][]HandlerFunc
 }
 
 // sliceRoute 路由
@@ -24,8 +28,17 @@ type sliceRoute struct {
 	// 反向指针，每个路由可以知道属于哪个路由器
 	*SliceRouter
 
-	// 请求路径
+	// 请求路径，支持命名参数与通配参数，见 route_tree.go
 	path string
+	// 路径中的参数名
+	paramNames []string
+	// 注册顺序，优先级相同时先注册的路由优先
+	order int
+	// 匹配条件：主机、请求方法、请求头、查询参数，见 route_match.go
+	hosts   []string
+	methods []string
+	headers map[string]string
+	queries map[string]string
 	// 请求处理器列表
 	handlers []HandlerFunc
 }
@@ -35,7 +48,13 @@ type sliceRoute struct {
 type SliceRouteContext struct {
 	*sliceRoute
 
-	index int8
+	// 当前执行的中间件索引
+	index int
+	// 是否跳出了中间件
+	aborted bool
+
+	// 路由参数：命名参数与通配参数的值
+	Params Params
 
 	Ctx context.Context
 	Req *http.Request
@@ -44,7 +63,7 @@ type SliceRouteContext struct {
 
 // NewSliceRouter 构造路由器实例
 func NewSliceRouter() *SliceRouter {
-	return &SliceRouter{}
+	return &SliceRouter{tree: &routeNode{}}
 }
 
 // Group 根据指定路径构造路由
@@ -54,6 +73,7 @@ func (g *SliceRouter) Group(path string) *sliceRoute {
 	return &sliceRoute{
 		SliceRouter: g, // this
 		path:        path,
+		paramNames:  parseRoutePath(path),
 	}
 }
 
@@ -72,7 +92,12 @@ func (route *sliceRoute) Use(middlewares ...HandlerFunc) *sliceRoute {
 	}
 	if !flag {
 		// 不存在，则添加
+		route.order = len(route.SliceRouter.groups)
 		route.SliceRouter.groups = append(route.SliceRouter.groups, route)
+		if route.SliceRouter.tree == nil {
+			route.SliceRouter.tree = &routeNode{}
+		}
+		route.SliceRouter.tree.insert(route)
 	}
 	return route
 }
@@ -87,18 +112,28 @@ type handler func(*SliceRouteContext) http.Handler
 // 	支持用户自定义处理器
 type SliceRouterHandler struct {
 	h handler
-	// 维护一个方法数组路由器的指针
-	router *SliceRouter
+	// 维护一个方法数组路由器的指针，可以通过 SetRouter 原子替换
+	router atomic.Value // *SliceRouter
 }
 
 // NewSliceRouterHandler 创建 http 服务的处理器
 // 将实现了 http.Handler 接口的实例返回
 func NewSliceRouterHandler(h handler, router *SliceRouter) *SliceRouterHandler {
 	// build http.handler instance with SliceRouter
-	return &SliceRouterHandler{
-		h:      h,
-		router: router,
-	}
+	rh := &SliceRouterHandler{h: h}
+	rh.router.Store(router)
+	return rh
+}
+
+// Router 获取当前使用的路由器
+func (rh *SliceRouterHandler) Router() *SliceRouter {
+	return rh.router.Load().(*SliceRouter)
+}
+
+// SetRouter 原子替换路由器（配置热加载）
+// 替换后到达的请求使用新路由器，处理中的请求仍在原路由器上执行完成
+func (rh *SliceRouterHandler) SetRouter(router *SliceRouter) {
+	rh.router.Store(router)
 }
 
 // ServeHTTP 实现了 http.Handler 接口的方法
@@ -108,40 +143,55 @@ func NewSliceRouterHandler(h handler, router *SliceRouter) *SliceRouterHandler {
 //	2.检查该路由是否绑定用户自定义处理函数，添加到路由处理列表中
 // 	3.依次执行路由的处理函数（中间件）
 func (rh *SliceRouterHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
-	c := NewSliceRouterContext(rw, req, rh.router)
+	c := NewSliceRouterContext(rw, req, rh.Router())
 	if rh.h != nil {
 		c.handlers = append(c.handlers, func(c *SliceRouteContext) {
 			rh.h(c).ServeHTTP(c.Rw, c.Req)
 		})
 	}
-	// 	3.依次执行路由的处理函数（中间件）
+	// 	3.依次执行路由的处理函数（中间件）：全局中间件、路由中间件、核心处理器
 	c.Reset()
 	c.Next()
 }
 
 // NewSliceRouterContext 初始化路由上下文实例
+// 在路由树中查找请求路径（不含查询参数）经过的路由，
+// 再按主机、路径、请求方法、请求头、查询参数选择优先级最高的路由，优先级见 route_match.go
 func NewSliceRouterContext(rw http.ResponseWriter, req *http.Request, r *SliceRouter) *SliceRouteContext {
-	// 初始化最长url匹配路由
+	// 初始化匹配路由
 	sr := &sliceRoute{}
-	// 最长url前缀匹配
-	matchUrlLen := 0
-	for _, route := range r.groups {
-		// uri匹配成功：前缀匹配
-		if strings.HasPrefix(req.RequestURI, route.path) {
-			// 记录最长匹配 uri
-			pathLen := len(route.path)
-			if pathLen > matchUrlLen {
-				matchUrlLen = pathLen
+	var params Params
+	if r.tree != nil {
+		var best routeMatch
+		matched := false
+		for _, cand := range r.tree.lookup(req.URL.Path, 0, nil, nil) {
+			m, ok := cand.route.match(req)
+			if !ok {
+				continue
+			}
+			m.pathLen, m.paramCount, m.order = cand.pathLen, len(cand.values), cand.route.order
+			if !matched || m.better(best) {
+				matched, best = true, m
 				// 浅拷贝：拷贝数组指针
-				*sr = *route
+				*sr = *cand.route
+				params = make(Params, len(cand.values))
+				for i, v := range cand.values {
+					params[i] = Param{Key: cand.route.paramNames[i], Value: v}
+				}
 			}
 		}
 	}
 
+	// 全局中间件在前：重新分配处理器列表，避免追加核心处理器时修改路由共享的数组
+	handlers := make([]HandlerFunc, 0, len(r.global)+len(sr.handlers)+1)
+	handlers = append(handlers, r.global...)
+	sr.handlers = append(handlers, sr.handlers...)
+
 	c := &SliceRouteContext{
 		Rw:         rw,
 		Req:        req,
 		Ctx:        req.Context(),
+		Params:     params,
 		sliceRoute: sr}
 	// 确保每一次请求，中间件（函数列表）都是从第一个开始执行
 	c.Reset()
@@ -156,10 +206,20 @@ func (c *SliceRouteContext) Set(key, val interface{}) {
 	c.Ctx = context.WithValue(c.Ctx, key, val)
 }
 
+// Param 获取指定名称的路由参数值
+func (c *SliceRouteContext) Param(name string) string {
+	return c.Params.ByName(name)
+}
+
+// RoutePath 获取匹配到的路由注册时的路径（如 /users/:id），没有匹配的路由时为空字符串
+func (c *SliceRouteContext) RoutePath() string {
+	return c.path
+}
+
 // Next 从最先加入中间件开始回调
 func (c *SliceRouteContext) Next() {
 	c.index++
-	for c.index < int8(len(c.handlers)) {
+	for !c.aborted && c.index < len(c.handlers) {
 		// 循环调用每一个handler
 		c.handlers[c.index](c)
 		c.index++
@@ -168,15 +228,16 @@ func (c *SliceRouteContext) Next() {
 
 // Abort 跳出中间件方法
 func (c *SliceRouteContext) Abort() {
-	c.index = AbortIndex
+	c.aborted = true
 }
 
 // IsAborted 是否跳过了回调
 func (c *SliceRouteContext) IsAborted() bool {
-	return c.index >= AbortIndex
+	return c.aborted
 }
 
 // Reset 重置回调
 func (c *SliceRouteContext) Reset() {
 	c.index = -1
+	c.aborted = false
 }
@@ -6,7 +6,9 @@ import (
 	"gateway/proxy"
 	"log"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"strings"
 	"testing"
 )
 
@@ -76,3 +78,200 @@ func reverseProxy(c context.Context) http.Handler {
 	urls := []*url.URL{url1, url2}
 	return proxy.NewMultipleHostsReverseProxy(c, urls)
 }
+
+// TestSliceRouterMatch 测试主机、请求方法、请求头、查询参数匹配，以及匹配优先级
+func TestSliceRouterMatch(t *testing.T) {
+	sliceRouter := NewSliceRouter()
+	name := func(n string) HandlerFunc {
+		return func(c *SliceRouteContext) { c.Rw.Write([]byte(n)) }
+	}
+	sliceRouter.Group("/").Use(name("root"))
+	sliceRouter.Group("/api").Use(name("api"))
+	sliceRouter.Group("/").Host("*.example.com").Use(name("wildcard"))
+	sliceRouter.Group("/").Host("*.admin.example.com").Use(name("admin-wildcard"))
+	sliceRouter.Group("/").Host("api.example.com").Use(name("api-host"))
+	sliceRouter.Group("/users").Host("api.example.com").Method(http.MethodPost).Use(name("create-user"))
+	sliceRouter.Group("/users").Host("api.example.com").Header("X-Env", "canary").Use(name("canary"))
+	sliceRouter.Group("/users").Host("api.example.com").Query("debug", "").Use(name("debug"))
+	routerHandler := NewSliceRouterHandler(nil, sliceRouter)
+
+	cases := []struct {
+		method, host, uri string
+		header            http.Header
+		want              string
+	}{
+		{http.MethodGet, "other.com", "/api/v1", nil, "api"},
+		{http.MethodGet, "other.com", "/index", nil, "root"},
+		{http.MethodGet, "www.example.com:8080", "/api/v1", nil, "wildcard"},
+		{http.MethodGet, "example.com", "/", nil, "root"},
+		{http.MethodGet, "a.b.example.com", "/", nil, "wildcard"},
+		{http.MethodGet, "x.admin.example.com", "/", nil, "admin-wildcard"},
+		{http.MethodGet, "API.example.com", "/users", nil, "api-host"},
+		{http.MethodPost, "api.example.com", "/users", nil, "create-user"},
+		{http.MethodGet, "api.example.com", "/users/1", http.Header{"X-Env": {"canary"}}, "canary"},
+		{http.MethodGet, "api.example.com", "/users/1", http.Header{"X-Env": {"prod"}}, "api-host"},
+		{http.MethodGet, "api.example.com", "/users?debug=1", nil, "debug"},
+		// 条件个数相同，先注册的路由优先
+		{http.MethodGet, "api.example.com", "/users?debug=1", http.Header{"X-Env": {"canary"}}, "canary"},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest(c.method, c.uri, nil)
+		req.Host = c.host
+		for k, v := range c.header {
+			req.Header[k] = v
+		}
+		rw := httptest.NewRecorder()
+		routerHandler.ServeHTTP(rw, req)
+		if rw.Body.String() != c.want {
+			t.Errorf("%s %s%s: want %s, got %s", c.method, c.host, c.uri, c.want, rw.Body.String())
+		}
+	}
+}
+
+// TestSliceRouterParams 测试命名参数、通配参数，以及静态路径优先
+func TestSliceRouterParams(t *testing.T) {
+	sliceRouter := NewSliceRouter()
+	name := func(n string) HandlerFunc {
+		return func(c *SliceRouteContext) {
+			c.Rw.Write([]byte(n))
+			for _, p := range c.Params {
+				c.Rw.Write([]byte(" " + p.Key + "=" + p.Value))
+			}
+		}
+	}
+	sliceRouter.Group("/").Use(name("root"))
+	sliceRouter.Group("/users/:id").Use(name("user"))
+	sliceRouter.Group("/users/new").Use(name("new-user"))
+	sliceRouter.Group("/users/:id/posts/:post").Use(name("post"))
+	sliceRouter.Group("/static/*filepath").Use(name("static"))
+	sliceRouter.Group("/static/css").Use(name("css"))
+	sliceRouter.Group("/user:name").Use(name("literal"))
+	routerHandler := NewSliceRouterHandler(nil, sliceRouter)
+
+	cases := map[string]string{
+		"/users/42":              "user id=42",
+		"/users/42?tab=info":     "user id=42",
+		"/users/new":             "new-user",
+		"/users/news":            "user id=news",
+		"/users/":                "root",
+		"/users/42/posts/7":      "post id=42 post=7",
+		"/users/42/comments":     "user id=42",
+		"/static/js/app.js":      "static filepath=js/app.js",
+		"/static/css/a.css":      "css",
+		"/static/":               "static filepath=",
+		"/user:name":             "literal",
+		"/unknown":               "root",
+		"/users/42/posts/7/edit": "post id=42 post=7",
+	}
+	for uri, want := range cases {
+		req := httptest.NewRequest(http.MethodGet, uri, nil)
+		rw := httptest.NewRecorder()
+		routerHandler.ServeHTTP(rw, req)
+		if rw.Body.String() != want {
+			t.Errorf("%s: want %q, got %q", uri, want, rw.Body.String())
+		}
+	}
+}
+
+// benchmarkRoutes 生成 4000 个路由，模拟自动生成的 API 目录
+func benchmarkRoutes() []string {
+	routes := []string{}
+	for svc := 0; svc < 100; svc++ {
+		for res := 0; res < 20; res++ {
+			routes = append(routes,
+				fmt.Sprintf("/api/v1/svc%d/res%d", svc, res),
+				fmt.Sprintf("/api/v1/svc%d/res%d/:id/detail", svc, res))
+		}
+	}
+	return routes
+}
+
+func BenchmarkSliceRouter4kRoutes(b *testing.B) {
+	sliceRouter := NewSliceRouter()
+	for _, path := range benchmarkRoutes() {
+		sliceRouter.Group(path).Use(func(c *SliceRouteContext) {})
+	}
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/svc87/res13/12345/detail?x=1", nil)
+	rw := httptest.NewRecorder()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c := NewSliceRouterContext(rw, req, sliceRouter)
+		if c.Param("id") != "12345" {
+			b.Fatal("route not matched")
+		}
+	}
+}
+
+// BenchmarkLinearScan4kRoutes 对照组：逐个路由做前缀匹配
+func BenchmarkLinearScan4kRoutes(b *testing.B) {
+	routes := benchmarkRoutes()
+	uri := "/api/v1/svc87/res13"
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		matched := ""
+		for _, path := range routes {
+			if strings.HasPrefix(uri, path) && len(path) > len(matched) {
+				matched = path
+			}
+		}
+		if matched == "" {
+			b.Fatal("route not matched")
+		}
+	}
+}
+
+// TestSliceRouterMiddlewareStack 测试不限数量的中间件、全局中间件、命名中间件栈与 Abort
+func TestSliceRouterMiddlewareStack(t *testing.T) {
+	sliceRouter := NewSliceRouter()
+	trace := func(n string) HandlerFunc {
+		return func(c *SliceRouteContext) {
+			c.Rw.Write([]byte(n + ","))
+			c.Next()
+		}
+	}
+	sliceRouter.UseGlobal(trace("global"))
+	sliceRouter.Stack("auth", trace("auth"), func(c *SliceRouteContext) {
+		if c.Req.Header.Get("Authorization") == "" {
+			c.Rw.Write([]byte("denied"))
+			c.Abort()
+		}
+	})
+	sliceRouter.Stack("log", trace("log"))
+
+	// 超过原来 63 个中间件的限制
+	many := []HandlerFunc{}
+	for i := 0; i < 200; i++ {
+		many = append(many, func(c *SliceRouteContext) {})
+	}
+	sliceRouter.Group("/api").UseStack("log", "auth").Use(many...).Use(trace("api"))
+	sliceRouter.Group("/public").UseStack("log").Use(trace("public"))
+	routerHandler := NewSliceRouterHandler(func(c *SliceRouteContext) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			rw.Write([]byte("core"))
+		})
+	}, sliceRouter)
+
+	cases := []struct {
+		uri, auth, want string
+	}{
+		{"/api/users", "token", "global,log,auth,api,core"},
+		{"/api/users", "", "global,log,auth,denied"},
+		{"/public/index", "", "global,log,public,core"},
+		{"/unknown", "", "global,core"},
+	}
+	for i := 0; i < 2; i++ {
+		for _, c := range cases {
+			req := httptest.NewRequest(http.MethodGet, c.uri, nil)
+			if c.auth != "" {
+				req.Header.Set("Authorization", c.auth)
+			}
+			rw := httptest.NewRecorder()
+			routerHandler.ServeHTTP(rw, req)
+			if rw.Body.String() != c.want {
+				t.Errorf("%s: want %q, got %q", c.uri, c.want, rw.Body.String())
+			}
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package tcp
+
+// 中间件组合，与 http 路由器相同：
+// 	UseGlobal：全局中间件，在所有路由之前执行
+// 	Stack：命名中间件栈，定义一组可复用的中间件，可以绑定到多个路由
+// 	UseStack：将命名中间件栈追加到路由的中间件列表中
+
+// UseGlobal 添加全局中间件
+func (g *TcpSliceRouter) UseGlobal(middlewares ...TcpHandlerFunc) *TcpSliceRouter {
+	g.global = append(g.global, middlewares...)
+	return g
+}
+
+// Stack 定义命名中间件栈，同名时追加到已有的栈
+// 需要在 UseStack 之前定义，UseStack 时复制栈中的中间件
+func (g *TcpSliceRouter) Stack(name string, middlewares ...TcpHandlerFunc) *TcpSliceRouter {
+	if g.stacks == nil {
+		g.stacks = map[string][]TcpHandlerFunc{}
+	}
+	g.stacks[name] = append(g.stacks[name], middlewares...)
+	return g
+}
+
+// UseStack 将命名中间件栈添加到路由的中间件列表中
+// 中间件栈未定义属于注册错误，直接 panic
+func (tr *TcpSliceRoute) UseStack(names ...string) *TcpSliceRoute {
+	for _, name := range names {
+		stack, ok := tr.TcpSliceRouter.stacks[name]
+		if !ok {
+			panic("middleware stack not defined: " + name)
+		}
+		tr.Use(stack...)
+	}
+	return tr
+}
@@ -0,0 +1,227 @@
+package tcp
+
+import (
+	tcp "gateway/proxy/tcp_proxy/server"
+	"net"
+	"strings"
+)
+
+// TCP 路由匹配条件
+//
+// 	ListenAddr：本地监听地址，host:port 或 :port（任意主机）
+// 	SNI：TLS ClientHello 中的主机名，支持通配符 *.example.com，只预读不终止 TLS
+// 	SourceCIDR：客户端地址所在网段
+// 所有条件同时满足才算匹配，没有条件的路由匹配所有连接。
+// 多个路由同时匹配时，按以下优先级选择（依次比较，相同时比较下一项）：
+// 	1.SNI：精确主机名 > 通配符（后缀越长越优先）> 未限定
+// 	2.监听地址：host:port > :port > 未限定
+// 	3.客户端网段：掩码越长越优先，未限定最低
+// 	4.注册顺序：先注册的路由优先
+
+// SNI 匹配的优先级
+const (
+	sniMatchAny = iota
+	sniMatchWildcard
+	sniMatchExact
+)
+
+// 监听地址匹配的优先级
+const (
+	listenMatchAny = iota
+	listenMatchPort
+	listenMatchExact
+)
+
+// tcpRouteMatch 路由匹配结果，用于比较多个匹配路由的优先级
+type tcpRouteMatch struct {
+	sniKind    int // SNI 匹配的优先级
+	sniLen     int // 匹配的主机名（通配符后缀）长度
+	listenKind int // 监听地址匹配的优先级
+	cidrBits   int // 匹配的网段掩码长度，-1 表示未限定
+	order      int // 路由注册顺序
+}
+
+// better 比较两个匹配结果，m 的优先级更高时返回 true
+func (m tcpRouteMatch) better(o tcpRouteMatch) bool {
+	if m.sniKind != o.sniKind {
+		return m.sniKind > o.sniKind
+	}
+	if m.sniLen != o.sniLen {
+		return m.sniLen > o.sniLen
+	}
+	if m.listenKind != o.listenKind {
+		return m.listenKind > o.listenKind
+	}
+	if m.cidrBits != o.cidrBits {
+		return m.cidrBits > o.cidrBits
+	}
+	return m.order < o.order
+}
+
+// ListenAddr 限定本地监听地址，可以指定多个，满足其一即可
+func (tr *TcpSliceRoute) ListenAddr(addrs ...string) *TcpSliceRoute {
+	tr.listenAddrs = append(tr.listenAddrs, addrs...)
+	return tr
+}
+
+// SNI 限定 TLS SNI 主机名，可以指定多个，满足其一即可
+// 支持通配符：*.example.com 匹配 example.com 的任意子域名
+func (tr *TcpSliceRoute) SNI(names ...string) *TcpSliceRoute {
+	for _, n := range names {
+		tr.sniNames = append(tr.sniNames, strings.ToLower(n))
+	}
+	tr.TcpSliceRouter.peekSNI = true
+	return tr
+}
+
+// SourceCIDR 限定客户端网段，可以指定多个，满足其一即可
+// 网段格式错误属于注册错误，直接 panic
+func (tr *TcpSliceRoute) SourceCIDR(cidrs ...string) *TcpSliceRoute {
+	for _, c := range cidrs {
+		_, ipNet, err := net.ParseCIDR(c)
+		if err != nil {
+			panic("invalid source cidr: " + c)
+		}
+		tr.sourceNets = append(tr.sourceNets, ipNet)
+	}
+	return tr
+}
+
+// Handler 设置路由的核心处理器（如该路由专属的 TCPReverseProxy）
+// 设置后，匹配该路由的连接不再调用 TcpSliceRouterHandler 的 coreFunc
+func (tr *TcpSliceRoute) Handler(h tcp.TCPHandler) *TcpSliceRoute {
+	tr.handler = h
+	return tr
+}
+
+// connInfo 连接的匹配信息
+type connInfo struct {
+	localAddr string
+	sourceIP  net.IP
+	sni       string
+}
+
+// match 检查连接是否满足路由的所有条件，返回匹配结果
+func (tr *TcpSliceRoute) match(info *connInfo) (tcpRouteMatch, bool) {
+	m, ok := tr.matchAddr(info)
+	if !ok {
+		return m, false
+	}
+	if len(tr.sniNames) > 0 {
+		kind, length, ok := matchSNI(tr.sniNames, info.sni)
+		if !ok {
+			return m, false
+		}
+		m.sniKind, m.sniLen = kind, length
+	}
+	return m, true
+}
+
+// matchAddr 检查监听地址和客户端网段条件，不检查 SNI
+func (tr *TcpSliceRoute) matchAddr(info *connInfo) (tcpRouteMatch, bool) {
+	m := tcpRouteMatch{cidrBits: -1, order: tr.order}
+	if len(tr.listenAddrs) > 0 {
+		kind, ok := matchListenAddr(tr.listenAddrs, info.localAddr)
+		if !ok {
+			return m, false
+		}
+		m.listenKind = kind
+	}
+	if len(tr.sourceNets) > 0 {
+		ok := false
+		for _, ipNet := range tr.sourceNets {
+			if info.sourceIP != nil && ipNet.Contains(info.sourceIP) {
+				ones, _ := ipNet.Mask.Size()
+				if ones > m.cidrBits {
+					m.cidrBits = ones
+				}
+				ok = true
+			}
+		}
+		if !ok {
+			return m, false
+		}
+	}
+	return m, true
+}
+
+// needSNI 监听地址和客户端网段都满足的路由中，是否有路由设置了 SNI 条件
+// 没有时不预读，避免服务端先发数据的协议（MySQL、SMTP 等）等待 SNITimeout
+func (r *TcpSliceRouter) needSNI(info *connInfo) bool {
+	for _, route := range r.groups {
+		if len(route.sniNames) == 0 {
+			continue
+		}
+		if _, ok := route.matchAddr(info); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// matchSNI 匹配 SNI 主机名，精确匹配优先，通配符中后缀最长的优先
+func matchSNI(names []string, sni string) (kind, length int, ok bool) {
+	if sni == "" {
+		return
+	}
+	sni = strings.ToLower(sni)
+	for _, n := range names {
+		if n == sni {
+			return sniMatchExact, len(n), true
+		}
+		if strings.HasPrefix(n, "*.") {
+			suffix := n[1:]
+			if len(sni) > len(suffix) && strings.HasSuffix(sni, suffix) && len(suffix) > length {
+				kind, length, ok = sniMatchWildcard, len(suffix), true
+			}
+		}
+	}
+	return
+}
+
+// matchListenAddr 匹配本地监听地址，host:port 精确匹配优先于 :port
+func matchListenAddr(addrs []string, localAddr string) (int, bool) {
+	host, port, err := net.SplitHostPort(localAddr)
+	if err != nil {
+		return listenMatchAny, false
+	}
+	kind, ok := listenMatchAny, false
+	for _, a := range addrs {
+		h, p, err := net.SplitHostPort(a)
+		if err != nil || p != port {
+			continue
+		}
+		if h == "" || h == "0.0.0.0" || h == "::" {
+			if !ok {
+				kind, ok = listenMatchPort, true
+			}
+			continue
+		}
+		if net.ParseIP(h).Equal(net.ParseIP(host)) || h == host {
+			return listenMatchExact, true
+		}
+	}
+	return kind, ok
+}
+
+// newConnInfo 收集连接的匹配信息，候选路由有 SNI 条件时才预读 ClientHello
+// 返回的连接可能是预读包装后的连接，后续处理器必须使用该连接
+func (r *TcpSliceRouter) newConnInfo(conn net.Conn) (net.Conn, *connInfo) {
+	info := &connInfo{}
+	if addr := conn.LocalAddr(); addr != nil {
+		info.localAddr = addr.String()
+	}
+	if addr := conn.RemoteAddr(); addr != nil {
+		if host, _, err := net.SplitHostPort(addr.String()); err == nil {
+			info.sourceIP = net.ParseIP(host)
+		}
+	}
+	if r.peekSNI && r.needSNI(info) {
+		timeout := r.SNITimeout
+		if timeout <= 0 {
+			timeout = defaultSNITimeout
+		}
+		conn, info.sni = peekSNI(conn, timeout)
+	}
+	return conn, info
+}
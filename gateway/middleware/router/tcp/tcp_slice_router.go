@@ -2,9 +2,10 @@ package tcp
 
 import (
 	"context"
-	"gateway/middleware/router/http"
 	tcp "gateway/proxy/tcp_proxy/server"
 	"net"
+	"sync/atomic"
+	"time"
 )
 
 type TcpHandlerFunc func(*TcpSliceRouteContext)
@@ -12,20 +13,44 @@ type TcpHandlerFunc func(*TcpSliceRouteContext)
 // TcpSliceRouter router 结构体
 type TcpSliceRouter struct {
 	groups []*TcpSliceRoute
+
+	// 全局中间件，在所有路由的中间件之前执行，见 tcp_middleware_stack.go
+	global []TcpHandlerFunc
+	// 命名中间件栈：名称 -> 中间件列表
+	stacks map[string][]TcpHandlerFunc
+
+	// 等待 TLS ClientHello 的时间，默认 1 秒，只有候选路由设置了 SNI 条件时才会预读
+	SNITimeout time.Duration
+	// 是否有路由设置了 SNI 条件
+	peekSNI bool
 }
 
 // TcpSliceRoute tcp路由结构体
+// 按监听地址、SNI、客户端网段匹配连接，见 tcp_route_match.go
 type TcpSliceRoute struct {
 	*TcpSliceRouter
+	// 路由名称，仅用于标识路由，不参与匹配
 	path     string
 	handlers []TcpHandlerFunc
+
+	// 匹配条件
+	listenAddrs []string
+	sniNames    []string
+	sourceNets  []*net.IPNet
+	// 路由专属的核心处理器，可选
+	handler tcp.TCPHandler
+	// 注册顺序，优先级相同时先注册的路由优先
+	order int
 }
 
 // TcpSliceRouteContext router上下文
 type TcpSliceRouteContext struct {
 	*TcpSliceRoute
 
-	index int8
+	// 当前执行的中间件索引
+	index int
+	// 是否跳出了中间件
+	aborted bool
 
 	Ctx  context.Context
 	Conn net.Conn
@@ -55,6 +80,7 @@ func (tr *TcpSliceRoute) Use(middlewares ...TcpHandlerFunc) *TcpSliceRoute {
 		}
 	}
 	if !existsFlag {
+		tr.order = len(tr.TcpSliceRouter.groups)
 		tr.TcpSliceRouter.groups = append(tr.TcpSliceRouter.groups, tr)
 	}
 	return tr
@@ -64,28 +90,64 @@ type tcpHandleFunc func(*TcpSliceRouteContext) tcp.TCPHandler
 
 type TcpSliceRouterHandler struct {
 	coreFunc tcpHandleFunc
-	router   *TcpSliceRouter
+	// 路由器，可以通过 SetRouter 原子替换
+	router atomic.Value // *TcpSliceRouter
 }
 
 func NewTcpSliceRouterHandler(coreFunc tcpHandleFunc, router *TcpSliceRouter) *TcpSliceRouterHandler {
-	return &TcpSliceRouterHandler{
-		coreFunc: coreFunc,
-		router:   router,
-	}
+	w := &TcpSliceRouterHandler{coreFunc: coreFunc}
+	w.router.Store(router)
+	return w
+}
+
+// Router 获取当前使用的路由器
+func (w *TcpSliceRouterHandler) Router() *TcpSliceRouter {
+	return w.router.Load().(*TcpSliceRouter)
 }
 
+// SetRouter 原子替换路由器（配置热加载）
+// 只影响之后建立的连接，已建立的连接仍由原路由器选中的处理器服务，不会断开
+func (w *TcpSliceRouterHandler) SetRouter(router *TcpSliceRouter) {
+	w.router.Store(router)
+}
+
+// ServeTCP 匹配路由，依次执行全局中间件、路由中间件、核心处理器
+// 核心处理器：路由专属的 Handler 优先，其次是 coreFunc；都没有时关闭连接
 func (w *TcpSliceRouterHandler) ServeTCP(ctx context.Context, conn net.Conn) {
-	c := NewTcpSliceRouterContext(conn, w.router, ctx)
+	c := NewTcpSliceRouterContext(conn, w.Router(), ctx)
 	c.handlers = append(c.handlers, func(c *TcpSliceRouteContext) {
-		w.coreFunc(c).ServeTCP(ctx, conn)
+		switch {
+		case c.handler != nil:
+			c.handler.ServeTCP(ctx, c.Conn)
+		case w.coreFunc != nil:
+			w.coreFunc(c).ServeTCP(ctx, c.Conn)
+		default:
+			c.Conn.Close()
+		}
 	})
 	c.Reset()
 	c.Next()
 }
 
+// NewTcpSliceRouterContext 初始化路由上下文实例
+// 按监听地址、SNI、客户端网段选择优先级最高的路由，优先级见 tcp_route_match.go
+// 候选路由有 SNI 条件时，Conn 为预读包装后的连接
 func NewTcpSliceRouterContext(conn net.Conn, r *TcpSliceRouter, ctx context.Context) *TcpSliceRouteContext {
+	conn, info := r.newConnInfo(conn)
 	newTcpSliceGroup := &TcpSliceRoute{}
-	*newTcpSliceGroup = *r.groups[0] //浅拷贝数组指针
+	var best tcpRouteMatch
+	matched := false
+	for _, route := range r.groups {
+		m, ok := route.match(info)
+		if ok && (!matched || m.better(best)) {
+			matched, best = true, m
+			*newTcpSliceGroup = *route //浅拷贝数组指针
+		}
+	}
+	// 全局中间件在前：重新分配处理器列表，避免追加核心处理器时修改路由共享的数组
+	handlers := make([]TcpHandlerFunc, 0, len(r.global)+len(newTcpSliceGroup.handlers)+1)
+	handlers = append(handlers, r.global...)
+	newTcpSliceGroup.handlers = append(handlers, newTcpSliceGroup.handlers...)
 	c := &TcpSliceRouteContext{Conn: conn, TcpSliceRoute: newTcpSliceGroup, Ctx: ctx}
 	c.Reset()
 	return c
@@ -102,7 +164,7 @@ func (c *TcpSliceRouteContext) Set(key, val interface{}) {
 // Next 从最先加入中间件开始回调
 func (c *TcpSliceRouteContext) Next() {
 	c.index++
-	for c.index < int8(len(c.handlers)) {
+	for !c.aborted && c.index < len(c.handlers) {
 		c.handlers[c.index](c)
 		c.index++
 	}
@@ -110,15 +172,16 @@ func (c *TcpSliceRouteContext) Next() {
 
 // Abort 跳出中间件方法
 func (c *TcpSliceRouteContext) Abort() {
-	c.index = http.AbortIndex
+	c.aborted = true
 }
 
 // IsAborted 是否跳过了回调
 func (c *TcpSliceRouteContext) IsAborted() bool {
-	return c.index >= http.AbortIndex
+	return c.aborted
 }
 
 // Reset 重置回调
 func (c *TcpSliceRouteContext) Reset() {
 	c.index = -1
+	c.aborted = false
 }
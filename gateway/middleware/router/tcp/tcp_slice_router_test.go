@@ -1,12 +1,18 @@
-package tcp
+package tcp_test
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
 	lb "gateway/loadbalance"
 	"gateway/middleware/flowcount"
+	"gateway/middleware/router/tcp"
 	"gateway/middleware/whitelist"
 	"gateway/proxy"
 	tcp_proxy "gateway/proxy/tcp_proxy/server"
+	"io/ioutil"
+	"net"
+	"strings"
 	"testing"
 	"time"
 )
@@ -19,11 +25,11 @@ func TestTcpSliceRouter(t *testing.T) {
 
 	// 构建路由及设置中间件
 	counter, _ := flowcount.NewFlowCountService("local_app", time.Second)
-	router := NewTcpSliceRouter()
+	router := tcp.NewTcpSliceRouter()
 	router.Group("/").Use(whitelist.IpWhiteListMiddleWare(), flowcount.FlowCountMiddleWare(counter))
 
 	// 构建回调handler
-	routerHandler := NewTcpSliceRouterHandler(func(c *TcpSliceRouteContext) tcp_proxy.TCPHandler {
+	routerHandler := tcp.NewTcpSliceRouterHandler(func(c *tcp.TcpSliceRouteContext) tcp_proxy.TCPHandler {
 		return proxy.NewTcpLoadBalanceReverseProxy(c.Ctx, rb)
 	}, router)
 
@@ -33,3 +39,192 @@ func TestTcpSliceRouter(t *testing.T) {
 	fmt.Println("Starting tcp_proxy at " + addr)
 	tcpServ.ListenAndServe()
 }
+
+// TestTcpSliceRouterMiddlewareStack 测试不限数量的中间件、全局中间件、命名中间件栈与 Abort
+func TestTcpSliceRouterMiddlewareStack(t *testing.T) {
+	trace := []string{}
+	mark := func(n string) tcp.TcpHandlerFunc {
+		return func(c *tcp.TcpSliceRouteContext) {
+			trace = append(trace, n)
+			c.Next()
+		}
+	}
+	router := tcp.NewTcpSliceRouter()
+	router.UseGlobal(mark("global"))
+	router.Stack("guard", mark("guard"), func(c *tcp.TcpSliceRouteContext) {
+		if c.Get("deny") != nil {
+			c.Abort()
+		}
+	})
+	many := []tcp.TcpHandlerFunc{}
+	for i := 0; i < 200; i++ {
+		many = append(many, func(c *tcp.TcpSliceRouteContext) {})
+	}
+	router.Group("/").UseStack("guard").Use(many...).Use(mark("route"))
+	routerHandler := tcp.NewTcpSliceRouterHandler(func(c *tcp.TcpSliceRouteContext) tcp_proxy.TCPHandler {
+		trace = append(trace, "core")
+		return nopTCPHandler{}
+	}, router)
+
+	src, dst := net.Pipe()
+	defer src.Close()
+	defer dst.Close()
+	routerHandler.ServeTCP(context.Background(), src)
+	if got := strings.Join(trace, ","); got != "global,guard,route,core" {
+		t.Fatalf("unexpected trace: %s", got)
+	}
+
+	trace = nil
+	routerHandler.ServeTCP(context.WithValue(context.Background(), "deny", true), src)
+	if got := strings.Join(trace, ","); got != "global,guard" {
+		t.Fatalf("unexpected trace after abort: %s", got)
+	}
+}
+
+type nopTCPHandler struct{}
+
+func (nopTCPHandler) ServeTCP(ctx context.Context, conn net.Conn) {}
+
+// TestTcpSliceRouterMatch 测试按 SNI、监听地址、客户端网段匹配路由，预读的数据不丢失
+func TestTcpSliceRouterMatch(t *testing.T) {
+	type result struct {
+		route string
+		first byte
+	}
+	results := make(chan result, 1)
+	route := func(name string) tcp_proxy.TCPHandler {
+		return tcpHandlerFunc(func(ctx context.Context, conn net.Conn) {
+			buf := make([]byte, 1)
+			conn.Read(buf)
+			results <- result{name, buf[0]}
+			conn.Close()
+		})
+	}
+	listen := func() net.Listener {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ln
+	}
+	ln1, ln2 := listen(), listen()
+	defer ln1.Close()
+	defer ln2.Close()
+	_, port2, _ := net.SplitHostPort(ln2.Addr().String())
+
+	router := tcp.NewTcpSliceRouter()
+	router.Group("default").Use().Handler(route("default"))
+	router.Group("db1").SNI("db1.example.com").Use().Handler(route("db1"))
+	router.Group("wildcard").SNI("*.example.com").Use().Handler(route("wildcard"))
+	router.Group("other-net").SourceCIDR("10.0.0.0/8").Use().Handler(route("other-net"))
+	router.Group("loopback").SourceCIDR("127.0.0.0/8").ListenAddr(":" + port2).Use().Handler(route("loopback"))
+	routerHandler := tcp.NewTcpSliceRouterHandler(nil, router)
+	for _, ln := range []net.Listener{ln1, ln2} {
+		go func(ln net.Listener) {
+			for {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				go routerHandler.ServeTCP(context.Background(), conn)
+			}
+		}(ln)
+	}
+
+	dialTLS := func(addr, serverName string) {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		// 网关不终止 TLS，握手失败即可
+		tls.Client(conn, &tls.Config{ServerName: serverName}).Handshake()
+	}
+	dialPlain := func(addr string) {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.Write([]byte("hello"))
+		ioutil.ReadAll(conn)
+	}
+	cases := []struct {
+		dial  func()
+		want  string
+		first byte
+	}{
+		{func() { dialTLS(ln1.Addr().String(), "db1.example.com") }, "db1", 0x16},
+		{func() { dialTLS(ln1.Addr().String(), "db2.example.com") }, "wildcard", 0x16},
+		{func() { dialTLS(ln1.Addr().String(), "example.org") }, "default", 0x16},
+		{func() { dialPlain(ln1.Addr().String()) }, "default", 'h'},
+		{func() { dialPlain(ln2.Addr().String()) }, "loopback", 'h'},
+	}
+	for _, c := range cases {
+		c.dial()
+		r := <-results
+		if r.route != c.want || r.first != c.first {
+			t.Errorf("want %s %x, got %s %x", c.want, c.first, r.route, r.first)
+		}
+	}
+}
+
+type tcpHandlerFunc func(ctx context.Context, conn net.Conn)
+
+func (f tcpHandlerFunc) ServeTCP(ctx context.Context, conn net.Conn) { f(ctx, conn) }
+
+// TestTcpSliceRouterSNIPeek 候选路由没有 SNI 条件时不预读，不是 TLS 握手时不等待后续数据
+func TestTcpSliceRouterSNIPeek(t *testing.T) {
+	listen := func() net.Listener {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ln
+	}
+	tlsLn, plainLn := listen(), listen()
+	defer tlsLn.Close()
+	defer plainLn.Close()
+
+	// 服务端先发言的协议，如 MySQL
+	greet := tcpHandlerFunc(func(ctx context.Context, conn net.Conn) {
+		conn.Write([]byte("hi"))
+		conn.Close()
+	})
+	router := tcp.NewTcpSliceRouter()
+	router.SNITimeout = 5 * time.Second
+	router.Group("tls").SNI("db1.example.com").ListenAddr(tlsLn.Addr().String()).Use().Handler(greet)
+	router.Group("default").Use().Handler(greet)
+	routerHandler := tcp.NewTcpSliceRouterHandler(nil, router)
+	for _, ln := range []net.Listener{tlsLn, plainLn} {
+		go func(ln net.Listener) {
+			for {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				go routerHandler.ServeTCP(context.Background(), conn)
+			}
+		}(ln)
+	}
+
+	read := func(addr string, send []byte) {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		if send != nil {
+			conn.Write(send)
+		}
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		buf, err := ioutil.ReadAll(conn)
+		if err != nil || string(buf) != "hi" {
+			t.Errorf("%s: want greeting, got %q %v", addr, buf, err)
+		}
+	}
+	// 没有 SNI 候选路由：不预读，客户端不发数据也能立即收到问候
+	read(plainLn.Addr().String(), nil)
+	// 有 SNI 候选路由：第一个字节不是 0x16 时立即停止预读
+	read(tlsLn.Addr().String(), []byte{'x'})
+}
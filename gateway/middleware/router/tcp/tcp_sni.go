@@ -0,0 +1,144 @@
+package tcp
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"net"
+	"time"
+)
+
+// 默认等待 TLS ClientHello 的时间：服务端先发言的协议（如 MySQL）不会发送 ClientHello
+const defaultSNITimeout = time.Second
+
+// peekedConn 预读了数据的连接：预读的数据仍然可以被后续处理器读到
+type peekedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *peekedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// peekSNI 预读 TLS ClientHello，取出 SNI 主机名，不终止 TLS
+// 返回包装后的连接，后续处理器必须使用该连接，才能读到完整的数据流
+// 不是 TLS 连接、超时或没有 SNI 时，返回空字符串
+func peekSNI(conn net.Conn, timeout time.Duration) (net.Conn, string) {
+	br := bufio.NewReaderSize(conn, 5+1<<14)
+	pc := &peekedConn{Conn: conn, r: br}
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	// TLS 记录头：类型（0x16 握手）、版本（2字节）、长度（2字节）
+	// 先只读第一个字节，不是握手记录时立即返回，不等待后续数据
+	if b, err := br.Peek(1); err != nil || b[0] != 0x16 {
+		return pc, ""
+	}
+	hdr, err := br.Peek(5)
+	if err != nil {
+		return pc, ""
+	}
+	recLen := int(binary.BigEndian.Uint16(hdr[3:5]))
+	rec, err := br.Peek(5 + recLen)
+	if err != nil {
+		return pc, ""
+	}
+	sni, err := parseClientHelloSNI(rec[5:])
+	if err != nil {
+		return pc, ""
+	}
+	return pc, sni
+}
+
+var errNotClientHello = errors.New("not a tls client hello")
+
+// parseClientHelloSNI 从握手消息中解析 server_name 扩展
+// 只解析第一个 TLS 记录，ClientHello 跨多个记录时返回错误
+func parseClientHelloSNI(b []byte) (string, error) {
+	// 握手类型（0x01 ClientHello）、长度（3字节）
+	if len(b) < 4 || b[0] != 0x01 {
+		return "", errNotClientHello
+	}
+	hsLen := int(b[1])<<16 | int(b[2])<<8 | int(b[3])
+	b = b[4:]
+	if len(b) < hsLen {
+		return "", errNotClientHello
+	}
+	b = b[:hsLen]
+	// 版本（2字节）、随机数（32字节）
+	if len(b) < 34 {
+		return "", errNotClientHello
+	}
+	b = b[34:]
+	// 会话ID
+	b, ok := skipVector(b, 1)
+	if !ok {
+		return "", errNotClientHello
+	}
+	// 密码套件
+	if b, ok = skipVector(b, 2); !ok {
+		return "", errNotClientHello
+	}
+	// 压缩方法
+	if b, ok = skipVector(b, 1); !ok {
+		return "", errNotClientHello
+	}
+	// 扩展列表
+	if len(b) < 2 {
+		return "", nil
+	}
+	extLen := int(binary.BigEndian.Uint16(b))
+	b = b[2:]
+	if len(b) < extLen {
+		return "", errNotClientHello
+	}
+	b = b[:extLen]
+	for len(b) >= 4 {
+		extType := binary.BigEndian.Uint16(b)
+		l := int(binary.BigEndian.Uint16(b[2:]))
+		b = b[4:]
+		if len(b) < l {
+			return "", errNotClientHello
+		}
+		data := b[:l]
+		b = b[l:]
+		if extType != 0 { // server_name
+			continue
+		}
+		// server_name_list：长度（2字节），每项：类型（1字节，0 表示主机名）、长度（2字节）、名称
+		if len(data) < 2 {
+			return "", errNotClientHello
+		}
+		data = data[2:]
+		for len(data) >= 3 {
+			nameType := data[0]
+			nameLen := int(binary.BigEndian.Uint16(data[1:]))
+			data = data[3:]
+			if len(data) < nameLen {
+				return "", errNotClientHello
+			}
+			if nameType == 0 {
+				return string(data[:nameLen]), nil
+			}
+			data = data[nameLen:]
+		}
+	}
+	return "", nil
+}
+
+// skipVector 跳过 TLS 变长向量：lenBytes 字节的长度 + 数据
+func skipVector(b []byte, lenBytes int) ([]byte, bool) {
+	if len(b) < lenBytes {
+		return nil, false
+	}
+	l := 0
+	for i := 0; i < lenBytes; i++ {
+		l = l<<8 | int(b[i])
+	}
+	b = b[lenBytes:]
+	if len(b) < l {
+		return nil, false
+	}
+	return b[l:], true
+}
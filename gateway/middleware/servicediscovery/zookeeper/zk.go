@@ -3,6 +3,7 @@ package zookeeper
 import (
 	"fmt"
 	"github.com/samuel/go-zookeeper/zk"
+	"sync"
 	"time"
 )
 
@@ -16,12 +17,15 @@ type ZkManager struct {
 	hosts      []string // zk主机列表，支持同时维护多个zk服务器
 	conn       *zk.Conn // zookeeper连接，底层是 net.Conn
 	pathPrefix string   // 路径前缀，默认为：/gateway_servers_
+
+	closeOnce sync.Once
+	done      chan struct{} // 关闭后停止监听协程
 }
 
 // NewZkManager 新建 zookeeper管理器
 // 	封装指定主机列表
 func NewZkManager(hosts []string) *ZkManager {
-	return &ZkManager{hosts: hosts, pathPrefix: "/gateway_servers_"}
+	return &ZkManager{hosts: hosts, pathPrefix: "/gateway_servers_", done: make(chan struct{})}
 }
 
 // GetConnect 连接zk服务器
@@ -34,10 +38,14 @@ func (z *ZkManager) GetConnect() error {
 	return nil
 }
 
-// Close 关闭服务
+// Close 关闭服务，同时停止 WatchServerListByPath、WatchPathData 启动的监听协程
 func (z *ZkManager) Close() {
-	z.conn.Close()
-	return
+	z.closeOnce.Do(func() {
+		close(z.done)
+		if z.conn != nil {
+			z.conn.Close()
+		}
+	})
 }
 
 // GetPathData 获取配置
@@ -127,16 +135,30 @@ func (z *ZkManager) WatchServerListByPath(path string) (chan []string, chan erro
 			// events: 绑定到path的事件
 			snapshot, _, events, err := conn.ChildrenW(path)
 			if err != nil {
-				errors <- err
+				select {
+				case errors <- err:
+				case <-z.done:
+					return
+				}
+			}
+			select {
+			case snapshots <- snapshot:
+			case <-z.done:
+				return
 			}
-			snapshots <- snapshot
-			// 监听错误信息
+			// 监听错误信息，关闭后不再等待事件
 			select {
 			case evt := <-events:
 				if evt.Err != nil {
-					errors <- evt.Err
+					select {
+					case errors <- evt.Err:
+					case <-z.done:
+						return
+					}
 				}
 				fmt.Printf("ChildrenW Event Path:%v, Type:%v\n", evt.Path, evt.Type)
+			case <-z.done:
+				return
 			}
 		}
 	}()
@@ -154,14 +176,26 @@ func (z *ZkManager) WatchPathData(nodePath string) (chan []byte, chan error) {
 		for {
 			dataBuf, _, events, err := conn.GetW(nodePath)
 			if err != nil {
-				errors <- err
+				select {
+				case errors <- err:
+				case <-z.done:
+				}
 				return
 			}
-			snapshots <- dataBuf
 			select {
+			case snapshots <- dataBuf:
+			case <-z.done:
+				return
+			}
+			select {
+			case <-z.done:
+				return
 			case evt := <-events:
 				if evt.Err != nil {
-					errors <- evt.Err
+					select {
+					case errors <- evt.Err:
+					case <-z.done:
+					}
 					return
 				}
 				fmt.Printf("GetW Event Path:%v, Type:%v\n", evt.Path, evt.Type)
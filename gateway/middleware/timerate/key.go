@@ -0,0 +1,153 @@
+package timerate
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	sr "gateway/middleware/router/http"
+	"net"
+	"strings"
+)
+
+// KeyFunc 从请求中提取限流键
+// 返回空字符串表示无法提取（如没有携带请求头），这些请求共用键为空字符串的令牌桶
+type KeyFunc func(c *sr.SliceRouteContext) string
+
+// KeyByClientIP 按客户端 IP 限流
+// trustForwarded 为 true 时优先使用 X-Forwarded-For 中的第一个地址、X-Real-IP，
+// 只有网关部署在可信的代理之后时才能开启，否则客户端可以伪造请求头绕过限流
+func KeyByClientIP(trustForwarded bool) KeyFunc {
+	return func(c *sr.SliceRouteContext) string {
+		if trustForwarded {
+			if xff := c.Req.Header.Get("X-Forwarded-For"); xff != "" {
+				return strings.TrimSpace(strings.Split(xff, ",")[0])
+			}
+			if ip := c.Req.Header.Get("X-Real-IP"); ip != "" {
+				return strings.TrimSpace(ip)
+			}
+		}
+		host, _, err := net.SplitHostPort(c.Req.RemoteAddr)
+		if err != nil {
+			return c.Req.RemoteAddr
+		}
+		return host
+	}
+}
+
+// KeyByHeader 按请求头限流，如 X-API-Key
+func KeyByHeader(name string) KeyFunc {
+	return func(c *sr.SliceRouteContext) string {
+		return c.Req.Header.Get(name)
+	}
+}
+
+// KeyByJWTClaim 按 Authorization: Bearer <jwt> 中的声明限流，如 sub、client_id
+// 只解析载荷，不校验签名：需要放在鉴权中间件之后，否则客户端可以伪造声明
+func KeyByJWTClaim(claim string) KeyFunc {
+	return func(c *sr.SliceRouteContext) string {
+		auth := c.Req.Header.Get("Authorization")
+		if len(auth) < 7 || !strings.EqualFold(auth[:7], "Bearer ") {
+			return ""
+		}
+		parts := strings.Split(strings.TrimSpace(auth[7:]), ".")
+		if len(parts) != 3 {
+			return ""
+		}
+		payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+		if err != nil {
+			return ""
+		}
+		claims := map[string]interface{}{}
+		if err := json.Unmarshal(payload, &claims); err != nil {
+			return ""
+		}
+		switch v := claims[claim].(type) {
+		case string:
+			return v
+		case float64, bool:
+			return fmt.Sprint(v)
+		}
+		return ""
+	}
+}
+
+// KeyByRoute 按路由限流，同一路由的所有请求共用一个令牌桶
+// 用作全局中间件或中间件栈时，每个路由有独立的额度
+func KeyByRoute() KeyFunc {
+	return func(c *sr.SliceRouteContext) string {
+		return c.RoutePath()
+	}
+}
+
+// FirstKey 依次尝试多个 KeyFunc，使用第一个非空的键，如没有 API key 时按客户端 IP 限流
+func FirstKey(keys ...KeyFunc) KeyFunc {
+	return func(c *sr.SliceRouteContext) string {
+		for _, key := range keys {
+			if k := key(c); k != "" {
+				return k
+			}
+		}
+		return ""
+	}
+}
+
+// CompositeKey 组合多个键，如路由 + 客户端 IP：每个客户端在每个路由上有独立的额度
+func CompositeKey(keys ...KeyFunc) KeyFunc {
+	return func(c *sr.SliceRouteContext) string {
+		parts := make([]string, len(keys))
+		for i, key := range keys {
+			parts[i] = key(c)
+		}
+		return strings.Join(parts, "|")
+	}
+}
+
+// ParseKey 解析键的描述，用于配置文件：
+// 	client_ip：客户端 IP（连接地址）
+// 	forwarded_ip：X-Forwarded-For、X-Real-IP 中的客户端 IP，没有时使用连接地址
+// 	header:<name>：请求头
+// 	jwt:<claim>：JWT 声明
+// 	route：路由
+// 多个键用 + 组合（CompositeKey），用 , 分隔备选（FirstKey），如 header:X-API-Key,client_ip
+func ParseKey(spec string) (KeyFunc, error) {
+	var alternatives []KeyFunc
+	for _, alt := range strings.Split(spec, ",") {
+		var parts []KeyFunc
+		for _, part := range strings.Split(alt, "+") {
+			key, err := parseSingleKey(strings.TrimSpace(part))
+			if err != nil {
+				return nil, err
+			}
+			parts = append(parts, key)
+		}
+		if len(parts) == 1 {
+			alternatives = append(alternatives, parts[0])
+		} else {
+			alternatives = append(alternatives, CompositeKey(parts...))
+		}
+	}
+	if len(alternatives) == 1 {
+		return alternatives[0], nil
+	}
+	return FirstKey(alternatives...), nil
+}
+
+func parseSingleKey(spec string) (KeyFunc, error) {
+	name, arg := spec, ""
+	if i := strings.IndexByte(spec, ':'); i >= 0 {
+		name, arg = spec[:i], strings.TrimSpace(spec[i+1:])
+	}
+	switch {
+	case name == "client_ip" && arg == "":
+		return KeyByClientIP(false), nil
+	case name == "forwarded_ip" && arg == "":
+		return KeyByClientIP(true), nil
+	case name == "route" && arg == "":
+		return KeyByRoute(), nil
+	case name == "header" && arg != "":
+		return KeyByHeader(arg), nil
+	case name == "jwt" && arg != "":
+		return KeyByJWTClaim(arg), nil
+	}
+	return nil, fmt.Errorf("unknown rate limit key %q", spec)
+}
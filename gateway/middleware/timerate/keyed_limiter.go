@@ -0,0 +1,219 @@
+package timerate
+
+import (
+	"container/list"
+	sr "gateway/middleware/router/http"
+	"golang.org/x/time/rate"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// 按键限流
+//
+// 每个键（客户端 IP、API key、JWT 声明、路由等，见 key.go）使用独立的令牌桶，
+// 一个客户端用完自己的额度不影响其他客户端：
+// 	1.令牌桶保存在 LRU 表中，超过 MaxKeys 时淘汰最久未使用的键，空闲超过 TTL 的键过期
+// 	2.支持按键覆盖速率与容量（如付费客户），运行时可以修改
+// 	3.被限流的请求返回 429，携带 Retry-After；所有请求携带 X-RateLimit-* 响应头：
+// 		X-RateLimit-Limit：令牌桶容量
+// 		X-RateLimit-Remaining：剩余令牌数
+// 		X-RateLimit-Reset：令牌桶恢复满额的秒数
+
+// 默认的键数量上限与空闲过期时间
+const (
+	DefaultMaxKeys = 10000
+	DefaultKeyTTL  = 10 * time.Minute
+)
+
+// Allower 按键限流的限流器：KeyedLimiter、RedisLimiter
+type Allower interface {
+	// Allow 从键对应的额度中获取一个请求
+	Allow(key string) Decision
+}
+
+// Limit 令牌桶参数：每秒产生的令牌数与令牌桶容量
+type Limit struct {
+	Rate  float64
+	Burst int
+}
+
+// Decision 限流结果
+type Decision struct {
+	Allowed    bool
+	Limit      int           // 令牌桶容量
+	Remaining  int           // 本次请求之后剩余的令牌数
+	Reset      time.Duration // 令牌桶恢复满额的时间
+	RetryAfter time.Duration // 被限流时，下一个令牌产生的时间
+}
+
+// KeyedLimiter 按键限流器
+type KeyedLimiter struct {
+	limit   Limit
+	key     KeyFunc
+	maxKeys int
+	ttl     time.Duration
+
+	mu        sync.Mutex
+	overrides map[string]Limit         // 按键覆盖的参数
+	entries   map[string]*list.Element // 键 -> LRU 链表节点
+	lru       *list.List               // 表头为最近使用的键
+}
+
+// limiterEntry LRU 链表节点的值
+type limiterEntry struct {
+	key      string
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// NewKeyedLimiter 创建按键限流器，key 为 nil 时所有请求共用一个令牌桶
+// maxKeys、ttl 小于等于 0 时使用 DefaultMaxKeys、DefaultKeyTTL
+func NewKeyedLimiter(limit Limit, key KeyFunc, maxKeys int, ttl time.Duration) *KeyedLimiter {
+	if maxKeys <= 0 {
+		maxKeys = DefaultMaxKeys
+	}
+	if ttl <= 0 {
+		ttl = DefaultKeyTTL
+	}
+	return &KeyedLimiter{
+		limit:     limit,
+		key:       key,
+		maxKeys:   maxKeys,
+		ttl:       ttl,
+		overrides: map[string]Limit{},
+		entries:   map[string]*list.Element{},
+		lru:       list.New(),
+	}
+}
+
+// SetOverride 覆盖指定键的速率与容量，已经存在的令牌桶立即生效
+func (k *KeyedLimiter) SetOverride(key string, limit Limit) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.overrides[key] = limit
+	k.applyLocked(key, limit)
+}
+
+// RemoveOverride 删除指定键的覆盖参数，恢复默认的速率与容量
+func (k *KeyedLimiter) RemoveOverride(key string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	delete(k.overrides, key)
+	k.applyLocked(key, k.limit)
+}
+
+func (k *KeyedLimiter) applyLocked(key string, limit Limit) {
+	if e, ok := k.entries[key]; ok {
+		l := e.Value.(*limiterEntry).limiter
+		l.SetLimit(rate.Limit(limit.Rate))
+		l.SetBurst(limit.Burst)
+	}
+}
+
+// Len 当前保存的键数量
+func (k *KeyedLimiter) Len() int {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return len(k.entries)
+}
+
+// Allow 从键对应的令牌桶中获取一个令牌
+func (k *KeyedLimiter) Allow(key string) Decision {
+	now := time.Now()
+	l := k.limiter(key, now)
+	d := Decision{Limit: l.Burst()}
+	d.Allowed = l.AllowN(now, 1)
+	tokens := l.TokensAt(now)
+	if tokens > 0 {
+		d.Remaining = int(tokens)
+	}
+	r := float64(l.Limit())
+	if r > 0 && l.Limit() != rate.Inf {
+		d.Reset = secondsDuration((float64(d.Limit) - tokens) / r)
+		if !d.Allowed {
+			d.RetryAfter = secondsDuration((1 - tokens) / r)
+		}
+	}
+	return d
+}
+
+// limiter 获取键对应的令牌桶，不存在或已经过期时创建
+func (k *KeyedLimiter) limiter(key string, now time.Time) *rate.Limiter {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if e, ok := k.entries[key]; ok {
+		entry := e.Value.(*limiterEntry)
+		if now.Sub(entry.lastSeen) <= k.ttl {
+			entry.lastSeen = now
+			k.lru.MoveToFront(e)
+			return entry.limiter
+		}
+		k.removeLocked(e)
+	}
+	// 淘汰过期的键，以及超过数量上限时最久未使用的键
+	for back := k.lru.Back(); back != nil; back = k.lru.Back() {
+		if len(k.entries) < k.maxKeys && now.Sub(back.Value.(*limiterEntry).lastSeen) <= k.ttl {
+			break
+		}
+		k.removeLocked(back)
+	}
+	limit, ok := k.overrides[key]
+	if !ok {
+		limit = k.limit
+	}
+	entry := &limiterEntry{key: key, limiter: rate.NewLimiter(rate.Limit(limit.Rate), limit.Burst), lastSeen: now}
+	k.entries[key] = k.lru.PushFront(entry)
+	return entry.limiter
+}
+
+func (k *KeyedLimiter) removeLocked(e *list.Element) {
+	k.lru.Remove(e)
+	delete(k.entries, e.Value.(*limiterEntry).key)
+}
+
+// Middleware 限流中间件：被限流时返回 429 并跳出中间件
+func (k *KeyedLimiter) Middleware() func(c *sr.SliceRouteContext) {
+	return LimitMiddleware(k, k.key)
+}
+
+// LimitMiddleware 使用任意限流器的 http 限流中间件，key 为 nil 时所有请求共用一个键
+// 所有响应携带 X-RateLimit-* 响应头，被限流时返回 429、Retry-After 并跳出中间件
+func LimitMiddleware(l Allower, key KeyFunc) func(c *sr.SliceRouteContext) {
+	return func(c *sr.SliceRouteContext) {
+		k := ""
+		if key != nil {
+			k = key(c)
+		}
+		d := l.Allow(k)
+		header := c.Rw.Header()
+		header.Set("X-RateLimit-Limit", strconv.Itoa(d.Limit))
+		header.Set("X-RateLimit-Remaining", strconv.Itoa(d.Remaining))
+		header.Set("X-RateLimit-Reset", strconv.Itoa(ceilSeconds(d.Reset)))
+		if !d.Allowed {
+			if d.RetryAfter > 0 {
+				header.Set("Retry-After", strconv.Itoa(ceilSeconds(d.RetryAfter)))
+			}
+			http.Error(c.Rw, "rate limit exceeded", http.StatusTooManyRequests)
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// KeyedRateLimiter 网关集成按键限流功能，参数含义见 NewKeyedLimiter
+func KeyedRateLimiter(limit Limit, key KeyFunc, maxKeys int, ttl time.Duration) func(c *sr.SliceRouteContext) {
+	return NewKeyedLimiter(limit, key, maxKeys, ttl).Middleware()
+}
+
+func secondsDuration(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+// ceilSeconds 向上取整的秒数，Retry-After 等响应头使用整数秒
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
@@ -0,0 +1,151 @@
+package timerate
+
+import (
+	"encoding/base64"
+	sr "gateway/middleware/router/http"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func limitedHandler(mw func(c *sr.SliceRouteContext)) http.Handler {
+	router := sr.NewSliceRouter()
+	router.Group("/").Use(mw)
+	router.Group("/users/:id").Use(mw)
+	return sr.NewSliceRouterHandler(func(c *sr.SliceRouteContext) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			rw.Write([]byte("ok"))
+		})
+	}, router)
+}
+
+func serve(h http.Handler, path, remoteAddr string, header map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	req.RemoteAddr = remoteAddr
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, req)
+	return rw
+}
+
+// 按客户端 IP 限流：一个客户端用完额度不影响其他客户端，被限流时返回 429
+func TestKeyedRateLimiter(t *testing.T) {
+	h := limitedHandler(KeyedRateLimiter(Limit{Rate: 1, Burst: 2}, KeyByClientIP(false), 0, 0))
+
+	rw := serve(h, "/", "10.0.0.1:1000", nil)
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, "2", rw.Header().Get("X-RateLimit-Limit"))
+	assert.Equal(t, "1", rw.Header().Get("X-RateLimit-Remaining"))
+	assert.Equal(t, "1", rw.Header().Get("X-RateLimit-Reset"))
+	// 同一 IP 的不同端口共用额度
+	rw = serve(h, "/", "10.0.0.1:1001", nil)
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, "0", rw.Header().Get("X-RateLimit-Remaining"))
+	rw = serve(h, "/", "10.0.0.1:1002", nil)
+	assert.Equal(t, http.StatusTooManyRequests, rw.Code)
+	assert.Equal(t, "1", rw.Header().Get("Retry-After"))
+	assert.Equal(t, "0", rw.Header().Get("X-RateLimit-Remaining"))
+	assert.Equal(t, "2", rw.Header().Get("X-RateLimit-Reset"))
+
+	rw = serve(h, "/", "10.0.0.2:1000", nil)
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, "ok", rw.Body.String())
+}
+
+// 按键覆盖速率与容量，运行时修改立即生效
+func TestKeyedLimiterOverride(t *testing.T) {
+	l := NewKeyedLimiter(Limit{Rate: 1, Burst: 1}, nil, 0, 0)
+	l.SetOverride("vip", Limit{Rate: 1, Burst: 3})
+	allowed := func(key string, n int) int {
+		count := 0
+		for i := 0; i < n; i++ {
+			if l.Allow(key).Allowed {
+				count++
+			}
+		}
+		return count
+	}
+	assert.Equal(t, 1, allowed("free", 5))
+	assert.Equal(t, 3, allowed("vip", 5))
+	assert.Equal(t, 3, l.Allow("vip").Limit)
+
+	l.SetOverride("free", Limit{Rate: 1000, Burst: 10})
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, 10, l.Allow("free").Limit)
+	assert.True(t, allowed("free", 5) > 1)
+	l.RemoveOverride("vip")
+	assert.Equal(t, 1, l.Allow("vip").Limit)
+}
+
+// 键的数量受 LRU 限制，空闲的键过期
+func TestKeyedLimiterEviction(t *testing.T) {
+	l := NewKeyedLimiter(Limit{Rate: 1, Burst: 1}, nil, 2, time.Hour)
+	assert.True(t, l.Allow("a").Allowed)
+	assert.True(t, l.Allow("b").Allowed)
+	assert.False(t, l.Allow("a").Allowed) // a 最近使用
+	assert.True(t, l.Allow("c").Allowed)  // 淘汰 b
+	assert.Equal(t, 2, l.Len())
+	assert.True(t, l.Allow("b").Allowed) // b 重新创建，淘汰 a
+	assert.True(t, l.Allow("a").Allowed)
+
+	l = NewKeyedLimiter(Limit{Rate: 1, Burst: 1}, nil, 0, 20*time.Millisecond)
+	assert.True(t, l.Allow("a").Allowed)
+	assert.True(t, l.Allow("b").Allowed)
+	time.Sleep(30 * time.Millisecond)
+	assert.True(t, l.Allow("c").Allowed)
+	assert.Equal(t, 1, l.Len())
+}
+
+// 无键的限流器：所有请求共用一个令牌桶
+func TestRateLimiterShared(t *testing.T) {
+	h := limitedHandler(RateLimiter(1, 1))
+	assert.Equal(t, http.StatusOK, serve(h, "/", "10.0.0.1:1", nil).Code)
+	assert.Equal(t, http.StatusTooManyRequests, serve(h, "/", "10.0.0.2:1", nil).Code)
+}
+
+func TestParseKey(t *testing.T) {
+	jwt := func(payload string) string {
+		return "Bearer e30." + base64.RawURLEncoding.EncodeToString([]byte(payload)) + ".sig"
+	}
+	cases := []struct {
+		spec   string
+		path   string
+		header map[string]string
+		want   string
+	}{
+		{"client_ip", "/", map[string]string{"X-Forwarded-For": "1.1.1.1"}, "10.0.0.1"},
+		{"forwarded_ip", "/", map[string]string{"X-Forwarded-For": "1.1.1.1, 2.2.2.2"}, "1.1.1.1"},
+		{"forwarded_ip", "/", map[string]string{"X-Real-IP": "3.3.3.3"}, "3.3.3.3"},
+		{"forwarded_ip", "/", nil, "10.0.0.1"},
+		{"header:X-API-Key", "/", map[string]string{"X-API-Key": "k1"}, "k1"},
+		{"header:X-API-Key,client_ip", "/", nil, "10.0.0.1"},
+		{"jwt:sub", "/", map[string]string{"Authorization": jwt(`{"sub":"alice"}`)}, "alice"},
+		{"jwt:uid", "/", map[string]string{"Authorization": jwt(`{"uid":42}`)}, "42"},
+		{"jwt:sub", "/", map[string]string{"Authorization": "Bearer not-a-jwt"}, ""},
+		{"jwt:sub,client_ip", "/", map[string]string{"Authorization": "Basic abc"}, "10.0.0.1"},
+		{"route", "/users/7", nil, "/users/:id"},
+		{"route+client_ip", "/users/7", nil, "/users/:id|10.0.0.1"},
+	}
+	for _, c := range cases {
+		key, err := ParseKey(c.spec)
+		if !assert.Nil(t, err, c.spec) {
+			continue
+		}
+		got := ""
+		h := limitedHandler(func(ctx *sr.SliceRouteContext) {
+			got = key(ctx)
+			ctx.Next()
+		})
+		serve(h, c.path, "10.0.0.1:1000", c.header)
+		assert.Equal(t, c.want, got, c.spec)
+	}
+
+	for _, spec := range []string{"", "ip", "header", "header:", "jwt", "route:x", "client_ip+"} {
+		_, err := ParseKey(spec)
+		assert.NotNil(t, err, spec)
+	}
+}
@@ -1,28 +1,16 @@
 package timerate
 
 import (
-	"fmt"
 	sr "gateway/middleware/router/http"
-	"golang.org/x/time/rate"
 )
 
-// RateLimiter 网关集成限流功能
+// RateLimiter 网关集成限流功能，所有请求共用一个令牌桶，被限流时返回 429
+// params：每秒产生的令牌数、令牌桶容量，默认为 1、2
+// 按客户端 IP、API key 等维度限流使用 KeyedRateLimiter
 func RateLimiter(params ...int) func(c *sr.SliceRouteContext) {
-	var r rate.Limit = 1
-	var b = 2
+	limit := Limit{Rate: 1, Burst: 2}
 	if len(params) == 2 {
-		r = rate.Limit(params[0])
-		b = params[1]
-	}
-	l := rate.NewLimiter(r, b)
-	return func(c *sr.SliceRouteContext) {
-		// 1.如果无法获取到token，则跳出中间件，直接返回
-		if !l.Allow() {
-			c.Rw.Write([]byte(fmt.Sprintf("rate limit:%v, %v", l.Limit(), l.Burst())))
-			c.Abort()
-			return
-		}
-		// 2.可以获取到token，执行中间件
-		c.Next()
+		limit = Limit{Rate: float64(params[0]), Burst: params[1]}
 	}
+	return KeyedRateLimiter(limit, nil, 1, 0)
 }
@@ -0,0 +1,271 @@
+package timerate
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"log"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// 分布式限流
+//
+// 多个网关实例共用 Redis 中的计数，N 个实例合计只允许一份额度。
+// 每次判断是一次 Lua 脚本调用（EVALSHA），读取、判断、写入在 Redis 中原子完成：
+// 	sliding_log：滑动日志，有序集合记录窗口内每个请求的时间，精确但占用内存与请求数成正比
+// 	sliding_window：滑动窗口计数，当前窗口计数 + 上一个窗口计数按重叠比例加权，每个键只有两个计数
+// 	gcra：通用信元速率算法，每个键只保存理论到达时间（TAT），请求匀速通过，允许 burst 个突发请求
+// 时间使用网关本机时钟（毫秒），各实例之间需要时钟同步（NTP）。
+// 多个键使用哈希标签 {key}，Redis Cluster 中位于同一个槽。
+//
+// Redis 不可用时（连接失败、超时等）降级为本地限流（Fallback），
+// 之后每隔 RetryInterval 重新尝试 Redis，恢复后自动切回。
+
+// 分布式限流算法
+const (
+	SlidingLog    = "sliding_log"
+	SlidingWindow = "sliding_window"
+	GCRA          = "gcra"
+)
+
+// 默认的键前缀与 Redis 重试间隔
+const (
+	DefaultRedisPrefix   = "ratelimit:"
+	DefaultRetryInterval = time.Second
+)
+
+// slidingLogScript 滑动日志
+// KEYS[1]：有序集合；ARGV：limit、window（毫秒）、now（毫秒）、member（请求的唯一标识）
+// 返回：{是否允许、剩余请求数、重试等待毫秒数、恢复满额毫秒数}
+var slidingLogScript = redis.NewScript(1, `
+local limit = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', now - window)
+local count = redis.call('ZCARD', KEYS[1])
+local allowed = 0
+if count < limit then
+	redis.call('ZADD', KEYS[1], now, ARGV[4])
+	redis.call('PEXPIRE', KEYS[1], window)
+	count = count + 1
+	allowed = 1
+end
+local retry = 0
+local reset = 0
+if count > 0 then
+	local oldest = redis.call('ZRANGE', KEYS[1], 0, 0, 'WITHSCORES')
+	local newest = redis.call('ZRANGE', KEYS[1], -1, -1, 'WITHSCORES')
+	reset = tonumber(newest[2]) + window - now
+	if allowed == 0 then
+		retry = tonumber(oldest[2]) + window - now
+	end
+end
+return {allowed, limit - count, retry, reset}
+`)
+
+// slidingWindowScript 滑动窗口计数
+// KEYS[1]：当前窗口计数；KEYS[2]：上一个窗口计数；ARGV：limit、window（毫秒）、now（毫秒）
+// 返回值同 slidingLogScript
+var slidingWindowScript = redis.NewScript(2, `
+local limit = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local current = tonumber(redis.call('GET', KEYS[1]) or '0')
+local previous = tonumber(redis.call('GET', KEYS[2]) or '0')
+local elapsed = now % window
+local count = previous * (window - elapsed) / window + current
+local allowed = 0
+if count + 1 <= limit then
+	redis.call('INCR', KEYS[1])
+	redis.call('PEXPIRE', KEYS[1], window * 2)
+	current = current + 1
+	count = count + 1
+	allowed = 1
+end
+local retry = 0
+if allowed == 0 then
+	if current + 1 > limit or previous == 0 then
+		retry = window - elapsed
+	else
+		retry = math.ceil((count + 1 - limit) * window / previous)
+	end
+end
+local reset = 0
+if current > 0 then
+	reset = 2 * window - elapsed
+elseif previous > 0 then
+	reset = window - elapsed
+end
+return {allowed, math.floor(limit - count), retry, reset}
+`)
+
+// gcraScript 通用信元速率算法
+// KEYS[1]：理论到达时间；ARGV：burst、interval（相邻请求的间隔毫秒数，window / limit）、now（毫秒）
+// 返回值同 slidingLogScript
+var gcraScript = redis.NewScript(1, `
+local burst = tonumber(ARGV[1])
+local interval = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local tat = tonumber(redis.call('GET', KEYS[1]) or now)
+if tat < now then
+	tat = now
+end
+local newTat = tat + interval
+local diff = now - (newTat - interval * burst)
+if diff < 0 then
+	return {0, 0, math.ceil(-diff), math.ceil(tat - now)}
+end
+redis.call('SET', KEYS[1], newTat, 'PX', math.ceil(newTat - now))
+return {1, math.floor(diff / interval), 0, math.ceil(newTat - now)}
+`)
+
+// RedisBackoff Redis 不可用时的降级状态，多个使用 Redis 的中间件共用：
+// Redis 出错后，重试间隔内不再访问 Redis；只在不可用、恢复时各打印一次日志
+type RedisBackoff struct {
+	Name     string // 日志前缀，如 rate limit
+	Fallback string // 日志中说明的降级行为，如 fall back to local limiter
+
+	downUntil int64 // 在此时间（UnixNano）之前不访问 Redis
+}
+
+// Do 在 Redis 可用时调用 fn 访问 Redis，返回是否成功
+// fn 出错时返回 false，retry 时间内的后续调用不再执行 fn，直接返回 false
+func (b *RedisBackoff) Do(now time.Time, retry time.Duration, fn func() error) bool {
+	if now.UnixNano() < atomic.LoadInt64(&b.downUntil) {
+		return false
+	}
+	if err := fn(); err != nil {
+		if atomic.SwapInt64(&b.downUntil, now.Add(retry).UnixNano()) == 0 {
+			log.Printf("%s: redis unavailable, %s: %v\n", b.Name, b.Fallback, err)
+		}
+		return false
+	}
+	if atomic.SwapInt64(&b.downUntil, 0) != 0 {
+		log.Printf("%s: redis recovered\n", b.Name)
+	}
+	return true
+}
+
+// Degraded 是否因为 Redis 不可用正在降级
+func (b *RedisBackoff) Degraded() bool {
+	return atomic.LoadInt64(&b.downUntil) != 0
+}
+
+// RedisLimit 分布式限流参数：每个键在 Window 内最多 Limit 个请求
+type RedisLimit struct {
+	Limit  int
+	Window time.Duration
+	Burst  int // 仅 gcra 使用：允许的突发请求数，默认等于 Limit
+}
+
+// RedisLimiter 基于 Redis 的分布式限流器，实现 Allower
+type RedisLimiter struct {
+	Prefix        string        // 键前缀，默认 DefaultRedisPrefix
+	Fallback      Allower       // Redis 不可用时的本地限流器，默认使用相同参数的 KeyedLimiter
+	RetryInterval time.Duration // Redis 出错后重新尝试的间隔，默认 DefaultRetryInterval
+
+	pool      *redis.Pool
+	algorithm string
+	limit     RedisLimit
+	now       func() time.Time
+
+	id      string // 实例标识，滑动日志中区分不同实例同一毫秒的请求
+	seq     uint64
+	backoff RedisBackoff // Redis 不可用时直接使用本地限流
+}
+
+// NewRedisLimiter 创建分布式限流器，algorithm 为 SlidingLog、SlidingWindow 或 GCRA
+func NewRedisLimiter(pool *redis.Pool, algorithm string, limit RedisLimit) (*RedisLimiter, error) {
+	switch algorithm {
+	case SlidingLog, SlidingWindow, GCRA:
+	default:
+		return nil, fmt.Errorf("unknown rate limit algorithm %q", algorithm)
+	}
+	if limit.Limit <= 0 || limit.Window < time.Millisecond {
+		return nil, fmt.Errorf("rate limit needs positive limit and window of at least 1ms")
+	}
+	if limit.Burst <= 0 {
+		limit.Burst = limit.Limit
+	}
+	id := make([]byte, 4)
+	rand.Read(id)
+	l := &RedisLimiter{
+		Prefix:        DefaultRedisPrefix,
+		RetryInterval: DefaultRetryInterval,
+		pool:          pool,
+		algorithm:     algorithm,
+		limit:         limit,
+		now:           time.Now,
+		id:            hex.EncodeToString(id),
+		backoff:       RedisBackoff{Name: "rate limit", Fallback: "fall back to local limiter"},
+	}
+	burst := limit.Limit
+	if algorithm == GCRA {
+		burst = limit.Burst
+	}
+	l.Fallback = NewKeyedLimiter(Limit{Rate: float64(limit.Limit) / limit.Window.Seconds(), Burst: burst}, nil, 0, 0)
+	return l, nil
+}
+
+// Allow 从 Redis 中获取一个请求的额度，Redis 不可用时使用本地限流
+func (l *RedisLimiter) Allow(key string) Decision {
+	var d Decision
+	if !l.backoff.Do(l.now(), l.RetryInterval, func() (err error) {
+		d, err = l.AllowRedis(key)
+		return err
+	}) {
+		return l.Fallback.Allow(key)
+	}
+	return d
+}
+
+// Degraded 是否因为 Redis 不可用正在使用本地限流
+func (l *RedisLimiter) Degraded() bool {
+	return l.backoff.Degraded()
+}
+
+// AllowRedis 只使用 Redis 判断，不降级，Redis 出错时返回错误
+func (l *RedisLimiter) AllowRedis(key string) (Decision, error) {
+	conn := l.pool.Get()
+	defer conn.Close()
+	nowMs := l.now().UnixNano() / int64(time.Millisecond)
+	windowMs := int64(l.limit.Window / time.Millisecond)
+	base := l.Prefix + "{" + key + "}"
+	var reply []int64
+	var err error
+	switch l.algorithm {
+	case SlidingLog:
+		member := l.id + "-" + strconv.FormatUint(atomic.AddUint64(&l.seq, 1), 36)
+		reply, err = redis.Int64s(slidingLogScript.Do(conn, base, l.limit.Limit, windowMs, nowMs, member))
+	case SlidingWindow:
+		index := nowMs / windowMs
+		current, previous := base+":"+strconv.FormatInt(index, 10), base+":"+strconv.FormatInt(index-1, 10)
+		reply, err = redis.Int64s(slidingWindowScript.Do(conn, current, previous, l.limit.Limit, windowMs, nowMs))
+	case GCRA:
+		interval := float64(windowMs) / float64(l.limit.Limit)
+		reply, err = redis.Int64s(gcraScript.Do(conn, base, l.limit.Burst, strconv.FormatFloat(interval, 'f', -1, 64), nowMs))
+	}
+	if err != nil {
+		return Decision{}, err
+	}
+	if len(reply) != 4 {
+		return Decision{}, fmt.Errorf("unexpected rate limit script reply %v", reply)
+	}
+	d := Decision{
+		Allowed:    reply[0] == 1,
+		Limit:      l.limit.Limit,
+		Remaining:  int(reply[1]),
+		RetryAfter: time.Duration(reply[2]) * time.Millisecond,
+		Reset:      time.Duration(reply[3]) * time.Millisecond,
+	}
+	if l.algorithm == GCRA {
+		d.Limit = l.limit.Burst
+	}
+	if d.Remaining < 0 {
+		d.Remaining = 0
+	}
+	return d, nil
+}
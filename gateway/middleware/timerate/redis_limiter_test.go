@@ -0,0 +1,162 @@
+package timerate
+
+import (
+	"github.com/alicebob/miniredis/v2"
+	"github.com/garyburd/redigo/redis"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+// newTestPool 连接 miniredis 的连接池：限流脚本由 miniredis 内置的 Lua 解释器（gopher-lua）执行，
+// 与真实 Redis 一样经过 EVALSHA、NOSCRIPT、EVAL 的流程
+func newTestPool(s *miniredis.Miniredis) *redis.Pool {
+	addr := s.Addr()
+	return &redis.Pool{
+		MaxIdle: 4,
+		Dial: func() (redis.Conn, error) {
+			return redis.Dial("tcp", addr, redis.DialReadTimeout(time.Second))
+		},
+	}
+}
+
+// testClock 可控的时钟，从整秒开始，方便计算窗口
+// 同时推进 miniredis 的时钟，键按脚本设置的过期时间过期
+type testClock struct {
+	t     time.Time
+	redis *miniredis.Miniredis
+}
+
+func (c *testClock) now() time.Time { return c.t }
+
+func (c *testClock) advance(d time.Duration) {
+	c.t = c.t.Add(d)
+	c.redis.FastForward(d)
+}
+
+func newTestRedisLimiter(t *testing.T, clock *testClock, algorithm string, limit RedisLimit) *RedisLimiter {
+	l, err := NewRedisLimiter(newTestPool(clock.redis), algorithm, limit)
+	assert.Nil(t, err)
+	l.now = clock.now
+	return l
+}
+
+func allowedCount(l Allower, key string, n int) int {
+	count := 0
+	for i := 0; i < n; i++ {
+		if l.Allow(key).Allowed {
+			count++
+		}
+	}
+	return count
+}
+
+func TestRedisLimiterSlidingLog(t *testing.T) {
+	s := miniredis.RunT(t)
+	clock := &testClock{time.Unix(1700000000, 0), s}
+	l := newTestRedisLimiter(t, clock, SlidingLog, RedisLimit{Limit: 3, Window: time.Second})
+
+	d := l.Allow("a")
+	assert.True(t, d.Allowed)
+	assert.Equal(t, 3, d.Limit)
+	assert.Equal(t, 2, d.Remaining)
+	assert.Equal(t, time.Second, d.Reset)
+	clock.advance(400 * time.Millisecond)
+	assert.Equal(t, 2, allowedCount(l, "a", 5))
+	d = l.Allow("a")
+	assert.False(t, d.Allowed)
+	assert.Equal(t, 600*time.Millisecond, d.RetryAfter)
+	assert.Equal(t, 3, allowedCount(l, "b", 5))
+
+	// 最早的请求滑出窗口后只释放一个额度
+	clock.advance(600 * time.Millisecond)
+	assert.Equal(t, 1, allowedCount(l, "a", 5))
+	assert.False(t, l.Degraded())
+}
+
+func TestRedisLimiterSlidingWindow(t *testing.T) {
+	s := miniredis.RunT(t)
+	clock := &testClock{time.Unix(1700000000, 0), s}
+	l := newTestRedisLimiter(t, clock, SlidingWindow, RedisLimit{Limit: 10, Window: time.Second})
+
+	assert.Equal(t, 10, allowedCount(l, "a", 15))
+	d := l.Allow("a")
+	assert.False(t, d.Allowed)
+	assert.Equal(t, time.Second, d.RetryAfter)
+
+	// 下一个窗口过半：上一个窗口的 10 个请求按一半计算
+	clock.advance(1500 * time.Millisecond)
+	assert.Equal(t, 5, allowedCount(l, "a", 10))
+	d = l.Allow("a")
+	assert.False(t, d.Allowed)
+	assert.Equal(t, 100*time.Millisecond, d.RetryAfter)
+	clock.advance(100 * time.Millisecond)
+	assert.Equal(t, 1, allowedCount(l, "a", 5))
+}
+
+func TestRedisLimiterGCRA(t *testing.T) {
+	s := miniredis.RunT(t)
+	clock := &testClock{time.Unix(1700000000, 0), s}
+	l := newTestRedisLimiter(t, clock, GCRA, RedisLimit{Limit: 10, Window: time.Second, Burst: 2})
+
+	d := l.Allow("a")
+	assert.True(t, d.Allowed)
+	assert.Equal(t, 2, d.Limit)
+	assert.Equal(t, 1, d.Remaining)
+	assert.True(t, l.Allow("a").Allowed)
+	d = l.Allow("a")
+	assert.False(t, d.Allowed)
+	assert.Equal(t, 100*time.Millisecond, d.RetryAfter)
+	assert.Equal(t, 200*time.Millisecond, d.Reset)
+
+	// 请求匀速通过：每 100ms 一个
+	clock.advance(100 * time.Millisecond)
+	assert.Equal(t, 1, allowedCount(l, "a", 5))
+	clock.advance(time.Second)
+	assert.Equal(t, 2, allowedCount(l, "a", 5))
+}
+
+// 多个网关实例共用一份额度
+func TestRedisLimiterShared(t *testing.T) {
+	s := miniredis.RunT(t)
+	clock := &testClock{time.Unix(1700000000, 0), s}
+	for _, algorithm := range []string{SlidingLog, SlidingWindow, GCRA} {
+		limit := RedisLimit{Limit: 4, Window: time.Second}
+		a := newTestRedisLimiter(t, clock, algorithm, limit)
+		b := newTestRedisLimiter(t, clock, algorithm, limit)
+		assert.Equal(t, 4, allowedCount(a, "k", 2)+allowedCount(b, "k", 2)+allowedCount(a, "k", 2)+allowedCount(b, "k", 2), algorithm)
+		clock.advance(time.Hour)
+	}
+}
+
+// Redis 不可用时降级为本地限流，恢复后切回
+func TestRedisLimiterFallback(t *testing.T) {
+	s := miniredis.RunT(t)
+	clock := &testClock{time.Unix(1700000000, 0), s}
+	l := newTestRedisLimiter(t, clock, GCRA, RedisLimit{Limit: 2, Window: time.Hour})
+	assert.True(t, l.Allow("a").Allowed)
+
+	s.Close()
+	_, err := l.AllowRedis("a")
+	assert.NotNil(t, err)
+	assert.Equal(t, 2, allowedCount(l, "a", 5))
+	assert.True(t, l.Degraded())
+
+	// 重试间隔内不访问 Redis
+	assert.Nil(t, s.Restart())
+	assert.True(t, l.Allow("b").Allowed)
+	assert.True(t, l.Degraded())
+	// 恢复后使用 Redis 中的计数：a 在 Redis 中只用了一个额度
+	clock.advance(DefaultRetryInterval)
+	assert.Equal(t, 1, allowedCount(l, "a", 5))
+	assert.False(t, l.Degraded())
+}
+
+func TestNewRedisLimiterErrors(t *testing.T) {
+	_, err := NewRedisLimiter(nil, "fixed_window", RedisLimit{Limit: 1, Window: time.Second})
+	assert.NotNil(t, err)
+	_, err = NewRedisLimiter(nil, GCRA, RedisLimit{Limit: 0, Window: time.Second})
+	assert.NotNil(t, err)
+	_, err = NewRedisLimiter(nil, GCRA, RedisLimit{Limit: 1})
+	assert.NotNil(t, err)
+}
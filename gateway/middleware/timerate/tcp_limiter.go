@@ -0,0 +1,38 @@
+package timerate
+
+import (
+	"gateway/middleware/router/tcp"
+	"net"
+)
+
+// TcpKeyFunc 从 tcp 连接中提取限流键
+type TcpKeyFunc func(c *tcp.TcpSliceRouteContext) string
+
+// TcpKeyByClientIP 按客户端 IP 限流
+func TcpKeyByClientIP() TcpKeyFunc {
+	return func(c *tcp.TcpSliceRouteContext) string {
+		addr := c.Conn.RemoteAddr().String()
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return addr
+		}
+		return host
+	}
+}
+
+// TcpLimitMiddleware tcp 限流中间件：按新建连接限流，被限流时关闭连接并跳出中间件
+// key 为 nil 时所有连接共用一个键
+func TcpLimitMiddleware(l Allower, key TcpKeyFunc) func(c *tcp.TcpSliceRouteContext) {
+	return func(c *tcp.TcpSliceRouteContext) {
+		k := ""
+		if key != nil {
+			k = key(c)
+		}
+		if !l.Allow(k).Allowed {
+			c.Abort()
+			c.Conn.Close()
+			return
+		}
+		c.Next()
+	}
+}
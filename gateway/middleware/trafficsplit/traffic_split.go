@@ -0,0 +1,130 @@
+package trafficsplit
+
+import (
+	"context"
+	"errors"
+	"gateway/loadbalance"
+	sr "gateway/middleware/router/http"
+	"gateway/proxy"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Upstream 上游服务的一个版本
+// 每个版本使用独立的负载均衡器（通常由 loadbalance.LoadBalanceFactoryWithConf 创建），
+// 各自进行服务发现、健康检查
+type Upstream struct {
+	// 版本名称，如 v1、v2；请求头或 cookie 的值与之相同时，强制转发到该版本
+	Name string
+	// 流量权重，按各版本权重之和的比例分配流量；为 0 时只接收强制指定的请求
+	Weight int
+	// 该版本的负载均衡器
+	LB loadbalance.LoadBalance
+
+	handler http.Handler
+}
+
+// TrafficSplit 按权重切分流量，并支持请求头、cookie 强制指定版本（金丝雀发布）
+//
+// 选择版本的顺序：
+// 	1.请求头 Header 的值与某个版本名称相同，转发到该版本
+// 	2.cookie Cookie 的值与某个版本名称相同，转发到该版本
+// 	3.按权重随机选择版本
+type TrafficSplit struct {
+	upstreams []*Upstream
+	total     int
+
+	// 强制指定版本的请求头名称，如 X-Canary，为空表示不检查
+	Header string
+	// 强制指定版本的 cookie 名称，为空表示不检查
+	Cookie string
+
+	mux sync.Mutex
+	rnd *rand.Rand
+}
+
+// NewTrafficSplit 创建流量切分实例，为每个版本创建负载均衡反向代理
+func NewTrafficSplit(ctx context.Context, upstreams ...*Upstream) (*TrafficSplit, error) {
+	if len(upstreams) == 0 {
+		return nil, errors.New("upstreams length at least 1")
+	}
+	t := &TrafficSplit{rnd: rand.New(rand.NewSource(time.Now().UnixNano()))}
+	names := map[string]bool{}
+	for _, u := range upstreams {
+		if u.LB == nil {
+			return nil, errors.New("upstream " + u.Name + " has no load balancer")
+		}
+		if u.Weight < 0 {
+			return nil, errors.New("upstream " + u.Name + " weight must not be negative")
+		}
+		if names[u.Name] {
+			return nil, errors.New("duplicate upstream " + u.Name)
+		}
+		names[u.Name] = true
+		// 复制一份再保存反向代理，不修改调用方的 Upstream
+		cp := *u
+		cp.handler = proxy.NewLoadBalanceReverseProxy(ctx, cp.LB)
+		t.upstreams = append(t.upstreams, &cp)
+		t.total += cp.Weight
+	}
+	if t.total == 0 {
+		return nil, errors.New("total weight of upstreams must be positive")
+	}
+	return t, nil
+}
+
+// Pick 为请求选择上游版本
+func (t *TrafficSplit) Pick(req *http.Request) *Upstream {
+	if t.Header != "" {
+		if u := t.find(req.Header.Get(t.Header)); u != nil {
+			return u
+		}
+	}
+	if t.Cookie != "" {
+		if c, err := req.Cookie(t.Cookie); err == nil {
+			if u := t.find(c.Value); u != nil {
+				return u
+			}
+		}
+	}
+	t.mux.Lock()
+	n := t.rnd.Intn(t.total)
+	t.mux.Unlock()
+	for _, u := range t.upstreams {
+		if n < u.Weight {
+			return u
+		}
+		n -= u.Weight
+	}
+	return t.upstreams[len(t.upstreams)-1]
+}
+
+func (t *TrafficSplit) find(name string) *Upstream {
+	if name == "" {
+		return nil
+	}
+	for _, u := range t.upstreams {
+		if u.Name == name {
+			return u
+		}
+	}
+	return nil
+}
+
+// ServeHTTP 实现 http.Handler 接口，转发到选中版本的反向代理
+// 可以作为 SliceRouterHandler 的核心处理器
+func (t *TrafficSplit) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	t.Pick(req).handler.ServeHTTP(rw, req)
+}
+
+// TrafficSplitMiddleware 网关集成流量切分功能，作为路由的最后一个中间件
+// 选中的版本名称记录在路由上下文的 "upstream" 中
+func TrafficSplitMiddleware(t *TrafficSplit) func(c *sr.SliceRouteContext) {
+	return func(c *sr.SliceRouteContext) {
+		u := t.Pick(c.Req)
+		c.Set("upstream", u.Name)
+		u.handler.ServeHTTP(c.Rw, c.Req)
+	}
+}
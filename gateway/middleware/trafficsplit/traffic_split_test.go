@@ -0,0 +1,84 @@
+package trafficsplit
+
+import (
+	"context"
+	"gateway/loadbalance"
+	sr "gateway/middleware/router/http"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// 测试按权重切分流量，以及请求头、cookie 强制指定版本
+func TestTrafficSplit(t *testing.T) {
+	upstream := func(name string, weight int) (*Upstream, *httptest.Server) {
+		rs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(name))
+		}))
+		conf := loadbalance.NewLoadBalanceStaticConf("%s/", map[string]string{rs.URL: "50"})
+		lb := loadbalance.LoadBalanceFactoryWithConf(loadbalance.LbRoundRobin, conf)
+		conf.UpdateConf([]string{rs.URL})
+		return &Upstream{Name: name, Weight: weight, LB: lb}, rs
+	}
+	v1, rs1 := upstream("v1", 95)
+	defer rs1.Close()
+	v2, rs2 := upstream("v2", 5)
+	defer rs2.Close()
+	v3, rs3 := upstream("v3", 0)
+	defer rs3.Close()
+
+	split, err := NewTrafficSplit(context.Background(), v1, v2, v3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	split.Header = "X-Canary"
+	split.Cookie = "canary"
+
+	router := sr.NewSliceRouter()
+	router.Group("/").Use(TrafficSplitMiddleware(split))
+	pxy := httptest.NewServer(sr.NewSliceRouterHandler(nil, router))
+	defer pxy.Close()
+
+	get := func(header, cookie string) string {
+		req, _ := http.NewRequest(http.MethodGet, pxy.URL+"/demo", nil)
+		if header != "" {
+			req.Header.Set("X-Canary", header)
+		}
+		if cookie != "" {
+			req.AddCookie(&http.Cookie{Name: "canary", Value: cookie})
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return string(body)
+	}
+
+	count := map[string]int{}
+	for i := 0; i < 1000; i++ {
+		count[get("", "")]++
+	}
+	if count["v3"] != 0 || count["v2"] < 20 || count["v2"] > 100 {
+		t.Fatalf("unexpected split: %v", count)
+	}
+	if body := get("v2", ""); body != "v2" {
+		t.Fatalf("header canary: want v2, got %s", body)
+	}
+	if body := get("", "v3"); body != "v3" {
+		t.Fatalf("cookie canary: want v3, got %s", body)
+	}
+	if body := get("v3", "v2"); body != "v3" {
+		t.Fatalf("header before cookie: want v3, got %s", body)
+	}
+
+	if v1.handler != nil {
+		t.Fatal("NewTrafficSplit should not modify the caller's upstream")
+	}
+
+	if _, err := NewTrafficSplit(context.Background(), &Upstream{Name: "v1", LB: v1.LB}); err == nil {
+		t.Fatal("zero total weight should fail")
+	}
+}
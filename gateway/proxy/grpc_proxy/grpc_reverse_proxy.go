@@ -9,11 +9,15 @@ import (
 	"google.golang.org/grpc/status"
 	"io"
 	"strings"
+	"sync/atomic"
+	"time"
 )
 
 type handler struct {
 	// 流式 请求协调者
 	director StreamDirector
+	// 流结束回调，可选
+	finisher StreamFinisher
 }
 
 // handler from here
@@ -23,7 +27,7 @@ type handler struct {
 // 	封装下游客户端流实例
 // 2.上游与下游数据拷贝
 // 3.关闭双向流
-func (h *handler) handler(srv interface{}, pxyServerStream grpc.ServerStream) error {
+func (h *handler) handler(srv interface{}, pxyServerStream grpc.ServerStream) (err error) {
 	// 0.过滤非RPC请求
 	// "/service/method"
 	methodName, ok := grpc.MethodFromServerStream(pxyServerStream)
@@ -50,6 +54,13 @@ func (h *handler) handler(srv interface{}, pxyServerStream grpc.ServerStream) er
 		return err
 	}
 	defer pxyClientConn.Close()
+	// 记录收到下游响应头的时间，见 FirstResponse
+	firstResponse := new(int64)
+	ctx = context.WithValue(ctx, firstResponseKey{}, firstResponse)
+	// 流结束时回调，ctx 为 director 返回的上下文
+	if h.finisher != nil {
+		defer func() { h.finisher(ctx, err) }()
+	}
 
 	// 从上游请求上下文中获取元数据
 	md, _ := metadata.FromIncomingContext(ctx)
@@ -72,7 +83,7 @@ func (h *handler) handler(srv interface{}, pxyServerStream grpc.ServerStream) er
 	// 把上游请求消息，发送给下游真实服务器
 	s2cErrChan := h.serverToClient(pxyClientStream, pxyServerStream)
 	// 把下游响应消息，发回给上游客户端
-	c2sErrChan := h.clientToServer(pxyServerStream, pxyClientStream)
+	c2sErrChan := h.clientToServer(pxyServerStream, pxyClientStream, firstResponse)
 
 	// 3.关闭双向流
 
@@ -107,7 +118,7 @@ func (h *handler) handler(srv interface{}, pxyServerStream grpc.ServerStream) er
 	return nil
 }
 
-func (h *handler) clientToServer(dst grpc.ServerStream, src grpc.ClientStream) chan error {
+func (h *handler) clientToServer(dst grpc.ServerStream, src grpc.ClientStream, firstResponse *int64) chan error {
 	res := make(chan error, 1)
 	go func() {
 		//msg := &proto.EchoResponse{}
@@ -122,6 +133,7 @@ func (h *handler) clientToServer(dst grpc.ServerStream, src grpc.ClientStream) c
 					res <- err
 					break
 				}
+				atomic.StoreInt64(firstResponse, time.Now().UnixNano())
 				if err = dst.SendHeader(md); err != nil {
 					res <- err
 					break
@@ -185,6 +197,36 @@ type StreamDirector func(ctx context.Context, fullMethodName string) (context.Co
 // The indented use here is as a transparent proxy, where the server doesn't know about the services implemented by the
 // backends. It should be used as a `grpc.UnknownServiceHandler`.
 func TransparentHandler(director StreamDirector) grpc.StreamHandler {
-	streamer := &handler{director}
+	streamer := &handler{director: director}
+	return streamer.handler
+}
+
+// StreamFinisher is called once the proxied stream created by a StreamDirector is finished.
+//
+// The context is derived from the one returned by the StreamDirector (see FirstResponse), and err is the error returned to the client (nil on success).
+// It is typically used to release resources acquired in the director, e.g. load balancer connection counts.
+type StreamFinisher func(ctx context.Context, err error)
+
+// firstResponseKey 流上下文中记录收到下游响应头的时间（UnixNano）
+type firstResponseKey struct{}
+
+// FirstResponse 获取收到下游响应头的时间，StreamFinisher 中用于计算首包耗时
+// 下游发送响应头或第一条响应消息时即收到响应头，流式方法不受流持续时间的影响；
+// 没有收到响应头（下游不可用、流被取消）时返回 false
+func FirstResponse(ctx context.Context) (time.Time, bool) {
+	p, ok := ctx.Value(firstResponseKey{}).(*int64)
+	if !ok {
+		return time.Time{}, false
+	}
+	n := atomic.LoadInt64(p)
+	if n == 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(0, n), true
+}
+
+// TransparentHandlerWithFinisher is like TransparentHandler, but calls finisher when each proxied stream is finished.
+func TransparentHandlerWithFinisher(director StreamDirector, finisher StreamFinisher) grpc.StreamHandler {
+	streamer := &handler{director: director, finisher: finisher}
 	return streamer.handler
 }
@@ -0,0 +1,77 @@
+package interceptor
+
+import (
+	"context"
+	"gateway/middleware/timerate"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"net"
+	"strconv"
+)
+
+// GrpcKeyFunc 从 rpc 上下文与方法名中提取限流键
+type GrpcKeyFunc func(ctx context.Context, method string) string
+
+// GrpcKeyByClientIP 按客户端 IP 限流
+func GrpcKeyByClientIP(ctx context.Context, method string) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.Addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(p.Addr.String())
+	if err != nil {
+		return p.Addr.String()
+	}
+	return host
+}
+
+// GrpcKeyByMetadata 按请求元数据限流，如 x-api-key
+func GrpcKeyByMetadata(name string) GrpcKeyFunc {
+	return func(ctx context.Context, method string) string {
+		md, _ := metadata.FromIncomingContext(ctx)
+		if v := md.Get(name); len(v) > 0 {
+			return v[0]
+		}
+		return ""
+	}
+}
+
+// GrpcRateLimitUnaryInterceptor 限流
+// 一元RPC拦截器，被限流时返回 ResourceExhausted，key 为 nil 时所有请求共用一个键
+func GrpcRateLimitUnaryInterceptor(l timerate.Allower, key GrpcKeyFunc) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if err := grpcAllow(ctx, l, key, info.FullMethod); err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// GrpcRateLimitStreamInterceptor 限流
+// 流式RPC拦截器，按新建的流限流
+func GrpcRateLimitStreamInterceptor(l timerate.Allower, key GrpcKeyFunc) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if err := grpcAllow(ss.Context(), l, key, info.FullMethod); err != nil {
+			return err
+		}
+		return handler(srv, ss)
+	}
+}
+
+// grpcAllow 被限流时设置 retry-after 响应元数据并返回 ResourceExhausted
+func grpcAllow(ctx context.Context, l timerate.Allower, key GrpcKeyFunc, method string) error {
+	k := ""
+	if key != nil {
+		k = key(ctx, method)
+	}
+	d := l.Allow(k)
+	if d.Allowed {
+		return nil
+	}
+	retry := int(d.RetryAfter.Seconds() + 0.999)
+	grpc.SetHeader(ctx, metadata.Pairs("retry-after", strconv.Itoa(retry)))
+	return status.Errorf(codes.ResourceExhausted, "rate limit exceeded, retry after %ds", retry)
+}
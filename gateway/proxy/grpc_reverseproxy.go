@@ -6,26 +6,62 @@ import (
 	"gateway/proxy/grpc_proxy"
 	"gateway/proxy/grpc_proxy/public"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials/insecure"
-	"log"
+	"google.golang.org/grpc/status"
+	"time"
 )
 
+// grpcLbAddrKey 流上下文中记录负载均衡选出的下游地址
+type grpcLbAddrKey struct{}
+
+// grpcLbStartKey 流上下文中记录请求开始时间
+type grpcLbStartKey struct{}
+
 func NewGrpcLoadBalanceHandler(lb loadbalance.LoadBalance) grpc.StreamHandler {
 	return func() grpc.StreamHandler {
 		// 定义入口函数：实用负载均衡算法获取下游主机地址
 		director := func(ctx context.Context, fullMethodName string) (context.Context, *grpc.ClientConn, error) {
+			// 没有可用主机时返回 Unavailable，不能退出进程
 			nextAddr, err := lb.Get(fullMethodName)
 			if err != nil {
-				log.Fatal("get next address fail")
+				return ctx, nil, status.Errorf(codes.Unavailable, "no available upstream: %v", err)
 			}
 			c, err := grpc.DialContext(ctx, nextAddr,
 				// 自定义编码
 				grpc.WithDefaultCallOptions(grpc.CallContentSubtype(public.Codec().Name())),
 				// 禁用安全传输
 				grpc.WithTransportCredentials(insecure.NewCredentials()))
-			return ctx, c, err
+			if err != nil {
+				// 拨号失败，流不会建立，上报后直接归还
+				loadbalance.Report(lb, nextAddr, err)
+				loadbalance.Release(lb, nextAddr)
+				return ctx, c, err
+			}
+			ctx = context.WithValue(ctx, grpcLbAddrKey{}, nextAddr)
+			return context.WithValue(ctx, grpcLbStartKey{}, time.Now()), c, err
+		}
+
+		// 定义结束函数：流结束时回调负载均衡器，成功时记录往返耗时
+		// 往返耗时为收到下游响应头（首条响应）的时间，流式方法的持续时间与下游响应速度无关
+		// 只有 Unavailable 说明下游不可用，业务错误码不影响主机的健康状态
+		finisher := func(ctx context.Context, err error) {
+			addr, ok := ctx.Value(grpcLbAddrKey{}).(string)
+			if !ok {
+				return
+			}
+			start, ok := ctx.Value(grpcLbStartKey{}).(time.Time)
+			if first, hasFirst := grpc_proxy.FirstResponse(ctx); ok && hasFirst && err == nil {
+				loadbalance.ObserveRTT(lb, addr, first.Sub(start))
+			}
+			if status.Code(err) == codes.Unavailable {
+				loadbalance.Report(lb, addr, err)
+			} else {
+				loadbalance.Report(lb, addr, nil)
+			}
+			loadbalance.Release(lb, addr)
 		}
 
-		return grpc_proxy.TransparentHandler(director)
+		return grpc_proxy.TransparentHandlerWithFinisher(director, finisher)
 	}()
 }
@@ -1,13 +1,19 @@
 package proxy
 
 import (
+	"context"
 	"fmt"
 	lb "gateway/loadbalance"
 	"gateway/middleware/flowcount"
 	"gateway/proxy/grpc_proxy/interceptor"
+	"gateway/proxy/grpc_proxy/proto"
+	"gateway/proxy/grpc_proxy/public"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"io"
 	"log"
 	"net"
+	"sync"
 	"testing"
 	"time"
 )
@@ -54,3 +60,93 @@ func TestGrpcRPWithLoadBalance(t *testing.T) {
 		log.Fatalf("failed to server :%v", err)
 	}
 }
+
+// slowStreamEcho 服务端流：立即返回第一条消息，之后间隔 delay 再返回第二条
+type slowStreamEcho struct {
+	proto.UnimplementedEchoServer
+	delay time.Duration
+}
+
+func (e *slowStreamEcho) ServerStreamingEcho(req *proto.EchoRequest, stream proto.Echo_ServerStreamingEchoServer) error {
+	for i := 0; i < 2; i++ {
+		if i > 0 {
+			time.Sleep(e.delay)
+		}
+		if err := stream.Send(&proto.EchoResponse{Message: req.Message}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rttRecorder 记录代理上报的往返耗时
+type rttRecorder struct {
+	lb.LoadBalance
+	mu   sync.Mutex
+	rtts []time.Duration
+}
+
+func (r *rttRecorder) ObserveRTT(addr string, rtt time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.rtts = append(r.rtts, rtt)
+}
+
+// 流式方法的往返耗时为首条响应的耗时，不是整个流的持续时间
+func TestGrpcLoadBalanceRTT(t *testing.T) {
+	serve := func(s *grpc.Server) string {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go s.Serve(ln)
+		return ln.Addr().String()
+	}
+	backend := grpc.NewServer()
+	proto.RegisterEchoServer(backend, &slowStreamEcho{delay: 300 * time.Millisecond})
+	defer backend.Stop()
+	rb := &lb.RoundRobinBalance{}
+	rb.Add(serve(backend))
+	recorder := &rttRecorder{LoadBalance: rb}
+	pxy := grpc.NewServer(grpc.UnknownServiceHandler(NewGrpcLoadBalanceHandler(recorder)))
+	defer pxy.Stop()
+
+	conn, err := grpc.Dial(serve(pxy), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	start := time.Now()
+	stream, err := proto.NewEchoClient(conn).ServerStreamingEcho(context.Background(),
+		&proto.EchoRequest{Message: "hi"}, grpc.CallContentSubtype(public.Codec().Name()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for {
+		if _, err := stream.Recv(); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if time.Since(start) < 300*time.Millisecond {
+		t.Fatal("stream finished too early")
+	}
+
+	// finisher 在流结束后异步执行
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		recorder.mu.Lock()
+		n := len(recorder.rtts)
+		recorder.mu.Unlock()
+		if n > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	recorder.mu.Lock()
+	defer recorder.mu.Unlock()
+	if len(recorder.rtts) != 1 || recorder.rtts[0] >= 300*time.Millisecond {
+		t.Fatalf("want rtt of first response, got %v", recorder.rtts)
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"compress/gzip"
 	"context"
+	"errors"
+	"fmt"
 	"gateway/loadbalance"
 	"io/ioutil"
 	"log"
@@ -36,23 +38,54 @@ var transport = &http.Transport{
 }
 
 func NewLoadBalanceReverseProxy(ctx context.Context, lb loadbalance.LoadBalance) *httputil.ReverseProxy {
+	pxy, _ := NewStickyLoadBalanceReverseProxy(ctx, lb, nil)
+	return pxy
+}
+
+// NewStickyLoadBalanceReverseProxy 创建支持 cookie 会话保持的负载均衡反向代理
+// sticky 为 nil 时不开启会话保持，与 NewLoadBalanceReverseProxy 相同；
+// 会话保持的密钥无法生成时返回错误
+func NewStickyLoadBalanceReverseProxy(ctx context.Context, lb loadbalance.LoadBalance, sticky *StickySession) (*httputil.ReverseProxy, error) {
+	if sticky != nil {
+		var err error
+		if sticky, err = sticky.withDefaults(); err != nil {
+			return nil, err
+		}
+	}
 	// 请求协调者
 	director := func(req *http.Request) {
-		// 使用指定的负载均衡策略，获取服务地址
-		nextAddr, err := lb.Get(req.URL.String())
+		lbt := &lbTarget{}
+		if sticky != nil {
+			lbt.addr, lbt.sticky = sticky.pick(req, lb)
+			lbt.setCookie = !lbt.sticky
+			sticky.removeCookie(req)
+		}
+		if !lbt.sticky {
+			// 使用指定的负载均衡策略，获取服务地址
+			// 没有可用主机时（全部不健康、被驱逐或摘除）记录错误，由 lbTransport 返回，ErrorHandler 响应 503
+			nextAddr, err := lb.Get(req.URL.String())
+			if err != nil {
+				lbt.err = fmt.Errorf("%w: %v", ErrNoUpstream, err)
+				withLbTarget(req, lbt)
+				return
+			}
+			lbt.addr = nextAddr
+		}
+		target, err := url.Parse(lbt.addr)
 		if err != nil {
-			log.Fatal("get next addr fail")
+			lbt.err = err
 		}
-		target, err := url.Parse(nextAddr)
+		// 记录下游地址，请求结束时回调负载均衡器
+		withLbTarget(req, lbt)
 		if err != nil {
-			log.Fatal(err)
+			return
 		}
 
 		targetQuery := target.RawQuery
 		req.URL.Scheme = target.Scheme
 		req.URL.Host = target.Host
 		req.URL.Path = joinURLPath(target.Path, req.URL.Path)
-		req.Host = target.Host
+		req.Host = upstreamHost(req, target)
 		if targetQuery == "" || req.URL.RawQuery == "" {
 			req.URL.RawQuery = targetQuery + req.URL.RawQuery
 		} else {
@@ -65,6 +98,13 @@ func NewLoadBalanceReverseProxy(ctx context.Context, lb loadbalance.LoadBalance)
 
 	// 更改内容
 	modifyFunc := func(resp *http.Response) error {
+		// 会话保持：新选择的下游主机写入 cookie
+		// 生成 cookie 失败时不影响响应，下次请求重新选择
+		if lbt, ok := getLbTarget(resp.Request); ok && lbt.setCookie {
+			if c, err := sticky.cookie(lbt.addr); err == nil {
+				resp.Header.Add("Set-Cookie", c.String())
+			}
+		}
 		// 兼容websocket
 		if strings.Contains(resp.Header.Get("Connection"), "Upgrade") {
 			return nil
@@ -86,6 +126,8 @@ func NewLoadBalanceReverseProxy(ctx context.Context, lb loadbalance.LoadBalance)
 		if readErr != nil {
 			return readErr
 		}
+		// 原响应体已读完，关闭后再替换
+		resp.Body.Close()
 
 		// 异常请求时设置StatusCode
 		if resp.StatusCode != 200 {
@@ -104,11 +146,16 @@ func NewLoadBalanceReverseProxy(ctx context.Context, lb loadbalance.LoadBalance)
 	// 错误回调 ：关闭real_server时测试，错误回调
 	// 范围：transport.RoundTrip发生的错误、以及ModifyResponse发生的错误
 	errFunc := func(w http.ResponseWriter, r *http.Request, err error) {
+		if errors.Is(err, ErrNoUpstream) {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
 		http.Error(w, "ErrorHandler error:"+err.Error(), http.StatusInternalServerError)
-		log.Fatal(err)
+		// 下游故障已上报给负载均衡器，不能因为单个请求失败退出进程
+		log.Println(err)
 	}
 
-	return &httputil.ReverseProxy{Director: director, Transport: transport, ModifyResponse: modifyFunc, ErrorHandler: errFunc}
+	return &httputil.ReverseProxy{Director: director, Transport: &lbTransport{lb: lb, base: transport}, ModifyResponse: modifyFunc, ErrorHandler: errFunc}, nil
 }
 
 func NewMultipleHostsReverseProxy(ctx context.Context, targets []*url.URL) *httputil.ReverseProxy {
@@ -124,7 +171,7 @@ func NewMultipleHostsReverseProxy(ctx context.Context, targets []*url.URL) *http
 		req.URL.Host = target.Host
 		req.URL.Path = joinURLPath(target.Path, req.URL.Path)
 		// 当对域名(非内网)反向代理时需要设置此项, 当作后端反向代理时不需要
-		req.Host = target.Host
+		req.Host = upstreamHost(req, target)
 		if targetQuery == "" || req.URL.RawQuery == "" {
 			req.URL.RawQuery = targetQuery + req.URL.RawQuery
 		} else {
@@ -189,6 +236,22 @@ func NewMultipleHostsReverseProxy(ctx context.Context, targets []*url.URL) *http
 		ErrorHandler:   errFunc}
 }
 
+// hostOverrideKey 请求上下文中记录改写后的 Host 请求头
+type hostOverrideKey struct{}
+
+// WithHostOverride 返回指定了 Host 请求头的请求，反向代理转发时使用该 Host，而不是下游主机地址
+func WithHostOverride(req *http.Request, host string) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), hostOverrideKey{}, host))
+}
+
+// upstreamHost 转发到下游时的 Host 请求头：优先使用 WithHostOverride 指定的 Host
+func upstreamHost(req *http.Request, target *url.URL) string {
+	if host, ok := req.Context().Value(hostOverrideKey{}).(string); ok {
+		return host
+	}
+	return target.Host
+}
+
 // joinURLPath 合并 a 和 b 两个字符串，a在前，且不能有多余的斜杠
 // a: "" or "/"
 // b: /realserver ""
@@ -2,10 +2,15 @@ package proxy
 
 import (
 	"context"
+	"encoding/base64"
 	"fmt"
 	lb "gateway/loadbalance"
+	"io/ioutil"
 	"log"
 	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
 	"testing"
 )
 
@@ -49,3 +54,151 @@ func TestHttpLoadBalanceWithConf(t *testing.T) {
 	log.Println("Starting http server at " + addr)
 	log.Fatal(http.ListenAndServe(addr, proxy))
 }
+
+// 最少连接数负载均衡：请求结束后，反向代理需要归还占用的连接数
+func TestHttpLoadBalanceRelease(t *testing.T) {
+	rs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer rs.Close()
+
+	rb := &countingBalance{LeastConnBalance: &lb.LeastConnBalance{}}
+	rb.Add(rs.URL + "/")
+	pxy := httptest.NewServer(NewLoadBalanceReverseProxy(context.Background(), rb))
+	defer pxy.Close()
+
+	for i := 0; i < 3; i++ {
+		resp, err := http.Get(pxy.URL + "/demo")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+	if rb.gets != 3 || rb.releases != 3 {
+		t.Fatalf("gets=%d releases=%d", rb.gets, rb.releases)
+	}
+}
+
+// 下游地址无法解析时请求不会发出，同样归还选出的主机
+func TestHttpLoadBalanceReleaseBadAddr(t *testing.T) {
+	rb := &countingBalance{LeastConnBalance: &lb.LeastConnBalance{}}
+	rb.Add("http://127.0.0.1:1/%zz")
+	pxy := httptest.NewServer(NewLoadBalanceReverseProxy(context.Background(), rb))
+	defer pxy.Close()
+
+	resp, err := http.Get(pxy.URL + "/demo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("status code %d", resp.StatusCode)
+	}
+	if rb.gets != 1 || rb.releases != 1 {
+		t.Fatalf("gets=%d releases=%d", rb.gets, rb.releases)
+	}
+}
+
+// countingBalance 统计 Get 与 Release 的调用次数
+type countingBalance struct {
+	*lb.LeastConnBalance
+	mux      sync.Mutex
+	gets     int
+	releases int
+}
+
+func (c *countingBalance) Get(key string) (string, error) {
+	c.mux.Lock()
+	c.gets++
+	c.mux.Unlock()
+	return c.LeastConnBalance.Get(key)
+}
+
+func (c *countingBalance) Release(addr string) {
+	c.mux.Lock()
+	c.releases++
+	c.mux.Unlock()
+	c.LeastConnBalance.Release(addr)
+}
+
+// cookie 会话保持：同一客户端的后续请求落到同一台下游主机，主机下线后回退到负载均衡器
+func TestHttpStickySession(t *testing.T) {
+	servers := []*httptest.Server{}
+	for i := 0; i < 3; i++ {
+		name := fmt.Sprint("rs", i)
+		servers = append(servers, httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if _, err := r.Cookie("GATEWAY_STICKY"); err == nil {
+				w.WriteHeader(http.StatusBadRequest)
+			}
+			w.Write([]byte(name))
+		})))
+		defer servers[i].Close()
+	}
+	conf := lb.NewLoadBalanceStaticConf("%s/", map[string]string{})
+	rb := lb.LoadBalanceFactoryWithConf(lb.LbRoundRobin, conf)
+	conf.UpdateConf([]string{servers[0].URL, servers[1].URL, servers[2].URL})
+	handler, err := NewStickyLoadBalanceReverseProxy(context.Background(), rb, &StickySession{Secret: []byte("secret")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pxy := httptest.NewServer(handler)
+	defer pxy.Close()
+
+	get := func(cookie *http.Cookie) (string, *http.Cookie) {
+		req, _ := http.NewRequest(http.MethodGet, pxy.URL+"/demo", nil)
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		for _, c := range resp.Cookies() {
+			if c.Name == "GATEWAY_STICKY" {
+				return string(body), c
+			}
+		}
+		return string(body), nil
+	}
+
+	first, cookie := get(nil)
+	if cookie == nil {
+		t.Fatal("sticky cookie not set")
+	}
+	// cookie 不暴露下游主机地址
+	for _, part := range strings.Split(cookie.Value, ".") {
+		raw, _ := base64.RawURLEncoding.DecodeString(part)
+		if strings.Contains(part+string(raw), "127.0.0.1") {
+			t.Fatalf("sticky cookie leaks backend address: %s", cookie.Value)
+		}
+	}
+	for i := 0; i < 5; i++ {
+		body, c := get(cookie)
+		if body != first || c != nil {
+			t.Fatalf("want %s, got %s", first, body)
+		}
+	}
+
+	// 伪造的 cookie 回退到负载均衡器，并重新下发 cookie
+	forged := &http.Cookie{Name: cookie.Name, Value: "bm9uZQ.bm9uZQ"}
+	if _, c := get(forged); c == nil {
+		t.Fatal("forged cookie accepted")
+	}
+
+	// 主机下线后回退到负载均衡器，并重新下发 cookie
+	index := map[string]int{"rs0": 0, "rs1": 1, "rs2": 2}[first]
+	alive := []string{}
+	for i, s := range servers {
+		if i != index {
+			alive = append(alive, s.URL)
+		}
+	}
+	conf.UpdateConf(alive)
+	body, c := get(cookie)
+	if body == first || c == nil {
+		t.Fatalf("offline backend still sticky: %s", body)
+	}
+}
@@ -0,0 +1,137 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gateway/loadbalance"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ErrNoUpstream 负载均衡器没有可用的下游主机，反向代理响应 503
+var ErrNoUpstream = errors.New("no available upstream")
+
+// lbAddrKey 请求上下文中记录负载均衡选出的下游地址
+type lbAddrKey struct{}
+
+// lbTarget 请求选中的下游主机
+type lbTarget struct {
+	addr string
+	// 会话保持直接指定的主机，没有经过 Get，结束时不需要归还
+	sticky bool
+	// 响应时需要下发会话保持 cookie
+	setCookie bool
+	// 选择下游主机失败，请求不会发出
+	err error
+}
+
+// upstreamAddrKey 请求上下文中保存调用方接收下游地址的指针，见 WithUpstreamAddr
+type upstreamAddrKey struct{}
+
+// withLbTarget 将选出的下游主机记录到请求上下文中
+// Director 只能原地修改请求，所以替换请求内容而不是指针
+func withLbTarget(req *http.Request, target *lbTarget) {
+	if addr, ok := req.Context().Value(upstreamAddrKey{}).(*string); ok {
+		*addr = target.addr
+	}
+	*req = *req.WithContext(context.WithValue(req.Context(), lbAddrKey{}, target))
+}
+
+// WithUpstreamAddr 返回携带 addr 的请求，负载均衡反向代理选出下游主机后写入 addr，
+// 用于在代理之外获取请求转发到的主机，如流量统计；addr 只能在 ServeHTTP 返回后读取
+func WithUpstreamAddr(req *http.Request, addr *string) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), upstreamAddrKey{}, addr))
+}
+
+// getLbTarget 获取请求上下文中记录的下游主机
+func getLbTarget(req *http.Request) (*lbTarget, bool) {
+	target, ok := req.Context().Value(lbAddrKey{}).(*lbTarget)
+	return target, ok
+}
+
+// lbTransport 包装连接池，追踪每个请求选中的下游地址
+// 收到响应时，回调负载均衡器记录往返耗时，并上报请求结果（连接错误与 5xx 视为失败）
+// 请求结束（响应体读完、关闭或请求出错）时，回调负载均衡器的释放钩子
+type lbTransport struct {
+	lb   loadbalance.LoadBalance
+	base http.RoundTripper
+}
+
+func (t *lbTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	target, ok := getLbTarget(req)
+	if !ok {
+		return t.base.RoundTrip(req)
+	}
+	if target.err != nil {
+		// 负载均衡器已选出主机但地址无法解析，请求不会发出，归还选出的主机
+		if target.addr != "" && !target.sticky {
+			loadbalance.Release(t.lb, target.addr)
+		}
+		return nil, target.err
+	}
+	addr := target.addr
+	start := time.Now()
+	resp, err := t.base.RoundTrip(req)
+	done := func() {
+		if !target.sticky {
+			loadbalance.Release(t.lb, addr)
+		}
+	}
+	if err != nil {
+		loadbalance.Report(t.lb, addr, err)
+		done()
+		return nil, err
+	}
+	// 收到响应头即为一次完整的往返耗时
+	loadbalance.ObserveRTT(t.lb, addr, time.Since(start))
+	if resp.StatusCode >= http.StatusInternalServerError {
+		loadbalance.Report(t.lb, addr, fmt.Errorf("upstream status code %d", resp.StatusCode))
+	} else {
+		loadbalance.Report(t.lb, addr, nil)
+	}
+	// websocket 等协议升级时，ReverseProxy 需要可写的响应体
+	if rwc, ok := resp.Body.(io.ReadWriteCloser); ok && resp.StatusCode == http.StatusSwitchingProtocols {
+		resp.Body = &releaseReadWriteCloser{ReadWriteCloser: rwc, releaseBody: releaseBody{ReadCloser: rwc, done: done}}
+		return resp, nil
+	}
+	resp.Body = &releaseBody{ReadCloser: resp.Body, done: done}
+	return resp, nil
+}
+
+// releaseBody 响应体读到结尾或被关闭时，执行一次 done
+type releaseBody struct {
+	io.ReadCloser
+	once sync.Once
+	done func()
+}
+
+func (b *releaseBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil {
+		b.once.Do(b.done)
+	}
+	return n, err
+}
+
+func (b *releaseBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.done)
+	return err
+}
+
+// releaseReadWriteCloser 协议升级后的双向连接，关闭时执行一次 done
+type releaseReadWriteCloser struct {
+	io.ReadWriteCloser
+	releaseBody
+}
+
+func (b *releaseReadWriteCloser) Read(p []byte) (int, error) {
+	return b.releaseBody.Read(p)
+}
+
+func (b *releaseReadWriteCloser) Close() error {
+	return b.releaseBody.Close()
+}
@@ -0,0 +1,133 @@
+package proxy
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"gateway/loadbalance"
+	"net/http"
+	"time"
+)
+
+// 默认会话保持 cookie 名称
+const defaultStickyCookieName = "GATEWAY_STICKY"
+
+// StickySession 基于 cookie 的会话保持配置
+//
+// 首次请求由负载均衡器选择下游主机，响应时下发加密 cookie 记录该主机；
+// 后续请求携带 cookie，且主机仍然可用（在服务列表中、未被驱逐）时，直接转发到该主机，
+// cookie 无效、解密失败或主机不可用时，回退到负载均衡器重新选择并更新 cookie。
+// cookie 使用 AES-GCM 加密，客户端看不到下游主机地址，也无法伪造；
+// 多个网关实例使用相同的 Secret 时，cookie 可以互认
+type StickySession struct {
+	CookieName string        // cookie 名称，默认 GATEWAY_STICKY
+	Secret     []byte        // 加密密钥，为空时随机生成（网关重启后原 cookie 失效）
+	Path       string        // cookie 路径，默认 /
+	MaxAge     time.Duration // cookie 有效期，0 表示会话 cookie
+	Secure     bool          // 只在 https 下发送
+
+	aead cipher.AEAD // 由 Secret 派生的加密器
+}
+
+// withDefaults 返回填充默认值后的配置，随机生成密钥失败时返回错误
+func (s *StickySession) withDefaults() (*StickySession, error) {
+	n := *s
+	if n.CookieName == "" {
+		n.CookieName = defaultStickyCookieName
+	}
+	if n.Path == "" {
+		n.Path = "/"
+	}
+	if len(n.Secret) == 0 {
+		n.Secret = make([]byte, 32)
+		if _, err := rand.Read(n.Secret); err != nil {
+			return nil, fmt.Errorf("generate sticky session secret: %v", err)
+		}
+	}
+	// 任意长度的 Secret 派生为 AES-256 密钥
+	key := sha256.Sum256(n.Secret)
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	if n.aead, err = cipher.NewGCM(block); err != nil {
+		return nil, err
+	}
+	return &n, nil
+}
+
+// pick 从请求的 cookie 中取出仍然可用的下游主机
+func (s *StickySession) pick(req *http.Request, lb loadbalance.LoadBalance) (string, bool) {
+	c, err := req.Cookie(s.CookieName)
+	if err != nil {
+		return "", false
+	}
+	addr, err := s.decode(c.Value)
+	if err != nil || !loadbalance.Available(lb, addr) {
+		return "", false
+	}
+	return addr, true
+}
+
+// cookie 生成记录下游主机的加密 cookie
+func (s *StickySession) cookie(addr string) (*http.Cookie, error) {
+	value, err := s.encode(addr)
+	if err != nil {
+		return nil, err
+	}
+	c := &http.Cookie{
+		Name:     s.CookieName,
+		Value:    value,
+		Path:     s.Path,
+		HttpOnly: true,
+		Secure:   s.Secure,
+	}
+	if s.MaxAge > 0 {
+		c.MaxAge = int(s.MaxAge / time.Second)
+	}
+	return c, nil
+}
+
+// encode cookie 值格式：base64(nonce + AES-GCM(addr))，cookie 名称作为附加数据
+func (s *StickySession) encode(addr string) (string, error) {
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := s.aead.Seal(nonce, nonce, []byte(addr), []byte(s.CookieName))
+	return base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+func (s *StickySession) decode(value string) (string, error) {
+	sealed, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return "", err
+	}
+	size := s.aead.NonceSize()
+	if len(sealed) < size {
+		return "", errors.New("invalid sticky cookie")
+	}
+	addr, err := s.aead.Open(nil, sealed[:size], sealed[size:], []byte(s.CookieName))
+	if err != nil {
+		return "", errors.New("invalid sticky cookie")
+	}
+	return string(addr), nil
+}
+
+// removeCookie 转发到下游前去掉会话保持 cookie，下游不需要感知网关的 cookie
+func (s *StickySession) removeCookie(req *http.Request) {
+	cookies := req.Cookies()
+	if len(cookies) == 0 {
+		return
+	}
+	req.Header.Del("Cookie")
+	for _, c := range cookies {
+		if c.Name != s.CookieName {
+			req.AddCookie(c)
+		}
+	}
+}
@@ -3,6 +3,7 @@ package proxy
 import (
 	"context"
 	"gateway/loadbalance"
+	"gateway/proxy/tcp_proxy/server"
 	"io"
 	"log"
 	"net"
@@ -22,9 +23,15 @@ type TCPReverseProxy struct {
 	// 拨号器，支持自定义：拨号成功，返回连接；拨号失败，返回error
 	DialContext func(ctx context.Context, network, address string) (net.Conn, error)
 
-	// TCP整合负载均衡器 入口函数
-	// 执行指定的负载均衡算法，返回 TCP 服务器地址
+	// TCP整合负载均衡器 入口函数，可选，为 nil 时连接 Addr
+	// 执行指定的负载均衡算法，返回 TCP 服务器地址；返回错误时关闭上游连接
 	Director func(remoteAddr string) (string, error)
+	// 连接结束回调，可选
+	// 参数为 Director 返回的下游地址，用于归还负载均衡器占用的连接数
+	Release func(addr string)
+	// 拨号结果回调，可选
+	// 参数为 Director 返回的下游地址与拨号错误，用于负载均衡器驱逐异常主机
+	Report func(addr string, err error)
 
 	// 修改响应，可选
 	// 如果返回错误，则由 ErrorHandler 处理
@@ -42,16 +49,17 @@ func NewTcpLoadBalanceReverseProxy(c context.Context, lb loadbalance.LoadBalance
 		Deadline:        time.Minute,
 	}
 	// 定义入口函数：通过负载均衡算法得出TCP服务器地址
-	director := func(remoteAddr string) (nextAddr string, err error) {
-		nextAddr, err = lb.Get(remoteAddr)
-		if err != nil {
-			log.Fatal("get next addr fail")
-		}
-		// 给代理实例属性赋值
-		pxy.Addr = nextAddr
-		return
+	// 没有可用主机时返回错误，由 ServeTCP 关闭上游连接；代理实例被多个连接共用，不能修改 pxy.Addr
+	pxy.Director = func(remoteAddr string) (string, error) {
+		return lb.Get(remoteAddr)
+	}
+	pxy.Release = func(addr string) {
+		loadbalance.Release(lb, addr)
+	}
+	// 拨号结果上报给负载均衡器，用于被动健康检查
+	pxy.Report = func(addr string, err error) {
+		loadbalance.Report(lb, addr, err)
 	}
-	pxy.Director = director
 	return pxy
 }
 
@@ -76,6 +84,8 @@ func NewSingleHostReverseProxy(addr string) *TCPReverseProxy {
 // 	接收下游响应
 // 	拷贝/修改，响应到上游连接
 func (pxy *TCPReverseProxy) ServeTCP(ctx context.Context, src net.Conn) {
+	// 连接上下文，下面的 ctx 只用于拨号
+	connCtx := ctx
 	var cancel context.CancelFunc // 检查是否有取消操作
 	if pxy.DialTimeout >= 0 {     // 连接超时时间
 		ctx, cancel = context.WithTimeout(ctx, pxy.DialTimeout)
@@ -87,19 +97,37 @@ func (pxy *TCPReverseProxy) ServeTCP(ctx context.Context, src net.Conn) {
 		defer cancel()
 	}
 	// 拨号器：使用系统默认拨号器，还是自定义拨号器
-	if pxy.DialContext == nil {
-		pxy.DialContext = (&net.Dialer{
+	// 代理实例被多个连接共用，默认拨号器每次连接单独创建，截止时间从本次连接开始计算
+	dial := pxy.DialContext
+	if dial == nil {
+		dial = (&net.Dialer{
 			Timeout:   pxy.DialTimeout,              // 连接超时
 			Deadline:  time.Now().Add(pxy.Deadline), // 连接截至时间
 			KeepAlive: pxy.KeepAlivePeriod,          // 长连接超时
 		}).DialContext
 	}
 
-	// 执行入口函数：获取下游TCP服务器地址
-	pxy.Director(src.RemoteAddr().String())
+	// 执行入口函数：获取下游TCP服务器地址，没有入口函数时使用 Addr
+	nextAddr := pxy.Addr
+	if pxy.Director != nil {
+		addr, err := pxy.Director(src.RemoteAddr().String())
+		if err != nil {
+			pxy.getErrorHandler()(src, err)
+			src.Close()
+			return
+		}
+		nextAddr = addr
+	}
+	// 连接结束时，归还负载均衡器占用的连接数
+	if pxy.Release != nil {
+		defer pxy.Release(nextAddr)
+	}
 
 	// 向下游发送请求
-	dst, err := pxy.DialContext(ctx, "tcp", pxy.Addr)
+	dst, err := dial(ctx, "tcp", nextAddr)
+	if pxy.Report != nil {
+		pxy.Report(nextAddr, err)
+	}
 	if err != nil {
 		// 错误处理
 		pxy.getErrorHandler()(src, err)
@@ -131,12 +159,17 @@ func (pxy *TCPReverseProxy) ServeTCP(ctx context.Context, src net.Conn) {
 
 	// 数据拷贝：TCP连接是双向通道，支持全双工通信
 	// 启动两个协程完成拷贝动作，二者互不干扰
-	errc := make(chan error, 1)
+	errc := make(chan error, 2)
 	go bytesCopy(errc, src, dst) //	下游 -> 上游
 	go bytesCopy(errc, dst, src) //	上游 -> 下游
-	if errc != nil {
+	select {
+	case err := <-errc:
 		// 错误处理
-		pxy.getErrorHandler()(dst, <-errc)
+		pxy.getErrorHandler()(dst, err)
+	case <-server.ForceCloseDone(connCtx):
+		// 服务器强制关闭（排空到期）或上下文取消：关闭上下游连接，结束两个拷贝协程
+		src.Close()
+		dst.Close()
 	}
 }
 
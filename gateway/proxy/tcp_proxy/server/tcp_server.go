@@ -24,10 +24,15 @@ type TCPServer struct {
 	WriteTimeout     time.Duration // 写超时
 	KeepAliveTimeout time.Duration // 长连接超时
 
-	mu         sync.Mutex         // 连接关闭等关键动作需要加锁
-	doneChan   chan struct{}      // 服务已完成，监听系统信号
-	inShutdown int32              // 服务终止：0-未关闭，1-已关闭
-	l          *onceCloseListener // 服务器监听器，使用完成要进程关闭
+	mu          sync.Mutex         // 连接关闭等关键动作需要加锁
+	doneChan    chan struct{}      // 服务已完成，监听系统信号
+	inShutdown  int32              // 服务终止：0-未关闭，1-已关闭
+	l           *onceCloseListener // 服务器监听器，使用完成要进程关闭
+	activeConn  map[*conn]struct{} // 处理中的连接：Shutdown 等待其结束，Close 强制关闭
+	connCtx     context.Context    // 所有连接上下文的父上下文
+	cancelCtx   context.CancelFunc // 取消 connCtx，通知 Handler 服务正在关闭
+	forceCtx    context.Context    // 强制关闭连接时取消，见 ForceCloseDone
+	cancelForce context.CancelFunc
 }
 
 type TCPHandler interface {
@@ -49,6 +54,8 @@ var (
 	ErrAbortHandler     = errors.New("net/tcp: abort Handler")
 	ServerContextKey    = &contextKey{"tcp-server"}
 	LocalAddrContextKey = &contextKey{"local-addr"}
+
+	forceCloseContextKey = &contextKey{"force-close"}
 )
 
 func (srv *TCPServer) ListenAndServe() error {
@@ -75,16 +82,19 @@ func ListenAndServe(addr string, handler TCPHandler) error {
 }
 
 func (srv *TCPServer) Serve(l net.Listener) error {
-	srv.l = &onceCloseListener{Listener: l}
-	defer l.Close() // 执行监听器的关闭
+	ol := &onceCloseListener{Listener: l}
+	defer ol.Close() // 执行监听器的关闭
 
-	if srv.BaseCxt == nil {
-		srv.BaseCxt = context.Background()
+	srv.mu.Lock()
+	if srv.shuttingDown() { // 已经关闭：不再提供服务
+		srv.mu.Unlock()
+		return ErrServerClosed
 	}
-	baseCtx := srv.BaseCxt
-	ctx := context.WithValue(baseCtx, ServerContextKey, srv)
+	srv.l = ol
+	ctx := srv.connContextLocked()
+	srv.mu.Unlock()
 	for {
-		rw, err := l.Accept()
+		rw, err := ol.Accept()
 		if err != nil {
 			select {
 			case <-srv.getDoneChan():
@@ -94,8 +104,55 @@ func (srv *TCPServer) Serve(l net.Listener) error {
 			return err
 		}
 		c := srv.newConn(rw) // 对 TCPConn 二次封装
-		go c.serve(ctx)      // handler回调函数的调用
+		if !srv.trackConn(c, true) {
+			rw.Close() // 关闭过程中接受的连接：直接关闭
+			return ErrServerClosed
+		}
+		go c.serve(ctx) // handler回调函数的调用
+	}
+}
+
+// connContextLocked 所有连接上下文的父上下文，Shutdown、Close 时取消
+func (srv *TCPServer) connContextLocked() context.Context {
+	if srv.connCtx == nil {
+		if srv.BaseCxt == nil {
+			srv.BaseCxt = context.Background()
+		}
+		srv.forceCtx, srv.cancelForce = context.WithCancel(context.Background())
+		ctx := context.WithValue(srv.BaseCxt, ServerContextKey, srv)
+		ctx = context.WithValue(ctx, forceCloseContextKey, srv.forceCtx)
+		srv.connCtx, srv.cancelCtx = context.WithCancel(ctx)
+	}
+	return srv.connCtx
+}
+
+// ForceCloseDone 连接需要立即结束时关闭的通道：TCPServer 调用 Close、或 Shutdown 到期强制关闭连接时关闭
+// 连接上下文的 Done 在 Shutdown 开始时就会关闭，只是通知 Handler 服务正在关闭，可以在合适的时机结束连接；
+// TCP 代理等没有合适时机的 Handler 使用该通道，在排空期限到达时结束连接。
+// ctx 不是 TCPServer 的连接上下文时返回 ctx.Done()
+func ForceCloseDone(ctx context.Context) <-chan struct{} {
+	if force, ok := ctx.Value(forceCloseContextKey).(context.Context); ok {
+		return force.Done()
 	}
+	return ctx.Done()
+}
+
+// trackConn 记录或删除处理中的连接，服务关闭后不再记录新连接，返回 false
+func (srv *TCPServer) trackConn(c *conn, add bool) bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if !add {
+		delete(srv.activeConn, c)
+		return true
+	}
+	if srv.shuttingDown() {
+		return false
+	}
+	if srv.activeConn == nil {
+		srv.activeConn = make(map[*conn]struct{})
+	}
+	srv.activeConn[c] = struct{}{}
+	return true
 }
 
 func (srv *TCPServer) newConn(rwc net.Conn) *conn {
@@ -128,6 +185,7 @@ func (c *conn) serve(ctx context.Context) {
 			fmt.Printf("tcp: panic serving %v: %v\n%s", c.remoteAddr, err, buf)
 		}
 		c.rwc.Close()
+		c.server.trackConn(c, false)
 	}()
 
 	ctx = context.WithValue(ctx, LocalAddrContextKey, c.rwc.LocalAddr())
@@ -156,15 +214,72 @@ func (oc *onceCloseListener) Close() error {
 
 func (oc *onceCloseListener) close() { oc.closeErr = oc.Listener.Close() }
 
-// Close TCPServer关闭功能
-//
+// Close TCPServer关闭功能：立即关闭监听器与所有处理中的连接
+// 不等待连接处理结束，优雅关闭使用 Shutdown
 func (srv *TCPServer) Close() error {
-	//srv.inShutdown = 1
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	err := srv.stopLocked()
+	if srv.cancelForce != nil {
+		srv.cancelForce()
+	}
+	for c := range srv.activeConn {
+		c.rwc.Close()
+		delete(srv.activeConn, c)
+	}
+	return err
+}
+
+// shutdownPollInterval Shutdown 检查连接是否处理结束的间隔
+var shutdownPollInterval = 50 * time.Millisecond
+
+// Shutdown 优雅关闭 TCPServer：
+// 	1.关闭监听器，不再接受新连接
+// 	2.取消连接上下文，通知 Handler 服务正在关闭（Handler 可以在合适的时机结束连接）
+// 	3.等待处理中的连接结束
+// ctx 到期时强制关闭剩余连接（关闭 ForceCloseDone 通道），返回 ctx 的错误。Shutdown 之后 Serve 立即返回 ErrServerClosed
+func (srv *TCPServer) Shutdown(ctx context.Context) error {
+	srv.mu.Lock()
+	err := srv.stopLocked()
+	srv.mu.Unlock()
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		if srv.activeConns() == 0 {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			srv.Close()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// stopLocked 标记服务关闭，关闭监听器，通知 Serve 与 Handler。可以重复调用
+func (srv *TCPServer) stopLocked() error {
 	atomic.StoreInt32(&srv.inShutdown, 1) // 用原子操作修改服务器状态字段：1-关闭
-	close(srv.doneChan)                   // 关闭channel
-	srv.l.Close()                         // 关闭监听：listener
+	select {
+	case <-srv.getDoneChanLocked():
+	default:
+		close(srv.doneChan) // 关闭channel
+	}
+	if srv.cancelCtx != nil {
+		srv.cancelCtx()
+	}
+	if srv.l != nil {
+		return srv.l.Close() // 关闭监听：listener
+	}
 	return nil
+}
 
+// activeConns 处理中的连接数
+func (srv *TCPServer) activeConns() int {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return len(srv.activeConn)
 }
 
 // 检查当前服务器是否已关闭
@@ -180,6 +295,10 @@ type contextKey struct {
 func (s *TCPServer) getDoneChan() <-chan struct{} {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	return s.getDoneChanLocked()
+}
+
+func (s *TCPServer) getDoneChanLocked() chan struct{} {
 	if s.doneChan == nil {
 		s.doneChan = make(chan struct{})
 	}
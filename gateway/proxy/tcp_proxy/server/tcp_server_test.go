@@ -1,8 +1,13 @@
 package server
 
 import (
+	"bufio"
+	"context"
+	"github.com/stretchr/testify/assert"
 	"log"
+	"net"
 	"testing"
+	"time"
 )
 
 // TCP 服务器，实现服务与代理分离
@@ -28,3 +33,105 @@ func TestTcpServer(t *testing.T) {
 	log.Println("Starting TCP server at " + addr)
 	tcpServer.ListenAndServe()
 }
+
+type handlerFunc func(ctx context.Context, conn net.Conn)
+
+func (f handlerFunc) ServeTCP(ctx context.Context, conn net.Conn) { f(ctx, conn) }
+
+func startServer(t *testing.T, handler TCPHandler) (*TCPServer, string, chan error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	srv := &TCPServer{Handler: handler}
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(ln) }()
+	return srv, ln.Addr().String(), served
+}
+
+// 优雅关闭：不再接受新连接，通知 Handler，等待处理中的连接结束
+func TestTcpServerShutdown(t *testing.T) {
+	started := make(chan struct{})
+	srv, addr, served := startServer(t, handlerFunc(func(ctx context.Context, conn net.Conn) {
+		close(started)
+		<-ctx.Done()
+		time.Sleep(100 * time.Millisecond) // 处理完当前数据后再结束
+		conn.Write([]byte("bye\n"))
+	}))
+	conn, err := net.Dial("tcp", addr)
+	assert.Nil(t, err)
+	defer conn.Close()
+	<-started
+
+	assert.Nil(t, srv.Shutdown(context.Background()))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	assert.Nil(t, err)
+	assert.Equal(t, "bye\n", line)
+	assert.Equal(t, ErrServerClosed, <-served)
+	_, err = net.Dial("tcp", addr)
+	assert.NotNil(t, err)
+}
+
+// 超过 ctx 的期限：强制关闭剩余连接
+func TestTcpServerShutdownTimeout(t *testing.T) {
+	started := make(chan struct{})
+	srv, addr, served := startServer(t, handlerFunc(func(ctx context.Context, conn net.Conn) {
+		close(started)
+		conn.Read(make([]byte, 1)) // 忽略关闭通知，一直等待数据
+	}))
+	conn, err := net.Dial("tcp", addr)
+	assert.Nil(t, err)
+	defer conn.Close()
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, srv.Shutdown(ctx))
+	assert.Equal(t, ErrServerClosed, <-served)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	assert.NotNil(t, err)
+	assert.Equal(t, 0, srv.activeConns())
+}
+
+// Shutdown 开始时取消连接上下文，到期强制关闭时才关闭 ForceCloseDone 通道
+func TestTcpServerForceCloseDone(t *testing.T) {
+	forced := make(chan bool, 1)
+	srv, addr, _ := startServer(t, handlerFunc(func(ctx context.Context, conn net.Conn) {
+		<-ctx.Done()
+		select {
+		case <-ForceCloseDone(ctx):
+			forced <- true
+			return
+		default:
+		}
+		<-ForceCloseDone(ctx)
+		forced <- false
+	}))
+	conn, err := net.Dial("tcp", addr)
+	assert.Nil(t, err)
+	defer conn.Close()
+	for srv.activeConns() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, srv.Shutdown(ctx))
+	assert.False(t, <-forced)
+
+	other, cancel := context.WithCancel(context.Background())
+	cancel()
+	<-ForceCloseDone(other)
+}
+
+// 未启动、重复关闭都不会 panic，关闭后 Serve 立即返回
+func TestTcpServerClose(t *testing.T) {
+	srv := &TCPServer{Handler: &tcpHandler{}}
+	assert.Nil(t, srv.Close())
+	assert.Nil(t, srv.Close())
+	assert.Nil(t, srv.Shutdown(context.Background()))
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	assert.Equal(t, ErrServerClosed, srv.Serve(ln))
+	_, err = net.Dial("tcp", ln.Addr().String())
+	assert.NotNil(t, err)
+}
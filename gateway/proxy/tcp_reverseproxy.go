@@ -4,7 +4,6 @@ import (
 	"context"
 	"gateway/loadbalance"
 	tcp_proxy "gateway/proxy/tcp_proxy/proxy"
-	"log"
 	"time"
 )
 
@@ -21,13 +20,17 @@ func NewTcpLoadBalanceReverseProxy(c context.Context, lb loadbalance.LoadBalance
 		KeepAlivePeriod: time.Hour,
 	}
 	// 定义入口函数，根据负载均衡算法获取 TCP 服务器地址
-	pxy.Director = func(remoteAddr string) (nextAddr string, err error) {
-		nextAddr, err = lb.Get(remoteAddr)
-		if err != nil {
-			log.Fatal("get next address fail")
-		}
-		pxy.Addr = nextAddr
-		return
+	// 没有可用主机时返回错误，由 ServeTCP 关闭上游连接；代理实例被多个连接共用，不能修改 pxy.Addr
+	pxy.Director = func(remoteAddr string) (string, error) {
+		return lb.Get(remoteAddr)
+	}
+	// 连接结束时回调负载均衡器
+	pxy.Release = func(addr string) {
+		loadbalance.Release(lb, addr)
+	}
+	// 拨号结果上报给负载均衡器，用于被动健康检查
+	pxy.Report = func(addr string, err error) {
+		loadbalance.Report(lb, addr, err)
 	}
 	return pxy
 }
@@ -6,7 +6,10 @@ import (
 	lb "gateway/loadbalance"
 	"gateway/proxy/tcp_proxy/proxy"
 	tcp "gateway/proxy/tcp_proxy/server"
+	"io"
+	"net"
 	"testing"
+	"time"
 )
 
 // TestTcpLoadBalanceReverseProxy 测试TCP负载均衡代理服务器
@@ -47,3 +50,48 @@ func TestTcpLoadBalanceWithRedis(t *testing.T) {
 	fmt.Println("Starting tcp_proxy at " + addr)
 	tcpServ.ListenAndServe()
 }
+
+// 上下文取消（或 TCPServer 排空到期强制关闭）时，TCP 代理关闭上下游连接，不等待长连接自行结束
+func TestTcpReverseProxyCancel(t *testing.T) {
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	upstream := make(chan net.Conn, 1)
+	go func() {
+		if conn, err := backend.Accept(); err == nil {
+			upstream <- conn
+		}
+	}()
+
+	src, client := net.Pipe()
+	defer client.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan struct{})
+	go func() {
+		proxy.NewSingleHostReverseProxy(backend.Addr().String()).ServeTCP(ctx, src)
+		close(served)
+	}()
+	dst := <-upstream
+	defer dst.Close()
+	// 数据已经开始转发后再取消
+	client.Write([]byte("ping"))
+	if _, err := io.ReadFull(dst, make([]byte, 4)); err != nil {
+		t.Fatal(err)
+	}
+
+	cancel()
+	select {
+	case <-served:
+	case <-time.After(time.Second):
+		t.Fatal("proxy still serving after cancel")
+	}
+	dst.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := dst.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("upstream connection not closed: %v", err)
+	}
+	if _, err := client.Write([]byte("x")); err == nil {
+		t.Fatal("downstream connection not closed")
+	}
+}